@@ -0,0 +1,338 @@
+package prepalert
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+const (
+	// DefaultAlertGroupReportWindow is the default window before the alert group is created to find the member alerts.
+	DefaultAlertGroupReportWindow = 10 * time.Minute
+	// DefaultAlertGroupReportMaxPages is the default max pages of the alerts API scanned to find the member alerts.
+	DefaultAlertGroupReportMaxPages = 5
+
+	alertGroupHCLPrefix = "alert_group"
+)
+
+//go:embed example_alert_group_webhook.json
+var exampleAlertGroupWebhookJSON []byte
+
+func (svc *MackerelService) NewExampleAlertGroupWebhookBody() *WebhookBody {
+	var body WebhookBody
+	if err := json.Unmarshal(exampleAlertGroupWebhookJSON, &body); err != nil {
+		panic(err)
+	}
+	return &body
+}
+
+// AlertGroupObject is the alert_group object of the evaluation context, the alert group with its setting.
+type AlertGroupObject struct {
+	ID            string   `cty:"id"`
+	Status        string   `cty:"status"`
+	URL           string   `cty:"url"`
+	MonitorCount  int64    `cty:"monitor_count"`
+	CreatedAt     int64    `cty:"created_at"`
+	ClosedAt      *int64   `cty:"closed_at"`
+	SettingID     string   `cty:"setting_id"`
+	Name          string   `cty:"name"`
+	Memo          string   `cty:"memo"`
+	ServiceScopes []string `cty:"service_scopes"`
+	RoleScopes    []string `cty:"role_scopes"`
+	MonitorScopes []string `cty:"monitor_scopes"`
+}
+
+func NewAlertGroupObject(body *WebhookBody) *AlertGroupObject {
+	if body.AlertGroup == nil {
+		return nil
+	}
+	obj := &AlertGroupObject{
+		ID:            body.AlertGroup.ID,
+		Status:        strings.ToLower(body.AlertGroup.Status),
+		URL:           body.AlertGroup.URL,
+		MonitorCount:  body.AlertGroup.MonitorCount,
+		CreatedAt:     body.AlertGroup.CreatedAt,
+		ClosedAt:      body.AlertGroup.ClosedAt,
+		ServiceScopes: []string{},
+		RoleScopes:    []string{},
+		MonitorScopes: []string{},
+	}
+	if setting := body.AlertGroupSetting; setting != nil {
+		obj.SettingID = setting.ID
+		obj.Name = setting.Name
+		obj.Memo = setting.Memo
+		obj.ServiceScopes = append(obj.ServiceScopes, setting.ServiceScopes...)
+		obj.RoleScopes = append(obj.RoleScopes, setting.RoleScopes...)
+		obj.MonitorScopes = append(obj.MonitorScopes, setting.MonitorScopes...)
+	}
+	return obj
+}
+
+// refersAlertGroup returns true if the expression refers alert_group.
+func refersAlertGroup(expr hcl.Expression) bool {
+	for _, traversal := range expr.Variables() {
+		if traversal.RootName() == alertGroupHCLPrefix {
+			return true
+		}
+	}
+	return false
+}
+
+func (svc *MackerelService) GetAlertGroupSetting(_ context.Context, id string) (*mackerel.AlertGroupSetting, error) {
+	setting, err := svc.client.GetAlertGroupSetting(id)
+	if err != nil {
+		return nil, fmt.Errorf("get alert group setting:%w", err)
+	}
+	return setting, nil
+}
+
+// FindAlertGroupMemberAlerts returns the member alerts of the alert group, newest first.
+// the alerts listed in the payload are the members if the payload has them.
+// otherwise, the alerts opened from window before the alert group is created until the alert group is closed are scanned up to maxPages pages,
+// and the alerts in the scopes of the alert group setting are the members.
+// the alerts failed to look up are logged and skipped, so a retired host or a deleted monitor does not fail the report.
+func (svc *MackerelService) FindAlertGroupMemberAlerts(ctx context.Context, group *AlertGroup, setting *mackerel.AlertGroupSetting, window time.Duration, maxPages int) ([]*mackerel.Alert, error) {
+	if len(group.Alerts) > 0 {
+		members := make([]*mackerel.Alert, 0, len(group.Alerts))
+		for _, member := range group.Alerts {
+			alert, err := svc.GetAlertWithCache(ctx, member.ID)
+			if err != nil {
+				slog.WarnContext(ctx, "failed to get the member alert, skip it", "alert_id", member.ID, "error", err.Error())
+				continue
+			}
+			members = append(members, alert)
+		}
+		sort.SliceStable(members, func(i, j int) bool {
+			return members[i].OpenedAt > members[j].OpenedAt
+		})
+		return members, nil
+	}
+	from := alertGroupUnixSeconds(group.CreatedAt) - int64(window/time.Second)
+	to := flextime.Now().Unix()
+	if group.ClosedAt != nil {
+		to = alertGroupUnixSeconds(*group.ClosedAt)
+	}
+	alerts := make([]*mackerel.Alert, 0)
+	err := svc.walkAlerts(ctx, true, maxPages, func(alert *mackerel.Alert) bool {
+		if alert.OpenedAt < from {
+			return false
+		}
+		if alert.OpenedAt <= to {
+			alerts = append(alerts, alert)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	members := make([]*mackerel.Alert, 0, len(alerts))
+	for _, alert := range alerts {
+		ok, err := svc.inAlertGroupScope(ctx, setting, alert)
+		if err != nil {
+			slog.WarnContext(ctx, "failed to check the scope of the alert, skip it", "alert_id", alert.ID, "error", err.Error())
+			continue
+		}
+		if ok {
+			members = append(members, alert)
+		}
+	}
+	return members, nil
+}
+
+// alertGroupUnixSeconds returns the unix seconds of the timestamp of the alert group payload.
+// createdAt of the payload is unix milliseconds as alert.createdAt, the timestamp in seconds is also accepted.
+func alertGroupUnixSeconds(t int64) int64 {
+	if t >= 1e12 {
+		return t / 1000
+	}
+	return t
+}
+
+func (svc *MackerelService) inAlertGroupScope(ctx context.Context, setting *mackerel.AlertGroupSetting, alert *mackerel.Alert) (bool, error) {
+	if alert.MonitorID != "" && slices.Contains(setting.MonitorScopes, alert.MonitorID) {
+		return true, nil
+	}
+	if len(setting.ServiceScopes) == 0 && len(setting.RoleScopes) == 0 {
+		return false, nil
+	}
+	if alert.HostID != "" {
+		host, err := svc.FindHostWithCache(ctx, alert.HostID)
+		if err != nil {
+			return false, err
+		}
+		for serviceName, roleNames := range host.Roles {
+			if slices.Contains(setting.ServiceScopes, serviceName) {
+				return true, nil
+			}
+			for _, roleName := range roleNames {
+				if slices.Contains(setting.RoleScopes, serviceName+": "+roleName) {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	}
+	if alert.MonitorID != "" && len(setting.ServiceScopes) > 0 {
+		monitor, err := svc.GetMonitorWithCache(ctx, alert.MonitorID)
+		if err != nil {
+			return false, err
+		}
+		if service := monitorServiceName(monitor); service != "" && slices.Contains(setting.ServiceScopes, service) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// AlertGroupReportAction writes the report of the member alerts to the memo of each member alert.
+type AlertGroupReportAction struct {
+	app       *App
+	ruleName  string
+	enable    bool
+	window    time.Duration
+	maxPages  int
+	sizeLimit *int
+}
+
+func (action *AlertGroupReportAction) DecodeBody(body hcl.Body, evalCtx *hcl.EvalContext) hcl.Diagnostics {
+	attrs, diags := body.JustAttributes()
+	if diags.HasErrors() {
+		return diags
+	}
+	action.enable = true
+	action.window = DefaultAlertGroupReportWindow
+	action.maxPages = DefaultAlertGroupReportMaxPages
+	for _, attr := range attrs {
+		switch attr.Name {
+		case "window":
+			window, windowDiags := decodeDurationExpression(attr.Expr, evalCtx)
+			diags = diags.Extend(windowDiags)
+			if diags.HasErrors() {
+				continue
+			}
+			if window < 0 {
+				diags = diags.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "window must be greater than or equal to 0",
+					Subject:  attr.Range.Ptr(),
+				})
+				continue
+			}
+			action.window = window
+		case "max_pages":
+			diags = diags.Extend(gohcl.DecodeExpression(attr.Expr, evalCtx, &action.maxPages))
+			if diags.HasErrors() {
+				continue
+			}
+			if action.maxPages < 1 {
+				diags = diags.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "max_pages must be greater than 0",
+					Subject:  attr.Range.Ptr(),
+				})
+			}
+		case "max_size":
+			var maxSize int
+			diags = diags.Extend(gohcl.DecodeExpression(attr.Expr, evalCtx, &maxSize))
+			if diags.HasErrors() {
+				continue
+			}
+			action.sizeLimit = &maxSize
+		default:
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  fmt.Sprintf("unknown attribute %q", attr.Name),
+				Subject:  attr.Range.Ptr(),
+			})
+		}
+	}
+	return diags
+}
+
+func (action *AlertGroupReportAction) Enable() bool {
+	return action.enable
+}
+
+func (action *AlertGroupReportAction) SectionName() string {
+	return "rule." + action.ruleName + ".alert_group"
+}
+
+func (action *AlertGroupReportAction) Execute(ctx context.Context, evalCtx *hcl.EvalContext, u *MackerelUpdater) error {
+	body, err := WebhookFromEvalContext(evalCtx)
+	if err != nil {
+		return err
+	}
+	if body.AlertGroup == nil {
+		return nil
+	}
+	if body.AlertGroupSetting == nil || body.AlertGroupSetting.ID == "" {
+		return fmt.Errorf("alert group setting is not found in the webhook of alert group %s", body.AlertGroup.ID)
+	}
+	svc := action.app.MackerelService()
+	setting, err := svc.GetAlertGroupSetting(ctx, body.AlertGroupSetting.ID)
+	if err != nil {
+		return err
+	}
+	alerts, err := svc.FindAlertGroupMemberAlerts(ctx, body.AlertGroup, setting, action.window, action.maxPages)
+	if err != nil {
+		return fmt.Errorf("find member alerts: %w", err)
+	}
+	lines := make([]string, 0, len(alerts))
+	for _, alert := range alerts {
+		line, _, _ := describeAlert(ctx, svc, body.OrgName, alert)
+		lines = append(lines, line)
+	}
+	slog.DebugContext(ctx, "alert group member alerts", "alert_group_id", body.AlertGroup.ID, "count", len(alerts))
+	report := renderAlertGroupReport(body.AlertGroup, setting, lines)
+	for _, alert := range alerts {
+		member := u.AlertUpdater(newAlertGroupMemberWebhookBody(body.OrgName, alert))
+		member.AddMemoSectionText(action.SectionName(), report, action.sizeLimit)
+	}
+	return nil
+}
+
+func renderAlertGroupReport(group *AlertGroup, setting *mackerel.AlertGroupSetting, lines []string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "alert group %q is %s: %s\n", setting.Name, strings.ToLower(group.Status), group.URL)
+	fmt.Fprintf(&b, "%d member alerts\n", len(lines))
+	if len(lines) > 0 {
+		b.WriteString("\n")
+		b.WriteString(strings.Join(lines, "\n"))
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// newAlertGroupMemberWebhookBody returns the webhook body of the member alert, to update the memo of the alert.
+func newAlertGroupMemberWebhookBody(orgName string, alert *mackerel.Alert) *WebhookBody {
+	body := &WebhookBody{
+		OrgName: orgName,
+		Event:   WebhookEventAlert,
+		Alert: &Alert{
+			OpenedAt:    alert.OpenedAt,
+			IsOpen:      alert.ClosedAt == 0,
+			MetricValue: alert.Value,
+			Status:      strings.ToLower(alert.Status),
+			Trigger:     "monitor",
+			ID:          alert.ID,
+			URL:         fmt.Sprintf("https://mackerel.io/orgs/%s/alerts/%s", orgName, alert.ID),
+		},
+	}
+	if alert.ClosedAt != 0 {
+		closedAt := alert.ClosedAt
+		body.Alert.ClosedAt = &closedAt
+		body.Alert.Duration = alert.ClosedAt - alert.OpenedAt
+	}
+	return body
+}
@@ -11,7 +11,9 @@ import (
 	"net/http"
 	"strconv"
 	"sync"
+	"time"
 
+	"github.com/Songmu/flextime"
 	"github.com/hashicorp/hcl/v2"
 	"github.com/kayac/go-katsubushi"
 	"github.com/mackerelio/mackerel-client-go"
@@ -26,11 +28,24 @@ type App struct {
 	backend               Backend
 	rules                 []*Rule
 	queueName             string
+	dlqName               string
+	localQueue            *LocalQueue
+	idempotencyStore      IdempotencyStore
+	idempotencyTTL        time.Duration
+	memoLocker            MemoLocker
+	memoLockWait          time.Duration
+	workerSender          canyon.WorkerSender
+	workerSenderMu        sync.Mutex
 	webhookClientID       string
 	webhookClientSecret   string
 	providerParameters    provider.ProviderParameters
 	providers             map[string]provider.Provider
+	providerFactory       provider.ProviderFactory
+	pluginFactories       map[string]provider.ProviderFactory
 	queries               map[string]provider.Query
+	queryDependsOn        map[string][]string
+	queryOptions          map[string]*queryOptions
+	testBlocks            hcl.Blocks
 	diagWriter            *hclutil.DiagnosticsWriter
 	evalCtx               *hcl.EvalContext
 	loadingConfig         bool
@@ -41,8 +56,13 @@ type App struct {
 }
 
 func New(apikey string) *App {
+	// the local queue runs the workers concurrently in the same process,
+	// so the in-process memo lock is on by default to keep the memo read-modify-write from losing the sections.
+	// it costs nothing for a single worker, and the memo_lock block replaces it.
 	app := &App{
-		backend: NewDiscardBackend(),
+		backend:      NewDiscardBackend(),
+		memoLocker:   NewMemoryMemoLocker(),
+		memoLockWait: DefaultMemoLockWait,
 	}
 	return app.SetMackerelClient(mackerel.NewClient(apikey))
 }
@@ -100,6 +120,11 @@ func (app *App) SQSQueueName() string {
 	return app.queueName
 }
 
+// LocalQueue returns the local queue used instead of SQS, nil if not configured.
+func (app *App) LocalQueue() *LocalQueue {
+	return app.localQueue
+}
+
 func (app *App) MackerelService() *MackerelService {
 	return app.mkrSvc
 }
@@ -232,163 +257,191 @@ func (app *App) serveHTTPAsWorker(w http.ResponseWriter, r *http.Request) {
 		"path", r.URL.Path,
 		"sqs_message_id", r.Header.Get(canyon.HeaderSQSMessageID),
 	)
-	decoder := json.NewDecoder(r.Body)
+	payload, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.ErrorContext(ctx, "can not read request body", "error", err.Error())
+		app.retryPolicy.SetRetryAfter(w, r)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
 	var body WebhookBody
-	if err := decoder.Decode(&body); err != nil {
+	if err := json.Unmarshal(payload, &body); err != nil {
 		logger.ErrorContext(ctx, "can not parse request body as Mackerel webhook body", "error", err.Error())
 		app.retryPolicy.SetRetryAfter(w, r)
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
-	if body.Alert == nil {
-		logger.WarnContext(ctx, "not found alert in request body, maybe not webhook request", "text", body.Text, "org_name", body.OrgName, "event", body.Event)
+	if body.Alert == nil && body.Event == "" {
+		logger.WarnContext(ctx, "not found alert and event in request body, maybe not webhook request", "text", body.Text, "org_name", body.OrgName)
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprintln(w, http.StatusText(http.StatusOK))
 		return
 	}
-	ctx = slogutils.With(
-		ctx,
-		"alert_id", body.Alert.ID,
-		"alsert_status", body.Alert.Status,
-		"monitor", body.Alert.MonitorName,
-	)
+	ctx = withWebhookLogAttrs(ctx, &body)
 	logger.InfoContext(ctx, "parse request body as Mackerel webhook body")
-	if err := app.ExecuteRules(ctx, &body); err != nil {
+	refresh, err := parseRefreshRequest(r.Header)
+	if err != nil {
+		logger.WarnContext(ctx, "can not parse refresh request, skip", "error", err.Error())
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, http.StatusText(http.StatusOK))
+		return
+	}
+	if refresh != nil {
+		ctx = slogutils.With(ctx, "refresh_rule", refresh.ruleName, "refresh_count", refresh.count)
+		if body.Alert == nil {
+			logger.WarnContext(ctx, "refresh request has no alert, skip")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprintln(w, http.StatusText(http.StatusOK))
+			return
+		}
+		closed, err := app.isAlertClosed(ctx, body.Alert.ID)
+		if err != nil {
+			logger.ErrorContext(ctx, "failed check alert status for refresh", "error", err.Error())
+			app.retryPolicy.SetRetryAfter(w, r)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if closed {
+			logger.InfoContext(ctx, "alert is closed, stop refresh")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprintln(w, http.StatusText(http.StatusOK))
+			return
+		}
+	}
+	idempotencyKey := refresh.idempotencyKey(idempotencyKey(&body, r.Header.Get(HeaderRequestID)))
+	ctx = withIdempotencyKey(ctx, idempotencyKey)
+	if app.checkProcessed(ctx, idempotencyKey) {
+		logger.InfoContext(ctx, "already processed Mackerel webhook body, skip duplicate delivery")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, http.StatusText(http.StatusOK))
+		return
+	}
+	executedRules, err := app.executeRules(ctx, &body, refresh)
+	if err != nil {
 		logger.ErrorContext(ctx, "failed process Mackerel webhook body", "error", err.Error())
 		app.retryPolicy.SetRetryAfter(w, r)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
+	app.markProcessed(ctx, idempotencyKey)
+	if err := app.scheduleRefreshes(ctx, r, payload, &body, executedRules, refresh); err != nil {
+		// the memo is already updated, retrying the whole request does more harm than skipping the refresh.
+		logger.ErrorContext(ctx, "failed schedule refresh", "error", err.Error())
+	}
 	logger.InfoContext(ctx, "finish process Mackerel webhook body")
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintln(w, http.StatusText(http.StatusOK))
 }
 
+func withWebhookLogAttrs(ctx context.Context, body *WebhookBody) context.Context {
+	if body.Alert != nil {
+		return slogutils.With(
+			ctx,
+			"alert_id", body.Alert.ID,
+			"alsert_status", body.Alert.Status,
+			"monitor", body.Alert.MonitorName,
+		)
+	}
+	ctx = slogutils.With(ctx, "event", body.Event)
+	switch {
+	case body.Host != nil:
+		ctx = slogutils.With(ctx, "host_id", body.Host.ID, "host_name", body.Host.Name)
+	case body.Monitor != nil:
+		ctx = slogutils.With(ctx, "monitor_id", body.Monitor.ID, "monitor", body.Monitor.Name)
+	case body.AlertGroup != nil:
+		ctx = slogutils.With(ctx, "alert_group_id", body.AlertGroup.ID, "alert_group_status", body.AlertGroup.Status)
+	}
+	return ctx
+}
+
 func (app *App) ExecuteRules(ctx context.Context, body *WebhookBody) error {
+	_, err := app.executeRules(ctx, body, nil)
+	return err
+}
+
+// executeRules executes the matched rules and returns them, only the rule of the refresh request is executed if refresh is not nil.
+func (app *App) executeRules(ctx context.Context, body *WebhookBody, refresh *refreshRequest) ([]*Rule, error) {
 	slog.InfoContext(ctx, "start process rules")
-	matchCount := 0
 	evalCtx, err := app.NewEvalContext(body)
 	if err != nil {
-		return fmt.Errorf("failed build eval context: %w", err)
+		return nil, fmt.Errorf("failed build eval context: %w", err)
 	}
 	matchedRules := make([]*Rule, 0, len(app.rules))
 	dependsOnQueries := make(map[string]struct{})
 	for _, rule := range app.rules {
+		if refresh != nil && (rule.Name() != refresh.ruleName || !rule.RefreshPolicy().Enable()) {
+			continue
+		}
+		if !rule.HandleEvent(body) {
+			continue
+		}
 		if !rule.Match(evalCtx) {
 			continue
 		}
 		slog.InfoContext(ctx, "match rule", "rule", rule.Name())
-		matchCount++
+		if rec := dryRunRecorderFromContext(ctx); rec != nil {
+			rec.recordMatchedRule(rule.Name())
+		}
 		matchedRules = append(matchedRules, rule)
 		for _, queryFQN := range rule.DependsOnQueries() {
 			dependsOnQueries[queryFQN] = struct{}{}
 		}
 	}
-	u := app.mkrSvc.NewMackerelUpdater(body, app.Backend())
-	executeRule := func() error {
-		var errs []error
-		for _, rule := range matchedRules {
-			ctxWithRule := slogutils.With(ctx, "rule_name", rule.Name())
-			if err := rule.Execute(ctxWithRule, evalCtx, u); err != nil {
-				slog.ErrorContext(ctxWithRule, "failed execute rule", "error", err.Error())
-				errs = append(errs, fmt.Errorf(
-					"%s: %w",
-					rule.Name(),
-					app.UnwrapAndDumpDiagnoctics(err),
-				))
-			}
-		}
-		if len(errs) > 0 {
-			return errors.Join(errs...)
-		}
-		if err := u.Flush(ctx, evalCtx); err != nil {
-			return fmt.Errorf("failed flush to mackerel: %w", err)
+	evalCtx, err = app.runQueries(ctx, evalCtx, dependsOnQueries)
+	// the failed and timed out queries are returned after Flush, so their statuses are written to the memo,
+	// and the webhook is redelivered by the retry policy.
+	var errs []error
+	if err != nil {
+		if _, ok := err.(*queryNotSucceededError); !ok {
+			return nil, fmt.Errorf("failed process Mackerel webhook body: %w", err)
 		}
-		return nil
+		errs = append(errs, err)
 	}
-	var mu sync.Mutex
-	var wg sync.WaitGroup
-	var errs []error
-	for queryFQN := range dependsOnQueries {
-		query, ok := app.queries[queryFQN]
-		if !ok {
-			errs = append(errs, fmt.Errorf("not found query %q", queryFQN))
-			continue
+	backend := app.Backend()
+	rec := dryRunRecorderFromContext(ctx)
+	if rec != nil {
+		backend = rec.Backend(backend)
+	}
+	u := app.mkrSvc.NewMackerelUpdater(body, backend)
+	if rec != nil {
+		u.SetSink(rec)
+		u.SetNotifier(rec)
+		u.SetHTTPRequestSender(rec)
+	} else {
+		u.SetMemoLocker(app.memoLocker, app.memoLockWait)
+		if key := idempotencyKeyFromContext(ctx); key != "" {
+			u.SetSentRecorder(app.idempotencyStore, key, app.idempotencyTTL)
 		}
-		mu.Lock()
-		evalCtxQueryVariables := &provider.EvalContextQueryVariables{
-			FQN:    queryFQN,
-			Status: "running",
+	}
+	var ruleErrs []error
+	refreshedAt := flextime.Now()
+	for _, rule := range matchedRules {
+		ctxWithRule := slogutils.With(ctx, "rule_name", rule.Name())
+		execute := rule.Execute
+		if refresh != nil {
+			execute = func(ctx context.Context, evalCtx *hcl.EvalContext, u *MackerelUpdater) error {
+				return rule.Refresh(ctx, evalCtx, u, refreshedAt)
+			}
 		}
-		var err error
-		evalCtx, err = provider.WithQury(evalCtx, evalCtxQueryVariables)
-		mu.Unlock()
-		if err != nil {
-			errs = append(errs, fmt.Errorf("failed set query status %q", queryFQN))
-			continue
+		if err := execute(ctxWithRule, evalCtx, u); err != nil {
+			slog.ErrorContext(ctxWithRule, "failed execute rule", "error", err.Error())
+			ruleErrs = append(ruleErrs, fmt.Errorf(
+				"%s: %w",
+				rule.Name(),
+				app.UnwrapAndDumpDiagnoctics(err),
+			))
 		}
-		wg.Add(1)
-		go func(v *provider.EvalContextQueryVariables, query provider.Query) {
-			defer func() {
-				wg.Done()
-			}()
-			egctxWithQueryName := slogutils.With(
-				ctx,
-				"query", v.FQN,
-			)
-			slog.InfoContext(egctxWithQueryName, "start run query")
-			result, err := query.Run(egctxWithQueryName, evalCtx)
-			mu.Lock()
-			defer mu.Unlock()
-			if err != nil {
-				var diags hcl.Diagnostics
-				slog.DebugContext(
-					egctxWithQueryName,
-					"failed run query",
-					"error", err.Error(),
-					"errType", fmt.Sprintf("%T", err),
-				)
-				if errors.As(err, &diags) {
-					app.diagWriter.WriteDiagnostics(diags)
-				}
-				errs = append(errs, err)
-				slog.WarnContext(egctxWithQueryName, "failed run query", "reason", err.Error())
-				v.Status = "failed"
-				v.Error = err.Error()
-				evalCtx, err = provider.WithQury(evalCtx, v)
-				if err != nil {
-					errs = append(errs, fmt.Errorf("failed set query status %q: %w", v.FQN, err))
-				}
-				return
-			}
-			v.Status = "success"
-			v.Result = result
-			evalCtx, err = provider.WithQury(evalCtx, v)
-			if err != nil {
-				slog.ErrorContext(egctxWithQueryName, "failed marshal query result", "error", err.Error())
-				err = app.UnwrapAndDumpDiagnoctics(err)
-				errs = append(errs, fmt.Errorf("failed set query status %q: %w", v.FQN, err))
-			}
-			if err := executeRule(); err != nil {
-				errs = append(errs, err)
-				return
-			}
-			slog.InfoContext(egctxWithQueryName, "end run query")
-		}(evalCtxQueryVariables, query)
-	}
-	wg.Wait()
-	if len(errs) > 0 {
-		return fmt.Errorf("failed process Mackerel webhook body: %w", errors.Join(errs...))
 	}
-	if len(dependsOnQueries) > 0 {
-		return nil
+	if len(ruleErrs) > 0 {
+		errs = append(errs, ruleErrs...)
+	} else if err := u.Flush(ctx, evalCtx); err != nil {
+		errs = append(errs, fmt.Errorf("failed flush to mackerel: %w", err))
 	}
-	if err := executeRule(); err != nil {
-		return fmt.Errorf("failed process Mackerel webhook body: %w", err)
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("failed process Mackerel webhook body: %w", errors.Join(errs...))
 	}
-
-	slog.InfoContext(ctx, "finish process rules", "matched_rule_count", matchCount)
-	return nil
+	slog.InfoContext(ctx, "finish process rules", "matched_rule_count", len(matchedRules))
+	return matchedRules, nil
 }
 
 func (app *App) EnableBasicAuth() bool {
@@ -3,13 +3,17 @@ package prepalert_test
 import (
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -18,6 +22,7 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
 	"github.com/mackerelio/mackerel-client-go"
 	"github.com/mashiike/canyon"
 	"github.com/mashiike/canyon/canyontest"
@@ -207,6 +212,498 @@ func TestAppLoadConfig__WithQuery(t *testing.T) {
 	})
 }
 
+func TestAppLoadConfig__WithMultipleQueries(t *testing.T) {
+	restore := flextime.Fix(time.UnixMilli(1473129912693).Add(5 * time.Minute))
+	defer restore()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockProvider := mock.NewMockProvider(ctrl)
+	provider.RegisterProvider("mock", func(pp *provider.ProviderParameter) (provider.Provider, error) {
+		return mockProvider, nil
+	})
+	t.Cleanup(func() {
+		provider.UnregisterProvider("mock")
+	})
+	mockQueries := make(map[string]*mock.MockQuery)
+	mockProvider.EXPECT().NewQuery(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(name string, _ hcl.Body, _ *hcl.EvalContext) (provider.Query, error) {
+			q := mock.NewMockQuery(ctrl)
+			mockQueries[name] = q
+			return q, nil
+		},
+	).Times(3)
+
+	app := LoadApp(t, "testdata/config/with_multiple_queries.hcl")
+	require.ElementsMatch(t, []string{
+		"query.mock.access_logs",
+		"query.mock.error_logs",
+		"query.mock.slow_logs",
+	}, app.QueryList())
+	rules := app.Rules()
+	require.Len(t, rules, 1)
+	require.ElementsMatch(t, []string{
+		"query.mock.access_logs",
+		"query.mock.error_logs",
+		"query.mock.slow_logs",
+	}, rules[0].DependsOnQueries())
+
+	newClient := func(t *testing.T, updatedMemo *string, updateAlertCount, createGraphAnnotationCount *int) *mock.MockMackerelClient {
+		t.Helper()
+		client := mock.NewMockMackerelClient(ctrl)
+		client.EXPECT().GetAlert("2bj...").Return(
+			&mackerel.Alert{
+				ID:   "2bj...",
+				Memo: "this is a pen",
+			}, nil,
+		).AnyTimes()
+		client.EXPECT().UpdateAlert(gomock.Any(), gomock.Any()).DoAndReturn(
+			func(alertID string, param mackerel.UpdateAlertParam) (*mackerel.UpdateAlertResponse, error) {
+				*updateAlertCount++
+				*updatedMemo = param.Memo
+				return &mackerel.UpdateAlertResponse{
+					Memo: param.Memo,
+				}, nil
+			},
+		).AnyTimes()
+		client.EXPECT().FindGraphAnnotations(gomock.Any(), gomock.Any(), gomock.Any()).Return([]*mackerel.GraphAnnotation{}, nil).AnyTimes()
+		client.EXPECT().CreateGraphAnnotation(gomock.Any()).DoAndReturn(
+			func(param *mackerel.GraphAnnotation) (*mackerel.GraphAnnotation, error) {
+				*createGraphAnnotationCount++
+				require.NotContains(t, param.Description, "running")
+				param.ID = "dummy-graph-annotation-id"
+				return param, nil
+			},
+		).AnyTimes()
+		return client
+	}
+
+	t.Run("AsWorker", func(t *testing.T) {
+		g := goldie.New(t, goldie.WithFixtureDir("testdata/fixture/"), goldie.WithNameSuffix(".golden"))
+		for name, q := range mockQueries {
+			name := name
+			q.EXPECT().Run(gomock.Any(), gomock.Any()).DoAndReturn(
+				func(ctx context.Context, evalCtx *hcl.EvalContext) (*provider.QueryResult, error) {
+					return provider.NewQueryResultWithJSONLines(
+						name, "select * from "+name, nil,
+						map[string]json.RawMessage{
+							"Name": json.RawMessage(`"` + name + `"`),
+						},
+					), nil
+				},
+			).Times(1)
+		}
+		var updatedMemo string
+		var updateAlertCount, createGraphAnnotationCount int
+		client := newClient(t, &updatedMemo, &updateAlertCount, &createGraphAnnotationCount)
+		app.SetMackerelClient(client)
+		h := canyontest.AsWorker(app)
+		r := httptest.NewRequest(http.MethodPost, "/", LoadFileAsReader(t, "example_webhook.json"))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		resp := w.Result()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, 1, updateAlertCount)
+		require.Equal(t, 1, createGraphAnnotationCount)
+		g.Assert(t, "with_multiple_queries_as_worker__updated_alert_memo", []byte(updatedMemo))
+	})
+
+	t.Run("QueryFailed", func(t *testing.T) {
+		for name, q := range mockQueries {
+			if name == "error_logs" {
+				q.EXPECT().Run(gomock.Any(), gomock.Any()).Return(nil, errors.New("query timeout")).Times(1)
+				continue
+			}
+			q.EXPECT().Run(gomock.Any(), gomock.Any()).Return(
+				provider.NewQueryResultWithJSONLines(name, "select * from "+name, nil), nil,
+			).Times(1)
+		}
+		var updatedMemo string
+		var updateAlertCount, createGraphAnnotationCount int
+		client := newClient(t, &updatedMemo, &updateAlertCount, &createGraphAnnotationCount)
+		app.SetMackerelClient(client)
+		h := canyontest.AsWorker(app)
+		r := httptest.NewRequest(http.MethodPost, "/", LoadFileAsReader(t, "example_webhook.json"))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		resp := w.Result()
+		require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+		require.Equal(t, 1, updateAlertCount)
+		require.Equal(t, 1, createGraphAnnotationCount)
+		require.Contains(t, updatedMemo, `[query "query.mock.error_logs" failed: query timeout]`)
+	})
+}
+
+func TestAppLoadConfig__WithQueryDependencies(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockProvider := mock.NewMockProvider(ctrl)
+	provider.RegisterProvider("mock", func(pp *provider.ProviderParameter) (provider.Provider, error) {
+		return mockProvider, nil
+	})
+	t.Cleanup(func() {
+		provider.UnregisterProvider("mock")
+	})
+	mockQueries := make(map[string]*mock.MockQuery)
+	mockProvider.EXPECT().NewQuery(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(name string, _ hcl.Body, _ *hcl.EvalContext) (provider.Query, error) {
+			q := mock.NewMockQuery(ctrl)
+			mockQueries[name] = q
+			return q, nil
+		},
+	).Times(2)
+
+	app := LoadApp(t, "testdata/config/with_query_dependencies.hcl")
+	require.ElementsMatch(t, []string{"query.mock.top_error_path"}, app.QueryDependsOn("query.mock.access_logs"))
+	require.Empty(t, app.QueryDependsOn("query.mock.top_error_path"))
+	rules := app.Rules()
+	require.Len(t, rules, 1)
+	require.ElementsMatch(t, []string{"query.mock.access_logs"}, rules[0].DependsOnQueries())
+
+	t.Run("AsWorker", func(t *testing.T) {
+		var order []string
+		mockQueries["top_error_path"].EXPECT().Run(gomock.Any(), gomock.Any()).DoAndReturn(
+			func(ctx context.Context, evalCtx *hcl.EvalContext) (*provider.QueryResult, error) {
+				order = append(order, "top_error_path")
+				return provider.NewQueryResult(
+					"top_error_path", "fields path", nil,
+					[]string{"path", "cnt"},
+					[][]json.RawMessage{
+						{json.RawMessage(`"/api/users"`), json.RawMessage(`42`)},
+					},
+				), nil
+			},
+		).Times(1)
+		mockQueries["access_logs"].EXPECT().Run(gomock.Any(), gomock.Any()).DoAndReturn(
+			func(ctx context.Context, evalCtx *hcl.EvalContext) (*provider.QueryResult, error) {
+				order = append(order, "access_logs")
+				expr := ParseExpression(t, "query.mock.top_error_path.result.rows[0][0]")
+				v, diags := expr.Value(evalCtx)
+				require.False(t, diags.HasErrors(), diags.Error())
+				var path string
+				require.NoError(t, hclutil.UnmarshalCTYValue(v, &path))
+				require.Equal(t, "/api/users", path)
+				return provider.NewQueryResultWithJSONLines(
+					"access_logs", "SELECT * FROM access_logs WHERE path = :path", []interface{}{path},
+					map[string]json.RawMessage{
+						"path":   json.RawMessage(`"/api/users"`),
+						"status": json.RawMessage(`"500"`),
+					},
+				), nil
+			},
+		).Times(1)
+		var updatedMemo string
+		client := mock.NewMockMackerelClient(ctrl)
+		client.EXPECT().GetAlert("2bj...").Return(
+			&mackerel.Alert{
+				ID:   "2bj...",
+				Memo: "this is a pen",
+			}, nil,
+		).Times(1)
+		client.EXPECT().UpdateAlert(gomock.Any(), gomock.Any()).DoAndReturn(
+			func(alertID string, param mackerel.UpdateAlertParam) (*mackerel.UpdateAlertResponse, error) {
+				updatedMemo = param.Memo
+				return &mackerel.UpdateAlertResponse{
+					Memo: param.Memo,
+				}, nil
+			},
+		).Times(1)
+		app.SetMackerelClient(client)
+		h := canyontest.AsWorker(app)
+		r := httptest.NewRequest(http.MethodPost, "/", LoadFileAsReader(t, "example_webhook.json"))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		resp := w.Result()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, []string{"top_error_path", "access_logs"}, order)
+		require.Contains(t, updatedMemo, `{"path":"/api/users","status":"500"}`)
+	})
+
+	t.Run("DependencyFailed", func(t *testing.T) {
+		mockQueries["top_error_path"].EXPECT().Run(gomock.Any(), gomock.Any()).Return(nil, errors.New("query timeout")).Times(1)
+		mockQueries["access_logs"].EXPECT().Run(gomock.Any(), gomock.Any()).Times(0)
+		var updatedMemo string
+		client := mock.NewMockMackerelClient(ctrl)
+		client.EXPECT().GetAlert("2bj...").Return(
+			&mackerel.Alert{
+				ID:   "2bj...",
+				Memo: "this is a pen",
+			}, nil,
+		).Times(1)
+		client.EXPECT().UpdateAlert(gomock.Any(), gomock.Any()).DoAndReturn(
+			func(alertID string, param mackerel.UpdateAlertParam) (*mackerel.UpdateAlertResponse, error) {
+				updatedMemo = param.Memo
+				return &mackerel.UpdateAlertResponse{
+					Memo: param.Memo,
+				}, nil
+			},
+		).Times(1)
+		app.SetMackerelClient(client)
+		h := canyontest.AsWorker(app)
+		r := httptest.NewRequest(http.MethodPost, "/", LoadFileAsReader(t, "example_webhook.json"))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		resp := w.Result()
+		require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+		require.Contains(t, updatedMemo, `depends on query "query.mock.top_error_path", but it failed`)
+	})
+}
+
+func TestAppLoadConfig__InvalidQueryCycle(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockProvider := mock.NewMockProvider(ctrl)
+	provider.RegisterProvider("mock", func(pp *provider.ProviderParameter) (provider.Provider, error) {
+		return mockProvider, nil
+	})
+	t.Cleanup(func() {
+		provider.UnregisterProvider("mock")
+	})
+	mockProvider.EXPECT().NewQuery(gomock.Any(), gomock.Any(), gomock.Any()).Return(mock.NewMockQuery(ctrl), nil).Times(3)
+	g := goldie.New(t, goldie.WithFixtureDir("testdata/fixture/"), goldie.WithNameSuffix(".golden"))
+	app := prepalert.New("dummy-api-key")
+	var buf bytes.Buffer
+	err := app.LoadConfig("testdata/config/invalid_query_cycle.hcl", func(lco *prepalert.LoadConfigOptions) {
+		lco.DiagnosticDestination = &buf
+		lco.Color = aws.Bool(false)
+		lco.Width = aws.Uint(88)
+	})
+	require.Error(t, err)
+	g.Assert(t, "load_config_diagnotics__invalid_query_cycle", buf.Bytes())
+}
+
+func TestAppLoadConfig__WithQueryOptions(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockProvider := mock.NewMockProvider(ctrl)
+	provider.RegisterProvider("mock", func(pp *provider.ProviderParameter) (provider.Provider, error) {
+		return mockProvider, nil
+	})
+	t.Cleanup(func() {
+		provider.UnregisterProvider("mock")
+	})
+	mockQueries := make(map[string]*mock.MockQuery)
+	mockProvider.EXPECT().NewQuery(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(name string, _ hcl.Body, _ *hcl.EvalContext) (provider.Query, error) {
+			q := mock.NewMockQuery(ctrl)
+			mockQueries[name] = q
+			return q, nil
+		},
+	).Times(3)
+	app := LoadApp(t, "testdata/config/with_query_options.hcl")
+
+	mockQueries["slow"].EXPECT().Run(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, _ *hcl.EvalContext) (*provider.QueryResult, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	).Times(1)
+	flakyCount := 0
+	mockQueries["flaky"].EXPECT().Run(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, _ *hcl.EvalContext) (*provider.QueryResult, error) {
+			flakyCount++
+			if flakyCount < 3 {
+				return nil, errors.New("temporary error")
+			}
+			return provider.NewQueryResultWithJSONLines("flaky", "select 1", nil, map[string]json.RawMessage{
+				"attempt": json.RawMessage(`"3"`),
+			}), nil
+		},
+	).Times(3)
+	mockQueries["only_warning"].EXPECT().Run(gomock.Any(), gomock.Any()).Times(0)
+	var updatedMemo string
+	client := mock.NewMockMackerelClient(ctrl)
+	client.EXPECT().GetAlert("2bj...").Return(
+		&mackerel.Alert{
+			ID:   "2bj...",
+			Memo: "this is a pen",
+		}, nil,
+	).Times(1)
+	client.EXPECT().UpdateAlert(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(alertID string, param mackerel.UpdateAlertParam) (*mackerel.UpdateAlertResponse, error) {
+			updatedMemo = param.Memo
+			return &mackerel.UpdateAlertResponse{
+				Memo: param.Memo,
+			}, nil
+		},
+	).Times(1)
+	app.SetMackerelClient(client)
+	h := canyontest.AsWorker(app)
+	r := httptest.NewRequest(http.MethodPost, "/", LoadFileAsReader(t, "example_webhook.json"))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	resp := w.Result()
+	require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	require.Equal(t, 3, flakyCount)
+	require.Contains(t, updatedMemo, `[query "query.mock.slow" timed out: timed out after 50ms]`)
+	require.Contains(t, updatedMemo, `{"attempt":"3"}`)
+	require.Contains(t, updatedMemo, `[query "query.mock.only_warning" skipped: when condition is not satisfied]`)
+}
+
+func TestAppLoadConfig__WithMackerelMetrics(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	app := LoadApp(t, "testdata/config/with_mackerel_metrics.hcl")
+	require.ElementsMatch(t, []string{"mackerel_metrics.default"}, app.ProviderList())
+	require.ElementsMatch(t, []string{
+		"query.mackerel_metrics.loadavg",
+		"query.mackerel_metrics.response_time",
+	}, app.QueryList())
+
+	g := goldie.New(t, goldie.WithFixtureDir("testdata/fixture/"), goldie.WithNameSuffix(".golden"))
+	var updatedMemo string
+	client := mock.NewMockMackerelClient(ctrl)
+	client.EXPECT().GetAlert("2bj...").Return(
+		&mackerel.Alert{
+			ID:   "2bj...",
+			Memo: "this is a pen",
+		}, nil,
+	).Times(1)
+	client.EXPECT().FetchHostMetricValues("22D4...", "loadavg5", int64(1473129912-600), int64(1473130092)).Return(
+		[]mackerel.MetricValue{
+			{Name: "loadavg5", Time: 1473129900, Value: 0.5},
+			{Name: "loadavg5", Time: 1473129960, Value: 2.25},
+		}, nil,
+	).Times(1)
+	client.EXPECT().FetchServiceMetricValues("prod", "response_time", int64(1473129912-300), int64(1473130092)).Return(
+		[]mackerel.MetricValue{
+			{Name: "response_time", Time: 1473129900, Value: 120},
+		}, nil,
+	).Times(1)
+	client.EXPECT().UpdateAlert(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(alertID string, param mackerel.UpdateAlertParam) (*mackerel.UpdateAlertResponse, error) {
+			updatedMemo = param.Memo
+			return &mackerel.UpdateAlertResponse{
+				Memo: param.Memo,
+			}, nil
+		},
+	).Times(1)
+	app.SetMackerelClient(client)
+	h := canyontest.AsWorker(app)
+	r := httptest.NewRequest(http.MethodPost, "/", LoadFileAsReader(t, "example_webhook.json"))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	resp := w.Result()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	g.Assert(t, "with_mackerel_metrics_as_worker__updated_alert_memo", []byte(updatedMemo))
+}
+
+func TestAppLoadConfig__WithMackerelAlerts(t *testing.T) {
+	restore := flextime.Fix(time.Unix(1473129912, 0).Add(10 * time.Minute))
+	defer restore()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	app := LoadApp(t, "testdata/config/with_mackerel_alerts.hcl")
+	require.ElementsMatch(t, []string{"mackerel_alerts.default"}, app.ProviderList())
+
+	g := goldie.New(t, goldie.WithFixtureDir("testdata/fixture/"), goldie.WithNameSuffix(".golden"))
+	var updatedMemo string
+	current := &mackerel.Alert{
+		ID:        "2bj...",
+		Status:    "CRITICAL",
+		MonitorID: "mon1",
+		HostID:    "22D4...",
+		Value:     2.25,
+		OpenedAt:  1473129912,
+		Memo:      "this is a pen",
+	}
+	client := mock.NewMockMackerelClient(ctrl)
+	client.EXPECT().GetAlert("2bj...").Return(current, nil).AnyTimes()
+	client.EXPECT().GetMonitor("mon1").Return(&mackerel.MonitorHostMetric{ID: "mon1"}, nil).Times(1)
+	client.EXPECT().FindWithClosedAlerts().Return(&mackerel.AlertsResp{
+		Alerts: []*mackerel.Alert{
+			current,
+			{ID: "other", Status: "WARNING", MonitorID: "mon2", OpenedAt: 1473129912 - 60},
+			{ID: "past1", Status: "OK", MonitorID: "mon1", Value: 1.5, OpenedAt: 1473129912 - 3600, ClosedAt: 1473129912 - 3000},
+		},
+		NextID: "next1",
+	}, nil).Times(1)
+	client.EXPECT().FindWithClosedAlertsByNextID("next1").Return(&mackerel.AlertsResp{
+		Alerts: []*mackerel.Alert{
+			{ID: "past2", Status: "OK", MonitorID: "mon1", Value: 3, OpenedAt: 1473129912 - 7200, ClosedAt: 1473129912 - 6900},
+			{ID: "past3", Status: "OK", MonitorID: "mon1", Value: 3, OpenedAt: 1473129912 - 7500, ClosedAt: 1473129912 - 7400},
+		},
+		NextID: "next2",
+	}, nil).Times(1)
+	client.EXPECT().FindAlerts().Return(&mackerel.AlertsResp{
+		Alerts: []*mackerel.Alert{
+			current,
+			{ID: "other_host", Status: "CRITICAL", MonitorID: "mon1", HostID: "33E5...", OpenedAt: 1473129912 - 60},
+		},
+	}, nil).Times(1)
+	client.EXPECT().UpdateAlert(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(alertID string, param mackerel.UpdateAlertParam) (*mackerel.UpdateAlertResponse, error) {
+			updatedMemo = param.Memo
+			return &mackerel.UpdateAlertResponse{
+				Memo: param.Memo,
+			}, nil
+		},
+	).Times(1)
+	app.SetMackerelClient(client)
+	h := canyontest.AsWorker(app)
+	r := httptest.NewRequest(http.MethodPost, "/", LoadFileAsReader(t, "example_webhook.json"))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	resp := w.Result()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	g.Assert(t, "with_mackerel_alerts_as_worker__updated_alert_memo", []byte(updatedMemo))
+}
+
+func TestAppLoadConfig__WithCorrelatedAlerts(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	app := LoadApp(t, "testdata/config/with_correlated_alerts.hcl")
+	rules := app.Rules()
+	require.Len(t, rules, 1)
+	require.True(t, rules[0].CorrelatedAlertsAction().Enable())
+
+	g := goldie.New(t, goldie.WithFixtureDir("testdata/fixture/"), goldie.WithNameSuffix(".golden"))
+	var updatedMemo string
+	client := mock.NewMockMackerelClient(ctrl)
+	client.EXPECT().GetAlert("2bj...").Return(
+		&mackerel.Alert{
+			ID:   "2bj...",
+			Memo: "this is a pen",
+		}, nil,
+	).Times(1)
+	client.EXPECT().FindAlerts().Return(&mackerel.AlertsResp{
+		Alerts: []*mackerel.Alert{
+			{ID: "db", Status: "CRITICAL", MonitorID: "mon2", HostID: "db01", OpenedAt: 1473129912 + 120},
+			{ID: "2bj...", Status: "CRITICAL", MonitorID: "mon1", HostID: "22D4...", OpenedAt: 1473129912},
+			{ID: "latency", Status: "WARNING", MonitorID: "mon3", OpenedAt: 1473129912 - 60},
+			{ID: "unknown", Status: "WARNING", MonitorID: "mon4", HostID: "retired", OpenedAt: 1473129912 - 120},
+			{ID: "old", Status: "CRITICAL", MonitorID: "mon2", HostID: "db01", OpenedAt: 1473129912 - 3600},
+		},
+		NextID: "next",
+	}, nil).Times(1)
+	client.EXPECT().GetMonitor("mon2").Return(&mackerel.MonitorHostMetric{ID: "mon2", Name: "db cpu"}, nil).Times(1)
+	client.EXPECT().GetMonitor("mon3").Return(&mackerel.MonitorServiceMetric{ID: "mon3", Name: "latency", Service: "prod"}, nil).Times(1)
+	client.EXPECT().GetMonitor("mon4").Return(nil, errors.New("monitor not found")).Times(1)
+	client.EXPECT().FindHost("retired").Return(nil, errors.New("host not found")).Times(1)
+	client.EXPECT().FindHost("db01").Return(&mackerel.Host{
+		ID:   "db01",
+		Name: "db01",
+		Roles: mackerel.Roles{
+			"prod": []string{"db"},
+		},
+	}, nil).Times(1)
+	client.EXPECT().UpdateAlert(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(alertID string, param mackerel.UpdateAlertParam) (*mackerel.UpdateAlertResponse, error) {
+			updatedMemo = param.Memo
+			return &mackerel.UpdateAlertResponse{
+				Memo: param.Memo,
+			}, nil
+		},
+	).Times(1)
+	app.SetMackerelClient(client)
+	h := canyontest.AsWorker(app)
+	r := httptest.NewRequest(http.MethodPost, "/", LoadFileAsReader(t, "example_webhook.json"))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	resp := w.Result()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	g.Assert(t, "with_correlated_alerts_as_worker__updated_alert_memo", []byte(updatedMemo))
+}
+
 func TestAppLoadConfig__WithS3Backend(t *testing.T) {
 	t.Setenv("TZ", "UTC")
 	t.Setenv("GOOGLE_CLIENT_ID", "dummy-client-id")
@@ -272,6 +769,54 @@ func TestAppLoadConfig__WithS3Backend(t *testing.T) {
 		resp := w.Result()
 		require.Equal(t, http.StatusOK, resp.StatusCode)
 	})
+
+	t.Run("ExecDryRun", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		g := goldie.New(t, goldie.WithFixtureDir("testdata/fixture/"), goldie.WithNameSuffix(".golden"))
+		client := mock.NewMockMackerelClient(ctrl)
+		client.EXPECT().GetOrg().Return(&mackerel.Org{Name: "Macker..."}, nil).Times(1)
+		client.EXPECT().GetAlert("2bj...").Return(
+			&mackerel.Alert{
+				ID:        "2bj...",
+				OpenedAt:  1473129912,
+				Status:    "CRITICAL",
+				Type:      "service",
+				MonitorID: "4gx...",
+				Memo:      "this is a pen",
+			}, nil,
+		).Times(2)
+		client.EXPECT().GetMonitor("4gx...").Return(&mackerel.MonitorServiceMetric{
+			ID:      "4gx...",
+			Name:    "MonitorName",
+			Service: "prod",
+		}, nil).Times(1)
+		app.SetMackerelClient(client)
+		var buf bytes.Buffer
+		err := app.Exec(context.Background(), &prepalert.ExecOptions{
+			AlertID: "2bj...",
+			DryRun:  true,
+			Format:  "text",
+			Writer:  &buf,
+		})
+		require.NoError(t, err)
+		g.Assert(t, "with_s3backend_exec_dry_run", buf.Bytes())
+	})
+}
+
+func TestAppLoadConfig__WithFileQueue(t *testing.T) {
+	t.Setenv("PREPALERT_QUEUE_DIR", "/tmp/prepalert/queue")
+	t.Setenv("PREPALERT_DLQ_PATH", "/tmp/prepalert/dlq.jsonl")
+	app := LoadApp(t, "testdata/config/with_file_queue.hcl")
+	require.True(t, app.WebhookServerIsReady())
+	require.Equal(t, "prepalert", app.SQSQueueName())
+	q := app.LocalQueue()
+	require.NotNil(t, q)
+	require.Equal(t, "file", q.Type)
+	require.Equal(t, "/tmp/prepalert/queue", q.Path)
+	require.Equal(t, time.Minute, q.VisibilityTimeout)
+	require.EqualValues(t, 5, q.MaxReceiveCount)
+	require.Equal(t, "/tmp/prepalert/dlq.jsonl", q.DLQPath)
 }
 
 func TestAppLoadConfig__Dynamic(t *testing.T) {
@@ -295,6 +840,11 @@ func TestAppLoadConfig__Invalid(t *testing.T) {
 		{"invalid_duplicate", "testdata/config/invalid_duplicate.hcl"},
 		{"invalid_provider", "testdata/config/invalid_provider.hcl"},
 		{"invalid_version", "testdata/config/invalid_version.hcl"},
+		{"invalid_test_block", "testdata/config/invalid_test_block.hcl"},
+		{"invalid_queue", "testdata/config/invalid_queue.hcl"},
+		{"invalid_refresh", "testdata/config/invalid_refresh.hcl"},
+		{"invalid_events", "testdata/config/invalid_events.hcl"},
+		{"invalid_http_request", "testdata/config/invalid_http_request.hcl"},
 	}
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -332,7 +882,7 @@ func TestAppLoadConfig__When_Is_List(t *testing.T) {
 				MonitorID: "4gx...",
 				Memo:      "How do you respond to alerts?",
 			}, nil,
-		).Times(1)
+		).Times(2)
 		client.EXPECT().GetMonitor("4gx...").Return(
 			&mackerel.MonitorServiceMetric{
 				ID:   "4gx...",
@@ -491,3 +1041,657 @@ func TestAppLoadConfig__WithRulePriorty(t *testing.T) {
 		require.Equal(t, http.StatusOK, resp.StatusCode)
 	})
 }
+
+func TestAppLoadConfig__WithHostEvents(t *testing.T) {
+	app := LoadApp(t, "testdata/config/with_host_events.hcl")
+	rules := app.Rules()
+	require.Len(t, rules, 2)
+	require.Equal(t, []string{"alert"}, rules[0].Events())
+	require.Equal(t, []string{"hostRetire"}, rules[1].Events())
+
+	body := LoadJSON[prepalert.WebhookBody](t, "testdata/host_retire_webhook.json")
+	require.False(t, rules[0].HandleEvent(&body))
+	require.True(t, rules[1].HandleEvent(&body))
+	evalCtx, err := app.NewEvalContext(&body)
+	require.NoError(t, err)
+	for _, src := range []string{`webhook.alert.id == null`, `webhook.alert.status != "critical"`, `webhook.alert.closed_at == null`} {
+		expr, diags := hclsyntax.ParseExpression([]byte(src), "test.hcl", hcl.InitialPos)
+		require.False(t, diags.HasErrors())
+		v, diags := expr.Value(evalCtx)
+		require.False(t, diags.HasErrors(), "alert fields are null for the events without alert: %s", diags)
+		require.True(t, v.True(), src)
+	}
+
+	restore := flextime.Fix(time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC))
+	defer restore()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	client := mock.NewMockMackerelClient(ctrl)
+	client.EXPECT().FindGraphAnnotations("prod", gomock.Any(), gomock.Any()).Return([]*mackerel.GraphAnnotation{}, nil).Times(1)
+	client.EXPECT().CreateGraphAnnotation(gomock.Any()).DoAndReturn(
+		func(param *mackerel.GraphAnnotation) (*mackerel.GraphAnnotation, error) {
+			require.Equal(t, &mackerel.GraphAnnotation{
+				Title:       "prepalert event=hostRetire host_id=22D4...",
+				Description: "related host: https://mackerel.io/orgs/.../hosts/...\napp01 is retired by deployer\n",
+				From:        1696118400,
+				To:          1696118400,
+				Service:     "prod",
+			}, param)
+			param.ID = "dummy-graph-annotation-id"
+			return param, nil
+		},
+	).Times(1)
+	app.SetMackerelClient(client)
+
+	h := canyontest.AsWorker(app)
+	r := httptest.NewRequest(http.MethodPost, "/", LoadFileAsReader(t, "testdata/host_retire_webhook.json"))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+}
+
+func TestAppLoadConfig__WithAlertGroup(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	app := LoadApp(t, "testdata/config/with_alert_group.hcl")
+	rules := app.Rules()
+	require.Len(t, rules, 2)
+	alertBody := LoadJSON[prepalert.WebhookBody](t, "example_webhook.json")
+	alertGroupBody := LoadJSON[prepalert.WebhookBody](t, "example_alert_group_webhook.json")
+	require.True(t, rules[0].HandleEvent(&alertBody))
+	require.False(t, rules[0].HandleEvent(&alertGroupBody))
+	require.False(t, rules[1].HandleEvent(&alertBody))
+	require.True(t, rules[1].HandleEvent(&alertGroupBody))
+	require.True(t, rules[1].AlertGroupReportAction().Enable())
+
+	g := goldie.New(t, goldie.WithFixtureDir("testdata/fixture/"), goldie.WithNameSuffix(".golden"))
+	updatedMemos := make(map[string]string)
+	client := mock.NewMockMackerelClient(ctrl)
+	client.EXPECT().GetAlertGroupSetting("2sM...").Return(&mackerel.AlertGroupSetting{
+		ID:            "2sM...",
+		Name:          "Service outage",
+		ServiceScopes: []string{"Service"},
+		MonitorScopes: []string{"4gx..."},
+	}, nil).Times(1)
+	client.EXPECT().FindWithClosedAlerts().Return(&mackerel.AlertsResp{
+		Alerts: []*mackerel.Alert{
+			{ID: "api", Status: "CRITICAL", MonitorID: "4gx...", OpenedAt: 1473129912 + 60},
+			{ID: "app", Status: "WARNING", MonitorID: "mon2", HostID: "app01", OpenedAt: 1473129912, ClosedAt: 1473129912 + 120},
+			{ID: "other", Status: "CRITICAL", MonitorID: "mon2", HostID: "batch01", OpenedAt: 1473129912 - 60},
+			{ID: "old", Status: "CRITICAL", MonitorID: "4gx...", OpenedAt: 1473129912 - 3600},
+		},
+	}, nil).Times(1)
+	client.EXPECT().GetMonitor("4gx...").Return(&mackerel.MonitorServiceMetric{ID: "4gx...", Name: "api latency", Service: "Service"}, nil).Times(1)
+	client.EXPECT().GetMonitor("mon2").Return(&mackerel.MonitorHostMetric{ID: "mon2", Name: "cpu"}, nil).Times(1)
+	client.EXPECT().FindHost("app01").Return(&mackerel.Host{
+		ID:    "app01",
+		Name:  "app01",
+		Roles: mackerel.Roles{"Service": []string{"app"}},
+	}, nil).Times(1)
+	client.EXPECT().FindHost("batch01").Return(&mackerel.Host{
+		ID:    "batch01",
+		Name:  "batch01",
+		Roles: mackerel.Roles{"Other": []string{"batch"}},
+	}, nil).Times(1)
+	client.EXPECT().GetAlert(gomock.Any()).DoAndReturn(func(alertID string) (*mackerel.Alert, error) {
+		return &mackerel.Alert{ID: alertID, Memo: "written by human"}, nil
+	}).Times(2)
+	client.EXPECT().UpdateAlert(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(alertID string, param mackerel.UpdateAlertParam) (*mackerel.UpdateAlertResponse, error) {
+			updatedMemos[alertID] = param.Memo
+			return &mackerel.UpdateAlertResponse{Memo: param.Memo}, nil
+		},
+	).Times(2)
+	app.SetMackerelClient(client)
+	h := canyontest.AsWorker(app)
+	r := httptest.NewRequest(http.MethodPost, "/", LoadFileAsReader(t, "example_alert_group_webhook.json"))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Len(t, updatedMemos, 2)
+	require.Contains(t, updatedMemos, "api")
+	require.Contains(t, updatedMemos, "app")
+	require.Equal(t, updatedMemos["api"], updatedMemos["app"], "same report in each member alert")
+	g.Assert(t, "with_alert_group_as_worker__updated_alert_memo", []byte(updatedMemos["api"]))
+}
+
+func TestAppLoadConfig__WithRefresh(t *testing.T) {
+	app := LoadApp(t, "testdata/config/with_refresh.hcl")
+	rules := app.Rules()
+	require.Len(t, rules, 2)
+	require.True(t, rules[0].RefreshPolicy().Enable())
+	require.Equal(t, 10*time.Minute, rules[0].RefreshPolicy().Interval())
+	require.Equal(t, 2, rules[0].RefreshPolicy().MaxTimes())
+	require.False(t, rules[1].RefreshPolicy().Enable())
+
+	restore := flextime.Fix(time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC))
+	defer restore()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	alertStatus := "CRITICAL"
+	var currentMemo string
+	client := mock.NewMockMackerelClient(ctrl)
+	client.EXPECT().GetAlert("2bj...").DoAndReturn(func(alertID string) (*mackerel.Alert, error) {
+		return &mackerel.Alert{ID: alertID, Status: alertStatus, Memo: currentMemo}, nil
+	}).AnyTimes()
+	client.EXPECT().UpdateAlert("2bj...", gomock.Any()).DoAndReturn(
+		func(alertID string, param mackerel.UpdateAlertParam) (*mackerel.UpdateAlertResponse, error) {
+			currentMemo = param.Memo
+			return &mackerel.UpdateAlertResponse{Memo: param.Memo}, nil
+		},
+	).Times(3)
+	app.SetMackerelClient(client)
+
+	type sentRequest struct {
+		header       http.Header
+		body         []byte
+		delaySeconds int32
+	}
+	var sent []sentRequest
+	app.SetWorkerSender(canyon.WorkerSenderFunc(func(r *http.Request, opts *canyon.SendOptions) (string, error) {
+		bs, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		sent = append(sent, sentRequest{header: r.Header.Clone(), body: bs, delaySeconds: *opts.DelaySeconds})
+		return fmt.Sprintf("message-%d", len(sent)), nil
+	}))
+	deliver := func(header http.Header, body io.Reader) {
+		t.Helper()
+		h := canyontest.AsWorker(app)
+		r := httptest.NewRequest(http.MethodPost, "/", body)
+		for k, values := range header {
+			for _, v := range values {
+				r.Header.Add(k, v)
+			}
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	}
+
+	deliver(http.Header{prepalert.HeaderRequestID: []string{"1"}}, LoadFileAsReader(t, "example_webhook.json"))
+	require.Contains(t, currentMemo, "alert 2bj... is still open")
+	require.Contains(t, currentMemo, "written only once")
+	require.NotContains(t, currentMemo, "last refreshed")
+	require.Len(t, sent, 1)
+	require.Equal(t, int32(600), sent[0].delaySeconds)
+	require.Equal(t, "refresh", sent[0].header.Get(prepalert.HeaderRefreshRule))
+	require.Equal(t, "1", sent[0].header.Get(prepalert.HeaderRefreshCount))
+	require.Equal(t, "1", sent[0].header.Get(prepalert.HeaderRequestID))
+
+	deliver(sent[0].header, bytes.NewReader(sent[0].body))
+	require.Contains(t, currentMemo, "### rule.refresh\n\nlast refreshed: 2023-10-01T00:00:00Z\n\nalert 2bj... is still open")
+	require.Contains(t, currentMemo, "written only once", "the memo of other rules is kept")
+	require.Len(t, sent, 2)
+	require.Equal(t, "2", sent[1].header.Get(prepalert.HeaderRefreshCount))
+
+	deliver(sent[1].header, bytes.NewReader(sent[1].body))
+	require.Len(t, sent, 2, "reached max_times")
+
+	alertStatus = "OK"
+	deliver(sent[0].header, bytes.NewReader(sent[0].body))
+	require.Len(t, sent, 2, "the alert is closed")
+}
+
+func TestAppLoadConfig__WithNotify(t *testing.T) {
+	type received struct {
+		path string
+		body []byte
+	}
+	var requests []received
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bs, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		requests = append(requests, received{path: r.URL.Path, body: bs})
+		fmt.Fprintln(w, "ok")
+	}))
+	defer server.Close()
+	t.Setenv("SLACK_WEBHOOK_URL", server.URL+"/slack")
+	t.Setenv("NOTIFY_WEBHOOK_URL", server.URL+"/webhook")
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockS3Client := mock.NewMockS3Client(ctrl)
+	prepalert.GlobalS3Client = mockS3Client
+	t.Cleanup(func() {
+		prepalert.GlobalS3Client = nil
+	})
+	mockProvider := mock.NewMockProvider(ctrl)
+	provider.RegisterProvider("mock", func(pp *provider.ProviderParameter) (provider.Provider, error) {
+		return mockProvider, nil
+	})
+	t.Cleanup(func() {
+		provider.UnregisterProvider("mock")
+	})
+	mockQuery := mock.NewMockQuery(ctrl)
+	mockProvider.EXPECT().NewQuery(gomock.Any(), gomock.Any(), gomock.Any()).Return(mockQuery, nil).Times(1)
+
+	app := LoadApp(t, "testdata/config/with_notify.hcl")
+	rules := app.Rules()
+	require.Len(t, rules, 1)
+	require.True(t, rules[0].NotifySlackAction().Enable())
+	require.True(t, rules[0].NotifyWebhookAction().Enable())
+	require.ElementsMatch(t, []string{"query.mock.error_count"}, rules[0].NotifySlackAction().DependsOnQueries())
+	require.ElementsMatch(t, []string{"query.mock.error_count"}, rules[0].DependsOnQueries())
+
+	g := goldie.New(t, goldie.WithFixtureDir("testdata/fixture/"), goldie.WithNameSuffix(".golden"))
+	mockQuery.EXPECT().Run(gomock.Any(), gomock.Any()).Return(provider.NewQueryResult(
+		"error_count", "stats count(*) as cnt", nil,
+		[]string{"cnt"},
+		[][]json.RawMessage{{json.RawMessage(`42`)}},
+	), nil).Times(1)
+	mockS3Client.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any()).Return(&s3.PutObjectOutput{}, nil).Times(1)
+	client := mock.NewMockMackerelClient(ctrl)
+	client.EXPECT().GetAlert("2bj...").Return(&mackerel.Alert{ID: "2bj..."}, nil).Times(1)
+	client.EXPECT().UpdateAlert("2bj...", gomock.Any()).Return(&mackerel.UpdateAlertResponse{}, nil).Times(1)
+	app.SetMackerelClient(client)
+
+	h := canyontest.AsWorker(app)
+	r := httptest.NewRequest(http.MethodPost, "/", LoadFileAsReader(t, "example_webhook.json"))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Len(t, requests, 2)
+	require.Equal(t, "/slack", requests[0].path)
+	g.AssertJson(t, "with_notify_as_worker__slack_payload", json.RawMessage(requests[0].body))
+	require.Equal(t, "/webhook", requests[1].path)
+	var payload struct {
+		Rule        string                 `json:"rule"`
+		Text        string                 `json:"text"`
+		FullTextURL string                 `json:"full_text_url"`
+		Webhook     *prepalert.WebhookBody `json:"webhook"`
+	}
+	require.NoError(t, json.Unmarshal(requests[1].body, &payload))
+	require.Equal(t, "incident", payload.Rule)
+	require.Equal(t, "errors: 42", payload.Text)
+	require.Equal(t, "http://localhost:8080/Macker.../2bj.../2bj....txt", payload.FullTextURL)
+	require.Equal(t, "2bj...", payload.Webhook.Alert.ID)
+}
+
+func TestAppLoadConfig__WithHTTPRequest(t *testing.T) {
+	var statusCodes []int
+	type received struct {
+		method string
+		path   string
+		header http.Header
+		body   []byte
+	}
+	var requests []received
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bs, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		requests = append(requests, received{method: r.Method, path: r.URL.Path, header: r.Header.Clone(), body: bs})
+		code := statusCodes[0]
+		statusCodes = statusCodes[1:]
+		w.WriteHeader(code)
+		fmt.Fprintln(w, http.StatusText(code))
+	}))
+	defer server.Close()
+	t.Setenv("TRACKER_URL", server.URL)
+	t.Setenv("TRACKER_TOKEN", "dummy-token")
+	t.Setenv("TRACKER_SECRET", "dummy-secret")
+
+	app := LoadApp(t, "testdata/config/with_http_request.hcl")
+	rules := app.Rules()
+	require.Len(t, rules, 1)
+	require.True(t, rules[0].HTTPRequestAction().Enable())
+
+	setupClient := func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+		client := mock.NewMockMackerelClient(ctrl)
+		client.EXPECT().GetAlert("2bj...").Return(&mackerel.Alert{ID: "2bj..."}, nil).Times(1)
+		client.EXPECT().UpdateAlert("2bj...", gomock.Any()).Return(&mackerel.UpdateAlertResponse{}, nil).Times(1)
+		app.SetMackerelClient(client)
+	}
+	serve := func() *http.Response {
+		h := canyontest.AsWorker(app)
+		r := httptest.NewRequest(http.MethodPost, "/", LoadFileAsReader(t, "example_webhook.json"))
+		r.Header.Set(prepalert.HeaderRequestID, "1234567890")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	t.Run("RetrySucceeded", func(t *testing.T) {
+		setupClient(t)
+		requests = nil
+		statusCodes = []int{http.StatusServiceUnavailable, http.StatusOK}
+		require.Equal(t, http.StatusOK, serve().StatusCode)
+		require.Len(t, requests, 2)
+		req := requests[1]
+		require.Equal(t, http.MethodPut, req.method)
+		require.Equal(t, "/incidents/2bj...", req.path)
+		require.Equal(t, "Bearer dummy-token", req.header.Get("Authorization"))
+		require.Equal(t, "application/json", req.header.Get("Content-Type"))
+		require.JSONEq(t, `{"title":"MonitorName","status":"critical"}`, string(req.body))
+		mac := hmac.New(sha256.New, []byte("dummy-secret"))
+		mac.Write(req.body)
+		require.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), req.header.Get("X-Prepalert-Signature"))
+		require.Equal(t, "2bj.../critical/1234567890/sent/tracker/http_request", req.header.Get("Idempotency-Key"))
+		require.Equal(t, req.header.Get("Idempotency-Key"), requests[0].header.Get("Idempotency-Key"), "same key for the retry")
+	})
+
+	t.Run("Failed", func(t *testing.T) {
+		setupClient(t)
+		requests = nil
+		statusCodes = []int{http.StatusBadRequest}
+		body := LoadJSON[prepalert.WebhookBody](t, "example_webhook.json")
+		err := app.ExecuteRules(context.Background(), &body)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "rule tracker: http_request PUT "+server.URL+"/incidents/2bj...: unexpected status 400 Bad Request")
+		require.Len(t, requests, 1, "client error is not retried")
+	})
+}
+
+func TestAppLoadConfig__WithCloseAlert(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockProvider := mock.NewMockProvider(ctrl)
+	provider.RegisterProvider("mock", func(pp *provider.ProviderParameter) (provider.Provider, error) {
+		return mockProvider, nil
+	})
+	t.Cleanup(func() {
+		provider.UnregisterProvider("mock")
+	})
+	mockQuery := mock.NewMockQuery(ctrl)
+	mockProvider.EXPECT().NewQuery(gomock.Any(), gomock.Any(), gomock.Any()).Return(mockQuery, nil).Times(1)
+
+	app := LoadApp(t, "testdata/config/with_close_alert.hcl")
+	rules := app.Rules()
+	require.Len(t, rules, 1)
+	require.True(t, rules[0].CloseAlertAction().Enable())
+	require.ElementsMatch(t, []string{"query.mock.user_agents"}, rules[0].CloseAlertAction().DependsOnQueries())
+	require.ElementsMatch(t, []string{"query.mock.user_agents"}, rules[0].DependsOnQueries())
+
+	expectUserAgents := func(userAgents ...string) {
+		rows := make([][]json.RawMessage, 0, len(userAgents))
+		for _, ua := range userAgents {
+			rows = append(rows, []json.RawMessage{json.RawMessage(strconv.Quote(ua)), json.RawMessage(`120`)})
+		}
+		mockQuery.EXPECT().Run(gomock.Any(), gomock.Any()).Return(provider.NewQueryResult(
+			"user_agents", "stats count(*) as cnt by user_agent", nil,
+			[]string{"user_agent", "cnt"},
+			rows,
+		), nil).Times(1)
+	}
+	const reason = "5xx burst came from a single user agent: BadBot/1.0"
+
+	t.Run("Closed", func(t *testing.T) {
+		expectUserAgents("BadBot/1.0")
+		client := mock.NewMockMackerelClient(ctrl)
+		client.EXPECT().GetAlert("2bj...").Return(&mackerel.Alert{ID: "2bj...", Status: "CRITICAL"}, nil).Times(2)
+		var updatedMemo string
+		gomock.InOrder(
+			client.EXPECT().UpdateAlert("2bj...", gomock.Any()).DoAndReturn(
+				func(_ string, param mackerel.UpdateAlertParam) (*mackerel.UpdateAlertResponse, error) {
+					updatedMemo = param.Memo
+					return &mackerel.UpdateAlertResponse{}, nil
+				},
+			).Times(1),
+			client.EXPECT().CloseAlert("2bj...", reason).Return(&mackerel.Alert{ID: "2bj...", Status: "OK"}, nil).Times(1),
+		)
+		app.SetMackerelClient(client)
+
+		h := canyontest.AsWorker(app)
+		r := httptest.NewRequest(http.MethodPost, "/", LoadFileAsReader(t, "example_webhook.json"))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		require.Contains(t, updatedMemo, "### rule.bot_noise.close_alert\n\nclosed by prepalert: "+reason)
+		require.Contains(t, updatedMemo, "BadBot/1.0")
+		require.Contains(t, updatedMemo, "| user_agent |")
+	})
+
+	t.Run("NotClosed", func(t *testing.T) {
+		expectUserAgents("BadBot/1.0", "Mozilla/5.0")
+		client := mock.NewMockMackerelClient(ctrl)
+		client.EXPECT().GetAlert("2bj...").Return(&mackerel.Alert{ID: "2bj..."}, nil).Times(1)
+		var updatedMemo string
+		client.EXPECT().UpdateAlert("2bj...", gomock.Any()).DoAndReturn(
+			func(_ string, param mackerel.UpdateAlertParam) (*mackerel.UpdateAlertResponse, error) {
+				updatedMemo = param.Memo
+				return &mackerel.UpdateAlertResponse{}, nil
+			},
+		).Times(1)
+		app.SetMackerelClient(client)
+
+		body := LoadJSON[prepalert.WebhookBody](t, "example_webhook.json")
+		require.NoError(t, app.ExecuteRules(context.Background(), &body))
+		require.NotContains(t, updatedMemo, "close_alert")
+	})
+
+	t.Run("AlreadyClosed", func(t *testing.T) {
+		// the webhook is redelivered after the alert is closed, the payload still says critical.
+		expectUserAgents("BadBot/1.0")
+		client := mock.NewMockMackerelClient(ctrl)
+		client.EXPECT().GetAlert("2bj...").Return(&mackerel.Alert{ID: "2bj...", Status: "OK"}, nil).Times(2)
+		var updatedMemo string
+		client.EXPECT().UpdateAlert("2bj...", gomock.Any()).DoAndReturn(
+			func(_ string, param mackerel.UpdateAlertParam) (*mackerel.UpdateAlertResponse, error) {
+				updatedMemo = param.Memo
+				return &mackerel.UpdateAlertResponse{}, nil
+			},
+		).Times(1)
+		client.EXPECT().CloseAlert(gomock.Any(), gomock.Any()).Times(0)
+		app.SetMackerelClient(client)
+
+		body := LoadJSON[prepalert.WebhookBody](t, "example_webhook.json")
+		require.NoError(t, app.ExecuteRules(context.Background(), &body))
+		require.NotContains(t, updatedMemo, "close_alert")
+	})
+
+	t.Run("DryRun", func(t *testing.T) {
+		expectUserAgents("BadBot/1.0")
+		client := mock.NewMockMackerelClient(ctrl)
+		client.EXPECT().GetAlert("2bj...").Return(&mackerel.Alert{ID: "2bj..."}, nil).Times(2)
+		app.SetMackerelClient(client)
+
+		rec := prepalert.NewDryRunRecorder()
+		body := LoadJSON[prepalert.WebhookBody](t, "example_webhook.json")
+		require.NoError(t, app.ExecuteRules(prepalert.WithDryRunRecorder(context.Background(), rec), &body))
+		require.Equal(t, []*prepalert.DryRunClosedAlertRecord{
+			{AlertID: "2bj...", Reason: reason},
+		}, rec.ClosedAlerts)
+		require.Len(t, rec.AlertMemos, 1)
+		require.Contains(t, rec.AlertMemos[0].Memo, "closed by prepalert: "+reason)
+	})
+}
+
+func TestAppLoadConfig__WithCreateDowntime(t *testing.T) {
+	restore := flextime.Fix(time.Unix(1700000000, 0))
+	defer restore()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockProvider := mock.NewMockProvider(ctrl)
+	provider.RegisterProvider("mock", func(pp *provider.ProviderParameter) (provider.Provider, error) {
+		return mockProvider, nil
+	})
+	t.Cleanup(func() {
+		provider.UnregisterProvider("mock")
+	})
+	mockQuery := mock.NewMockQuery(ctrl)
+	mockProvider.EXPECT().NewQuery(gomock.Any(), gomock.Any(), gomock.Any()).Return(mockQuery, nil).Times(1)
+
+	app := LoadApp(t, "testdata/config/with_create_downtime.hcl")
+	rules := app.Rules()
+	require.Len(t, rules, 1)
+	require.True(t, rules[0].CreateDowntimeAction().Enable())
+	require.ElementsMatch(t, []string{"query.mock.running_migrations"}, rules[0].DependsOnQueries())
+
+	expectMigrations := func(names ...string) {
+		rows := make([][]json.RawMessage, 0, len(names))
+		for _, name := range names {
+			rows = append(rows, []json.RawMessage{json.RawMessage(strconv.Quote(name))})
+		}
+		mockQuery.EXPECT().Run(gomock.Any(), gomock.Any()).Return(provider.NewQueryResult(
+			"running_migrations", "select name from migrations where status = 'running'", nil,
+			[]string{"name"},
+			rows,
+		), nil).Times(1)
+	}
+	newClient := func(downtimes []*mackerel.Downtime) *mock.MockMackerelClient {
+		client := mock.NewMockMackerelClient(ctrl)
+		client.EXPECT().GetAlert("2bj...").Return(&mackerel.Alert{ID: "2bj...", MonitorID: "2cSZzK3XfmG"}, nil).AnyTimes()
+		client.EXPECT().GetMonitor("2cSZzK3XfmG").Return(&mackerel.MonitorConnectivity{ID: "2cSZzK3XfmG"}, nil).AnyTimes()
+		client.EXPECT().FindDowntimes().Return(downtimes, nil).AnyTimes()
+		return client
+	}
+	expected := &mackerel.Downtime{
+		Name:          "prepalert: migration add_users_index",
+		Memo:          "muted during the migration",
+		Start:         1700000000,
+		Duration:      30,
+		MonitorScopes: []string{"2cSZzK3XfmG"},
+	}
+
+	t.Run("Created", func(t *testing.T) {
+		expectMigrations("add_users_index")
+		client := newClient([]*mackerel.Downtime{
+			{ID: "expired", Name: expected.Name, Start: 1700000000 - 3600, Duration: 30, MonitorScopes: []string{"2cSZzK3XfmG"}},
+		})
+		client.EXPECT().CreateDowntime(expected).Return(&mackerel.Downtime{ID: "3Ju"}, nil).Times(1)
+		app.SetMackerelClient(client)
+
+		h := canyontest.AsWorker(app)
+		r := httptest.NewRequest(http.MethodPost, "/", LoadFileAsReader(t, "example_webhook.json"))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	})
+
+	t.Run("Deduplicated", func(t *testing.T) {
+		expectMigrations("add_users_index")
+		client := newClient([]*mackerel.Downtime{
+			{ID: "active", Name: expected.Name, Start: 1700000000 - 600, Duration: 30, MonitorScopes: []string{"2cSZzK3XfmG"}},
+		})
+		app.SetMackerelClient(client)
+
+		body := LoadJSON[prepalert.WebhookBody](t, "example_webhook.json")
+		require.NoError(t, app.ExecuteRules(context.Background(), &body))
+	})
+
+	t.Run("NoMigration", func(t *testing.T) {
+		expectMigrations()
+		app.SetMackerelClient(newClient(nil))
+
+		body := LoadJSON[prepalert.WebhookBody](t, "example_webhook.json")
+		require.NoError(t, app.ExecuteRules(context.Background(), &body))
+	})
+
+	t.Run("DryRun", func(t *testing.T) {
+		expectMigrations("add_users_index")
+		app.SetMackerelClient(newClient(nil))
+
+		rec := prepalert.NewDryRunRecorder()
+		body := LoadJSON[prepalert.WebhookBody](t, "example_webhook.json")
+		require.NoError(t, app.ExecuteRules(prepalert.WithDryRunRecorder(context.Background(), rec), &body))
+		require.Equal(t, []*mackerel.Downtime{expected}, rec.Downtimes)
+	})
+}
+
+func TestAppLoadConfig__WithPostServiceMetric(t *testing.T) {
+	restore := flextime.Fix(time.Unix(1700000060, 0))
+	defer restore()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockProvider := mock.NewMockProvider(ctrl)
+	provider.RegisterProvider("mock", func(pp *provider.ProviderParameter) (provider.Provider, error) {
+		return mockProvider, nil
+	})
+	t.Cleanup(func() {
+		provider.UnregisterProvider("mock")
+	})
+	mockQuery := mock.NewMockQuery(ctrl)
+	mockProvider.EXPECT().NewQuery(gomock.Any(), gomock.Any(), gomock.Any()).Return(mockQuery, nil).Times(1)
+
+	app := LoadApp(t, "testdata/config/with_post_service_metric.hcl")
+	rules := app.Rules()
+	require.Len(t, rules, 2)
+	for _, rule := range rules {
+		require.True(t, rule.PostServiceMetricAction().Enable())
+		require.ElementsMatch(t, []string{"query.mock.alb_5xx"}, rule.DependsOnQueries())
+	}
+
+	mockQuery.EXPECT().Run(gomock.Any(), gomock.Any()).Return(provider.NewQueryResult(
+		"alb_5xx", "stats count(*) as cnt by path", nil,
+		[]string{"path", "cnt"},
+		[][]json.RawMessage{
+			{json.RawMessage(`"/api/users"`), json.RawMessage(`42`)},
+			{json.RawMessage(`"/api/items"`), json.RawMessage(`"3"`)},
+		},
+	), nil).Times(1)
+	client := mock.NewMockMackerelClient(ctrl)
+	client.EXPECT().PostServiceMetricValues("prod", gomock.Any()).DoAndReturn(
+		func(_ string, values []*mackerel.MetricValue) error {
+			require.ElementsMatch(t, []*mackerel.MetricValue{
+				{Name: "prepalert.alb.5xx_count", Time: 1473129912, Value: float64(42)},
+				{Name: "prepalert.alb.5xx_paths", Time: 1700000000, Value: float64(3)},
+			}, values)
+			return nil
+		},
+	).Times(1)
+	app.SetMackerelClient(client)
+
+	h := canyontest.AsWorker(app)
+	r := httptest.NewRequest(http.MethodPost, "/", LoadFileAsReader(t, "example_webhook.json"))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+}
+
+func TestAppExecuteRules__QueryFailedSideEffectsOnce(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		fmt.Fprintln(w, "ok")
+	}))
+	defer server.Close()
+	t.Setenv("SLACK_WEBHOOK_URL", server.URL+"/slack")
+	t.Setenv("NOTIFY_WEBHOOK_URL", server.URL+"/webhook")
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockS3Client := mock.NewMockS3Client(ctrl)
+	prepalert.GlobalS3Client = mockS3Client
+	t.Cleanup(func() {
+		prepalert.GlobalS3Client = nil
+	})
+	mockProvider := mock.NewMockProvider(ctrl)
+	provider.RegisterProvider("mock", func(pp *provider.ProviderParameter) (provider.Provider, error) {
+		return mockProvider, nil
+	})
+	t.Cleanup(func() {
+		provider.UnregisterProvider("mock")
+	})
+	mockQuery := mock.NewMockQuery(ctrl)
+	mockProvider.EXPECT().NewQuery(gomock.Any(), gomock.Any(), gomock.Any()).Return(mockQuery, nil).Times(1)
+	app := LoadApp(t, "testdata/config/with_notify.hcl")
+
+	// the first delivery fails the query, the notifications refer the rows of the query and fail to render.
+	// the second delivery, redelivered by the queue, succeeds.
+	gomock.InOrder(
+		mockQuery.EXPECT().Run(gomock.Any(), gomock.Any()).Return(nil, errors.New("connection refused")).Times(1),
+		mockQuery.EXPECT().Run(gomock.Any(), gomock.Any()).Return(provider.NewQueryResult(
+			"error_count", "stats count(*) as cnt", nil,
+			[]string{"cnt"},
+			[][]json.RawMessage{{json.RawMessage(`42`)}},
+		), nil).Times(1),
+	)
+	mockS3Client.EXPECT().PutObject(gomock.Any(), gomock.Any(), gomock.Any()).Return(&s3.PutObjectOutput{}, nil).Times(1)
+	client := mock.NewMockMackerelClient(ctrl)
+	client.EXPECT().GetAlert("2bj...").Return(&mackerel.Alert{ID: "2bj..."}, nil).Times(1)
+	client.EXPECT().UpdateAlert("2bj...", gomock.Any()).Return(&mackerel.UpdateAlertResponse{}, nil).Times(1)
+	app.SetMackerelClient(client)
+
+	h := canyontest.AsWorker(app)
+	deliver := func() int {
+		r := httptest.NewRequest(http.MethodPost, "/", LoadFileAsReader(t, "example_webhook.json"))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Result().StatusCode
+	}
+	require.Equal(t, http.StatusInternalServerError, deliver())
+	require.Empty(t, requests, "nothing is sent with the failed query")
+	require.Equal(t, http.StatusOK, deliver())
+	require.Equal(t, []string{"/slack", "/webhook"}, requests)
+}
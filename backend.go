@@ -265,21 +265,29 @@ func (b *S3Backend) String() string {
 	return fmt.Sprintf("s3_backend{location=s3://%s/%s}", b.BucketName, *b.ObjectKeyPrefix)
 }
 
-func (b *S3Backend) Upload(ctx context.Context, evalCtx *hcl.EvalContext, name string, body io.Reader) (string, bool, error) {
+// ObjectLocation returns the S3 object key and the viewer URL of the object to upload.
+func (b *S3Backend) ObjectLocation(evalCtx *hcl.EvalContext, name string) (string, string, error) {
 	expr := *b.ObjectKeyTemplate
 	objectKeyTemplateValue, diags := expr.Value(evalCtx)
 	if diags.HasErrors() {
-		return "", false, fmt.Errorf("eval object key template: %w", diags)
+		return "", "", fmt.Errorf("eval object key template: %w", diags)
 	}
 	if objectKeyTemplateValue.Type() != cty.String {
-		return "", false, errors.New("object key template is not string")
+		return "", "", errors.New("object key template is not string")
 	}
 	if !objectKeyTemplateValue.IsKnown() {
-		return "", false, errors.New("object key template is unknown")
+		return "", "", errors.New("object key template is unknown")
 	}
 	objectKey := filepath.Join(*b.ObjectKeyPrefix, objectKeyTemplateValue.AsString(), fmt.Sprintf("%s.txt", name))
 	u := b.ViewerBaseURL.JoinPath(objectKeyTemplateValue.AsString(), fmt.Sprintf("%s.txt", name))
-	showDetailsURL := u.String()
+	return objectKey, u.String(), nil
+}
+
+func (b *S3Backend) Upload(ctx context.Context, evalCtx *hcl.EvalContext, name string, body io.Reader) (string, bool, error) {
+	objectKey, showDetailsURL, err := b.ObjectLocation(evalCtx, name)
+	if err != nil {
+		return "", false, err
+	}
 	slog.DebugContext(
 		ctx,
 		"try upload to backend",
@@ -40,15 +40,18 @@ func (e *ErrorHandling) UnmarshalText(text []byte) error {
 }
 
 type CLI struct {
-	LogLevel       string        `help:"output log-level" env:"PREPALERT_LOG_LEVEL" default:"info"`
-	MackerelAPIKey string        `name:"mackerel-apikey" help:"for access mackerel API" env:"MACKEREL_APIKEY"`
-	ErrorHandling  ErrorHandling `help:"error handling" env:"PREPALERT_ERROR_HANDLING" default:"continue" enum:"continue,return"`
-	Config         string        `help:"config path" env:"PREPALERT_CONFIG" default:"."`
-	Run            *RunOptions   `cmd:"" help:"run server (default command)" default:""`
-	Init           struct{}      `cmd:"" help:"create initial config"`
-	Validate       struct{}      `cmd:"" help:"validate the configuration"`
-	Exec           *ExecOptions  `cmd:"" help:"Generate a virtual webhook from past alert to execute the rule"`
-	Version        struct{}      `cmd:"" help:"Show version"`
+	LogLevel       string          `help:"output log-level" env:"PREPALERT_LOG_LEVEL" default:"info"`
+	MackerelAPIKey string          `name:"mackerel-apikey" help:"for access mackerel API" env:"MACKEREL_APIKEY"`
+	ErrorHandling  ErrorHandling   `help:"error handling" env:"PREPALERT_ERROR_HANDLING" default:"continue" enum:"continue,return"`
+	Config         string          `help:"config path" env:"PREPALERT_CONFIG" default:"."`
+	Run            *RunOptions     `cmd:"" help:"run server (default command)" default:""`
+	Init           struct{}        `cmd:"" help:"create initial config"`
+	Validate       struct{}        `cmd:"" help:"validate the configuration"`
+	Exec           *ExecOptions    `cmd:"" help:"Generate a virtual webhook from past alert or saved payloads to execute the rule"`
+	Test           *TestOptions    `cmd:"" help:"run the test blocks in *.test.hcl files"`
+	Console        *ConsoleOptions `cmd:"" help:"interactive console to evaluate expressions against a webhook"`
+	DLQ            *DLQOptions     `cmd:"" name:"dlq" help:"inspect and replay messages in the dead-letter queue"`
+	Version        struct{}        `cmd:"" help:"Show version"`
 }
 
 func ParseCLI(ctx context.Context, args []string, opts ...kong.Option) (string, *CLI, error) {
@@ -67,7 +70,11 @@ func ParseCLI(ctx context.Context, args []string, opts ...kong.Option) (string,
 	if err != nil {
 		return "", nil, err
 	}
-	cmd := strings.Fields(kctx.Command())[0]
+	fields := strings.Fields(kctx.Command())
+	cmd := fields[0]
+	if cmd == "dlq" && len(fields) > 1 {
+		cli.DLQ.Subcommand = fields[1]
+	}
 	return cmd, &cli, nil
 }
 
@@ -84,6 +91,9 @@ func RunCLI(ctx context.Context, args []string, setLogLevel func(string)) error
 	case "version":
 		fmt.Printf("prepalert %s\n", Version)
 		return nil
+	case "test":
+		defer app.Close()
+		return app.Test(ctx, cli.Config, cli.Test)
 	}
 	slog.DebugContext(ctx, "load config", "config", cli.Config, "error_handling", cli.ErrorHandling)
 	err = app.LoadConfig(cli.Config)
@@ -101,6 +111,10 @@ func RunCLI(ctx context.Context, args []string, setLogLevel func(string)) error
 		return nil
 	case "exec":
 		return app.Exec(ctx, cli.Exec)
+	case "console":
+		return app.Console(ctx, cli.Console)
+	case "dlq":
+		return app.DLQ(ctx, cli.DLQ)
 	}
 	return fmt.Errorf("unknown command: %s", cmd)
 }
@@ -37,7 +37,14 @@ func TestParseCLI(t *testing.T) {
 					Prefix:    "/",
 					BatchSize: 1,
 				},
-				Exec: &prepalert.ExecOptions{},
+				Exec:    &prepalert.ExecOptions{Format: "text"},
+				Test:    &prepalert.TestOptions{},
+				Console: &prepalert.ConsoleOptions{},
+				DLQ: &prepalert.DLQOptions{
+					List:   &prepalert.DLQListOptions{Limit: 100, Format: "text"},
+					Show:   &prepalert.DLQShowOptions{Format: "text"},
+					Replay: &prepalert.DLQReplayOptions{},
+				},
 			},
 		},
 		{
@@ -73,7 +80,14 @@ func TestParseCLI(t *testing.T) {
 					Prefix:    "/",
 					BatchSize: 1,
 				},
-				Exec: &prepalert.ExecOptions{},
+				Exec:    &prepalert.ExecOptions{Format: "text"},
+				Test:    &prepalert.TestOptions{},
+				Console: &prepalert.ConsoleOptions{},
+				DLQ: &prepalert.DLQOptions{
+					List:   &prepalert.DLQListOptions{Limit: 100, Format: "text"},
+					Show:   &prepalert.DLQShowOptions{Format: "text"},
+					Replay: &prepalert.DLQReplayOptions{},
+				},
 			},
 		},
 		{
@@ -89,13 +103,41 @@ func TestParseCLI(t *testing.T) {
 					Prefix:    "/",
 					BatchSize: 1,
 				},
-				Exec: &prepalert.ExecOptions{},
+				Exec:    &prepalert.ExecOptions{Format: "text"},
+				Test:    &prepalert.TestOptions{},
+				Console: &prepalert.ConsoleOptions{},
+				DLQ: &prepalert.DLQOptions{
+					List:   &prepalert.DLQListOptions{Limit: 100, Format: "text"},
+					Show:   &prepalert.DLQShowOptions{Format: "text"},
+					Replay: &prepalert.DLQReplayOptions{},
+				},
 			},
 		},
 		{
-			args:   []string{"prepalert", "--config", ".", "exec"},
-			cmd:    "exec",
-			errStr: `expected "<alert-id>"`,
+			args: []string{"prepalert", "--config", ".", "exec", "--payload", "-"},
+			cmd:  "exec",
+			expected: &prepalert.CLI{
+				LogLevel:       "info",
+				MackerelAPIKey: "*******************",
+				Config:         ".",
+				Run: &prepalert.RunOptions{
+					Mode:      "worker",
+					Address:   ":8080",
+					Prefix:    "/",
+					BatchSize: 1,
+				},
+				Exec: &prepalert.ExecOptions{
+					Payload: "-",
+					Format:  "text",
+				},
+				Test:    &prepalert.TestOptions{},
+				Console: &prepalert.ConsoleOptions{},
+				DLQ: &prepalert.DLQOptions{
+					List:   &prepalert.DLQListOptions{Limit: 100, Format: "text"},
+					Show:   &prepalert.DLQShowOptions{Format: "text"},
+					Replay: &prepalert.DLQReplayOptions{},
+				},
+			},
 		},
 		{
 			args:        []string{"prepalert", "--config", ".", "exec", "--help"},
@@ -117,6 +159,38 @@ func TestParseCLI(t *testing.T) {
 				},
 				Exec: &prepalert.ExecOptions{
 					AlertID: "xxxxxxxx",
+					Format:  "text",
+				},
+				Test:    &prepalert.TestOptions{},
+				Console: &prepalert.ConsoleOptions{},
+				DLQ: &prepalert.DLQOptions{
+					List:   &prepalert.DLQListOptions{Limit: 100, Format: "text"},
+					Show:   &prepalert.DLQShowOptions{Format: "text"},
+					Replay: &prepalert.DLQReplayOptions{},
+				},
+			},
+		},
+		{
+			args: []string{"prepalert", "dlq", "replay", "--all", "--enqueue"},
+			cmd:  "dlq",
+			expected: &prepalert.CLI{
+				LogLevel:       "info",
+				MackerelAPIKey: "*******************",
+				Config:         "./testdata/",
+				Run: &prepalert.RunOptions{
+					Mode:      "worker",
+					Address:   ":8080",
+					Prefix:    "/",
+					BatchSize: 1,
+				},
+				Exec:    &prepalert.ExecOptions{Format: "text"},
+				Test:    &prepalert.TestOptions{},
+				Console: &prepalert.ConsoleOptions{},
+				DLQ: &prepalert.DLQOptions{
+					List:       &prepalert.DLQListOptions{Limit: 100, Format: "text"},
+					Show:       &prepalert.DLQShowOptions{Format: "text"},
+					Replay:     &prepalert.DLQReplayOptions{All: true, Enqueue: true},
+					Subcommand: "replay",
 				},
 			},
 		},
@@ -133,7 +207,14 @@ func TestParseCLI(t *testing.T) {
 					Prefix:    "/",
 					BatchSize: 1,
 				},
-				Exec: &prepalert.ExecOptions{},
+				Exec:    &prepalert.ExecOptions{Format: "text"},
+				Test:    &prepalert.TestOptions{},
+				Console: &prepalert.ConsoleOptions{},
+				DLQ: &prepalert.DLQOptions{
+					List:   &prepalert.DLQListOptions{Limit: 100, Format: "text"},
+					Show:   &prepalert.DLQShowOptions{Format: "text"},
+					Replay: &prepalert.DLQReplayOptions{},
+				},
 			},
 		},
 		{
@@ -149,7 +230,14 @@ func TestParseCLI(t *testing.T) {
 					Prefix:    "/",
 					BatchSize: 1,
 				},
-				Exec: &prepalert.ExecOptions{},
+				Exec:    &prepalert.ExecOptions{Format: "text"},
+				Test:    &prepalert.TestOptions{},
+				Console: &prepalert.ConsoleOptions{},
+				DLQ: &prepalert.DLQOptions{
+					List:   &prepalert.DLQListOptions{Limit: 100, Format: "text"},
+					Show:   &prepalert.DLQShowOptions{Format: "text"},
+					Replay: &prepalert.DLQReplayOptions{},
+				},
 			},
 		},
 	}
@@ -0,0 +1,130 @@
+package prepalert
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+)
+
+// CloseAlertAction closes the alert which is confirmed as noise by the queries, such as the 5xx burst from a single bot.
+// the reason and the evidence are written to the memo before the alert is closed.
+type CloseAlertAction struct {
+	app              *App
+	ruleName         string
+	enable           bool
+	whenExpr         hcl.Expression
+	reasonExpr       hcl.Expression
+	evidenceExpr     hcl.Expression
+	dependsOnQueries map[string]struct{}
+}
+
+// alertClosing is the close of the alert requested by the close_alert action, done in Flush after the memo is updated.
+type alertClosing struct {
+	ruleName string
+	reason   string
+}
+
+func (action *CloseAlertAction) DecodeBody(body hcl.Body, evalCtx *hcl.EvalContext) hcl.Diagnostics {
+	attrs, diags := body.JustAttributes()
+	if diags.HasErrors() {
+		return diags
+	}
+	for _, attr := range attrs {
+		switch attr.Name {
+		case "when":
+			action.whenExpr = attr.Expr
+			registerQueryFQNs(attr.Expr, action.dependsOnQueries)
+		case "reason":
+			action.reasonExpr = attr.Expr
+			registerQueryFQNs(attr.Expr, action.dependsOnQueries)
+		case "evidence":
+			action.evidenceExpr = attr.Expr
+			registerQueryFQNs(attr.Expr, action.dependsOnQueries)
+		default:
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  fmt.Sprintf("unknown attribute %q", attr.Name),
+				Subject:  attr.Range.Ptr(),
+			})
+		}
+	}
+	if diags.HasErrors() {
+		return diags
+	}
+	if action.reasonExpr == nil {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "close_alert block must have reason attribute",
+			Subject:  body.MissingItemRange().Ptr(),
+		})
+	}
+	action.enable = !diags.HasErrors()
+	return diags
+}
+
+func (action *CloseAlertAction) Enable() bool {
+	return action.enable
+}
+
+func (action *CloseAlertAction) DependsOnQueries() []string {
+	queries := make([]string, 0, len(action.dependsOnQueries))
+	for query := range action.dependsOnQueries {
+		queries = append(queries, query)
+	}
+	return queries
+}
+
+func (action *CloseAlertAction) SectionName() string {
+	return "rule." + action.ruleName + ".close_alert"
+}
+
+// Execute evaluates the when guard with the query results, and requests the close of the alert if the guard is true.
+// the status of the payload may be stale, e.g. the webhook is redelivered after the alert is closed,
+// so the live status is checked before the close is requested, and the alert already closed is neither closed again nor given the reason again.
+func (action *CloseAlertAction) Execute(ctx context.Context, evalCtx *hcl.EvalContext, u *MackerelUpdater) error {
+	body, err := WebhookFromEvalContext(evalCtx)
+	if err != nil {
+		return fmt.Errorf("close_alert: %w", err)
+	}
+	if body.Alert == nil || strings.EqualFold(body.Alert.Status, "ok") {
+		slog.DebugContext(ctx, "skip close_alert, the alert is not open", "rule_name", action.ruleName)
+		return nil
+	}
+	if action.whenExpr != nil {
+		ok, err := evaluateWhenExpression(action.whenExpr, evalCtx)
+		if err != nil {
+			return fmt.Errorf("close_alert: %w", err)
+		}
+		if !ok {
+			slog.DebugContext(ctx, "skip close_alert, when is false", "rule_name", action.ruleName)
+			return nil
+		}
+	}
+	alert, err := u.svc.GetAlert(ctx, body.Alert.ID)
+	if err != nil {
+		return fmt.Errorf("close_alert: %w", err)
+	}
+	if strings.EqualFold(alert.Status, "ok") {
+		slog.InfoContext(ctx, "skip close_alert, the alert is already closed", "rule_name", action.ruleName, "alert_id", alert.ID)
+		return nil
+	}
+	reason, err := ExpressionToString(action.reasonExpr, evalCtx)
+	if err != nil {
+		return fmt.Errorf("close_alert: render reason: %w", err)
+	}
+	section := "closed by prepalert: " + reason
+	if action.evidenceExpr != nil {
+		evidence, err := ExpressionToString(action.evidenceExpr, evalCtx)
+		if err != nil {
+			return fmt.Errorf("close_alert: render evidence: %w", err)
+		}
+		section += "\n\n" + evidence
+	}
+	slog.DebugContext(ctx, "dump close_alert reason", "reason", reason)
+	u.AddMemoSectionText(action.SectionName(), section, nil)
+	u.AddAlertClosing(action.ruleName, reason)
+	return nil
+}
@@ -11,12 +11,18 @@ import (
 	"syscall"
 
 	"github.com/fatih/color"
+	_ "github.com/go-sql-driver/mysql"
 	"github.com/handlename/ssmwrap"
+	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/mashiike/prepalert"
 	_ "github.com/mashiike/prepalert/provider/cloudwatchlogsinsights"
+	_ "github.com/mashiike/prepalert/provider/httpprovider"
+	_ "github.com/mashiike/prepalert/provider/prometheus"
 	_ "github.com/mashiike/prepalert/provider/redshiftdata"
 	_ "github.com/mashiike/prepalert/provider/s3select"
+	_ "github.com/mashiike/prepalert/provider/sqlprovider"
 	"github.com/mashiike/slogutils"
+	_ "modernc.org/sqlite"
 )
 
 func main() {
@@ -0,0 +1,230 @@
+package prepalert
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/zclconf/go-cty/cty"
+)
+
+type ConsoleOptions struct {
+	AlertID string    `help:"Mackerel AlertID, generate a virtual webhook from the past alert" name:"alert-id"`
+	Payload string    `help:"webhook payload JSON file"`
+	Stdin   io.Reader `kong:"-"`
+	Writer  io.Writer `kong:"-"`
+}
+
+const consoleHelp = `Enter an HCL expression to evaluate it against the webhook, e.g.
+  webhook.alert.monitor_name
+  get_monitor(webhook.alert).name
+  local.default_message
+Queries referred by the expression are run on demand.
+
+Commands:
+  :queries        list the queries and their status
+  :run <query>    run the query and show the result table, e.g. :run query.redshift_data.access_logs
+  :help           show this help
+  :quit           exit the console
+`
+
+// Console is a REPL to evaluate HCL expressions with the eval context of the webhook.
+func (app *App) Console(ctx context.Context, opts *ConsoleOptions) error {
+	if !app.WorkerIsReady() {
+		return errors.New("worker is not ready, check configureion error")
+	}
+	var body *WebhookBody
+	switch {
+	case opts.AlertID != "" && opts.Payload != "":
+		return errors.New("--alert-id and --payload are exclusive")
+	case opts.AlertID != "":
+		var err error
+		body, err = app.mkrSvc.NewEmulatedWebhookBody(ctx, opts.AlertID)
+		if err != nil {
+			return err
+		}
+	case opts.Payload == "-":
+		return errors.New("--payload - is not supported in console, stdin is used for input")
+	case opts.Payload != "":
+		payloads, err := loadExecPayloads(opts.Payload, nil)
+		if err != nil {
+			return err
+		}
+		if len(payloads) != 1 {
+			return errors.New("--payload must be a file in console")
+		}
+		body = payloads[0].body
+	default:
+		body = app.mkrSvc.NewExampleWebhookBody()
+	}
+	evalCtx, err := app.NewEvalContext(body)
+	if err != nil {
+		return fmt.Errorf("failed build eval context: %w", err)
+	}
+	c := &console{
+		app:      app,
+		evalCtx:  evalCtx,
+		statuses: make(map[string]string),
+		w:        opts.Writer,
+	}
+	if c.w == nil {
+		c.w = os.Stdout
+	}
+	r := opts.Stdin
+	if r == nil {
+		r = os.Stdin
+	}
+	fmt.Fprintln(c.w, `prepalert console, type ":help" for help`)
+	scanner := bufio.NewScanner(r)
+	for {
+		fmt.Fprint(c.w, "> ")
+		if !scanner.Scan() {
+			fmt.Fprintln(c.w)
+			return scanner.Err()
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if quit := c.execute(ctx, line); quit {
+			return nil
+		}
+	}
+}
+
+type console struct {
+	app      *App
+	evalCtx  *hcl.EvalContext
+	statuses map[string]string
+	w        io.Writer
+}
+
+// execute executes a line of the console, returns true if the console should exit.
+func (c *console) execute(ctx context.Context, line string) bool {
+	if !strings.HasPrefix(line, ":") {
+		c.evaluate(ctx, line)
+		return false
+	}
+	cmd, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+	switch cmd {
+	case ":quit", ":exit", ":q":
+		return true
+	case ":help", ":h":
+		fmt.Fprint(c.w, consoleHelp)
+	case ":queries":
+		c.listQueries()
+	case ":run":
+		if arg == "" {
+			fmt.Fprintln(c.w, "Error: query name is required, e.g. :run query.redshift_data.access_logs")
+			return false
+		}
+		queryFQN := arg
+		if !strings.HasPrefix(queryFQN, "query.") {
+			queryFQN = "query." + queryFQN
+		}
+		if err := c.runQueries(ctx, map[string]struct{}{queryFQN: {}}, true); err != nil {
+			fmt.Fprintf(c.w, "Error: %s\n", err)
+			return false
+		}
+		c.evaluate(ctx, fmt.Sprintf("%s.status == \"success\" ? result_to_table(%s) : %s.error", queryFQN, queryFQN, queryFQN))
+	default:
+		fmt.Fprintf(c.w, "Error: unknown command %q, type \":help\" for help\n", cmd)
+	}
+	return false
+}
+
+func (c *console) evaluate(ctx context.Context, src string) {
+	expr, diags := hclsyntax.ParseExpression([]byte(src), "<console>", hcl.InitialPos)
+	if diags.HasErrors() {
+		fmt.Fprintf(c.w, "Error: %s\n", diags.Error())
+		return
+	}
+	dependsOn := make(map[string]struct{})
+	registerQueryFQNs(expr, dependsOn)
+	if err := c.runQueries(ctx, dependsOn, false); err != nil {
+		fmt.Fprintf(c.w, "Error: %s\n", err)
+		return
+	}
+	value, diags := expr.Value(c.evalCtx)
+	if diags.HasErrors() {
+		fmt.Fprintf(c.w, "Error: %s\n", diags.Error())
+		return
+	}
+	fmt.Fprintln(c.w, formatConsoleValue(value))
+}
+
+// runQueries runs the queries not run yet, force runs them again.
+func (c *console) runQueries(ctx context.Context, queryFQNs map[string]struct{}, force bool) error {
+	required := make(map[string]struct{}, len(queryFQNs))
+	for queryFQN := range queryFQNs {
+		if _, ok := c.app.queries[queryFQN]; !ok {
+			return fmt.Errorf("not found query %q", queryFQN)
+		}
+		if _, ok := c.statuses[queryFQN]; ok && !force {
+			continue
+		}
+		required[queryFQN] = struct{}{}
+	}
+	if len(required) == 0 {
+		return nil
+	}
+	// query errors are shown as status of the query, so ignore the error here.
+	c.evalCtx, _ = c.app.runQueries(ctx, c.evalCtx, required)
+	for queryFQN := range c.app.queries {
+		if status, ok := queryStatus(c.evalCtx, queryFQN); ok {
+			c.statuses[queryFQN] = status
+		}
+	}
+	return nil
+}
+
+// queryStatus returns query.<type>.<name>.status in the eval context.
+func queryStatus(evalCtx *hcl.EvalContext, queryFQN string) (string, bool) {
+	traversal, diags := hclsyntax.ParseTraversalAbs([]byte(queryFQN+".status"), "<console>", hcl.InitialPos)
+	if diags.HasErrors() {
+		return "", false
+	}
+	value, diags := traversal.TraverseAbs(evalCtx)
+	if diags.HasErrors() || !value.IsKnown() || value.IsNull() || value.Type() != cty.String {
+		return "", false
+	}
+	return value.AsString(), true
+}
+
+func (c *console) listQueries() {
+	queryFQNs := make([]string, 0, len(c.app.queries))
+	for queryFQN := range c.app.queries {
+		queryFQNs = append(queryFQNs, queryFQN)
+	}
+	sort.Strings(queryFQNs)
+	if len(queryFQNs) == 0 {
+		fmt.Fprintln(c.w, "(no queries)")
+	}
+	for _, queryFQN := range queryFQNs {
+		status, ok := c.statuses[queryFQN]
+		if !ok {
+			status = "not run"
+		}
+		fmt.Fprintf(c.w, "%s: %s\n", queryFQN, status)
+	}
+}
+
+// formatConsoleValue formats a string as is, and other values as HCL.
+func formatConsoleValue(value cty.Value) string {
+	if value.IsKnown() && !value.IsNull() && value.Type() == cty.String {
+		return value.AsString()
+	}
+	if !value.IsWhollyKnown() {
+		return "(unknown)"
+	}
+	return string(hclwrite.Format(hclwrite.TokensForValue(value).Bytes()))
+}
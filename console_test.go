@@ -0,0 +1,74 @@
+package prepalert_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/mashiike/prepalert"
+	"github.com/mashiike/prepalert/mock"
+	"github.com/mashiike/prepalert/provider"
+	"github.com/sebdah/goldie/v2"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+)
+
+func TestAppConsole(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockProvider := mock.NewMockProvider(ctrl)
+	provider.RegisterProvider("mock", func(pp *provider.ProviderParameter) (provider.Provider, error) {
+		return mockProvider, nil
+	})
+	t.Cleanup(func() {
+		provider.UnregisterProvider("mock")
+	})
+	mockQueries := make(map[string]*mock.MockQuery)
+	mockProvider.EXPECT().NewQuery(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(name string, _ hcl.Body, _ *hcl.EvalContext) (provider.Query, error) {
+			q := mock.NewMockQuery(ctrl)
+			mockQueries[name] = q
+			return q, nil
+		},
+	).Times(3)
+	app := LoadApp(t, "testdata/config/with_multiple_queries.hcl")
+	mockQueries["access_logs"].EXPECT().Run(gomock.Any(), gomock.Any()).Return(
+		provider.NewQueryResultWithJSONLines("access_logs", "select * from access_logs", nil, map[string]json.RawMessage{
+			"path":   json.RawMessage(`"/api/users"`),
+			"status": json.RawMessage(`500`),
+		}),
+		nil,
+	).Times(2)
+	mockQueries["error_logs"].EXPECT().Run(gomock.Any(), gomock.Any()).Return(nil, errors.New("connection refused")).Times(1)
+	mockQueries["slow_logs"].EXPECT().Run(gomock.Any(), gomock.Any()).Times(0)
+
+	input := strings.Join([]string{
+		`webhook.alert.monitor_name`,
+		`webhook.alert.id == "2bj..." && has_prefix(webhook.org_name, "Macker")`,
+		`[for role in webhook.host.roles : role.fullname]`,
+		`:queries`,
+		`query.mock.access_logs.result.columns`,
+		`query.mock.access_logs.status`,
+		`:run mock.access_logs`,
+		`:run query.mock.error_logs`,
+		`:queries`,
+		`query.mock.unknown`,
+		`webhook.alert.`,
+		`:unknown`,
+		`:quit`,
+		`webhook.alert.monitor_name`,
+	}, "\n")
+	var buf bytes.Buffer
+	err := app.Console(context.Background(), &prepalert.ConsoleOptions{
+		Payload: "example_webhook.json",
+		Stdin:   strings.NewReader(input),
+		Writer:  &buf,
+	})
+	require.NoError(t, err)
+	g := goldie.New(t, goldie.WithFixtureDir("testdata/fixture/"), goldie.WithNameSuffix(".golden"))
+	g.Assert(t, "console", buf.Bytes())
+}
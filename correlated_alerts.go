@@ -0,0 +1,260 @@
+package prepalert
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+const (
+	// DefaultCorrelatedAlertsWindow is the default window around webhook.alert.opened_at to find correlated alerts.
+	DefaultCorrelatedAlertsWindow = 10 * time.Minute
+	// DefaultCorrelatedAlertsMaxPages is the default max pages of the alerts API scanned to find correlated alerts.
+	DefaultCorrelatedAlertsMaxPages = 5
+
+	correlatedAlertsGroupByNone    = "none"
+	correlatedAlertsGroupByRole    = "role"
+	correlatedAlertsGroupByService = "service"
+	correlatedAlertsUngrouped      = "(ungrouped)"
+)
+
+// CorrelatedAlertsAction lists other alerts opened around the alert in a separate memo section.
+type CorrelatedAlertsAction struct {
+	app        *App
+	ruleName   string
+	enable     bool
+	window     time.Duration
+	maxPages   int
+	groupBy    string
+	withClosed bool
+	sizeLimit  *int
+}
+
+func (action *CorrelatedAlertsAction) DecodeBody(body hcl.Body, evalCtx *hcl.EvalContext) hcl.Diagnostics {
+	attrs, diags := body.JustAttributes()
+	if diags.HasErrors() {
+		return diags
+	}
+	action.enable = true
+	action.window = DefaultCorrelatedAlertsWindow
+	action.maxPages = DefaultCorrelatedAlertsMaxPages
+	action.groupBy = correlatedAlertsGroupByNone
+	for _, attr := range attrs {
+		switch attr.Name {
+		case "window":
+			window, windowDiags := decodeDurationExpression(attr.Expr, evalCtx)
+			diags = diags.Extend(windowDiags)
+			if diags.HasErrors() {
+				continue
+			}
+			if window <= 0 {
+				diags = diags.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "window must be greater than 0",
+					Subject:  attr.Range.Ptr(),
+				})
+				continue
+			}
+			action.window = window
+		case "max_pages":
+			diags = diags.Extend(gohcl.DecodeExpression(attr.Expr, evalCtx, &action.maxPages))
+			if diags.HasErrors() {
+				continue
+			}
+			if action.maxPages < 1 {
+				diags = diags.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "max_pages must be greater than 0",
+					Subject:  attr.Range.Ptr(),
+				})
+			}
+		case "group_by":
+			diags = diags.Extend(gohcl.DecodeExpression(attr.Expr, evalCtx, &action.groupBy))
+			switch action.groupBy {
+			case correlatedAlertsGroupByNone, correlatedAlertsGroupByRole, correlatedAlertsGroupByService:
+			default:
+				diags = diags.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  fmt.Sprintf("unknown group_by %q", action.groupBy),
+					Detail:   "group_by allows [none, role, service]",
+					Subject:  attr.Range.Ptr(),
+				})
+			}
+		case "with_closed":
+			diags = diags.Extend(gohcl.DecodeExpression(attr.Expr, evalCtx, &action.withClosed))
+		case "max_size":
+			var maxSize int
+			diags = diags.Extend(gohcl.DecodeExpression(attr.Expr, evalCtx, &maxSize))
+			if diags.HasErrors() {
+				continue
+			}
+			action.sizeLimit = &maxSize
+		default:
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  fmt.Sprintf("unknown attribute %q", attr.Name),
+				Subject:  attr.Range.Ptr(),
+			})
+		}
+	}
+	return diags
+}
+
+func (action *CorrelatedAlertsAction) Enable() bool {
+	return action.enable
+}
+
+func (action *CorrelatedAlertsAction) SectionName() string {
+	return "rule." + action.ruleName + ".correlated_alerts"
+}
+
+func (action *CorrelatedAlertsAction) Execute(ctx context.Context, evalCtx *hcl.EvalContext, u *MackerelUpdater) error {
+	body, err := WebhookFromEvalContext(evalCtx)
+	if err != nil {
+		return err
+	}
+	if body.Alert == nil {
+		return nil
+	}
+	svc := action.app.MackerelService()
+	window := int64(action.window / time.Second)
+	alerts, err := svc.FindAlertsOpenedBetweenWithCache(ctx, body.Alert.OpenedAt-window, body.Alert.OpenedAt+window, action.withClosed, action.maxPages)
+	if err != nil {
+		return fmt.Errorf("find correlated alerts: %w", err)
+	}
+	groups := make(map[string][]string)
+	count := 0
+	for _, alert := range alerts {
+		if alert.ID == body.Alert.ID {
+			continue
+		}
+		line, keys := action.describe(ctx, body, alert)
+		for _, key := range keys {
+			groups[key] = append(groups[key], line)
+		}
+		count++
+	}
+	slog.DebugContext(ctx, "correlated alerts", "count", count, "window", action.window.String())
+	u.AddMemoSectionText(action.SectionName(), renderCorrelatedAlerts(groups, action.groupBy, action.window), action.sizeLimit)
+	return nil
+}
+
+// describe returns a markdown list item of the alert and the group keys.
+func (action *CorrelatedAlertsAction) describe(ctx context.Context, body *WebhookBody, alert *mackerel.Alert) (string, []string) {
+	line, host, monitorService := describeAlert(ctx, action.app.MackerelService(), body.OrgName, alert)
+	keys := make([]string, 0)
+	switch action.groupBy {
+	case correlatedAlertsGroupByRole:
+		if host != nil {
+			for serviceName, roleNames := range host.Roles {
+				for _, roleName := range roleNames {
+					keys = append(keys, serviceName+": "+roleName)
+				}
+			}
+		}
+		if len(keys) == 0 && monitorService != "" {
+			keys = append(keys, monitorService)
+		}
+	case correlatedAlertsGroupByService:
+		if host != nil {
+			for serviceName := range host.Roles {
+				keys = append(keys, serviceName)
+			}
+		}
+		if len(keys) == 0 && monitorService != "" {
+			keys = append(keys, monitorService)
+		}
+	default:
+		keys = append(keys, "")
+	}
+	if len(keys) == 0 {
+		keys = append(keys, correlatedAlertsUngrouped)
+	}
+	return line, keys
+}
+
+// describeAlert returns a markdown list item of the alert, the host of the alert and the service of the monitor.
+// if the monitor or the host is not found, the failure is logged and the alert is described with their ids.
+func describeAlert(ctx context.Context, svc *MackerelService, orgName string, alert *mackerel.Alert) (string, *mackerel.Host, string) {
+	var monitorName string
+	var monitorService string
+	if alert.MonitorID != "" {
+		monitor, err := svc.GetMonitorWithCache(ctx, alert.MonitorID)
+		if err != nil {
+			slog.WarnContext(ctx, "failed to get the monitor of the alert, describe without it", "alert_id", alert.ID, "monitor_id", alert.MonitorID, "error", err.Error())
+			monitorName = fmt.Sprintf("(monitor %s)", alert.MonitorID)
+		} else {
+			monitorName = monitor.MonitorName()
+			monitorService = monitorServiceName(monitor)
+		}
+	}
+	var host *mackerel.Host
+	if alert.HostID != "" {
+		var err error
+		host, err = svc.FindHostWithCache(ctx, alert.HostID)
+		if err != nil {
+			slog.WarnContext(ctx, "failed to find the host of the alert, describe without it", "alert_id", alert.ID, "host_id", alert.HostID, "error", err.Error())
+		}
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "- %s %s %s", time.Unix(alert.OpenedAt, 0).UTC().Format(time.RFC3339), alert.Status, monitorName)
+	switch {
+	case host != nil:
+		fmt.Fprintf(&b, " host=%s", host.Name)
+	case alert.HostID != "":
+		fmt.Fprintf(&b, " host_id=%s", alert.HostID)
+	}
+	if orgName != "" {
+		fmt.Fprintf(&b, " https://mackerel.io/orgs/%s/alerts/%s", orgName, alert.ID)
+	}
+	return b.String(), host, monitorService
+}
+
+// monitorServiceName returns the service of the service metric and external http monitors.
+func monitorServiceName(monitor mackerel.Monitor) string {
+	switch m := monitor.(type) {
+	case *mackerel.MonitorServiceMetric:
+		return m.Service
+	case *mackerel.MonitorExternalHTTP:
+		return m.Service
+	}
+	return ""
+}
+
+func renderCorrelatedAlerts(groups map[string][]string, groupBy string, window time.Duration) string {
+	if len(groups) == 0 {
+		return fmt.Sprintf("no correlated alerts within %s", window)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "alerts opened within %s:\n", window)
+	if groupBy == correlatedAlertsGroupByNone {
+		for _, line := range groups[""] {
+			b.WriteString(line + "\n")
+		}
+		return b.String()
+	}
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		if key != correlatedAlertsUngrouped {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if _, ok := groups[correlatedAlertsUngrouped]; ok {
+		keys = append(keys, correlatedAlertsUngrouped)
+	}
+	for _, key := range keys {
+		fmt.Fprintf(&b, "\n#### %s\n\n", key)
+		for _, line := range groups[key] {
+			b.WriteString(line + "\n")
+		}
+	}
+	return b.String()
+}
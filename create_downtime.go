@@ -0,0 +1,165 @@
+package prepalert
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+// CreateDowntimeAction mutes the monitor during the planned maintenance detected by the queries, such as the running migration.
+type CreateDowntimeAction struct {
+	app               *App
+	ruleName          string
+	enable            bool
+	whenExpr          hcl.Expression
+	nameExpr          hcl.Expression
+	memoExpr          hcl.Expression
+	durationExpr      hcl.Expression
+	serviceScopesExpr hcl.Expression
+	roleScopesExpr    hcl.Expression
+	monitorScopesExpr hcl.Expression
+	dependsOnQueries  map[string]struct{}
+}
+
+// downtimeCreation is the downtime requested by the create_downtime action, created in Flush.
+type downtimeCreation struct {
+	ruleName string
+	downtime *mackerel.Downtime
+}
+
+func (action *CreateDowntimeAction) DecodeBody(body hcl.Body, evalCtx *hcl.EvalContext) hcl.Diagnostics {
+	attrs, diags := body.JustAttributes()
+	if diags.HasErrors() {
+		return diags
+	}
+	for _, attr := range attrs {
+		switch attr.Name {
+		case "when":
+			action.whenExpr = attr.Expr
+		case "name":
+			action.nameExpr = attr.Expr
+		case "memo":
+			action.memoExpr = attr.Expr
+		case "duration":
+			action.durationExpr = attr.Expr
+		case "service_scopes":
+			action.serviceScopesExpr = attr.Expr
+		case "role_scopes":
+			action.roleScopesExpr = attr.Expr
+		case "monitor_scopes":
+			action.monitorScopesExpr = attr.Expr
+		default:
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  fmt.Sprintf("unknown attribute %q", attr.Name),
+				Subject:  attr.Range.Ptr(),
+			})
+			continue
+		}
+		registerQueryFQNs(attr.Expr, action.dependsOnQueries)
+	}
+	if diags.HasErrors() {
+		return diags
+	}
+	if action.durationExpr == nil {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "create_downtime block must have duration attribute",
+			Subject:  body.MissingItemRange().Ptr(),
+		})
+	}
+	action.enable = !diags.HasErrors()
+	return diags
+}
+
+func (action *CreateDowntimeAction) Enable() bool {
+	return action.enable
+}
+
+func (action *CreateDowntimeAction) DependsOnQueries() []string {
+	queries := make([]string, 0, len(action.dependsOnQueries))
+	for query := range action.dependsOnQueries {
+		queries = append(queries, query)
+	}
+	return queries
+}
+
+// Execute evaluates the when guard with the query results, and requests the downtime if the guard is true.
+// if no scope is given, the downtime is scoped to the monitor of the alert, as get_monitor returns.
+func (action *CreateDowntimeAction) Execute(ctx context.Context, evalCtx *hcl.EvalContext, u *MackerelUpdater) error {
+	if action.whenExpr != nil {
+		ok, err := evaluateWhenExpression(action.whenExpr, evalCtx)
+		if err != nil {
+			return fmt.Errorf("create_downtime: %w", err)
+		}
+		if !ok {
+			slog.DebugContext(ctx, "skip create_downtime, when is false", "rule_name", action.ruleName)
+			return nil
+		}
+	}
+	body, err := WebhookFromEvalContext(evalCtx)
+	if err != nil {
+		return fmt.Errorf("create_downtime: %w", err)
+	}
+	duration, diags := decodeDurationExpression(action.durationExpr, evalCtx)
+	if diags.HasErrors() {
+		return fmt.Errorf("create_downtime: render duration: %w", diags)
+	}
+	if duration <= 0 {
+		return fmt.Errorf("create_downtime: duration must be greater than 0, got %s", duration)
+	}
+	downtime := &mackerel.Downtime{
+		Name:     "prepalert rule=" + action.ruleName,
+		Start:    flextime.Now().Unix(),
+		Duration: int64(math.Ceil(duration.Minutes())),
+	}
+	if action.nameExpr != nil {
+		if downtime.Name, err = ExpressionToString(action.nameExpr, evalCtx); err != nil {
+			return fmt.Errorf("create_downtime: render name: %w", err)
+		}
+	}
+	if action.memoExpr != nil {
+		if downtime.Memo, err = ExpressionToString(action.memoExpr, evalCtx); err != nil {
+			return fmt.Errorf("create_downtime: render memo: %w", err)
+		}
+	} else if body.Alert != nil {
+		downtime.Memo = "related alert: " + body.Alert.URL
+	}
+	scopes := []struct {
+		name string
+		expr hcl.Expression
+		dst  *[]string
+	}{
+		{name: "service_scopes", expr: action.serviceScopesExpr, dst: &downtime.ServiceScopes},
+		{name: "role_scopes", expr: action.roleScopesExpr, dst: &downtime.RoleScopes},
+		{name: "monitor_scopes", expr: action.monitorScopesExpr, dst: &downtime.MonitorScopes},
+	}
+	for _, scope := range scopes {
+		if scope.expr == nil {
+			continue
+		}
+		if diags := gohcl.DecodeExpression(scope.expr, evalCtx, scope.dst); diags.HasErrors() {
+			return fmt.Errorf("create_downtime: render %s: %w", scope.name, diags)
+		}
+	}
+	if len(downtime.ServiceScopes)+len(downtime.RoleScopes)+len(downtime.MonitorScopes) == 0 {
+		if body.Alert == nil || body.Alert.Trigger != "monitor" {
+			return fmt.Errorf("create_downtime: no scope is given, and the webhook has no alert of the monitor")
+		}
+		monitor, err := u.svc.GetMonitorByAlertID(ctx, body.Alert.ID)
+		if err != nil {
+			return fmt.Errorf("create_downtime: %w", err)
+		}
+		downtime.MonitorScopes = []string{monitor.MonitorID()}
+	}
+	slog.DebugContext(ctx, "dump downtime", "name", downtime.Name, "duration", time.Duration(downtime.Duration)*time.Minute)
+	u.AddDowntimeCreation(action.ruleName, downtime)
+	return nil
+}
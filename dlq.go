@@ -0,0 +1,628 @@
+package prepalert
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/mashiike/canyon"
+)
+
+type DLQOptions struct {
+	List       *DLQListOptions   `cmd:"" help:"list messages in the dead-letter queue"`
+	Show       *DLQShowOptions   `cmd:"" help:"show a message in the dead-letter queue"`
+	Replay     *DLQReplayOptions `cmd:"" help:"replay messages in the dead-letter queue"`
+	Subcommand string            `kong:"-"`
+	Writer     io.Writer         `kong:"-"`
+}
+
+type DLQListOptions struct {
+	Limit  int    `help:"max number of messages to list" default:"100"`
+	Format string `help:"output format" default:"text" enum:"text,json"`
+}
+
+type DLQShowOptions struct {
+	MessageID string `arg:"" name:"message-id" help:"SQS message id"`
+	Format    string `help:"output format" default:"text" enum:"text,json"`
+}
+
+type DLQReplayOptions struct {
+	MessageIDs []string `arg:"" name:"message-id" help:"SQS message ids to replay" optional:""`
+	All        bool     `help:"replay all messages in the dead-letter queue"`
+	Enqueue    bool     `help:"re-enqueue to the worker queue instead of executing the rules in-process"`
+}
+
+// SQSClient is the subset of SQS API used by the dead-letter queue commands.
+type SQSClient interface {
+	GetQueueUrl(ctx context.Context, params *sqs.GetQueueUrlInput, optFns ...func(*sqs.Options)) (*sqs.GetQueueUrlOutput, error)
+	ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error)
+	DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error)
+	SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error)
+	ChangeMessageVisibilityBatch(ctx context.Context, params *sqs.ChangeMessageVisibilityBatchInput, optFns ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityBatchOutput, error)
+}
+
+var GlobalSQSClient SQSClient
+
+const (
+	// dlqVisibilityTimeout hides the received messages while the command is running, they are released at the end.
+	dlqVisibilityTimeout = 300
+	dlqMaxScanMessages   = 1000
+)
+
+// DLQMessage is a message in the dead-letter queue, decoded as the webhook body.
+type DLQMessage struct {
+	MessageID       string            `json:"message_id"`
+	SentAt          *time.Time        `json:"sent_at,omitempty"`
+	FirstReceivedAt *time.Time        `json:"first_received_at,omitempty"`
+	ReceiveCount    int               `json:"receive_count"`
+	RequestID       string            `json:"request_id,omitempty"`
+	Attributes      map[string]string `json:"attributes,omitempty"`
+	Webhook         *WebhookBody      `json:"webhook,omitempty"`
+	Error           string            `json:"error,omitempty"`
+
+	message types.Message
+	header  http.Header
+	payload []byte
+	deleted bool
+}
+
+func newDLQMessage(ctx context.Context, msg types.Message) *DLQMessage {
+	m := &DLQMessage{
+		MessageID:  aws.ToString(msg.MessageId),
+		Attributes: msg.Attributes,
+		message:    msg,
+	}
+	if t, ok := parseSQSTimestamp(msg.Attributes["SentTimestamp"]); ok {
+		m.SentAt = &t
+	}
+	if t, ok := parseSQSTimestamp(msg.Attributes["ApproximateFirstReceiveTimestamp"]); ok {
+		m.FirstReceivedAt = &t
+	}
+	if count, err := strconv.Atoi(msg.Attributes["ApproximateReceiveCount"]); err == nil {
+		m.ReceiveCount = count
+	}
+	req, err := canyon.NewDefaultSerializer().Deserialize(ctx, &events.SQSMessage{
+		MessageId:     m.MessageID,
+		ReceiptHandle: aws.ToString(msg.ReceiptHandle),
+		Body:          aws.ToString(msg.Body),
+		Attributes:    msg.Attributes,
+	})
+	if err != nil {
+		m.Error = fmt.Sprintf("deserialize worker request: %s", err)
+		return m
+	}
+	defer req.Body.Close()
+	m.RequestID = req.Header.Get(HeaderRequestID)
+	m.header = req.Header.Clone()
+	m.payload, err = io.ReadAll(req.Body)
+	if err != nil {
+		m.Error = fmt.Sprintf("read worker request body: %s", err)
+		return m
+	}
+	body, err := decodeWebhookBody(bytes.NewReader(m.payload))
+	if err != nil {
+		m.Error = err.Error()
+		return m
+	}
+	m.Webhook = body
+	return m
+}
+
+func parseSQSTimestamp(str string) (time.Time, bool) {
+	msec, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(msec).UTC(), true
+}
+
+func (m *DLQMessage) alertID() string {
+	if m.Webhook == nil || m.Webhook.Alert == nil {
+		return ""
+	}
+	return m.Webhook.Alert.ID
+}
+
+type sqsQueue struct {
+	client   SQSClient
+	queueURL string
+}
+
+func newSQSClient(ctx context.Context) (SQSClient, error) {
+	if GlobalSQSClient != nil {
+		return GlobalSQSClient, nil
+	}
+	awsCfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("can not create aws config: %w", err)
+	}
+	return sqs.NewFromConfig(awsCfg), nil
+}
+
+func openSQSQueue(ctx context.Context, client SQSClient, queueName string) (*sqsQueue, error) {
+	output, err := client.GetQueueUrl(ctx, &sqs.GetQueueUrlInput{
+		QueueName: aws.String(queueName),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("get queue url of %s: %w", queueName, err)
+	}
+	return &sqsQueue{
+		client:   client,
+		queueURL: aws.ToString(output.QueueUrl),
+	}, nil
+}
+
+func (app *App) openDeadLetterQueue(ctx context.Context) (*sqsQueue, error) {
+	if q := app.localQueue; q != nil {
+		if q.DLQPath == "" {
+			return nil, errors.New("dead-letter queue is not configured, set dlq_path in the queue block")
+		}
+		return &sqsQueue{
+			client:   newFileDLQClient(q.DLQPath),
+			queueURL: q.DLQPath,
+		}, nil
+	}
+	if app.dlqName == "" {
+		return nil, errors.New("dead-letter queue is not configured, set sqs_dead_letter_queue_name in the prepalert block")
+	}
+	client, err := newSQSClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return openSQSQueue(ctx, client, app.dlqName)
+}
+
+// openWorkerQueue opens the queue which the worker receives from, for re-enqueue.
+func (app *App) openWorkerQueue(ctx context.Context) (*sqsQueue, error) {
+	if q := app.localQueue; q != nil {
+		if q.Type != localQueueTypeFile {
+			return nil, errors.New("can not enqueue to the memory queue from another process, replay in-process instead")
+		}
+		fq, err := NewFileQueue(q.Path, q.VisibilityTimeout, int(q.MaxReceiveCount), nil)
+		if err != nil {
+			return nil, err
+		}
+		return &sqsQueue{
+			client:   fq,
+			queueURL: q.Path,
+		}, nil
+	}
+	client, err := newSQSClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return openSQSQueue(ctx, client, app.queueName)
+}
+
+// receiveAll receives messages until the queue is empty or limit is reached.
+// received messages are invisible until release is called.
+func (q *sqsQueue) receiveAll(ctx context.Context, limit int) ([]*DLQMessage, error) {
+	msgs := make([]*DLQMessage, 0)
+	seen := make(map[string]bool)
+	for limit <= 0 || len(msgs) < limit {
+		maxNumberOfMessages := int32(10)
+		if limit > 0 && limit-len(msgs) < 10 {
+			maxNumberOfMessages = int32(limit - len(msgs))
+		}
+		output, err := q.client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:              aws.String(q.queueURL),
+			MaxNumberOfMessages:   maxNumberOfMessages,
+			VisibilityTimeout:     dlqVisibilityTimeout,
+			WaitTimeSeconds:       1,
+			AttributeNames:        []types.QueueAttributeName{types.QueueAttributeNameAll},
+			MessageAttributeNames: []string{"All"},
+		})
+		if err != nil {
+			return msgs, fmt.Errorf("receive message: %w", err)
+		}
+		received := 0
+		for _, msg := range output.Messages {
+			messageID := aws.ToString(msg.MessageId)
+			if seen[messageID] {
+				continue
+			}
+			seen[messageID] = true
+			msgs = append(msgs, newDLQMessage(ctx, msg))
+			received++
+		}
+		if received == 0 {
+			break
+		}
+	}
+	return msgs, nil
+}
+
+func (q *sqsQueue) delete(ctx context.Context, m *DLQMessage) error {
+	_, err := q.client.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(q.queueURL),
+		ReceiptHandle: m.message.ReceiptHandle,
+	})
+	if err != nil {
+		return fmt.Errorf("delete message %s: %w", m.MessageID, err)
+	}
+	m.deleted = true
+	return nil
+}
+
+// release makes the received messages visible again, except deleted ones.
+func (q *sqsQueue) release(ctx context.Context, msgs []*DLQMessage) {
+	entries := make([]types.ChangeMessageVisibilityBatchRequestEntry, 0, 10)
+	flush := func() {
+		if len(entries) == 0 {
+			return
+		}
+		output, err := q.client.ChangeMessageVisibilityBatch(ctx, &sqs.ChangeMessageVisibilityBatchInput{
+			QueueUrl: aws.String(q.queueURL),
+			Entries:  entries,
+		})
+		if err != nil {
+			slog.WarnContext(ctx, "failed to release dead-letter queue messages, they are visible again after visibility timeout", "error", err)
+		} else {
+			for _, f := range output.Failed {
+				slog.WarnContext(ctx, "failed to release dead-letter queue message", "message_id", aws.ToString(f.Id), "error", aws.ToString(f.Message))
+			}
+		}
+		entries = entries[:0]
+	}
+	for _, m := range msgs {
+		if m.deleted {
+			continue
+		}
+		entries = append(entries, types.ChangeMessageVisibilityBatchRequestEntry{
+			Id:                aws.String(m.MessageID),
+			ReceiptHandle:     m.message.ReceiptHandle,
+			VisibilityTimeout: 0,
+		})
+		if len(entries) == 10 {
+			flush()
+		}
+	}
+	flush()
+}
+
+func (app *App) DLQ(ctx context.Context, opts *DLQOptions) error {
+	w := opts.Writer
+	if w == nil {
+		w = os.Stdout
+	}
+	q, err := app.openDeadLetterQueue(ctx)
+	if err != nil {
+		return err
+	}
+	switch opts.Subcommand {
+	case "list":
+		return app.dlqList(ctx, q, opts.List, w)
+	case "show":
+		return app.dlqShow(ctx, q, opts.Show, w)
+	case "replay":
+		return app.dlqReplay(ctx, q, opts.Replay, w)
+	}
+	return fmt.Errorf("unknown dlq command: %s", opts.Subcommand)
+}
+
+func (app *App) dlqList(ctx context.Context, q *sqsQueue, opts *DLQListOptions, w io.Writer) error {
+	msgs, err := q.receiveAll(ctx, opts.Limit)
+	defer q.release(ctx, msgs)
+	if err != nil {
+		return err
+	}
+	if opts.Format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(msgs)
+	}
+	if len(msgs) == 0 {
+		fmt.Fprintln(w, "no messages in the dead-letter queue")
+		return nil
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "MESSAGE ID\tSENT AT\tRECEIVE COUNT\tALERT ID\tSTATUS\tMONITOR\tERROR")
+	for _, m := range msgs {
+		var sentAt, status, monitorName string
+		if m.SentAt != nil {
+			sentAt = m.SentAt.Format(time.RFC3339)
+		}
+		if m.Webhook != nil && m.Webhook.Alert != nil {
+			status = m.Webhook.Alert.Status
+			monitorName = m.Webhook.Alert.MonitorName
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\t%s\n", m.MessageID, sentAt, m.ReceiveCount, m.alertID(), status, monitorName, m.Error)
+	}
+	return tw.Flush()
+}
+
+func findDLQMessage(msgs []*DLQMessage, messageID string) *DLQMessage {
+	for _, m := range msgs {
+		if m.MessageID == messageID {
+			return m
+		}
+	}
+	return nil
+}
+
+func (app *App) dlqShow(ctx context.Context, q *sqsQueue, opts *DLQShowOptions, w io.Writer) error {
+	msgs, err := q.receiveAll(ctx, dlqMaxScanMessages)
+	defer q.release(ctx, msgs)
+	if err != nil {
+		return err
+	}
+	m := findDLQMessage(msgs, opts.MessageID)
+	if m == nil {
+		return fmt.Errorf("message %s is not found in the dead-letter queue", opts.MessageID)
+	}
+	if opts.Format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(m)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Message ID: %s\n", m.MessageID)
+	if m.SentAt != nil {
+		fmt.Fprintf(&b, "Sent At: %s\n", m.SentAt.Format(time.RFC3339))
+	}
+	if m.FirstReceivedAt != nil {
+		fmt.Fprintf(&b, "First Received At: %s\n", m.FirstReceivedAt.Format(time.RFC3339))
+	}
+	fmt.Fprintf(&b, "Receive Count: %d\n", m.ReceiveCount)
+	if m.RequestID != "" {
+		fmt.Fprintf(&b, "Request ID: %s\n", m.RequestID)
+	}
+	if m.Error != "" {
+		fmt.Fprintf(&b, "Error: %s\n", m.Error)
+	}
+	if m.Webhook != nil {
+		fmt.Fprintf(&b, "Org Name: %s\n", m.Webhook.OrgName)
+		fmt.Fprintf(&b, "Event: %s\n", m.Webhook.Event)
+		if alert := m.Webhook.Alert; alert != nil {
+			fmt.Fprintf(&b, "Alert ID: %s\n", alert.ID)
+			fmt.Fprintf(&b, "Alert Status: %s\n", alert.Status)
+			fmt.Fprintf(&b, "Monitor Name: %s\n", alert.MonitorName)
+			fmt.Fprintf(&b, "Opened At: %s\n", time.Unix(alert.OpenedAt, 0).UTC().Format(time.RFC3339))
+			if alert.URL != "" {
+				fmt.Fprintf(&b, "URL: %s\n", alert.URL)
+			}
+		}
+		bs, err := json.MarshalIndent(m.Webhook, "", "  ")
+		if err != nil {
+			return err
+		}
+		b.WriteString("\nWebhook:\n")
+		b.Write(bs)
+		b.WriteString("\n")
+	}
+	_, err = io.WriteString(w, b.String())
+	return err
+}
+
+func (app *App) dlqReplay(ctx context.Context, q *sqsQueue, opts *DLQReplayOptions, w io.Writer) error {
+	if len(opts.MessageIDs) > 0 && opts.All {
+		return errors.New("message-id and --all are exclusive")
+	}
+	if len(opts.MessageIDs) == 0 && !opts.All {
+		return errors.New("message-id or --all is required")
+	}
+	if !opts.Enqueue && !app.WorkerIsReady() {
+		return errors.New("worker is not ready, check configureion error")
+	}
+	var workerQueue *sqsQueue
+	if opts.Enqueue {
+		var err error
+		workerQueue, err = app.openWorkerQueue(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	msgs, err := q.receiveAll(ctx, dlqMaxScanMessages)
+	defer q.release(ctx, msgs)
+	if err != nil {
+		return err
+	}
+	targets := msgs
+	if !opts.All {
+		targets = make([]*DLQMessage, 0, len(opts.MessageIDs))
+		for _, messageID := range opts.MessageIDs {
+			m := findDLQMessage(msgs, messageID)
+			if m == nil {
+				return fmt.Errorf("message %s is not found in the dead-letter queue", messageID)
+			}
+			targets = append(targets, m)
+		}
+	}
+	var errs []error
+	replayed := 0
+	for _, m := range targets {
+		if err := app.replayDLQMessage(ctx, q, workerQueue, m); err != nil {
+			fmt.Fprintf(w, "FAIL: %s: %s\n", m.MessageID, err)
+			errs = append(errs, fmt.Errorf("%s: %w", m.MessageID, err))
+			continue
+		}
+		fmt.Fprintf(w, "OK: %s", m.MessageID)
+		if alertID := m.alertID(); alertID != "" {
+			fmt.Fprintf(w, " (alert_id=%s)", alertID)
+		}
+		fmt.Fprintln(w)
+		replayed++
+	}
+	fmt.Fprintf(w, "%d of %d messages replayed\n", replayed, len(targets))
+	return errors.Join(errs...)
+}
+
+// replayDLQMessage executes the rules or re-enqueues to the worker queue, and deletes the message from the dead-letter queue on success.
+func (app *App) replayDLQMessage(ctx context.Context, q *sqsQueue, workerQueue *sqsQueue, m *DLQMessage) error {
+	if workerQueue != nil {
+		_, err := workerQueue.client.SendMessage(ctx, &sqs.SendMessageInput{
+			QueueUrl:          aws.String(workerQueue.queueURL),
+			MessageBody:       m.message.Body,
+			MessageAttributes: m.message.MessageAttributes,
+		})
+		if err != nil {
+			return fmt.Errorf("send message to worker queue: %w", err)
+		}
+		return q.delete(ctx, m)
+	}
+	if m.Error != "" {
+		return errors.New(m.Error)
+	}
+	// the message is served as the worker request with its headers, same as delivered from the worker queue.
+	// e.g. the refresh request is executed as the refresh, and the non-alert events are handled by the rules.
+	req, err := http.NewRequestWithContext(canyon.EmbedIsWorkerInContext(ctx, true), http.MethodPost, "/", bytes.NewReader(m.payload))
+	if err != nil {
+		return fmt.Errorf("new worker request: %w", err)
+	}
+	req.Header = m.header.Clone()
+	w := canyon.NewWorkerResponseWriter()
+	app.ServeHTTP(w, req)
+	if resp := w.Response(req); resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("worker responded %s, see the log for details", resp.Status)
+	}
+	return q.delete(ctx, m)
+}
+
+// fileDLQClient reads the dead-letter queue written by the local queue as JSON lines.
+type fileDLQClient struct {
+	mu       sync.Mutex
+	path     string
+	received map[string]bool
+}
+
+func newFileDLQClient(path string) *fileDLQClient {
+	return &fileDLQClient{
+		path:     path,
+		received: make(map[string]bool),
+	}
+}
+
+func (c *fileDLQClient) load() ([]types.Message, error) {
+	fp, err := os.Open(c.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer fp.Close()
+	msgs := make([]types.Message, 0)
+	scanner := bufio.NewScanner(fp)
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var msg types.Message
+		if err := json.Unmarshal([]byte(line), &msg); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", c.path, err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, scanner.Err()
+}
+
+func (c *fileDLQClient) GetQueueUrl(_ context.Context, _ *sqs.GetQueueUrlInput, _ ...func(*sqs.Options)) (*sqs.GetQueueUrlOutput, error) {
+	return &sqs.GetQueueUrlOutput{QueueUrl: aws.String(c.path)}, nil
+}
+
+func (c *fileDLQClient) ReceiveMessage(_ context.Context, params *sqs.ReceiveMessageInput, _ ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	msgs, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	output := &sqs.ReceiveMessageOutput{}
+	for _, msg := range msgs {
+		if len(output.Messages) >= int(params.MaxNumberOfMessages) {
+			break
+		}
+		messageID := aws.ToString(msg.MessageId)
+		if c.received[messageID] {
+			continue
+		}
+		c.received[messageID] = true
+		msg.ReceiptHandle = aws.String(messageID)
+		output.Messages = append(output.Messages, msg)
+	}
+	return output, nil
+}
+
+func (c *fileDLQClient) DeleteMessage(_ context.Context, params *sqs.DeleteMessageInput, _ ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	msgs, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), "."+filepath.Base(c.path)+".*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	enc := json.NewEncoder(tmp)
+	for _, msg := range msgs {
+		if aws.ToString(msg.MessageId) == aws.ToString(params.ReceiptHandle) {
+			continue
+		}
+		if err := enc.Encode(msg); err != nil {
+			tmp.Close()
+			return nil, err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		return nil, err
+	}
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func (c *fileDLQClient) SendMessage(_ context.Context, params *sqs.SendMessageInput, _ ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fp, err := os.OpenFile(c.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	msg := types.Message{
+		MessageId:         aws.String(randomHex(16)),
+		Body:              params.MessageBody,
+		MD5OfBody:         aws.String(md5Digest(aws.ToString(params.MessageBody))),
+		MessageAttributes: params.MessageAttributes,
+	}
+	if err := json.NewEncoder(fp).Encode(msg); err != nil {
+		return nil, err
+	}
+	return &sqs.SendMessageOutput{MessageId: msg.MessageId}, nil
+}
+
+func (c *fileDLQClient) ChangeMessageVisibilityBatch(_ context.Context, params *sqs.ChangeMessageVisibilityBatchInput, _ ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityBatchOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	output := &sqs.ChangeMessageVisibilityBatchOutput{}
+	for _, entry := range params.Entries {
+		if entry.VisibilityTimeout == 0 {
+			delete(c.received, aws.ToString(entry.ReceiptHandle))
+		}
+		output.Successful = append(output.Successful, types.ChangeMessageVisibilityBatchResultEntry{Id: entry.Id})
+	}
+	return output, nil
+}
@@ -0,0 +1,322 @@
+package prepalert_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/mackerelio/mackerel-client-go"
+	"github.com/mashiike/canyon"
+	"github.com/mashiike/prepalert"
+	"github.com/mashiike/prepalert/mock"
+	"github.com/sebdah/goldie/v2"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+)
+
+// fakeSQSClient is a minimal SQS, messages are kept in order by queue url.
+type fakeSQSClient struct {
+	mu       sync.Mutex
+	messages map[string][]types.Message
+	inflight map[string]bool
+}
+
+func newFakeSQSClient() *fakeSQSClient {
+	return &fakeSQSClient{
+		messages: make(map[string][]types.Message),
+		inflight: make(map[string]bool),
+	}
+}
+
+func (c *fakeSQSClient) GetQueueUrl(_ context.Context, params *sqs.GetQueueUrlInput, _ ...func(*sqs.Options)) (*sqs.GetQueueUrlOutput, error) {
+	return &sqs.GetQueueUrlOutput{
+		QueueUrl: aws.String("https://sqs.ap-northeast-1.amazonaws.com/123456789012/" + aws.ToString(params.QueueName)),
+	}, nil
+}
+
+func (c *fakeSQSClient) ReceiveMessage(_ context.Context, params *sqs.ReceiveMessageInput, _ ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	output := &sqs.ReceiveMessageOutput{}
+	for _, msg := range c.messages[aws.ToString(params.QueueUrl)] {
+		if len(output.Messages) >= int(params.MaxNumberOfMessages) {
+			break
+		}
+		if c.inflight[aws.ToString(msg.MessageId)] {
+			continue
+		}
+		c.inflight[aws.ToString(msg.MessageId)] = true
+		msg.ReceiptHandle = msg.MessageId
+		output.Messages = append(output.Messages, msg)
+	}
+	return output, nil
+}
+
+func (c *fakeSQSClient) DeleteMessage(_ context.Context, params *sqs.DeleteMessageInput, _ ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	queueURL := aws.ToString(params.QueueUrl)
+	msgs := c.messages[queueURL][:0]
+	for _, msg := range c.messages[queueURL] {
+		if aws.ToString(msg.MessageId) != aws.ToString(params.ReceiptHandle) {
+			msgs = append(msgs, msg)
+		}
+	}
+	c.messages[queueURL] = msgs
+	delete(c.inflight, aws.ToString(params.ReceiptHandle))
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func (c *fakeSQSClient) SendMessage(_ context.Context, params *sqs.SendMessageInput, _ ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	queueURL := aws.ToString(params.QueueUrl)
+	messageID := fmt.Sprintf("%s-%d", queueURL[strings.LastIndex(queueURL, "/")+1:], len(c.messages[queueURL])+1)
+	c.messages[queueURL] = append(c.messages[queueURL], types.Message{
+		MessageId: aws.String(messageID),
+		Body:      params.MessageBody,
+		Attributes: map[string]string{
+			"SentTimestamp":                    "1696118400000",
+			"ApproximateFirstReceiveTimestamp": "1696118401000",
+			"ApproximateReceiveCount":          "4",
+		},
+	})
+	return &sqs.SendMessageOutput{MessageId: aws.String(messageID)}, nil
+}
+
+func (c *fakeSQSClient) ChangeMessageVisibilityBatch(_ context.Context, params *sqs.ChangeMessageVisibilityBatchInput, _ ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityBatchOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	output := &sqs.ChangeMessageVisibilityBatchOutput{}
+	for _, entry := range params.Entries {
+		delete(c.inflight, aws.ToString(entry.ReceiptHandle))
+		output.Successful = append(output.Successful, types.ChangeMessageVisibilityBatchResultEntry{Id: entry.Id})
+	}
+	return output, nil
+}
+
+func (c *fakeSQSClient) queue(name string) []types.Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.messages["https://sqs.ap-northeast-1.amazonaws.com/123456789012/"+name]
+}
+
+// setupFakeDLQ sends a worker request of the example webhook and a broken message to the dead-letter queue.
+func setupFakeDLQ(t *testing.T) *fakeSQSClient {
+	t.Helper()
+	client := newFakeSQSClient()
+	prepalert.GlobalSQSClient = client
+	t.Cleanup(func() {
+		prepalert.GlobalSQSClient = nil
+	})
+	sendToFakeDLQ(t, client, "example_webhook.json", http.Header{
+		prepalert.HeaderRequestID: []string{"1234567890"},
+	})
+	_, err := client.SendMessage(context.Background(), &sqs.SendMessageInput{
+		QueueUrl:    aws.String("https://sqs.ap-northeast-1.amazonaws.com/123456789012/prepalert-dlq"),
+		MessageBody: aws.String("broken"),
+	})
+	require.NoError(t, err)
+	return client
+}
+
+// sendToFakeDLQ sends a worker request of the webhook file with the header to the dead-letter queue.
+func sendToFakeDLQ(t *testing.T, client *fakeSQSClient, path string, header http.Header) {
+	t.Helper()
+	ctx := context.Background()
+	req := httptest.NewRequest("POST", "/", LoadFileAsReader(t, path))
+	req.Header.Set("Content-Type", "application/json")
+	for key, values := range header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	input, err := canyon.NewDefaultSerializer().Serialize(ctx, req)
+	require.NoError(t, err)
+	urlOutput, err := client.GetQueueUrl(ctx, &sqs.GetQueueUrlInput{QueueName: aws.String("prepalert-dlq")})
+	require.NoError(t, err)
+	input.QueueUrl = urlOutput.QueueUrl
+	_, err = client.SendMessage(ctx, input)
+	require.NoError(t, err)
+}
+
+func TestAppDLQ__ListAndShow(t *testing.T) {
+	app := LoadApp(t, "testdata/config/with_dead_letter_queue.hcl")
+	client := setupFakeDLQ(t)
+	g := goldie.New(t, goldie.WithFixtureDir("testdata/fixture/"), goldie.WithNameSuffix(".golden"))
+
+	var buf bytes.Buffer
+	err := app.DLQ(context.Background(), &prepalert.DLQOptions{
+		Subcommand: "list",
+		List:       &prepalert.DLQListOptions{Limit: 100, Format: "text"},
+		Writer:     &buf,
+	})
+	require.NoError(t, err)
+	g.Assert(t, "dlq_list", buf.Bytes())
+
+	buf.Reset()
+	err = app.DLQ(context.Background(), &prepalert.DLQOptions{
+		Subcommand: "show",
+		Show:       &prepalert.DLQShowOptions{MessageID: "prepalert-dlq-1", Format: "text"},
+		Writer:     &buf,
+	})
+	require.NoError(t, err)
+	g.Assert(t, "dlq_show", buf.Bytes())
+
+	err = app.DLQ(context.Background(), &prepalert.DLQOptions{
+		Subcommand: "show",
+		Show:       &prepalert.DLQShowOptions{MessageID: "not-found", Format: "text"},
+		Writer:     &buf,
+	})
+	require.EqualError(t, err, "message not-found is not found in the dead-letter queue")
+	require.Len(t, client.queue("prepalert-dlq"), 2, "list and show do not consume messages")
+}
+
+func TestAppDLQ__ReplayInProcess(t *testing.T) {
+	app := LoadApp(t, "testdata/config/with_dead_letter_queue.hcl")
+	client := setupFakeDLQ(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mkrClient := mock.NewMockMackerelClient(ctrl)
+	mkrClient.EXPECT().GetAlert("2bj...").Return(&mackerel.Alert{ID: "2bj..."}, nil).Times(1)
+	mkrClient.EXPECT().UpdateAlert("2bj...", gomock.Any()).Return(&mackerel.UpdateAlertResponse{}, nil).Times(1)
+	app.SetMackerelClient(mkrClient)
+
+	var buf bytes.Buffer
+	err := app.DLQ(context.Background(), &prepalert.DLQOptions{
+		Subcommand: "replay",
+		Replay:     &prepalert.DLQReplayOptions{All: true},
+		Writer:     &buf,
+	})
+	require.Error(t, err)
+	require.Equal(t, strings.Join([]string{
+		"OK: prepalert-dlq-1 (alert_id=2bj...)",
+		"FAIL: prepalert-dlq-2: deserialize worker request: failed to unmarshal request: invalid character 'b' looking for beginning of value",
+		"1 of 2 messages replayed",
+		"",
+	}, "\n"), buf.String())
+	remaining := client.queue("prepalert-dlq")
+	require.Len(t, remaining, 1)
+	require.Equal(t, "prepalert-dlq-2", aws.ToString(remaining[0].MessageId))
+}
+
+func TestAppDLQ__ReplayNonAlertEvent(t *testing.T) {
+	app := LoadApp(t, "testdata/config/with_dead_letter_queue_events.hcl")
+	client := newFakeSQSClient()
+	prepalert.GlobalSQSClient = client
+	t.Cleanup(func() {
+		prepalert.GlobalSQSClient = nil
+	})
+	sendToFakeDLQ(t, client, "testdata/host_retire_webhook.json", nil)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mkrClient := mock.NewMockMackerelClient(ctrl)
+	mkrClient.EXPECT().FindGraphAnnotations("prod", gomock.Any(), gomock.Any()).Return([]*mackerel.GraphAnnotation{}, nil).Times(1)
+	mkrClient.EXPECT().CreateGraphAnnotation(gomock.Any()).DoAndReturn(
+		func(param *mackerel.GraphAnnotation) (*mackerel.GraphAnnotation, error) {
+			require.Equal(t, "prepalert event=hostRetire host_id=22D4...", param.Title)
+			return param, nil
+		},
+	).Times(1)
+	app.SetMackerelClient(mkrClient)
+
+	var buf bytes.Buffer
+	err := app.DLQ(context.Background(), &prepalert.DLQOptions{
+		Subcommand: "replay",
+		Replay:     &prepalert.DLQReplayOptions{All: true},
+		Writer:     &buf,
+	})
+	require.NoError(t, err)
+	require.Equal(t, "OK: prepalert-dlq-1\n1 of 1 messages replayed\n", buf.String())
+	require.Empty(t, client.queue("prepalert-dlq"))
+}
+
+func TestAppDLQ__ReplayRefresh(t *testing.T) {
+	app := LoadApp(t, "testdata/config/with_dead_letter_queue_refresh.hcl")
+	client := newFakeSQSClient()
+	prepalert.GlobalSQSClient = client
+	t.Cleanup(func() {
+		prepalert.GlobalSQSClient = nil
+	})
+	sendToFakeDLQ(t, client, "example_webhook.json", http.Header{
+		prepalert.HeaderRequestID:    []string{"1234567890"},
+		prepalert.HeaderRefreshRule:  []string{"refresh"},
+		prepalert.HeaderRefreshCount: []string{"1"},
+	})
+	restore := flextime.Fix(time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC))
+	defer restore()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	var updatedMemo string
+	mkrClient := mock.NewMockMackerelClient(ctrl)
+	mkrClient.EXPECT().GetAlert("2bj...").Return(&mackerel.Alert{ID: "2bj...", Status: "CRITICAL"}, nil).AnyTimes()
+	mkrClient.EXPECT().UpdateAlert("2bj...", gomock.Any()).DoAndReturn(
+		func(_ string, param mackerel.UpdateAlertParam) (*mackerel.UpdateAlertResponse, error) {
+			updatedMemo = param.Memo
+			return &mackerel.UpdateAlertResponse{Memo: param.Memo}, nil
+		},
+	).Times(1)
+	app.SetMackerelClient(mkrClient)
+
+	var buf bytes.Buffer
+	err := app.DLQ(context.Background(), &prepalert.DLQOptions{
+		Subcommand: "replay",
+		Replay:     &prepalert.DLQReplayOptions{All: true},
+		Writer:     &buf,
+	})
+	require.NoError(t, err)
+	require.Equal(t, "OK: prepalert-dlq-1 (alert_id=2bj...)\n1 of 1 messages replayed\n", buf.String())
+	require.Empty(t, client.queue("prepalert-dlq"))
+	require.Contains(t, updatedMemo, "### rule.refresh\n\nlast refreshed: 2023-10-01T00:00:00Z\n\nalert 2bj... is still open")
+	require.NotContains(t, updatedMemo, "written only once", "only the rule of the refresh is executed")
+
+	// the next refresh is scheduled to the worker queue with the incremented count
+	scheduled := client.queue("prepalert")
+	require.Len(t, scheduled, 1)
+	req, err := canyon.NewDefaultSerializer().Deserialize(context.Background(), &events.SQSMessage{
+		MessageId: aws.ToString(scheduled[0].MessageId),
+		Body:      aws.ToString(scheduled[0].Body),
+	})
+	require.NoError(t, err)
+	require.Equal(t, "refresh", req.Header.Get(prepalert.HeaderRefreshRule))
+	require.Equal(t, "2", req.Header.Get(prepalert.HeaderRefreshCount))
+}
+
+func TestAppDLQ__ReplayEnqueue(t *testing.T) {
+	app := LoadApp(t, "testdata/config/with_dead_letter_queue.hcl")
+	client := setupFakeDLQ(t)
+	original := client.queue("prepalert-dlq")[0]
+
+	var buf bytes.Buffer
+	err := app.DLQ(context.Background(), &prepalert.DLQOptions{
+		Subcommand: "replay",
+		Replay:     &prepalert.DLQReplayOptions{MessageIDs: []string{"prepalert-dlq-1"}, Enqueue: true},
+		Writer:     &buf,
+	})
+	require.NoError(t, err)
+	require.Equal(t, "OK: prepalert-dlq-1 (alert_id=2bj...)\n1 of 1 messages replayed\n", buf.String())
+	require.Len(t, client.queue("prepalert-dlq"), 1)
+	enqueued := client.queue("prepalert")
+	require.Len(t, enqueued, 1)
+	require.Equal(t, aws.ToString(original.Body), aws.ToString(enqueued[0].Body))
+}
+
+func TestAppDLQ__NotConfigured(t *testing.T) {
+	app := LoadApp(t, "testdata/config/simple.hcl")
+	err := app.DLQ(context.Background(), &prepalert.DLQOptions{
+		Subcommand: "list",
+		List:       &prepalert.DLQListOptions{Limit: 100, Format: "text"},
+	})
+	require.EqualError(t, err, "dead-letter queue is not configured, set sqs_dead_letter_queue_name in the prepalert block")
+}
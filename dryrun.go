@@ -0,0 +1,347 @@
+package prepalert
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+// DryRunRecorder records what ExecuteRules would do, instead of writing to Mackerel and the backend.
+type DryRunRecorder struct {
+	mu               sync.Mutex
+	Source           string                       `json:"source,omitempty"`
+	MatchedRules     []string                     `json:"matched_rules"`
+	Queries          []*DryRunQueryRecord         `json:"queries"`
+	AlertMemos       []*DryRunAlertMemoRecord     `json:"alert_memos"`
+	GraphAnnotations []*mackerel.GraphAnnotation  `json:"graph_annotations"`
+	BackendObjects   []*DryRunBackendObjectRecord `json:"backend_objects"`
+	Notifications    []*Notification              `json:"notifications,omitempty"`
+	HTTPRequests     []*HTTPRequest               `json:"http_requests,omitempty"`
+	ClosedAlerts     []*DryRunClosedAlertRecord   `json:"closed_alerts,omitempty"`
+	Downtimes        []*mackerel.Downtime         `json:"downtimes,omitempty"`
+	ServiceMetrics   []*DryRunServiceMetricRecord `json:"service_metrics,omitempty"`
+}
+
+type DryRunQueryRecord struct {
+	FQN     string        `json:"fqn"`
+	Status  string        `json:"status"`
+	Error   string        `json:"error,omitempty"`
+	Elapsed time.Duration `json:"elapsed"`
+}
+
+type DryRunAlertMemoRecord struct {
+	AlertID string `json:"alert_id"`
+	Memo    string `json:"memo"`
+}
+
+type DryRunClosedAlertRecord struct {
+	AlertID string `json:"alert_id"`
+	Reason  string `json:"reason"`
+}
+
+type DryRunServiceMetricRecord struct {
+	Service string                  `json:"service"`
+	Values  []*mackerel.MetricValue `json:"values"`
+}
+
+type DryRunBackendObjectRecord struct {
+	Name      string `json:"name"`
+	Backend   string `json:"backend"`
+	ObjectKey string `json:"object_key,omitempty"`
+	URL       string `json:"url,omitempty"`
+	Size      int    `json:"size"`
+}
+
+func NewDryRunRecorder() *DryRunRecorder {
+	return &DryRunRecorder{
+		MatchedRules:     make([]string, 0),
+		Queries:          make([]*DryRunQueryRecord, 0),
+		AlertMemos:       make([]*DryRunAlertMemoRecord, 0),
+		GraphAnnotations: make([]*mackerel.GraphAnnotation, 0),
+		BackendObjects:   make([]*DryRunBackendObjectRecord, 0),
+	}
+}
+
+type dryRunRecorderContextKey struct{}
+
+// WithDryRunRecorder returns a context, ExecuteRules with the context records to rec instead of writing to Mackerel and the backend.
+func WithDryRunRecorder(ctx context.Context, rec *DryRunRecorder) context.Context {
+	return context.WithValue(ctx, dryRunRecorderContextKey{}, rec)
+}
+
+func dryRunRecorderFromContext(ctx context.Context) *DryRunRecorder {
+	rec, ok := ctx.Value(dryRunRecorderContextKey{}).(*DryRunRecorder)
+	if !ok {
+		return nil
+	}
+	return rec
+}
+
+func (rec *DryRunRecorder) recordMatchedRule(ruleName string) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.MatchedRules = append(rec.MatchedRules, ruleName)
+}
+
+func (rec *DryRunRecorder) recordQuery(record *DryRunQueryRecord) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.Queries = append(rec.Queries, record)
+	sort.SliceStable(rec.Queries, func(i, j int) bool {
+		return rec.Queries[i].FQN < rec.Queries[j].FQN
+	})
+}
+
+// UpdateAlertMemo implements MackerelSink
+func (rec *DryRunRecorder) UpdateAlertMemo(_ context.Context, alertID string, memo string) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.AlertMemos = append(rec.AlertMemos, &DryRunAlertMemoRecord{
+		AlertID: alertID,
+		Memo:    memo,
+	})
+	return nil
+}
+
+// PostGraphAnnotation implements MackerelSink
+func (rec *DryRunRecorder) PostGraphAnnotation(_ context.Context, params *mackerel.GraphAnnotation) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	params.Description = triming(params.Description, GraphAnnotationDescriptionMaxSize, "...")
+	rec.GraphAnnotations = append(rec.GraphAnnotations, params)
+	sort.SliceStable(rec.GraphAnnotations, func(i, j int) bool {
+		return rec.GraphAnnotations[i].Service < rec.GraphAnnotations[j].Service
+	})
+	return nil
+}
+
+// CloseAlert implements MackerelSink
+func (rec *DryRunRecorder) CloseAlert(_ context.Context, alertID string, reason string) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.ClosedAlerts = append(rec.ClosedAlerts, &DryRunClosedAlertRecord{
+		AlertID: alertID,
+		Reason:  reason,
+	})
+	return nil
+}
+
+// CreateDowntime implements MackerelSink
+func (rec *DryRunRecorder) CreateDowntime(_ context.Context, downtime *mackerel.Downtime) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.Downtimes = append(rec.Downtimes, downtime)
+	return nil
+}
+
+// PostServiceMetricValues implements MackerelSink
+func (rec *DryRunRecorder) PostServiceMetricValues(_ context.Context, serviceName string, values []*mackerel.MetricValue) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.ServiceMetrics = append(rec.ServiceMetrics, &DryRunServiceMetricRecord{
+		Service: serviceName,
+		Values:  values,
+	})
+	return nil
+}
+
+// PostNotification implements Notifier
+func (rec *DryRunRecorder) PostNotification(_ context.Context, n *Notification, _ *WebhookBody) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.Notifications = append(rec.Notifications, n)
+	return nil
+}
+
+// SendHTTPRequest implements HTTPRequestSender, header values except Content-Type are redacted because they may have credentials.
+func (rec *DryRunRecorder) SendHTTPRequest(_ context.Context, req *HTTPRequest) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	recorded := *req
+	recorded.Header = make(map[string][]string, len(req.Header))
+	for key, values := range req.Header {
+		if key == "Content-Type" {
+			recorded.Header[key] = values
+			continue
+		}
+		recorded.Header[key] = []string{"(redacted)"}
+	}
+	rec.HTTPRequests = append(rec.HTTPRequests, &recorded)
+	return nil
+}
+
+// Backend wraps the backend, the returned backend records objects instead of uploading.
+func (rec *DryRunRecorder) Backend(b Backend) Backend {
+	return &dryRunBackend{
+		Backend: b,
+		rec:     rec,
+	}
+}
+
+type objectLocator interface {
+	ObjectLocation(evalCtx *hcl.EvalContext, name string) (string, string, error)
+}
+
+type dryRunBackend struct {
+	Backend
+	rec *DryRunRecorder
+}
+
+func (b *dryRunBackend) Upload(ctx context.Context, evalCtx *hcl.EvalContext, name string, body io.Reader) (string, bool, error) {
+	locator, ok := b.Backend.(objectLocator)
+	if !ok {
+		// backend does not upload, e.g. discard backend
+		return b.Backend.Upload(ctx, evalCtx, name, body)
+	}
+	objectKey, showDetailsURL, err := locator.ObjectLocation(evalCtx, name)
+	if err != nil {
+		return "", false, err
+	}
+	bs, err := io.ReadAll(body)
+	if err != nil {
+		return "", false, err
+	}
+	b.rec.mu.Lock()
+	defer b.rec.mu.Unlock()
+	b.rec.BackendObjects = append(b.rec.BackendObjects, &DryRunBackendObjectRecord{
+		Name:      name,
+		Backend:   b.Backend.String(),
+		ObjectKey: objectKey,
+		URL:       showDetailsURL,
+		Size:      len(bs),
+	})
+	return showDetailsURL, true, nil
+}
+
+// WriteJSON writes the records as JSON.
+func (rec *DryRunRecorder) WriteJSON(w io.Writer) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	type queryRecord struct {
+		*DryRunQueryRecord
+		Elapsed string `json:"elapsed"`
+	}
+	queries := make([]queryRecord, 0, len(rec.Queries))
+	for _, q := range rec.Queries {
+		queries = append(queries, queryRecord{
+			DryRunQueryRecord: q,
+			Elapsed:           q.Elapsed.String(),
+		})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		*DryRunRecorder
+		Queries []queryRecord `json:"queries"`
+	}{
+		DryRunRecorder: rec,
+		Queries:        queries,
+	})
+}
+
+// WriteText writes the records as human readable text.
+func (rec *DryRunRecorder) WriteText(w io.Writer) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	var b strings.Builder
+	if rec.Source != "" {
+		fmt.Fprintf(&b, "Source: %s\n\n", rec.Source)
+	}
+	b.WriteString("Matched Rules:\n")
+	if len(rec.MatchedRules) == 0 {
+		b.WriteString("  (none)\n")
+	}
+	for _, ruleName := range rec.MatchedRules {
+		fmt.Fprintf(&b, "  - %s\n", ruleName)
+	}
+	b.WriteString("\nQueries:\n")
+	if len(rec.Queries) == 0 {
+		b.WriteString("  (none)\n")
+	}
+	for _, q := range rec.Queries {
+		fmt.Fprintf(&b, "  - %s: %s (%s)", q.FQN, q.Status, q.Elapsed.Round(time.Millisecond))
+		if q.Error != "" {
+			fmt.Fprintf(&b, ": %s", q.Error)
+		}
+		b.WriteString("\n")
+	}
+	for _, m := range rec.AlertMemos {
+		fmt.Fprintf(&b, "\nAlert Memo (alert_id=%s):\n", m.AlertID)
+		b.WriteString(m.Memo)
+		if !strings.HasSuffix(m.Memo, "\n") {
+			b.WriteString("\n")
+		}
+	}
+	for _, c := range rec.ClosedAlerts {
+		fmt.Fprintf(&b, "\nClose Alert (alert_id=%s):\n", c.AlertID)
+		fmt.Fprintf(&b, "reason: %s\n", c.Reason)
+	}
+	for _, d := range rec.Downtimes {
+		fmt.Fprintf(&b, "\nDowntime (name=%s, start=%d, duration=%dm):\n", d.Name, d.Start, d.Duration)
+		for _, scope := range d.ServiceScopes {
+			fmt.Fprintf(&b, "service: %s\n", scope)
+		}
+		for _, scope := range d.RoleScopes {
+			fmt.Fprintf(&b, "role: %s\n", scope)
+		}
+		for _, scope := range d.MonitorScopes {
+			fmt.Fprintf(&b, "monitor: %s\n", scope)
+		}
+		if d.Memo != "" {
+			b.WriteString(d.Memo)
+			if !strings.HasSuffix(d.Memo, "\n") {
+				b.WriteString("\n")
+			}
+		}
+	}
+	for _, m := range rec.ServiceMetrics {
+		fmt.Fprintf(&b, "\nService Metrics (service=%s):\n", m.Service)
+		for _, v := range m.Values {
+			fmt.Fprintf(&b, "  - %s %v %d\n", v.Name, v.Value, v.Time)
+		}
+	}
+	for _, a := range rec.GraphAnnotations {
+		fmt.Fprintf(&b, "\nGraph Annotation (service=%s, from=%d, to=%d):\n", a.Service, a.From, a.To)
+		fmt.Fprintf(&b, "title: %s\n", a.Title)
+		b.WriteString(a.Description)
+		if !strings.HasSuffix(a.Description, "\n") {
+			b.WriteString("\n")
+		}
+	}
+	for _, n := range rec.Notifications {
+		fmt.Fprintf(&b, "\nNotification (rule=%s, type=%s, channel=%s):\n", n.RuleName, n.Type, n.Channel)
+		b.WriteString(n.Text)
+		if !strings.HasSuffix(n.Text, "\n") {
+			b.WriteString("\n")
+		}
+		if n.FullTextURL != "" {
+			fmt.Fprintf(&b, "full text: %s\n", n.FullTextURL)
+		}
+	}
+	for _, req := range rec.HTTPRequests {
+		fmt.Fprintf(&b, "\nHTTP Request (rule=%s):\n", req.RuleName)
+		fmt.Fprintf(&b, "%s %s\n", req.Method, req.URL)
+		if req.Body != "" {
+			b.WriteString(req.Body)
+			if !strings.HasSuffix(req.Body, "\n") {
+				b.WriteString("\n")
+			}
+		}
+	}
+	if len(rec.BackendObjects) > 0 {
+		b.WriteString("\nBackend Objects:\n")
+	}
+	for _, o := range rec.BackendObjects {
+		fmt.Fprintf(&b, "  - %s: %s (%d bytes) %s\n", o.Backend, o.ObjectKey, o.Size, o.URL)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
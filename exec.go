@@ -2,20 +2,146 @@ package prepalert
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 )
 
 type ExecOptions struct {
-	AlertID string `arg:"" name:"alert-id" help:"Mackerel AlertID" required:""`
+	AlertID string    `arg:"" name:"alert-id" help:"Mackerel AlertID" optional:""`
+	Payload string    `help:"webhook payload JSON file, directory of JSON files for batch replay, or - for stdin"`
+	DryRun  bool      `help:"run rules and queries, but print the memo, graph annotations and backend objects instead of writing them" name:"dry-run"`
+	Format  string    `help:"dry-run output format" default:"text" enum:"text,json"`
+	Stdin   io.Reader `kong:"-"`
+	Writer  io.Writer `kong:"-"`
+}
+
+type execPayload struct {
+	source string
+	body   *WebhookBody
 }
 
 func (app *App) Exec(ctx context.Context, opts *ExecOptions) error {
 	if !app.WorkerIsReady() {
 		return errors.New("worker is not ready, check configureion error")
 	}
-	body, err := app.mkrSvc.NewEmulatedWebhookBody(ctx, opts.AlertID)
+	var payloads []*execPayload
+	switch {
+	case opts.AlertID != "" && opts.Payload != "":
+		return errors.New("alert-id and --payload are exclusive")
+	case opts.AlertID != "":
+		body, err := app.mkrSvc.NewEmulatedWebhookBody(ctx, opts.AlertID)
+		if err != nil {
+			return err
+		}
+		payloads = []*execPayload{{body: body}}
+	case opts.Payload != "":
+		var err error
+		payloads, err = loadExecPayloads(opts.Payload, opts.Stdin)
+		if err != nil {
+			return err
+		}
+	default:
+		return errors.New("alert-id or --payload is required")
+	}
+	w := opts.Writer
+	if w == nil {
+		w = os.Stdout
+	}
+	var errs []error
+	for _, payload := range payloads {
+		if err := app.execPayload(ctx, payload, opts, w); err != nil {
+			if payload.source != "" {
+				err = fmt.Errorf("%s: %w", payload.source, err)
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (app *App) execPayload(ctx context.Context, payload *execPayload, opts *ExecOptions, w io.Writer) error {
+	body := payload.body
+	if body.Alert == nil && body.Event == "" {
+		slog.WarnContext(ctx, "not found alert and event in payload, skip", "source", payload.source, "org_name", body.OrgName)
+		return nil
+	}
+	if !opts.DryRun {
+		return app.ExecuteRules(ctx, body)
+	}
+	rec := NewDryRunRecorder()
+	rec.Source = payload.source
+	execErr := app.ExecuteRules(WithDryRunRecorder(ctx, rec), body)
+	var writeErr error
+	switch opts.Format {
+	case "json":
+		writeErr = rec.WriteJSON(w)
+	default:
+		writeErr = rec.WriteText(w)
+	}
+	return errors.Join(execErr, writeErr)
+}
+
+// loadExecPayloads loads webhook bodies from the file, the directory or stdin if path is "-".
+func loadExecPayloads(path string, stdin io.Reader) ([]*execPayload, error) {
+	if path == "-" {
+		if stdin == nil {
+			stdin = os.Stdin
+		}
+		body, err := decodeWebhookBody(stdin)
+		if err != nil {
+			return nil, fmt.Errorf("stdin: %w", err)
+		}
+		return []*execPayload{{source: "stdin", body: body}}, nil
+	}
+	info, err := os.Stat(path)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	paths := []string{path}
+	if info.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		paths = make([]string, 0, len(entries))
+		for _, entry := range entries {
+			if entry.IsDir() || !strings.EqualFold(filepath.Ext(entry.Name()), ".json") {
+				continue
+			}
+			paths = append(paths, filepath.Join(path, entry.Name()))
+		}
+		if len(paths) == 0 {
+			return nil, fmt.Errorf("no JSON payload found in %s", path)
+		}
+		sort.Strings(paths)
+	}
+	payloads := make([]*execPayload, 0, len(paths))
+	for _, p := range paths {
+		fp, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		body, err := decodeWebhookBody(fp)
+		fp.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		payloads = append(payloads, &execPayload{source: p, body: body})
+	}
+	return payloads, nil
+}
+
+func decodeWebhookBody(r io.Reader) (*WebhookBody, error) {
+	var body WebhookBody
+	if err := json.NewDecoder(r).Decode(&body); err != nil {
+		return nil, fmt.Errorf("parse webhook payload: %w", err)
 	}
-	return app.ExecuteRules(ctx, body)
+	return &body, nil
 }
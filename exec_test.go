@@ -0,0 +1,106 @@
+package prepalert_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mackerelio/mackerel-client-go"
+	"github.com/mashiike/prepalert"
+	"github.com/mashiike/prepalert/mock"
+	"github.com/sebdah/goldie/v2"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+)
+
+func TestAppExec__PayloadDirectory(t *testing.T) {
+	app := LoadApp(t, "testdata/config/simple.hcl")
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	client := mock.NewMockMackerelClient(ctrl)
+	client.EXPECT().GetAlert("2bj...").Return(
+		&mackerel.Alert{
+			ID:   "2bj...",
+			Memo: "this is a pen",
+		}, nil,
+	).AnyTimes()
+	app.SetMackerelClient(client)
+
+	dir := t.TempDir()
+	payload := LoadFile(t, "example_webhook.json")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "01.json"), payload, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "02.json"), []byte(`{"orgName":"Macker...","event":"hostStatus"}`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "README.md"), []byte("not a payload"), 0644))
+
+	var buf bytes.Buffer
+	err := app.Exec(context.Background(), &prepalert.ExecOptions{
+		Payload: dir,
+		DryRun:  true,
+		Format:  "text",
+		Writer:  &buf,
+	})
+	require.NoError(t, err)
+	actual := bytes.ReplaceAll(buf.Bytes(), []byte(dir), []byte("<dir>"))
+	g := goldie.New(t, goldie.WithFixtureDir("testdata/fixture/"), goldie.WithNameSuffix(".golden"))
+	g.Assert(t, "exec_payload_directory_dry_run", actual)
+}
+
+func TestAppExec__PayloadStdin(t *testing.T) {
+	app := LoadApp(t, "testdata/config/simple.hcl")
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	client := mock.NewMockMackerelClient(ctrl)
+	client.EXPECT().GetAlert("2bj...").Return(
+		&mackerel.Alert{
+			ID:   "2bj...",
+			Memo: "this is a pen",
+		}, nil,
+	).Times(1)
+	client.EXPECT().UpdateAlert("2bj...", gomock.Any()).Return(&mackerel.UpdateAlertResponse{}, nil).Times(1)
+	app.SetMackerelClient(client)
+
+	err := app.Exec(context.Background(), &prepalert.ExecOptions{
+		Payload: "-",
+		Stdin:   LoadFileAsReader(t, "example_webhook.json"),
+	})
+	require.NoError(t, err)
+}
+
+func TestAppExec__Invalid(t *testing.T) {
+	app := LoadApp(t, "testdata/config/simple.hcl")
+	cases := []struct {
+		name   string
+		opts   *prepalert.ExecOptions
+		errStr string
+	}{
+		{
+			name:   "empty",
+			opts:   &prepalert.ExecOptions{},
+			errStr: "alert-id or --payload is required",
+		},
+		{
+			name: "exclusive",
+			opts: &prepalert.ExecOptions{
+				AlertID: "2bj...",
+				Payload: "example_webhook.json",
+			},
+			errStr: "alert-id and --payload are exclusive",
+		},
+		{
+			name: "broken payload",
+			opts: &prepalert.ExecOptions{
+				Payload: "-",
+				Stdin:   bytes.NewBufferString("{"),
+			},
+			errStr: "stdin: parse webhook payload: unexpected EOF",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := app.Exec(context.Background(), c.opts)
+			require.EqualError(t, err, c.errStr)
+		})
+	}
+}
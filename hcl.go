@@ -2,12 +2,14 @@ package prepalert
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/hcl/v2"
 	"github.com/hashicorp/hcl/v2/ext/dynblock"
@@ -18,6 +20,7 @@ import (
 	"github.com/mashiike/prepalert/provider"
 	"github.com/zclconf/go-cty/cty"
 	"github.com/zclconf/go-cty/cty/function"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
 )
 
 type LoadConfigOptions struct {
@@ -104,6 +107,10 @@ func (app *App) DecodeBody(body hcl.Body, evalCtx *hcl.EvalContext) hcl.Diagnost
 				Type:       "rule",
 				LabelNames: []string{"name"},
 			},
+			{
+				Type:       "test",
+				LabelNames: []string{"name"},
+			},
 		},
 	}
 	content, contentDiags = remain.Content(schema)
@@ -117,6 +124,10 @@ func (app *App) DecodeBody(body hcl.Body, evalCtx *hcl.EvalContext) hcl.Diagnost
 			Type:         "rule",
 			UniqueLabels: true,
 		},
+		{
+			Type:         "test",
+			UniqueLabels: true,
+		},
 	}...))
 	if diags.HasErrors() {
 		return diags
@@ -125,6 +136,7 @@ func (app *App) DecodeBody(body hcl.Body, evalCtx *hcl.EvalContext) hcl.Diagnost
 	diags = diags.Extend(app.decodeProviderBlocks(blocksByType["provider"]))
 	diags = diags.Extend(app.decodeQueryBlocks(blocksByType["query"]))
 	diags = diags.Extend(app.decodeRuleBlocks(blocksByType["rule"]))
+	diags = diags.Extend(app.setTestBlocks(blocksByType["test"]))
 	return diags
 }
 
@@ -135,8 +147,10 @@ func (app *App) decodePrepalertBlock(body hcl.Body) hcl.Diagnostics {
 				Name: "required_version",
 			},
 			{
-				Name:     "sqs_queue_name",
-				Required: true,
+				Name: "sqs_queue_name",
+			},
+			{
+				Name: "sqs_dead_letter_queue_name",
 			},
 		},
 		Blocks: []hcl.BlockHeaderSchema{
@@ -153,9 +167,30 @@ func (app *App) decodePrepalertBlock(body hcl.Body) hcl.Diagnostics {
 				Type:       "backend",
 				LabelNames: []string{"type"},
 			},
+			{
+				Type:       "queue",
+				LabelNames: []string{"type"},
+			},
+			{
+				Type:       "idempotency",
+				LabelNames: []string{"type"},
+			},
+			{
+				Type:       "memo_lock",
+				LabelNames: []string{"type"},
+			},
 		},
 	}
 	content, diags := body.Content(schema)
+	// sqs_queue_name is required unless the local queue is used.
+	if _, ok := content.Attributes["sqs_queue_name"]; !ok && len(content.Blocks.OfType("queue")) == 0 {
+		diags = append(hcl.Diagnostics{{
+			Severity: hcl.DiagError,
+			Summary:  `Missing required argument`,
+			Detail:   `The argument "sqs_queue_name" is required, but no definition was found.`,
+			Subject:  body.MissingItemRange().Ptr(),
+		}}, diags...)
+	}
 	if diags.HasErrors() {
 		return diags
 	}
@@ -176,6 +211,18 @@ func (app *App) decodePrepalertBlock(body hcl.Body) hcl.Diagnostics {
 			Type:   "backend",
 			Unique: true, //TODO Multiple backend, none unique
 		},
+		{
+			Type:   "queue",
+			Unique: true,
+		},
+		{
+			Type:   "idempotency",
+			Unique: true,
+		},
+		{
+			Type:   "memo_lock",
+			Unique: true,
+		},
 	}...))
 	for name, attr := range content.Attributes {
 		switch name {
@@ -193,12 +240,14 @@ func (app *App) decodePrepalertBlock(body hcl.Body) hcl.Diagnostics {
 		case "sqs_queue_name":
 			diags = diags.Extend(gohcl.DecodeExpression(attr.Expr, app.evalCtx, &app.queueName))
 			app.webhookServerPrepared = true
+		case "sqs_dead_letter_queue_name":
+			diags = diags.Extend(gohcl.DecodeExpression(attr.Expr, app.evalCtx, &app.dlqName))
 		}
 	}
 	if diags.HasErrors() {
 		return diags
 	}
-	if blocks := content.Blocks.OfType("plugins"); len(blocks) > 0 {
+	if blocks := content.Blocks.OfType("plugins"); len(blocks) > 0 && app.providerFactory == nil {
 		attrs, attrDiags := blocks[0].Body.JustAttributes()
 		diags = diags.Extend(attrDiags)
 		if !attrDiags.HasErrors() {
@@ -281,9 +330,42 @@ func (app *App) decodePrepalertBlock(body hcl.Body) hcl.Diagnostics {
 			}
 		}
 	}
+	if blocks := content.Blocks.OfType("queue"); len(blocks) > 0 {
+		diags = diags.Extend(app.SetupLocalQueue(blocks[0]))
+		if app.localQueue != nil {
+			if app.queueName == "" {
+				app.queueName = DefaultLocalQueueName
+			}
+			app.webhookServerPrepared = true
+		}
+	}
+	if blocks := content.Blocks.OfType("idempotency"); len(blocks) > 0 {
+		diags = diags.Extend(app.SetupIdempotencyStore(blocks[0]))
+	}
+	if blocks := content.Blocks.OfType("memo_lock"); len(blocks) > 0 {
+		diags = diags.Extend(app.SetupMemoLock(blocks[0]))
+	}
 	return diags
 }
 
+// newProvider creates provider, the built-in providers using Mackerel API are created with app.
+// the plugins take precedence over the built-in providers, so that the plugin named such as http keeps working.
+func (app *App) newProvider(pp *provider.ProviderParameter) (provider.Provider, error) {
+	if app.providerFactory != nil {
+		return app.providerFactory(pp)
+	}
+	if factory, ok := app.pluginFactories[pp.Type]; ok {
+		return factory(pp)
+	}
+	switch pp.Type {
+	case mackerelMetricsProviderType:
+		return app.newMackerelMetricsProvider(pp)
+	case mackerelAlertsProviderType:
+		return app.newMackerelAlertsProvider(pp)
+	}
+	return provider.NewProvider(pp)
+}
+
 func (app *App) decodeProviderBlocks(blocks hcl.Blocks) hcl.Diagnostics {
 	app.providers = make(map[string]provider.Provider, 0)
 	app.providerParameters = make(provider.ProviderParameters, 0)
@@ -321,7 +403,7 @@ func (app *App) decodeProviderBlocks(blocks hcl.Blocks) hcl.Diagnostics {
 			})
 			continue
 		}
-		provider, err := provider.NewProvider(pp)
+		provider, err := app.newProvider(pp)
 		if err != nil {
 			diags = diags.Append(&hcl.Diagnostic{
 				Severity: hcl.DiagError,
@@ -350,12 +432,26 @@ func (app *App) decodeProviderBlocks(blocks hcl.Blocks) hcl.Diagnostics {
 
 func (app *App) decodeQueryBlocks(blocks hcl.Blocks) hcl.Diagnostics {
 	app.queries = make(map[string]provider.Query, 0)
+	app.queryOptions = make(map[string]*queryOptions, 0)
 	var diags hcl.Diagnostics
+	queryAttrs := make(map[string]hcl.Attributes, len(blocks))
+	queryDefRanges := make(map[string]hcl.Range, len(blocks))
 	commonQuerySchema := &hcl.BodySchema{
 		Attributes: []hcl.AttributeSchema{
 			{
 				Name: "provider",
 			},
+			{
+				Name: "timeout",
+			},
+			{
+				Name: "when",
+			},
+		},
+		Blocks: []hcl.BlockHeaderSchema{
+			{
+				Type: "retry",
+			},
 		},
 	}
 	for _, block := range blocks {
@@ -364,7 +460,16 @@ func (app *App) decodeQueryBlocks(blocks hcl.Blocks) hcl.Diagnostics {
 		if contentDiags.HasErrors() {
 			continue
 		}
+		diags = diags.Extend(hclutil.RestrictBlock(content, hclutil.BlockRestrictionSchema{
+			Type:   "retry",
+			Unique: true,
+		}))
+		queryFQN := "query." + block.Labels[0] + "." + block.Labels[1]
+		queryDefRanges[queryFQN] = block.DefRange
 		fqn := block.Labels[0] + ".default"
+		opts := &queryOptions{
+			maxAttempts: 1,
+		}
 		for name, attr := range content.Attributes {
 			switch name {
 			case "provider":
@@ -379,6 +484,21 @@ func (app *App) decodeQueryBlocks(blocks hcl.Blocks) hcl.Diagnostics {
 					continue
 				}
 				fqn = hclutil.TraversalToString(variables[0])
+			case "timeout":
+				timeout, timeoutDiags := decodeDurationExpression(attr.Expr, app.evalCtx)
+				diags = diags.Extend(timeoutDiags)
+				if timeout < 0 {
+					diags = diags.Append(&hcl.Diagnostic{
+						Severity: hcl.DiagError,
+						Summary:  `Query creation failed`,
+						Detail:   "timeout must be positive",
+						Subject:  attr.Expr.Range().Ptr(),
+					})
+					continue
+				}
+				opts.timeout = timeout
+			case "when":
+				opts.when = attr.Expr
 			default:
 				diags = diags.Append(&hcl.Diagnostic{
 					Severity: hcl.DiagError,
@@ -389,6 +509,13 @@ func (app *App) decodeQueryBlocks(blocks hcl.Blocks) hcl.Diagnostics {
 				continue
 			}
 		}
+		if blocks := content.Blocks.OfType("retry"); len(blocks) > 0 {
+			attrs, attrDiags := blocks[0].Body.JustAttributes()
+			diags = diags.Extend(attrDiags)
+			if !attrDiags.HasErrors() {
+				diags = diags.Extend(opts.decodeRetryAttributes(attrs, app.evalCtx))
+			}
+		}
 		provider, ok := app.providers[fqn]
 		if !ok {
 			diags = diags.Append(&hcl.Diagnostic{
@@ -409,9 +536,18 @@ func (app *App) decodeQueryBlocks(blocks hcl.Blocks) hcl.Diagnostics {
 			})
 			continue
 		}
-		queryFQN := "query." + block.Labels[0] + "." + block.Labels[1]
 		app.queries[queryFQN] = query
+		app.queryOptions[queryFQN] = opts
+		attrs, _ := hclutil.ExtructAttributes(remain)
+		if attrs == nil {
+			attrs = make(hcl.Attributes)
+		}
+		if attr, ok := content.Attributes["when"]; ok {
+			attrs[attr.Name] = attr
+		}
+		queryAttrs[queryFQN] = attrs
 	}
+	diags = diags.Extend(app.decodeQueryDependencies(queryAttrs, queryDefRanges))
 	return diags
 }
 
@@ -457,11 +593,89 @@ func (app *App) NewEvalContext(body *WebhookBody) (*hcl.EvalContext, error) {
 	if app.evalCtx == nil {
 		app.evalCtx = hclutil.NewEvalContext()
 	}
+	return withWebhook(app.evalCtx, body)
+}
+
+// withWebhook returns the child context with the webhook, and the alert_group for the alert group events.
+func withWebhook(evalCtx *hcl.EvalContext, body *WebhookBody) (*hcl.EvalContext, error) {
 	webhook, err := hclutil.MarshalCTYValue(body)
 	if err != nil {
-		return app.evalCtx.NewChild(), fmt.Errorf("failed marshal Mackerel webhook body to cty value: %w", err)
+		return evalCtx.NewChild(), fmt.Errorf("failed marshal Mackerel webhook body to cty value: %w", err)
+	}
+	if body.Alert == nil {
+		// the fields of webhook.alert are null for the events without alert, so that the rules of several events can refer them.
+		if webhook, err = withNullAlert(webhook); err != nil {
+			return evalCtx.NewChild(), err
+		}
+	}
+	evalCtx = hclutil.WithValue(evalCtx, webhookHCLPrefix, webhook)
+	if body.AlertGroup != nil {
+		alertGroup, err := hclutil.MarshalCTYValue(NewAlertGroupObject(body))
+		if err != nil {
+			return evalCtx, fmt.Errorf("failed marshal alert group to cty value: %w", err)
+		}
+		evalCtx = hclutil.WithValue(evalCtx, alertGroupHCLPrefix, alertGroup)
+	}
+	return evalCtx, nil
+}
+
+func withNullAlert(webhook cty.Value) (cty.Value, error) {
+	// the pointer fields are set to marshal the attributes with omitempty.
+	alert, err := hclutil.MarshalCTYValue(&Alert{
+		ClosedAt:          new(int64),
+		CriticalThreshold: new(float64),
+		WarningThreshold:  new(float64),
+	})
+	if err != nil {
+		return webhook, fmt.Errorf("failed marshal null alert to cty value: %w", err)
+	}
+	attrs := make(map[string]cty.Value, len(alert.Type().AttributeTypes()))
+	for name, t := range alert.Type().AttributeTypes() {
+		attrs[name] = cty.NullVal(t)
 	}
-	return hclutil.WithValue(app.evalCtx, webhookHCLPrefix, webhook), nil
+	values := webhook.AsValueMap()
+	values["alert"] = cty.ObjectVal(attrs)
+	return cty.ObjectVal(values), nil
+}
+
+// decodeDurationExpression decodes the duration written as a string such as "10m", or as seconds such as duration("10m").
+func decodeDurationExpression(expr hcl.Expression, evalCtx *hcl.EvalContext) (time.Duration, hcl.Diagnostics) {
+	value, diags := expr.Value(evalCtx)
+	if diags.HasErrors() {
+		return 0, diags
+	}
+	if value.Type() == cty.String && value.IsKnown() && !value.IsNull() {
+		d, err := time.ParseDuration(value.AsString())
+		if err != nil {
+			return 0, diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "invalid duration",
+				Detail:   err.Error(),
+				Subject:  expr.Range().Ptr(),
+			})
+		}
+		return d, diags
+	}
+	var seconds float64
+	diags = diags.Extend(gohcl.DecodeExpression(expr, evalCtx, &seconds))
+	return time.Duration(seconds * float64(time.Second)), diags
+}
+
+// decodeDurationJSON decodes the duration of the provider parameter, which is passed as JSON, as decodeDurationExpression.
+func decodeDurationJSON(raw json.RawMessage) (time.Duration, error) {
+	ty, err := ctyjson.ImpliedType(raw)
+	if err != nil {
+		return 0, err
+	}
+	value, err := ctyjson.Unmarshal(raw, ty)
+	if err != nil {
+		return 0, err
+	}
+	d, diags := decodeDurationExpression(hcl.StaticExpr(value, hcl.Range{}), nil)
+	if diags.HasErrors() {
+		return 0, diags
+	}
+	return d, nil
 }
 
 type LoadPluginConfig struct {
@@ -484,7 +698,16 @@ func (app *App) LoadPlugin(ctx context.Context, cfg *LoadPluginConfig) error {
 	if err != nil {
 		return fmt.Errorf("failed load plugin: %w", err)
 	}
-	return provider.RegisterProviderWithError(cfg.PluginName, f.NewProvider)
+	if err := provider.ValidateTypeName(cfg.PluginName); err != nil {
+		return err
+	}
+	if app.pluginFactories == nil {
+		app.pluginFactories = make(map[string]provider.ProviderFactory)
+	}
+	app.pluginFactories[cfg.PluginName] = func(pp *provider.ProviderParameter) (provider.Provider, error) {
+		return f.NewProvider(pp)
+	}
+	return nil
 }
 
 func WebhookFromEvalContext(evalCtx *hcl.EvalContext) (*WebhookBody, error) {
@@ -496,6 +719,14 @@ func WebhookFromEvalContext(evalCtx *hcl.EvalContext) (*WebhookBody, error) {
 	if !ok {
 		return nil, errors.New("webhook body not found")
 	}
+	if v.Type().IsObjectType() && v.Type().HasAttribute("alert") {
+		if alert := v.GetAttr("alert"); alert.Type().IsObjectType() && alert.Type().HasAttribute("id") && alert.GetAttr("id").IsNull() {
+			// the null alert of the events without alert, see withNullAlert.
+			values := v.AsValueMap()
+			delete(values, "alert")
+			v = cty.ObjectVal(values)
+		}
+	}
 	js, _ := hclutil.DumpCTYValue(v)
 	slog.Debug("dump webhook body", "detail", js)
 	if err := hclutil.UnmarshalCTYValue(v, &body); err != nil {
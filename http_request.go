@@ -0,0 +1,419 @@
+package prepalert
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/zclconf/go-cty/cty"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+)
+
+var (
+	// DefaultHTTPRequestTimeout is the default timeout of each attempt of the http_request action.
+	DefaultHTTPRequestTimeout = 10 * time.Second
+	// DefaultHTTPRequestSignatureHeader is the default header of the HMAC signature.
+	DefaultHTTPRequestSignatureHeader = "X-Prepalert-Signature"
+	// HTTPRequestIdempotencyKeyHeader is the header of the idempotency key, which is the same for the redelivered webhook.
+	HTTPRequestIdempotencyKeyHeader = "Idempotency-Key"
+
+	defaultHTTPRequestSender HTTPRequestSender = NewHTTPRequestClient(nil)
+)
+
+// HTTPRequest is the request of the http_request action, sent after the alert memo is updated.
+type HTTPRequest struct {
+	RuleName string              `json:"rule"`
+	Method   string              `json:"method"`
+	URL      string              `json:"url"`
+	Header   map[string][]string `json:"header,omitempty"`
+	Body     string              `json:"body,omitempty"`
+	retry    *HTTPRequestRetry
+	signer   *HTTPRequestSigner
+	// idempotencyKey is derived from the idempotency key of the webhook, so the receiver can drop the resent request.
+	idempotencyKey string
+}
+
+// HTTPRequestSender is the destination of the requests of the http_request action.
+type HTTPRequestSender interface {
+	SendHTTPRequest(ctx context.Context, req *HTTPRequest) error
+}
+
+// HTTPRequestRetry is the `retry` block of the http_request action, the request is retried on the network error, 429 and 5xx.
+type HTTPRequestRetry struct {
+	MaxAttempts   int
+	Interval      time.Duration
+	MaxInterval   time.Duration
+	BackoffFactor float64
+}
+
+// Wait returns the wait before the attempt, attempt starts from 1.
+func (r *HTTPRequestRetry) Wait(attempt int) time.Duration {
+	if attempt <= 1 {
+		return 0
+	}
+	wait := time.Duration(float64(r.Interval) * math.Pow(r.BackoffFactor, float64(attempt-2)))
+	if r.MaxInterval > 0 && wait > r.MaxInterval {
+		wait = r.MaxInterval
+	}
+	return wait
+}
+
+// HTTPRequestSigner is the `hmac` block of the http_request action, the signature of the body is set to the header as `<algorithm>=<hex>`.
+type HTTPRequestSigner struct {
+	Secret    string
+	Header    string
+	Algorithm string
+}
+
+func (s *HTTPRequestSigner) Sign(body []byte) string {
+	var h func() hash.Hash
+	switch s.Algorithm {
+	case "sha1":
+		h = sha1.New
+	case "sha512":
+		h = sha512.New
+	default:
+		h = sha256.New
+	}
+	mac := hmac.New(h, []byte(s.Secret))
+	mac.Write(body)
+	return s.Algorithm + "=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// HTTPRequestClient sends the requests with the retry and the HMAC signature.
+type HTTPRequestClient struct {
+	client *http.Client
+}
+
+func NewHTTPRequestClient(client *http.Client) *HTTPRequestClient {
+	if client == nil {
+		client = &http.Client{Timeout: DefaultHTTPRequestTimeout}
+	}
+	return &HTTPRequestClient{client: client}
+}
+
+func (c *HTTPRequestClient) SendHTTPRequest(ctx context.Context, req *HTTPRequest) error {
+	maxAttempts := 1
+	if req.retry != nil && req.retry.MaxAttempts > 1 {
+		maxAttempts = req.retry.MaxAttempts
+	}
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if attempt > 1 {
+			wait := req.retry.Wait(attempt)
+			slog.WarnContext(ctx, "failed http_request, retry", "attempt", attempt-1, "wait", wait.String(), "reason", err.Error())
+			select {
+			case <-ctx.Done():
+				return errors.Join(err, ctx.Err())
+			case <-time.After(wait):
+			}
+		}
+		var retryable bool
+		retryable, err = c.do(ctx, req)
+		if err == nil || !retryable {
+			return err
+		}
+	}
+	if maxAttempts > 1 {
+		return fmt.Errorf("gave up after %d attempts: %w", maxAttempts, err)
+	}
+	return err
+}
+
+func (c *HTTPRequestClient) do(ctx context.Context, req *HTTPRequest) (bool, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, req.Method, req.URL, bytes.NewReader([]byte(req.Body)))
+	if err != nil {
+		return false, fmt.Errorf("new request: %w", err)
+	}
+	for key, values := range req.Header {
+		for _, v := range values {
+			httpReq.Header.Add(key, v)
+		}
+	}
+	if req.idempotencyKey != "" && httpReq.Header.Get(HTTPRequestIdempotencyKeyHeader) == "" {
+		httpReq.Header.Set(HTTPRequestIdempotencyKeyHeader, req.idempotencyKey)
+	}
+	if req.signer != nil {
+		httpReq.Header.Set(req.signer.Header, req.signer.Sign([]byte(req.Body)))
+	}
+	resp, err := c.client.Do(httpReq)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body)
+		return false, nil
+	}
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	err = fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(respBody)))
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode/100 == 5, err
+}
+
+// HTTPRequestAction sends the request to other systems, such as the incident tracker.
+type HTTPRequestAction struct {
+	app              *App
+	ruleName         string
+	enable           bool
+	urlExpr          hcl.Expression
+	method           string
+	headersExpr      hcl.Expression
+	bodyExpr         hcl.Expression
+	retry            *HTTPRequestRetry
+	signer           *HTTPRequestSigner
+	dependsOnQueries map[string]struct{}
+}
+
+// httpRequestMethods is the methods which the http_request block can send.
+var httpRequestMethods = []string{
+	http.MethodGet,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+}
+
+func (action *HTTPRequestAction) DecodeBody(body hcl.Body, evalCtx *hcl.EvalContext) hcl.Diagnostics {
+	schema := &hcl.BodySchema{
+		Attributes: []hcl.AttributeSchema{
+			{Name: "url", Required: true},
+			{Name: "method"},
+			{Name: "headers"},
+			{Name: "body"},
+		},
+		Blocks: []hcl.BlockHeaderSchema{
+			{Type: "retry"},
+			{Type: "hmac"},
+		},
+	}
+	content, diags := body.Content(schema)
+	if diags.HasErrors() {
+		return diags
+	}
+	action.method = http.MethodPost
+	for name, attr := range content.Attributes {
+		switch name {
+		case "url":
+			action.urlExpr = attr.Expr
+			registerQueryFQNs(attr.Expr, action.dependsOnQueries)
+		case "method":
+			diags = diags.Extend(gohcl.DecodeExpression(attr.Expr, evalCtx, &action.method))
+			action.method = strings.ToUpper(action.method)
+			if !slices.Contains(httpRequestMethods, action.method) {
+				diags = diags.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "http_request block validation",
+					Detail:   fmt.Sprintf("method %q is not supported, allows [%s]", action.method, strings.Join(httpRequestMethods, ", ")),
+					Subject:  attr.Expr.Range().Ptr(),
+				})
+			}
+		case "headers":
+			action.headersExpr = attr.Expr
+			registerQueryFQNs(attr.Expr, action.dependsOnQueries)
+		case "body":
+			action.bodyExpr = attr.Expr
+			registerQueryFQNs(attr.Expr, action.dependsOnQueries)
+		}
+	}
+	for _, block := range content.Blocks {
+		switch block.Type {
+		case "retry":
+			if action.retry != nil {
+				diags = diags.Append(duplicateBlockDiagnostic(block))
+				continue
+			}
+			action.retry = &HTTPRequestRetry{
+				MaxAttempts:   3,
+				Interval:      time.Second,
+				BackoffFactor: 2,
+			}
+			diags = diags.Extend(action.retry.DecodeBody(block.Body, evalCtx))
+		case "hmac":
+			if action.signer != nil {
+				diags = diags.Append(duplicateBlockDiagnostic(block))
+				continue
+			}
+			action.signer = &HTTPRequestSigner{
+				Header:    DefaultHTTPRequestSignatureHeader,
+				Algorithm: "sha256",
+			}
+			diags = diags.Extend(action.signer.DecodeBody(block.Body, evalCtx))
+		}
+	}
+	action.enable = !diags.HasErrors()
+	return diags
+}
+
+func duplicateBlockDiagnostic(block *hcl.Block) *hcl.Diagnostic {
+	return &hcl.Diagnostic{
+		Severity: hcl.DiagError,
+		Summary:  fmt.Sprintf("duplicate %q block", block.Type),
+		Detail:   fmt.Sprintf("only one %q block is allowed", block.Type),
+		Subject:  block.DefRange.Ptr(),
+	}
+}
+
+func (r *HTTPRequestRetry) DecodeBody(body hcl.Body, evalCtx *hcl.EvalContext) hcl.Diagnostics {
+	attrs, diags := body.JustAttributes()
+	if diags.HasErrors() {
+		return diags
+	}
+	for _, attr := range attrs {
+		switch attr.Name {
+		case "max_attempts":
+			diags = diags.Extend(gohcl.DecodeExpression(attr.Expr, evalCtx, &r.MaxAttempts))
+			if r.MaxAttempts <= 0 {
+				diags = diags.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "max_attempts must be greater than 0",
+					Subject:  attr.Expr.Range().Ptr(),
+				})
+			}
+		case "interval", "max_interval":
+			d, durationDiags := decodeDurationExpression(attr.Expr, evalCtx)
+			diags = diags.Extend(durationDiags)
+			if attr.Name == "interval" {
+				r.Interval = d
+			} else {
+				r.MaxInterval = d
+			}
+		case "backoff_factor":
+			diags = diags.Extend(gohcl.DecodeExpression(attr.Expr, evalCtx, &r.BackoffFactor))
+		default:
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  fmt.Sprintf("unknown attribute %q", attr.Name),
+				Subject:  attr.Range.Ptr(),
+			})
+		}
+	}
+	return diags
+}
+
+func (s *HTTPRequestSigner) DecodeBody(body hcl.Body, evalCtx *hcl.EvalContext) hcl.Diagnostics {
+	attrs, diags := body.JustAttributes()
+	if diags.HasErrors() {
+		return diags
+	}
+	for _, attr := range attrs {
+		switch attr.Name {
+		case "secret":
+			diags = diags.Extend(gohcl.DecodeExpression(attr.Expr, evalCtx, &s.Secret))
+		case "header":
+			diags = diags.Extend(gohcl.DecodeExpression(attr.Expr, evalCtx, &s.Header))
+		case "algorithm":
+			diags = diags.Extend(gohcl.DecodeExpression(attr.Expr, evalCtx, &s.Algorithm))
+			switch s.Algorithm {
+			case "sha1", "sha256", "sha512":
+			default:
+				diags = diags.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  fmt.Sprintf("unknown algorithm %q", s.Algorithm),
+					Detail:   "algorithm allows [sha1, sha256, sha512]",
+					Subject:  attr.Expr.Range().Ptr(),
+				})
+			}
+		default:
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  fmt.Sprintf("unknown attribute %q", attr.Name),
+				Subject:  attr.Range.Ptr(),
+			})
+		}
+	}
+	if s.Secret == "" && !diags.HasErrors() {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "hmac block must have secret attribute",
+			Subject:  body.MissingItemRange().Ptr(),
+		})
+	}
+	return diags
+}
+
+func (action *HTTPRequestAction) Enable() bool {
+	return action.enable
+}
+
+func (action *HTTPRequestAction) DependsOnQueries() []string {
+	queries := make([]string, 0, len(action.dependsOnQueries))
+	for query := range action.dependsOnQueries {
+		queries = append(queries, query)
+	}
+	return queries
+}
+
+func (action *HTTPRequestAction) Execute(ctx context.Context, evalCtx *hcl.EvalContext, u *MackerelUpdater) error {
+	url, err := ExpressionToString(action.urlExpr, evalCtx)
+	if err != nil {
+		return fmt.Errorf("http_request: render url: %w", err)
+	}
+	req := &HTTPRequest{
+		RuleName: action.ruleName,
+		Method:   action.method,
+		URL:      url,
+		Header:   make(map[string][]string),
+		retry:    action.retry,
+		signer:   action.signer,
+	}
+	if action.headersExpr != nil {
+		var headers map[string]string
+		if diags := gohcl.DecodeExpression(action.headersExpr, evalCtx, &headers); diags.HasErrors() {
+			return fmt.Errorf("http_request: render headers: %w", diags)
+		}
+		for key, value := range headers {
+			http.Header(req.Header).Set(key, value)
+		}
+	}
+	if action.bodyExpr != nil {
+		body, isJSON, err := renderHTTPRequestBody(action.bodyExpr, evalCtx)
+		if err != nil {
+			return fmt.Errorf("http_request: render body: %w", err)
+		}
+		req.Body = body
+		if isJSON && http.Header(req.Header).Get("Content-Type") == "" {
+			http.Header(req.Header).Set("Content-Type", "application/json")
+		}
+	}
+	slog.DebugContext(ctx, "dump http_request", "method", req.Method, "url", req.URL, "body", req.Body)
+	u.AddHTTPRequest(req)
+	return nil
+}
+
+// renderHTTPRequestBody renders the body, the string is sent as is and the other values are encoded as JSON.
+func renderHTTPRequestBody(expr hcl.Expression, evalCtx *hcl.EvalContext) (string, bool, error) {
+	value, diags := expr.Value(evalCtx)
+	if diags.HasErrors() {
+		return "", false, diags
+	}
+	if !value.IsWhollyKnown() {
+		return "", false, errors.New("body is unknown")
+	}
+	if value.IsNull() {
+		return "", false, nil
+	}
+	if value.Type() == cty.String {
+		return value.AsString(), false, nil
+	}
+	bs, err := ctyjson.SimpleJSONValue{Value: value}.MarshalJSON()
+	if err != nil {
+		return "", false, err
+	}
+	return string(bs), true, nil
+}
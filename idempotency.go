@@ -0,0 +1,355 @@
+package prepalert
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+)
+
+const (
+	// DefaultIdempotencyTTL is the default duration to remember the processed webhooks.
+	DefaultIdempotencyTTL = 24 * time.Hour
+
+	idempotencyStoreTypeMemory   = "memory"
+	idempotencyStoreTypeFile     = "file"
+	idempotencyStoreTypeDynamoDB = "dynamodb"
+)
+
+// IdempotencyStore records the processed webhooks, to skip the duplicate deliveries of SQS.
+type IdempotencyStore interface {
+	// Exists returns true if the key is recorded and not expired.
+	Exists(ctx context.Context, key string) (bool, error)
+	// Put records the key until expiresAt.
+	Put(ctx context.Context, key string, expiresAt time.Time) error
+}
+
+// idempotencyKey returns the key of the webhook, redelivered messages have the same request id.
+func idempotencyKey(body *WebhookBody, requestID string) string {
+	if requestID == "" {
+		return ""
+	}
+	switch {
+	case body.Alert != nil:
+		return strings.Join([]string{body.Alert.ID, body.Alert.Status, requestID}, "/")
+	case body.AlertGroup != nil:
+		return strings.Join([]string{body.Event, body.AlertGroup.ID, body.AlertGroup.Status, requestID}, "/")
+	case body.Host != nil:
+		return strings.Join([]string{body.Event, body.Host.ID, requestID}, "/")
+	case body.Monitor != nil:
+		return strings.Join([]string{body.Event, body.Monitor.ID, requestID}, "/")
+	}
+	return ""
+}
+
+func (app *App) SetupIdempotencyStore(block *hcl.Block) hcl.Diagnostics {
+	storeType := block.Labels[0]
+	schema := &hcl.BodySchema{
+		Attributes: []hcl.AttributeSchema{
+			{
+				Name: "ttl",
+			},
+		},
+	}
+	switch storeType {
+	case idempotencyStoreTypeMemory:
+	case idempotencyStoreTypeFile:
+		schema.Attributes = append(schema.Attributes, hcl.AttributeSchema{
+			Name:     "path",
+			Required: true,
+		})
+	case idempotencyStoreTypeDynamoDB:
+		schema.Attributes = append(schema.Attributes, hcl.AttributeSchema{
+			Name:     "table_name",
+			Required: true,
+		})
+	default:
+		return hcl.Diagnostics{{
+			Severity: hcl.DiagError,
+			Summary:  `idempotency block validation`,
+			Detail:   fmt.Sprintf("idempotency store type %q is not supported, allows [memory, file, dynamodb]", storeType),
+			Subject:  block.LabelRanges[0].Ptr(),
+		}}
+	}
+	content, diags := block.Body.Content(schema)
+	if diags.HasErrors() {
+		return diags
+	}
+	ttl := DefaultIdempotencyTTL
+	var path, tableName string
+	for name, attr := range content.Attributes {
+		switch name {
+		case "ttl":
+			d, durationDiags := decodeDurationExpression(attr.Expr, app.evalCtx)
+			diags = diags.Extend(durationDiags)
+			if d <= 0 {
+				diags = diags.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  `idempotency block validation`,
+					Detail:   "ttl must be greater than 0",
+					Subject:  attr.Expr.Range().Ptr(),
+				})
+				continue
+			}
+			ttl = d
+		case "path":
+			diags = diags.Extend(gohcl.DecodeExpression(attr.Expr, app.evalCtx, &path))
+		case "table_name":
+			diags = diags.Extend(gohcl.DecodeExpression(attr.Expr, app.evalCtx, &tableName))
+		}
+	}
+	if diags.HasErrors() {
+		return diags
+	}
+	var store IdempotencyStore
+	switch storeType {
+	case idempotencyStoreTypeMemory:
+		store = NewMemoryIdempotencyStore()
+	case idempotencyStoreTypeFile:
+		fileStore, err := NewFileIdempotencyStore(path)
+		if err != nil {
+			return diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  `idempotency block validation`,
+				Detail:   err.Error(),
+				Subject:  content.Attributes["path"].Expr.Range().Ptr(),
+			})
+		}
+		store = fileStore
+	case idempotencyStoreTypeDynamoDB:
+		client := GlobalDynamoDBClient
+		if client == nil {
+			awsCfg, err := config.LoadDefaultConfig(context.Background())
+			if err != nil {
+				return diags.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "DynamoDB idempotency store initialization failed",
+					Detail:   fmt.Sprintf("can not create aws config: %v", err.Error()),
+					Subject:  block.DefRange.Ptr(),
+				})
+			}
+			client = dynamodb.NewFromConfig(awsCfg)
+		}
+		store = NewDynamoDBIdempotencyStore(client, tableName)
+	}
+	app.idempotencyStore = store
+	app.idempotencyTTL = ttl
+	return diags
+}
+
+type idempotencyKeyContextKey struct{}
+
+// withIdempotencyKey returns the context with the idempotency key of the webhook, which the outbound actions are recorded under.
+func withIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyContextKey{}, key)
+}
+
+func idempotencyKeyFromContext(ctx context.Context) string {
+	key, _ := ctx.Value(idempotencyKeyContextKey{}).(string)
+	return key
+}
+
+// checkProcessed returns true if the webhook was already processed successfully.
+// store errors are logged and ignored, the webhook is processed again in that case.
+func (app *App) checkProcessed(ctx context.Context, key string) bool {
+	if app.idempotencyStore == nil || key == "" {
+		return false
+	}
+	exists, err := app.idempotencyStore.Exists(ctx, key)
+	if err != nil {
+		slog.WarnContext(ctx, "failed to check idempotency store, process the webhook", "error", err.Error())
+		return false
+	}
+	return exists
+}
+
+func (app *App) markProcessed(ctx context.Context, key string) {
+	if app.idempotencyStore == nil || key == "" {
+		return
+	}
+	if err := app.idempotencyStore.Put(ctx, key, flextime.Now().Add(app.idempotencyTTL)); err != nil {
+		slog.WarnContext(ctx, "failed to record to idempotency store, the webhook may be processed again on redelivery", "error", err.Error())
+	}
+}
+
+// MemoryIdempotencyStore is an in-process IdempotencyStore.
+type MemoryIdempotencyStore struct {
+	mu      sync.Mutex
+	expires map[string]time.Time
+}
+
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{
+		expires: make(map[string]time.Time),
+	}
+}
+
+func (s *MemoryIdempotencyStore) Exists(_ context.Context, key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expiresAt, ok := s.expires[key]
+	if !ok {
+		return false, nil
+	}
+	if !flextime.Now().Before(expiresAt) {
+		delete(s.expires, key)
+		return false, nil
+	}
+	return true, nil
+}
+
+func (s *MemoryIdempotencyStore) Put(_ context.Context, key string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := flextime.Now()
+	for k, v := range s.expires {
+		if !now.Before(v) {
+			delete(s.expires, k)
+		}
+	}
+	s.expires[key] = expiresAt
+	return nil
+}
+
+// FileIdempotencyStore is an IdempotencyStore on local disk, each key is a file which has the expiration unix time.
+// the file is written to a unique temporary file and renamed, so the concurrent writers never see a partial file.
+type FileIdempotencyStore struct {
+	mu  sync.Mutex
+	dir string
+}
+
+func NewFileIdempotencyStore(dir string) (*FileIdempotencyStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create idempotency store dir: %w", err)
+	}
+	return &FileIdempotencyStore{dir: dir}, nil
+}
+
+func (s *FileIdempotencyStore) keyPath(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:]))
+}
+
+func (s *FileIdempotencyStore) Exists(_ context.Context, key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := s.keyPath(key)
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	expiresAt, err := strconv.ParseInt(strings.TrimSpace(string(bs)), 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if flextime.Now().Unix() >= expiresAt {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return false, err
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+func (s *FileIdempotencyStore) Put(_ context.Context, key string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := s.keyPath(key)
+	tmp, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(strconv.FormatInt(expiresAt.Unix(), 10)); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write %s: %w", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close %s: %w", tmp.Name(), err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+type DynamoDBClient interface {
+	GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error)
+}
+
+var GlobalDynamoDBClient DynamoDBClient
+
+// DynamoDBIdempotencyStore is an IdempotencyStore on DynamoDB table.
+// the table has the string partition key "key", and "expires_at" is the unix time which can be used as DynamoDB TTL attribute.
+type DynamoDBIdempotencyStore struct {
+	client    DynamoDBClient
+	tableName string
+}
+
+func NewDynamoDBIdempotencyStore(client DynamoDBClient, tableName string) *DynamoDBIdempotencyStore {
+	return &DynamoDBIdempotencyStore{
+		client:    client,
+		tableName: tableName,
+	}
+}
+
+func (s *DynamoDBIdempotencyStore) Exists(ctx context.Context, key string) (bool, error) {
+	output, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.tableName),
+		Key: map[string]types.AttributeValue{
+			"key": &types.AttributeValueMemberS{Value: key},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return false, fmt.Errorf("get item from %s: %w", s.tableName, err)
+	}
+	if output.Item == nil {
+		return false, nil
+	}
+	// DynamoDB TTL deletes expired items lazily, so check the expiration here.
+	attr, ok := output.Item["expires_at"].(*types.AttributeValueMemberN)
+	if !ok {
+		return false, nil
+	}
+	expiresAt, err := strconv.ParseInt(attr.Value, 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("parse expires_at: %w", err)
+	}
+	return flextime.Now().Unix() < expiresAt, nil
+}
+
+func (s *DynamoDBIdempotencyStore) Put(ctx context.Context, key string, expiresAt time.Time) error {
+	_, err := s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.tableName),
+		Item: map[string]types.AttributeValue{
+			"key":        &types.AttributeValueMemberS{Value: key},
+			"expires_at": &types.AttributeValueMemberN{Value: strconv.FormatInt(expiresAt.Unix(), 10)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("put item to %s: %w", s.tableName, err)
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package prepalert_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/mackerelio/mackerel-client-go"
+	"github.com/mashiike/canyon/canyontest"
+	"github.com/mashiike/prepalert"
+	"github.com/mashiike/prepalert/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+)
+
+// fakeDynamoDBClient keeps items by the "key" attribute.
+// the condition expressions of the memo lock are emulated.
+type fakeDynamoDBClient struct {
+	mu    sync.Mutex
+	items map[string]map[string]types.AttributeValue
+}
+
+func (c *fakeDynamoDBClient) GetItem(_ context.Context, params *dynamodb.GetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := params.Key["key"].(*types.AttributeValueMemberS).Value
+	return &dynamodb.GetItemOutput{Item: c.items[aws.ToString(params.TableName)+"/"+key]}, nil
+}
+
+func (c *fakeDynamoDBClient) PutItem(_ context.Context, params *dynamodb.PutItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.items == nil {
+		c.items = make(map[string]map[string]types.AttributeValue)
+	}
+	key := aws.ToString(params.TableName) + "/" + params.Item["key"].(*types.AttributeValueMemberS).Value
+	if owner, ok := params.ExpressionAttributeValues[":owner"]; ok {
+		item, ok := c.items[key]
+		if !ok || item["owner"].(*types.AttributeValueMemberS).Value != owner.(*types.AttributeValueMemberS).Value {
+			return nil, &types.ConditionalCheckFailedException{}
+		}
+	} else if params.ConditionExpression != nil {
+		if item, ok := c.items[key]; ok {
+			now := params.ExpressionAttributeValues[":now"].(*types.AttributeValueMemberN).Value
+			if item["expires_at"].(*types.AttributeValueMemberN).Value >= now {
+				return nil, &types.ConditionalCheckFailedException{}
+			}
+		}
+	}
+	c.items[key] = params.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (c *fakeDynamoDBClient) DeleteItem(_ context.Context, params *dynamodb.DeleteItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := aws.ToString(params.TableName) + "/" + params.Key["key"].(*types.AttributeValueMemberS).Value
+	if params.ConditionExpression != nil {
+		owner := params.ExpressionAttributeValues[":owner"].(*types.AttributeValueMemberS).Value
+		item, ok := c.items[key]
+		if !ok || item["owner"].(*types.AttributeValueMemberS).Value != owner {
+			return nil, &types.ConditionalCheckFailedException{}
+		}
+	}
+	delete(c.items, key)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+func TestIdempotencyStore(t *testing.T) {
+	fileStore, err := prepalert.NewFileIdempotencyStore(t.TempDir())
+	require.NoError(t, err)
+	cases := []struct {
+		name  string
+		store prepalert.IdempotencyStore
+	}{
+		{"memory", prepalert.NewMemoryIdempotencyStore()},
+		{"file", fileStore},
+		{"dynamodb", prepalert.NewDynamoDBIdempotencyStore(&fakeDynamoDBClient{}, "prepalert-idempotency")},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			now := time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC)
+			restore := flextime.Fix(now)
+			defer restore()
+			ctx := context.Background()
+
+			exists, err := c.store.Exists(ctx, "2bj.../critical/1")
+			require.NoError(t, err)
+			require.False(t, exists)
+
+			require.NoError(t, c.store.Put(ctx, "2bj.../critical/1", now.Add(time.Hour)))
+			exists, err = c.store.Exists(ctx, "2bj.../critical/1")
+			require.NoError(t, err)
+			require.True(t, exists)
+			exists, err = c.store.Exists(ctx, "2bj.../ok/1")
+			require.NoError(t, err)
+			require.False(t, exists)
+
+			flextime.Fix(now.Add(time.Hour))
+			exists, err = c.store.Exists(ctx, "2bj.../critical/1")
+			require.NoError(t, err)
+			require.False(t, exists, "expired")
+		})
+	}
+}
+
+func TestFileIdempotencyStore__ConcurrentPut(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	expiresAt := time.Now().Add(time.Hour)
+	stores := make([]*prepalert.FileIdempotencyStore, 2)
+	for i := range stores {
+		var err error
+		stores[i], err = prepalert.NewFileIdempotencyStore(dir)
+		require.NoError(t, err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(store prepalert.IdempotencyStore) {
+			defer wg.Done()
+			require.NoError(t, store.Put(ctx, "2bj.../critical/1", expiresAt))
+			exists, err := store.Exists(ctx, "2bj.../critical/1")
+			require.NoError(t, err)
+			require.True(t, exists)
+		}(stores[i%len(stores)])
+	}
+	wg.Wait()
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "no temporary file is left")
+}
+
+func TestAppLoadConfig__WithIdempotency(t *testing.T) {
+	app := LoadApp(t, "testdata/config/with_idempotency.hcl")
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	client := mock.NewMockMackerelClient(ctrl)
+	client.EXPECT().GetAlert("2bj...").Return(&mackerel.Alert{ID: "2bj..."}, nil).AnyTimes()
+	client.EXPECT().UpdateAlert("2bj...", gomock.Any()).Return(&mackerel.UpdateAlertResponse{}, nil).Times(2)
+	app.SetMackerelClient(client)
+
+	h := canyontest.AsWorker(app)
+	serve := func(requestID string) {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPost, "/", LoadFileAsReader(t, "example_webhook.json"))
+		r.Header.Set(prepalert.HeaderRequestID, requestID)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	}
+	serve("1234567890")
+	serve("1234567890") // redelivery, skip
+	serve("1234567891") // another webhook
+}
+
+func TestAppWorker__IdempotencySentNotifications(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	webhookFailures := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, r.URL.Path)
+		if r.URL.Path == "/webhook" && webhookFailures > 0 {
+			webhookFailures--
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	t.Setenv("SLACK_WEBHOOK_URL", server.URL+"/slack")
+	t.Setenv("NOTIFY_WEBHOOK_URL", server.URL+"/webhook")
+	app := LoadApp(t, "testdata/config/with_notify_idempotency.hcl")
+
+	h := canyontest.AsWorker(app)
+	serve := func(requestID string) int {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPost, "/", LoadFileAsReader(t, "example_webhook.json"))
+		r.Header.Set(prepalert.HeaderRequestID, requestID)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Result().StatusCode
+	}
+	require.Equal(t, http.StatusInternalServerError, serve("1234567890"))
+	require.Equal(t, []string{"/slack", "/webhook"}, requests)
+	require.Equal(t, http.StatusOK, serve("1234567890"), "redelivery sends only the failed notification")
+	require.Equal(t, []string{"/slack", "/webhook", "/webhook"}, requests)
+	require.Equal(t, http.StatusOK, serve("1234567890"), "processed, skip")
+	require.Equal(t, []string{"/slack", "/webhook", "/webhook"}, requests)
+}
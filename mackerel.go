@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -25,6 +26,17 @@ type MackerelClient interface {
 	GetAlert(string) (*mackerel.Alert, error)
 	GetMonitor(string) (mackerel.Monitor, error)
 	FindHost(id string) (*mackerel.Host, error)
+	FetchHostMetricValues(hostID string, metricName string, from int64, to int64) ([]mackerel.MetricValue, error)
+	FetchServiceMetricValues(serviceName string, metricName string, from int64, to int64) ([]mackerel.MetricValue, error)
+	FindAlerts() (*mackerel.AlertsResp, error)
+	FindAlertsByNextID(nextID string) (*mackerel.AlertsResp, error)
+	FindWithClosedAlerts() (*mackerel.AlertsResp, error)
+	FindWithClosedAlertsByNextID(nextID string) (*mackerel.AlertsResp, error)
+	GetAlertGroupSetting(id string) (*mackerel.AlertGroupSetting, error)
+	CloseAlert(alertID string, reason string) (*mackerel.Alert, error)
+	FindDowntimes() ([]*mackerel.Downtime, error)
+	CreateDowntime(param *mackerel.Downtime) (*mackerel.Downtime, error)
+	PostServiceMetricValues(serviceName string, metricValues []*mackerel.MetricValue) error
 }
 
 type MackerelService struct {
@@ -35,6 +47,13 @@ type MackerelService struct {
 	monitorCacheMu  sync.Mutex
 	monitorCache    map[string]mackerel.Monitor
 	monitorCachedAt map[string]time.Time
+	hostCacheMu     sync.Mutex
+	hostCache       map[string]*mackerel.Host
+	hostCachedAt    map[string]time.Time
+	alertsCacheMu   sync.Mutex
+	alertsCache     map[string][]*mackerel.Alert
+	alertsCachedAt  map[string]time.Time
+	downtimeMu      sync.Mutex
 }
 
 func NewMackerelService(client MackerelClient) *MackerelService {
@@ -44,6 +63,10 @@ func NewMackerelService(client MackerelClient) *MackerelService {
 		alertCachedAt:   make(map[string]time.Time),
 		monitorCache:    make(map[string]mackerel.Monitor),
 		monitorCachedAt: make(map[string]time.Time),
+		hostCache:       make(map[string]*mackerel.Host),
+		hostCachedAt:    make(map[string]time.Time),
+		alertsCache:     make(map[string][]*mackerel.Alert),
+		alertsCachedAt:  make(map[string]time.Time),
 	}
 }
 
@@ -73,6 +96,29 @@ func (svc *MackerelService) UpdateAlertMemo(ctx context.Context, alertID string,
 	return nil
 }
 
+// CloseAlert closes the alert with the reason, and marks the cached alert as closed.
+func (svc *MackerelService) CloseAlert(ctx context.Context, alertID string, reason string) error {
+	alert, err := svc.client.CloseAlert(alertID, reason)
+	if err != nil {
+		return fmt.Errorf("close alert: %w", err)
+	}
+	slog.InfoContext(
+		ctx,
+		"closed alert",
+		"alert_id", alertID,
+	)
+	svc.alertCacheMu.Lock()
+	defer svc.alertCacheMu.Unlock()
+	if alert != nil {
+		svc.alertCache[alertID] = alert
+		svc.alertCachedAt[alertID] = flextime.Now()
+	} else {
+		delete(svc.alertCache, alertID)
+		delete(svc.alertCachedAt, alertID)
+	}
+	return nil
+}
+
 const (
 	FindGraphAnnotationOffset = int64(15 * time.Minute / time.Second)
 )
@@ -121,15 +167,162 @@ func (svc *MackerelService) PostGraphAnnotation(ctx context.Context, params *mac
 	return nil
 }
 
+func (svc *MackerelService) PostServiceMetricValues(ctx context.Context, serviceName string, values []*mackerel.MetricValue) error {
+	if err := svc.client.PostServiceMetricValues(serviceName, values); err != nil {
+		return fmt.Errorf("post service metric values: %w", err)
+	}
+	slog.InfoContext(
+		ctx,
+		"posted service metric values",
+		"service", serviceName,
+		"count", len(values),
+	)
+	return nil
+}
+
+func (svc *MackerelService) FetchHostMetricValues(ctx context.Context, hostID string, metricName string, from int64, to int64) ([]mackerel.MetricValue, error) {
+	slog.DebugContext(ctx, "fetch host metric values", "host_id", hostID, "metric_name", metricName, "from", from, "to", to)
+	values, err := svc.client.FetchHostMetricValues(hostID, metricName, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("fetch host metric values: %w", err)
+	}
+	return values, nil
+}
+
+func (svc *MackerelService) FetchServiceMetricValues(ctx context.Context, serviceName string, metricName string, from int64, to int64) ([]mackerel.MetricValue, error) {
+	slog.DebugContext(ctx, "fetch service metric values", "service_name", serviceName, "metric_name", metricName, "from", from, "to", to)
+	values, err := svc.client.FetchServiceMetricValues(serviceName, metricName, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("fetch service metric values: %w", err)
+	}
+	return values, nil
+}
+
+// WalkAlerts pages through alerts from the newest one, and calls fn for each alert until fn returns false.
+func (svc *MackerelService) WalkAlerts(ctx context.Context, withClosed bool, fn func(*mackerel.Alert) bool) error {
+	return svc.walkAlerts(ctx, withClosed, 0, fn)
+}
+
+// walkAlerts is WalkAlerts which stops after maxPages pages, 0 means no limit.
+func (svc *MackerelService) walkAlerts(ctx context.Context, withClosed bool, maxPages int, fn func(*mackerel.Alert) bool) error {
+	var nextID string
+	for page := 1; ; page++ {
+		var resp *mackerel.AlertsResp
+		var err error
+		switch {
+		case withClosed && nextID == "":
+			resp, err = svc.client.FindWithClosedAlerts()
+		case withClosed:
+			resp, err = svc.client.FindWithClosedAlertsByNextID(nextID)
+		case nextID == "":
+			resp, err = svc.client.FindAlerts()
+		default:
+			resp, err = svc.client.FindAlertsByNextID(nextID)
+		}
+		if err != nil {
+			return fmt.Errorf("find alerts: %w", err)
+		}
+		slog.DebugContext(ctx, "find alerts", "page", page, "count", len(resp.Alerts), "next_id", resp.NextID)
+		for _, alert := range resp.Alerts {
+			if !fn(alert) {
+				return nil
+			}
+		}
+		if resp.NextID == "" {
+			return nil
+		}
+		if maxPages > 0 && page >= maxPages {
+			slog.WarnContext(ctx, "stop finding alerts, reached the max pages", "max_pages", maxPages, "next_id", resp.NextID)
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		nextID = resp.NextID
+	}
+}
+
+// FindAlertsOpenedBetweenWithCache returns alerts opened between from and to, newest first.
+// the alerts are scanned up to maxPages pages, 0 means no limit.
+// the cache is not locked while scanning, so the concurrent calls with the same arguments may scan the alerts twice.
+func (svc *MackerelService) FindAlertsOpenedBetweenWithCache(ctx context.Context, from int64, to int64, withClosed bool, maxPages int) ([]*mackerel.Alert, error) {
+	key := fmt.Sprintf("%d:%d:%t:%d", from, to, withClosed, maxPages)
+	svc.alertsCacheMu.Lock()
+	if cachedAt, ok := svc.alertsCachedAt[key]; ok && time.Since(cachedAt) < CacheDuration {
+		alerts := svc.alertsCache[key]
+		svc.alertsCacheMu.Unlock()
+		return alerts, nil
+	}
+	svc.alertsCacheMu.Unlock()
+	alerts := make([]*mackerel.Alert, 0)
+	err := svc.walkAlerts(ctx, withClosed, maxPages, func(alert *mackerel.Alert) bool {
+		if alert.OpenedAt < from {
+			return false
+		}
+		if alert.OpenedAt <= to {
+			alerts = append(alerts, alert)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	svc.alertsCacheMu.Lock()
+	defer svc.alertsCacheMu.Unlock()
+	svc.alertsCache[key] = alerts
+	svc.alertsCachedAt[key] = flextime.Now()
+	return alerts, nil
+}
+
+func (svc *MackerelService) FindHostWithCache(ctx context.Context, hostID string) (*mackerel.Host, error) {
+	svc.hostCacheMu.Lock()
+	defer svc.hostCacheMu.Unlock()
+	if cachedAt, ok := svc.hostCachedAt[hostID]; ok && time.Since(cachedAt) < CacheDuration {
+		return svc.hostCache[hostID], nil
+	}
+	host, err := svc.client.FindHost(hostID)
+	if err != nil {
+		return nil, fmt.Errorf("find host:%w", err)
+	}
+	svc.hostCache[hostID] = host
+	svc.hostCachedAt[hostID] = flextime.Now()
+	return host, nil
+}
+
+// Mackerel webhook events, the webhook of the events except alert has no alert.
+const (
+	WebhookEventAlert         = "alert"
+	WebhookEventAlertGroup    = "alertGroup"
+	WebhookEventHostStatus    = "hostStatus"
+	WebhookEventHostRegister  = "hostRegister"
+	WebhookEventHostRetire    = "hostRetire"
+	WebhookEventMonitorCreate = "monitorCreate"
+	WebhookEventMonitorUpdate = "monitorUpdate"
+	WebhookEventMonitorDelete = "monitorDelete"
+)
+
 type WebhookBody struct {
-	OrgName  string   `json:"orgName" cty:"org_name"`
-	Text     string   `json:"text" cty:"-"`
-	Event    string   `json:"event" cty:"event"`
-	ImageURL *string  `json:"imageUrl" cty:"image_url"`
-	Memo     string   `json:"memo" cty:"memo"`
-	Host     *Host    `json:"host,omitempty" cty:"host,omitempty"`
-	Service  *Service `json:"service,omitempty" cty:"service,omitempty"`
-	Alert    *Alert   `json:"alert" cty:"alert,omitempty"`
+	OrgName           string             `json:"orgName" cty:"org_name"`
+	Text              string             `json:"text" cty:"-"`
+	Event             string             `json:"event" cty:"event"`
+	ImageURL          *string            `json:"imageUrl" cty:"image_url"`
+	Memo              string             `json:"memo" cty:"memo"`
+	Host              *Host              `json:"host,omitempty" cty:"host,omitempty"`
+	Service           *Service           `json:"service,omitempty" cty:"service,omitempty"`
+	Alert             *Alert             `json:"alert" cty:"alert,omitempty"`
+	User              *User              `json:"user,omitempty" cty:"user,omitempty"`
+	FromStatus        string             `json:"fromStatus,omitempty" cty:"from_status,omitempty"`
+	Monitor           *Monitor           `json:"monitor,omitempty" cty:"monitor,omitempty"`
+	AlertGroup        *AlertGroup        `json:"alertGroup,omitempty" cty:"alert_group,omitempty"`
+	AlertGroupSetting *AlertGroupSetting `json:"alertGroupSetting,omitempty" cty:"alert_group_setting,omitempty"`
+}
+
+// EventName returns the event of the webhook, the webhook of the old format without event is the alert event.
+func (body *WebhookBody) EventName() string {
+	if body.Event == "" && body.Alert != nil {
+		return WebhookEventAlert
+	}
+	return body.Event
 }
 
 //go:embed example_webhook.json
@@ -149,6 +342,19 @@ func (svc *MackerelService) GetAlertWithCache(ctx context.Context, alertID strin
 	return svc.getAlertWithCache(ctx, alertID)
 }
 
+// GetAlert gets the alert without cache, and refreshes the cache.
+func (svc *MackerelService) GetAlert(_ context.Context, alertID string) (*mackerel.Alert, error) {
+	alert, err := svc.client.GetAlert(alertID)
+	if err != nil {
+		return nil, fmt.Errorf("get alert:%w", err)
+	}
+	svc.alertCacheMu.Lock()
+	defer svc.alertCacheMu.Unlock()
+	svc.alertCache[alertID] = alert
+	svc.alertCachedAt[alertID] = flextime.Now()
+	return alert, nil
+}
+
 func (svc *MackerelService) getAlertWithCache(_ context.Context, alertID string) (*mackerel.Alert, error) {
 	if cachedAt, ok := svc.alertCachedAt[alertID]; ok && time.Since(cachedAt) < CacheDuration {
 		return svc.alertCache[alertID], nil
@@ -336,3 +542,92 @@ type Alert struct {
 	URL               string   `json:"url" cty:"url"`
 	WarningThreshold  *float64 `json:"warningThreshold,omitempty" cty:"warning_threshold,omitempty"`
 }
+
+// User is the user who operated the host or the monitor.
+type User struct {
+	ScreenName string `json:"screenName" cty:"screen_name"`
+}
+
+// Monitor is the monitor of monitorCreate, monitorUpdate and monitorDelete events, only common fields of the monitor types.
+type Monitor struct {
+	ID   string `json:"id" cty:"id"`
+	Name string `json:"name" cty:"name"`
+	Type string `json:"type" cty:"type"`
+	Memo string `json:"memo" cty:"memo"`
+}
+
+// AlertGroup is the alert group of alertGroup events.
+// createdAt is unix milliseconds as alert.createdAt.
+type AlertGroup struct {
+	ID           string             `json:"id" cty:"id"`
+	Status       string             `json:"status" cty:"status"`
+	MonitorCount int64              `json:"monitorCount" cty:"monitor_count"`
+	CreatedAt    int64              `json:"createdAt" cty:"created_at"`
+	ClosedAt     *int64             `json:"closedAt" cty:"closed_at"`
+	URL          string             `json:"url" cty:"url"`
+	Alerts       []*AlertGroupAlert `json:"alerts,omitempty" cty:"-"`
+}
+
+// AlertGroupAlert is the member alert listed in the alert group payload.
+type AlertGroupAlert struct {
+	ID string `json:"id"`
+}
+
+type AlertGroupSetting struct {
+	ID            string   `json:"id" cty:"id"`
+	Name          string   `json:"name" cty:"name"`
+	Memo          string   `json:"memo" cty:"memo"`
+	ServiceScopes []string `json:"serviceScopes" cty:"service_scopes"`
+	RoleScopes    []string `json:"roleScopes" cty:"role_scopes"`
+	MonitorScopes []string `json:"monitorScopes" cty:"monitor_scopes"`
+}
+
+// CreateDowntime creates the downtime, unless the active downtime with the same name and scopes exists.
+// repeated webhooks of the same alert do not stack the downtimes.
+func (svc *MackerelService) CreateDowntime(ctx context.Context, downtime *mackerel.Downtime) error {
+	svc.downtimeMu.Lock()
+	defer svc.downtimeMu.Unlock()
+	downtimes, err := svc.client.FindDowntimes()
+	if err != nil {
+		return fmt.Errorf("find downtimes: %w", err)
+	}
+	now := flextime.Now().Unix()
+	for _, d := range downtimes {
+		if d.Name != downtime.Name || !sameDowntimeScopes(d, downtime) {
+			continue
+		}
+		if d.Start <= now && now < d.Start+d.Duration*60 {
+			slog.InfoContext(
+				ctx,
+				"downtime is already active, skip create",
+				"downtime_id", d.ID,
+				"downtime_name", d.Name,
+			)
+			return nil
+		}
+	}
+	output, err := svc.client.CreateDowntime(downtime)
+	if err != nil {
+		return fmt.Errorf("create downtime: %w", err)
+	}
+	slog.InfoContext(
+		ctx,
+		"downtime created",
+		"downtime_id", output.ID,
+		"downtime_name", output.Name,
+	)
+	return nil
+}
+
+func sameDowntimeScopes(a, b *mackerel.Downtime) bool {
+	equal := func(x, y []string) bool {
+		x = append([]string{}, x...)
+		y = append([]string{}, y...)
+		sort.Strings(x)
+		sort.Strings(y)
+		return strings.Join(x, "\n") == strings.Join(y, "\n")
+	}
+	return equal(a.ServiceScopes, b.ServiceScopes) &&
+		equal(a.RoleScopes, b.RoleScopes) &&
+		equal(a.MonitorScopes, b.MonitorScopes)
+}
@@ -0,0 +1,258 @@
+package prepalert
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/mackerelio/mackerel-client-go"
+	"github.com/mashiike/prepalert/provider"
+)
+
+const (
+	mackerelAlertsProviderType = "mackerel_alerts"
+	// DefaultMackerelAlertsOffset is the default offset before the alert opened to find past alerts.
+	DefaultMackerelAlertsOffset = 7 * 24 * time.Hour
+	// DefaultMackerelAlertsLimit is the default max number of rows of mackerel_alerts queries.
+	DefaultMackerelAlertsLimit = 100
+)
+
+// MackerelAlertsProvider is a provider that finds past alerts with the Mackerel API.
+type MackerelAlertsProvider struct {
+	app    *App
+	offset time.Duration
+	MackerelAlertsProviderParameter
+}
+
+type MackerelAlertsProviderParameter struct {
+	// Offset is the duration before webhook.alert.opened_at, the default from of queries.
+	// it is a string such as "30m", or seconds such as duration("30m").
+	Offset json.RawMessage `json:"offset,omitempty"`
+}
+
+type MackerelAlertsQuery struct {
+	provider   *MackerelAlertsProvider
+	name       string
+	monitorID  hcl.Expression
+	hostID     hcl.Expression
+	from       hcl.Expression
+	to         hcl.Expression
+	withClosed bool
+	limit      int
+}
+
+func (app *App) newMackerelAlertsProvider(pp *provider.ProviderParameter) (*MackerelAlertsProvider, error) {
+	p := &MackerelAlertsProvider{
+		app:    app,
+		offset: DefaultMackerelAlertsOffset,
+	}
+	if err := json.Unmarshal(pp.Params, &p.MackerelAlertsProviderParameter); err != nil {
+		return nil, fmt.Errorf("failed to parse params: %w", err)
+	}
+	if len(p.Offset) > 0 && string(p.Offset) != "null" {
+		offset, err := decodeDurationJSON(p.Offset)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse offset: %w", err)
+		}
+		if offset < 0 {
+			return nil, errors.New("offset must be positive")
+		}
+		p.offset = offset
+	}
+	return p, nil
+}
+
+func (p *MackerelAlertsProvider) NewQuery(name string, body hcl.Body, evalCtx *hcl.EvalContext) (provider.Query, error) {
+	schema := &hcl.BodySchema{
+		Attributes: []hcl.AttributeSchema{
+			{Name: "monitor_id"},
+			{Name: "host_id"},
+			{Name: "from"},
+			{Name: "to"},
+			{Name: "with_closed"},
+			{Name: "limit"},
+		},
+	}
+	content, diags := body.Content(schema)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	q := &MackerelAlertsQuery{
+		provider:   p,
+		name:       name,
+		withClosed: true,
+		limit:      DefaultMackerelAlertsLimit,
+	}
+	for _, attr := range content.Attributes {
+		switch attr.Name {
+		case "monitor_id":
+			q.monitorID = attr.Expr
+		case "host_id":
+			q.hostID = attr.Expr
+		case "from":
+			q.from = attr.Expr
+		case "to":
+			q.to = attr.Expr
+		case "with_closed":
+			diags = diags.Extend(gohcl.DecodeExpression(attr.Expr, evalCtx, &q.withClosed))
+		case "limit":
+			diags = diags.Extend(gohcl.DecodeExpression(attr.Expr, evalCtx, &q.limit))
+			if !diags.HasErrors() && q.limit <= 0 {
+				return nil, errors.New("limit must be greater than 0")
+			}
+		}
+	}
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	return q, nil
+}
+
+// monitorIDFilter returns monitor id of the query, default is the monitor of webhook.alert.
+// empty string means no monitor filter, when monitor_id is null.
+func (q *MackerelAlertsQuery) monitorIDFilter(ctx context.Context, evalCtx *hcl.EvalContext, body *WebhookBody) (string, error) {
+	if q.monitorID != nil {
+		var monitorID *string
+		if diags := gohcl.DecodeExpression(q.monitorID, evalCtx, &monitorID); diags.HasErrors() {
+			return "", fmt.Errorf("failed to decode monitor_id: %w", diags)
+		}
+		if monitorID == nil {
+			return "", nil
+		}
+		return *monitorID, nil
+	}
+	if body.Alert == nil || body.Alert.ID == "" {
+		return "", errors.New("webhook has no alert, monitor_id is required")
+	}
+	monitor, err := q.provider.app.MackerelService().GetMonitorByAlertID(ctx, body.Alert.ID)
+	if err != nil {
+		return "", err
+	}
+	return monitor.MonitorID(), nil
+}
+
+func (q *MackerelAlertsQuery) timeRange(evalCtx *hcl.EvalContext, body *WebhookBody) (int64, int64, error) {
+	var from, to int64
+	if q.from != nil {
+		if diags := gohcl.DecodeExpression(q.from, evalCtx, &from); diags.HasErrors() {
+			return 0, 0, fmt.Errorf("failed to decode from: %w", diags)
+		}
+	} else {
+		if body.Alert == nil {
+			return 0, 0, errors.New("webhook has no alert, from is required")
+		}
+		from = body.Alert.OpenedAt - int64(q.provider.offset/time.Second)
+	}
+	if q.to != nil {
+		if diags := gohcl.DecodeExpression(q.to, evalCtx, &to); diags.HasErrors() {
+			return 0, 0, fmt.Errorf("failed to decode to: %w", diags)
+		}
+	} else {
+		if body.Alert == nil {
+			return 0, 0, errors.New("webhook has no alert, to is required")
+		}
+		to = body.Alert.OpenedAt
+	}
+	if from > to {
+		return 0, 0, fmt.Errorf("from must be before to: from=%d to=%d", from, to)
+	}
+	return from, to, nil
+}
+
+func (q *MackerelAlertsQuery) Run(ctx context.Context, evalCtx *hcl.EvalContext) (*provider.QueryResult, error) {
+	body, err := WebhookFromEvalContext(evalCtx)
+	if err != nil {
+		return nil, err
+	}
+	monitorID, err := q.monitorIDFilter(ctx, evalCtx, body)
+	if err != nil {
+		return nil, err
+	}
+	var hostID string
+	if q.hostID != nil {
+		if diags := gohcl.DecodeExpression(q.hostID, evalCtx, &hostID); diags.HasErrors() {
+			return nil, fmt.Errorf("failed to decode host_id: %w", diags)
+		}
+	}
+	from, to, err := q.timeRange(evalCtx, body)
+	if err != nil {
+		return nil, err
+	}
+	alerts := make([]*mackerel.Alert, 0)
+	err = q.provider.app.MackerelService().WalkAlerts(ctx, q.withClosed, func(alert *mackerel.Alert) bool {
+		if alert.OpenedAt < from {
+			// alerts are sorted by newest first
+			return false
+		}
+		if alert.OpenedAt > to {
+			return true
+		}
+		if monitorID != "" && alert.MonitorID != monitorID {
+			return true
+		}
+		if hostID != "" && alert.HostID != hostID {
+			return true
+		}
+		alerts = append(alerts, alert)
+		return len(alerts) < q.limit
+	})
+	if err != nil {
+		return nil, err
+	}
+	qr := &provider.QueryResult{
+		Name:  q.name,
+		Query: "alerts",
+		Params: []interface{}{
+			"monitor_id:" + monitorID,
+			"host_id:" + hostID,
+			time.Unix(from, 0).UTC().Format(time.RFC3339),
+			time.Unix(to, 0).UTC().Format(time.RFC3339),
+		},
+		Columns: []string{"alert_id", "status", "opened_at", "closed_at", "duration", "value"},
+		Rows:    make([][]json.RawMessage, 0, len(alerts)),
+	}
+	for _, alert := range alerts {
+		row, err := mackerelAlertToRow(alert)
+		if err != nil {
+			return nil, err
+		}
+		qr.Rows = append(qr.Rows, row)
+	}
+	slog.DebugContext(ctx, "dump QueryResult", "query_result", qr.ToMarkdownTable())
+	return qr, nil
+}
+
+func mackerelAlertToRow(alert *mackerel.Alert) ([]json.RawMessage, error) {
+	openedAt := time.Unix(alert.OpenedAt, 0)
+	var closedAt interface{}
+	var duration time.Duration
+	if alert.ClosedAt != 0 {
+		closedAt = time.Unix(alert.ClosedAt, 0).UTC().Format(time.RFC3339)
+		duration = time.Unix(alert.ClosedAt, 0).Sub(openedAt)
+	} else {
+		duration = flextime.Now().Sub(openedAt).Truncate(time.Second)
+	}
+	values := []interface{}{
+		alert.ID,
+		alert.Status,
+		openedAt.UTC().Format(time.RFC3339),
+		closedAt,
+		duration.String(),
+		alert.Value,
+	}
+	row := make([]json.RawMessage, 0, len(values))
+	for _, v := range values {
+		bs, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal alert: %w", err)
+		}
+		row = append(row, bs)
+	}
+	return row, nil
+}
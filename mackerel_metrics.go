@@ -0,0 +1,219 @@
+package prepalert
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/mackerelio/mackerel-client-go"
+	"github.com/mashiike/prepalert/provider"
+)
+
+const (
+	mackerelMetricsProviderType = "mackerel_metrics"
+	// DefaultMackerelMetricsOffset is the default offset before the alert opened to fetch metrics.
+	DefaultMackerelMetricsOffset = 30 * time.Minute
+)
+
+var defaultMackerelMetricsToExpr hcl.Expression
+
+func init() {
+	var diags hcl.Diagnostics
+	defaultMackerelMetricsToExpr, diags = hclsyntax.ParseExpression([]byte(`coalesce(webhook.alert.closed_at,now())`), "to.hcl", hcl.Pos{Line: 1, Column: 1})
+	if diags.HasErrors() {
+		panic(diags)
+	}
+}
+
+// MackerelMetricsProvider is a provider that fetches host or service metric values around the alert with the Mackerel API.
+type MackerelMetricsProvider struct {
+	app    *App
+	offset time.Duration
+	MackerelMetricsProviderParameter
+}
+
+type MackerelMetricsProviderParameter struct {
+	// Offset is the duration before webhook.alert.opened_at, the default from of queries.
+	// it is a string such as "30m", or seconds such as duration("30m").
+	Offset json.RawMessage `json:"offset,omitempty"`
+}
+
+type MackerelMetricsQuery struct {
+	provider    *MackerelMetricsProvider
+	name        string
+	metricName  hcl.Expression
+	hostID      hcl.Expression
+	serviceName hcl.Expression
+	from        hcl.Expression
+	to          hcl.Expression
+}
+
+func (app *App) newMackerelMetricsProvider(pp *provider.ProviderParameter) (*MackerelMetricsProvider, error) {
+	p := &MackerelMetricsProvider{
+		app:    app,
+		offset: DefaultMackerelMetricsOffset,
+	}
+	if err := json.Unmarshal(pp.Params, &p.MackerelMetricsProviderParameter); err != nil {
+		return nil, fmt.Errorf("failed to parse params: %w", err)
+	}
+	if len(p.Offset) > 0 && string(p.Offset) != "null" {
+		offset, err := decodeDurationJSON(p.Offset)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse offset: %w", err)
+		}
+		if offset < 0 {
+			return nil, errors.New("offset must be positive")
+		}
+		p.offset = offset
+	}
+	return p, nil
+}
+
+func (p *MackerelMetricsProvider) NewQuery(name string, body hcl.Body, evalCtx *hcl.EvalContext) (provider.Query, error) {
+	schema := &hcl.BodySchema{
+		Attributes: []hcl.AttributeSchema{
+			{Name: "metric_name", Required: true},
+			{Name: "host_id"},
+			{Name: "service_name"},
+			{Name: "from"},
+			{Name: "to"},
+		},
+	}
+	content, diags := body.Content(schema)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	q := &MackerelMetricsQuery{
+		provider: p,
+		name:     name,
+		to:       defaultMackerelMetricsToExpr,
+	}
+	for _, attr := range content.Attributes {
+		switch attr.Name {
+		case "metric_name":
+			q.metricName = attr.Expr
+		case "host_id":
+			q.hostID = attr.Expr
+		case "service_name":
+			q.serviceName = attr.Expr
+		case "from":
+			q.from = attr.Expr
+		case "to":
+			q.to = attr.Expr
+		}
+	}
+	if q.hostID != nil && q.serviceName != nil {
+		return nil, errors.New("host_id and service_name are exclusive")
+	}
+	return q, nil
+}
+
+// target returns host id or service name of the query, defaults are webhook.host.id and webhook.service.name.
+func (q *MackerelMetricsQuery) target(evalCtx *hcl.EvalContext) (hostID string, serviceName string, err error) {
+	if q.hostID != nil {
+		if diags := gohcl.DecodeExpression(q.hostID, evalCtx, &hostID); diags.HasErrors() {
+			return "", "", fmt.Errorf("failed to decode host_id: %w", diags)
+		}
+		return hostID, "", nil
+	}
+	if q.serviceName != nil {
+		if diags := gohcl.DecodeExpression(q.serviceName, evalCtx, &serviceName); diags.HasErrors() {
+			return "", "", fmt.Errorf("failed to decode service_name: %w", diags)
+		}
+		return "", serviceName, nil
+	}
+	body, err := WebhookFromEvalContext(evalCtx)
+	if err != nil {
+		return "", "", err
+	}
+	switch {
+	case body.Host != nil && body.Host.ID != "":
+		return body.Host.ID, "", nil
+	case body.Service != nil && body.Service.Name != "":
+		return "", body.Service.Name, nil
+	}
+	return "", "", errors.New("webhook has neither host nor service, host_id or service_name is required")
+}
+
+func (q *MackerelMetricsQuery) timeRange(evalCtx *hcl.EvalContext) (int64, int64, error) {
+	var from, to int64
+	if q.from != nil {
+		if diags := gohcl.DecodeExpression(q.from, evalCtx, &from); diags.HasErrors() {
+			return 0, 0, fmt.Errorf("failed to decode from: %w", diags)
+		}
+	} else {
+		body, err := WebhookFromEvalContext(evalCtx)
+		if err != nil {
+			return 0, 0, err
+		}
+		if body.Alert == nil {
+			return 0, 0, errors.New("webhook has no alert, from is required")
+		}
+		from = body.Alert.OpenedAt - int64(q.provider.offset/time.Second)
+	}
+	if diags := gohcl.DecodeExpression(q.to, evalCtx, &to); diags.HasErrors() {
+		return 0, 0, fmt.Errorf("failed to decode to: %w", diags)
+	}
+	if from > to {
+		return 0, 0, fmt.Errorf("from must be before to: from=%d to=%d", from, to)
+	}
+	return from, to, nil
+}
+
+func (q *MackerelMetricsQuery) Run(ctx context.Context, evalCtx *hcl.EvalContext) (*provider.QueryResult, error) {
+	var metricName string
+	if diags := gohcl.DecodeExpression(q.metricName, evalCtx, &metricName); diags.HasErrors() {
+		return nil, fmt.Errorf("failed to decode metric_name: %w", diags)
+	}
+	hostID, serviceName, err := q.target(evalCtx)
+	if err != nil {
+		return nil, err
+	}
+	from, to, err := q.timeRange(evalCtx)
+	if err != nil {
+		return nil, err
+	}
+	svc := q.provider.app.MackerelService()
+	var values []mackerel.MetricValue
+	var target string
+	if hostID != "" {
+		target = "host:" + hostID
+		values, err = svc.FetchHostMetricValues(ctx, hostID, metricName, from, to)
+	} else {
+		target = "service:" + serviceName
+		values, err = svc.FetchServiceMetricValues(ctx, serviceName, metricName, from, to)
+	}
+	if err != nil {
+		return nil, err
+	}
+	qr := &provider.QueryResult{
+		Name:  q.name,
+		Query: metricName,
+		Params: []interface{}{
+			target,
+			time.Unix(from, 0).UTC().Format(time.RFC3339),
+			time.Unix(to, 0).UTC().Format(time.RFC3339),
+		},
+		Columns: []string{"time", "value"},
+		Rows:    make([][]json.RawMessage, 0, len(values)),
+	}
+	for _, v := range values {
+		t, err := json.Marshal(time.Unix(v.Time, 0).UTC().Format(time.RFC3339))
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(v.Value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal metric value: %w", err)
+		}
+		qr.Rows = append(qr.Rows, []json.RawMessage{t, value})
+	}
+	slog.DebugContext(ctx, "dump QueryResult", "query_result", qr.ToMarkdownTable())
+	return qr, nil
+}
@@ -2,6 +2,7 @@ package prepalert_test
 
 import (
 	"context"
+	"errors"
 	"testing"
 	"time"
 
@@ -179,3 +180,114 @@ func TestWebnookBody__MarshalCTYValues(t *testing.T) {
 	  }`
 	require.JSONEq(t, expected, actual)
 }
+
+func TestMackerelService__FindAlertGroupMemberAlerts(t *testing.T) {
+	setting := &mackerel.AlertGroupSetting{
+		ID:            "2sM...",
+		Name:          "Service outage",
+		MonitorScopes: []string{"4gx..."},
+	}
+	t.Run("TimestampUnit", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		body := LoadJSON[prepalert.WebhookBody](t, "testdata/alert_group_webhook.json")
+		// createdAt of the payload is unix milliseconds, the alerts are in unix seconds.
+		createdAt := body.AlertGroup.CreatedAt / 1000
+		require.Equal(t, int64(1700000000), createdAt)
+		client := mock.NewMockMackerelClient(ctrl)
+		client.EXPECT().FindWithClosedAlerts().Return(&mackerel.AlertsResp{
+			Alerts: []*mackerel.Alert{
+				{ID: "after_closed", MonitorID: "4gx...", OpenedAt: createdAt + 700},
+				{ID: "member", MonitorID: "4gx...", OpenedAt: createdAt + 60},
+				{ID: "in_window", MonitorID: "4gx...", OpenedAt: createdAt - 300},
+				{ID: "before_window", MonitorID: "4gx...", OpenedAt: createdAt - 1200},
+			},
+			NextID: "next",
+		}, nil).Times(1)
+		svc := prepalert.NewMackerelService(client)
+		alerts, err := svc.FindAlertGroupMemberAlerts(context.Background(), body.AlertGroup, setting, 10*time.Minute, 5)
+		require.NoError(t, err)
+		ids := make([]string, 0, len(alerts))
+		for _, alert := range alerts {
+			ids = append(ids, alert.ID)
+		}
+		require.Equal(t, []string{"member", "in_window"}, ids)
+	})
+	t.Run("MaxPages", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		body := LoadJSON[prepalert.WebhookBody](t, "testdata/alert_group_webhook.json")
+		client := mock.NewMockMackerelClient(ctrl)
+		client.EXPECT().FindWithClosedAlerts().Return(&mackerel.AlertsResp{
+			Alerts: []*mackerel.Alert{{ID: "member1", MonitorID: "4gx...", OpenedAt: 1700000300}},
+			NextID: "page2",
+		}, nil).Times(1)
+		client.EXPECT().FindWithClosedAlertsByNextID("page2").Return(&mackerel.AlertsResp{
+			Alerts: []*mackerel.Alert{{ID: "member2", MonitorID: "4gx...", OpenedAt: 1700000200}},
+			NextID: "page3",
+		}, nil).Times(1)
+		svc := prepalert.NewMackerelService(client)
+		alerts, err := svc.FindAlertGroupMemberAlerts(context.Background(), body.AlertGroup, setting, 10*time.Minute, 2)
+		require.NoError(t, err)
+		require.Len(t, alerts, 2, "page3 is not scanned")
+	})
+	t.Run("PayloadMembers", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		body := LoadJSON[prepalert.WebhookBody](t, "testdata/alert_group_webhook.json")
+		body.AlertGroup.Alerts = []*prepalert.AlertGroupAlert{{ID: "older"}, {ID: "newer"}}
+		client := mock.NewMockMackerelClient(ctrl)
+		client.EXPECT().GetAlert("older").Return(&mackerel.Alert{ID: "older", OpenedAt: 1700000100}, nil).Times(1)
+		client.EXPECT().GetAlert("newer").Return(&mackerel.Alert{ID: "newer", OpenedAt: 1700000200}, nil).Times(1)
+		svc := prepalert.NewMackerelService(client)
+		alerts, err := svc.FindAlertGroupMemberAlerts(context.Background(), body.AlertGroup, setting, 10*time.Minute, 5)
+		require.NoError(t, err)
+		require.Len(t, alerts, 2)
+		require.Equal(t, "newer", alerts[0].ID, "newest first, the alerts API is not scanned")
+	})
+	t.Run("LookupFailed", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		body := LoadJSON[prepalert.WebhookBody](t, "testdata/alert_group_webhook.json")
+		setting := &mackerel.AlertGroupSetting{
+			ID:            "2sM...",
+			Name:          "Service outage",
+			ServiceScopes: []string{"prod"},
+		}
+		client := mock.NewMockMackerelClient(ctrl)
+		client.EXPECT().FindWithClosedAlerts().Return(&mackerel.AlertsResp{
+			Alerts: []*mackerel.Alert{
+				{ID: "retired", HostID: "retired", OpenedAt: 1700000300},
+				{ID: "member", HostID: "app01", OpenedAt: 1700000200},
+			},
+		}, nil).Times(1)
+		client.EXPECT().FindHost("retired").Return(nil, errors.New("host not found")).Times(1)
+		client.EXPECT().FindHost("app01").Return(&mackerel.Host{ID: "app01", Roles: mackerel.Roles{"prod": []string{"app"}}}, nil).Times(1)
+		svc := prepalert.NewMackerelService(client)
+		alerts, err := svc.FindAlertGroupMemberAlerts(context.Background(), body.AlertGroup, setting, 10*time.Minute, 5)
+		require.NoError(t, err)
+		require.Len(t, alerts, 1)
+		require.Equal(t, "member", alerts[0].ID, "the alert failed to look up is skipped")
+	})
+}
+
+func TestMackerelService__FindAlertsOpenedBetweenWithCache(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	client := mock.NewMockMackerelClient(ctrl)
+	client.EXPECT().FindAlerts().Return(&mackerel.AlertsResp{
+		Alerts: []*mackerel.Alert{{ID: "newer", OpenedAt: 1700000300}},
+		NextID: "page2",
+	}, nil).Times(1)
+	client.EXPECT().FindAlertsByNextID("page2").Return(&mackerel.AlertsResp{
+		Alerts: []*mackerel.Alert{{ID: "older", OpenedAt: 1700000200}},
+		NextID: "page3",
+	}, nil).Times(1)
+	svc := prepalert.NewMackerelService(client)
+	alerts, err := svc.FindAlertsOpenedBetweenWithCache(context.Background(), 1700000000, 1700000600, false, 2)
+	require.NoError(t, err)
+	require.Len(t, alerts, 2, "page3 is not scanned")
+	alerts, err = svc.FindAlertsOpenedBetweenWithCache(context.Background(), 1700000000, 1700000600, false, 2)
+	require.NoError(t, err)
+	require.Len(t, alerts, 2, "cached")
+}
@@ -0,0 +1,302 @@
+package prepalert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+)
+
+const (
+	// DefaultMemoLockLease is the default lease of DynamoDB memo lock, the lock is released after that even if the worker is crashed.
+	// the lease is renewed while the lock is held, so it does not need to exceed the time to update the memo.
+	DefaultMemoLockLease = 30 * time.Second
+	// DefaultMemoLockWait is the default duration to wait for the memo lock.
+	DefaultMemoLockWait = 60 * time.Second
+
+	memoLockTypeMemory   = "memory"
+	memoLockTypeDynamoDB = "dynamodb"
+)
+
+// MemoLocker serializes the read-modify-write of the alert memo by alert id.
+type MemoLocker interface {
+	// Lock blocks until the lock of the alert is acquired or ctx is done.
+	Lock(ctx context.Context, alertID string) (unlock func(context.Context) error, err error)
+}
+
+func (app *App) SetupMemoLock(block *hcl.Block) hcl.Diagnostics {
+	lockType := block.Labels[0]
+	schema := &hcl.BodySchema{
+		Attributes: []hcl.AttributeSchema{
+			{
+				Name: "wait",
+			},
+		},
+	}
+	switch lockType {
+	case memoLockTypeMemory:
+	case memoLockTypeDynamoDB:
+		schema.Attributes = append(schema.Attributes,
+			hcl.AttributeSchema{
+				Name:     "table_name",
+				Required: true,
+			},
+			hcl.AttributeSchema{
+				Name: "lease",
+			},
+		)
+	default:
+		return hcl.Diagnostics{{
+			Severity: hcl.DiagError,
+			Summary:  `memo_lock block validation`,
+			Detail:   fmt.Sprintf("memo lock type %q is not supported, allows [memory, dynamodb]", lockType),
+			Subject:  block.LabelRanges[0].Ptr(),
+		}}
+	}
+	content, diags := block.Body.Content(schema)
+	if diags.HasErrors() {
+		return diags
+	}
+	wait := DefaultMemoLockWait
+	lease := DefaultMemoLockLease
+	var tableName string
+	for name, attr := range content.Attributes {
+		switch name {
+		case "wait", "lease":
+			d, durationDiags := decodeDurationExpression(attr.Expr, app.evalCtx)
+			diags = diags.Extend(durationDiags)
+			if d <= 0 {
+				diags = diags.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  `memo_lock block validation`,
+					Detail:   fmt.Sprintf("%s must be greater than 0", name),
+					Subject:  attr.Expr.Range().Ptr(),
+				})
+				continue
+			}
+			if name == "wait" {
+				wait = d
+			} else {
+				lease = d
+			}
+		case "table_name":
+			diags = diags.Extend(gohcl.DecodeExpression(attr.Expr, app.evalCtx, &tableName))
+		}
+	}
+	if diags.HasErrors() {
+		return diags
+	}
+	switch lockType {
+	case memoLockTypeMemory:
+		app.memoLocker = NewMemoryMemoLocker()
+	case memoLockTypeDynamoDB:
+		client := GlobalDynamoDBClient
+		if client == nil {
+			awsCfg, err := config.LoadDefaultConfig(context.Background())
+			if err != nil {
+				return diags.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "DynamoDB memo lock initialization failed",
+					Detail:   fmt.Sprintf("can not create aws config: %v", err.Error()),
+					Subject:  block.DefRange.Ptr(),
+				})
+			}
+			client = dynamodb.NewFromConfig(awsCfg)
+		}
+		app.memoLocker = NewDynamoDBMemoLocker(client, tableName, lease)
+	}
+	app.memoLockWait = wait
+	return diags
+}
+
+// MemoryMemoLocker is an in-process MemoLocker, for the workers in the same process.
+// the lock of the alert is ref-counted, and removed when no worker holds or waits for it.
+type MemoryMemoLocker struct {
+	mu    sync.Mutex
+	locks map[string]*memoryMemoLock
+}
+
+type memoryMemoLock struct {
+	ch   chan struct{}
+	refs int
+}
+
+func NewMemoryMemoLocker() *MemoryMemoLocker {
+	return &MemoryMemoLocker{
+		locks: make(map[string]*memoryMemoLock),
+	}
+}
+
+func (l *MemoryMemoLocker) Lock(ctx context.Context, alertID string) (func(context.Context) error, error) {
+	l.mu.Lock()
+	lk, ok := l.locks[alertID]
+	if !ok {
+		lk = &memoryMemoLock{ch: make(chan struct{}, 1)}
+		l.locks[alertID] = lk
+	}
+	lk.refs++
+	l.mu.Unlock()
+	select {
+	case lk.ch <- struct{}{}:
+	case <-ctx.Done():
+		l.release(alertID, lk)
+		return nil, fmt.Errorf("wait memo lock of alert %s: %w", alertID, ctx.Err())
+	}
+	var once sync.Once
+	return func(context.Context) error {
+		once.Do(func() {
+			<-lk.ch
+			l.release(alertID, lk)
+		})
+		return nil
+	}, nil
+}
+
+func (l *MemoryMemoLocker) release(alertID string, lk *memoryMemoLock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lk.refs--
+	if lk.refs == 0 {
+		delete(l.locks, alertID)
+	}
+}
+
+// DynamoDBMemoLocker is a MemoLocker with DynamoDB conditional writes, for the workers across processes.
+// the lock item is stored in the same table layout as DynamoDBIdempotencyStore, and expires after the lease.
+// the lease is renewed every third of it until unlock.
+type DynamoDBMemoLocker struct {
+	client          DynamoDBClient
+	tableName       string
+	lease           time.Duration
+	pollingInterval time.Duration
+}
+
+func NewDynamoDBMemoLocker(client DynamoDBClient, tableName string, lease time.Duration) *DynamoDBMemoLocker {
+	if lease <= 0 {
+		lease = DefaultMemoLockLease
+	}
+	return &DynamoDBMemoLocker{
+		client:          client,
+		tableName:       tableName,
+		lease:           lease,
+		pollingInterval: 200 * time.Millisecond,
+	}
+}
+
+func (l *DynamoDBMemoLocker) Lock(ctx context.Context, alertID string) (func(context.Context) error, error) {
+	key := "memo_lock/" + alertID
+	owner := randomHex(16)
+	for {
+		now := flextime.Now()
+		_, err := l.client.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName:           aws.String(l.tableName),
+			Item:                l.lockItem(key, owner, now),
+			ConditionExpression: aws.String("attribute_not_exists(#key) OR expires_at < :now"),
+			ExpressionAttributeNames: map[string]string{
+				"#key": "key",
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+			},
+		})
+		if err == nil {
+			break
+		}
+		var ccf *types.ConditionalCheckFailedException
+		if !errors.As(err, &ccf) {
+			return nil, fmt.Errorf("put memo lock item to %s: %w", l.tableName, err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("wait memo lock of alert %s: %w", alertID, ctx.Err())
+		case <-time.After(l.pollingInterval):
+		}
+	}
+	renewCtx, stopRenew := context.WithCancel(context.WithoutCancel(ctx))
+	renewDone := make(chan struct{})
+	go func() {
+		defer close(renewDone)
+		l.renew(renewCtx, alertID, key, owner)
+	}()
+	return func(ctx context.Context) error {
+		stopRenew()
+		<-renewDone
+		_, err := l.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName: aws.String(l.tableName),
+			Key: map[string]types.AttributeValue{
+				"key": &types.AttributeValueMemberS{Value: key},
+			},
+			ConditionExpression: aws.String("#owner = :owner"),
+			ExpressionAttributeNames: map[string]string{
+				"#owner": "owner",
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":owner": &types.AttributeValueMemberS{Value: owner},
+			},
+		})
+		var ccf *types.ConditionalCheckFailedException
+		if errors.As(err, &ccf) {
+			// lease expired and taken by another worker, nothing to release.
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("delete memo lock item from %s: %w", l.tableName, err)
+		}
+		return nil
+	}, nil
+}
+
+func (l *DynamoDBMemoLocker) lockItem(key string, owner string, now time.Time) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"key":        &types.AttributeValueMemberS{Value: key},
+		"owner":      &types.AttributeValueMemberS{Value: owner},
+		"expires_at": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(l.lease).Unix(), 10)},
+	}
+}
+
+// renew extends the lease of the lock item owned by owner until ctx is done.
+// it gives up if the item is taken by another worker, then the memo may be written concurrently.
+func (l *DynamoDBMemoLocker) renew(ctx context.Context, alertID string, key string, owner string) {
+	ticker := time.NewTicker(max(l.lease/3, time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		_, err := l.client.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName:           aws.String(l.tableName),
+			Item:                l.lockItem(key, owner, flextime.Now()),
+			ConditionExpression: aws.String("#owner = :owner"),
+			ExpressionAttributeNames: map[string]string{
+				"#owner": "owner",
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":owner": &types.AttributeValueMemberS{Value: owner},
+			},
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		var ccf *types.ConditionalCheckFailedException
+		if errors.As(err, &ccf) {
+			slog.WarnContext(ctx, "memo lock is taken by another worker, stop renewing the lease", "alert_id", alertID)
+			return
+		}
+		if err != nil {
+			slog.WarnContext(ctx, "failed to renew the lease of memo lock", "alert_id", alertID, "error", err.Error())
+		}
+	}
+}
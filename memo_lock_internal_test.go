@@ -0,0 +1,41 @@
+package prepalert
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryMemoLocker__ReleaseLocks(t *testing.T) {
+	locker := NewMemoryMemoLocker()
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, err := locker.Lock(ctx, "2bj...")
+			require.NoError(t, err)
+			require.NoError(t, unlock(ctx))
+		}()
+	}
+	wg.Wait()
+	unlock, err := locker.Lock(ctx, "3cd...")
+	require.NoError(t, err)
+	require.NoError(t, unlock(ctx))
+	require.NoError(t, unlock(ctx), "unlock twice is no-op")
+	require.Empty(t, locker.locks, "locks of the released alerts are removed")
+
+	unlock, err = locker.Lock(ctx, "2bj...")
+	require.NoError(t, err)
+	ctxWithTimeout, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	_, err = locker.Lock(ctxWithTimeout, "2bj...")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Equal(t, 1, locker.locks["2bj..."].refs, "the waiter gave up is not counted")
+	require.NoError(t, unlock(ctx))
+	require.Empty(t, locker.locks)
+}
@@ -0,0 +1,182 @@
+package prepalert_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/mackerelio/mackerel-client-go"
+	"github.com/mashiike/canyon/canyontest"
+	"github.com/mashiike/hclutil"
+	"github.com/mashiike/prepalert"
+	"github.com/mashiike/prepalert/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+)
+
+// newSlowMemoClient returns the MackerelClient which keeps the alert memo in memory.
+// GetAlert sleeps to widen the window between read and write of the memo.
+func newSlowMemoClient(t *testing.T, ctrl *gomock.Controller, initialMemo string) (*mock.MockMackerelClient, func() string) {
+	t.Helper()
+	var mu sync.Mutex
+	memo := initialMemo
+	client := mock.NewMockMackerelClient(ctrl)
+	client.EXPECT().GetAlert("2bj...").DoAndReturn(func(id string) (*mackerel.Alert, error) {
+		mu.Lock()
+		current := memo
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		return &mackerel.Alert{ID: id, Memo: current}, nil
+	}).AnyTimes()
+	client.EXPECT().UpdateAlert("2bj...", gomock.Any()).DoAndReturn(func(_ string, param mackerel.UpdateAlertParam) (*mackerel.UpdateAlertResponse, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		memo = param.Memo
+		return &mackerel.UpdateAlertResponse{Memo: param.Memo}, nil
+	}).AnyTimes()
+	return client, func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return memo
+	}
+}
+
+func TestUpdater__ConcurrentFlush(t *testing.T) {
+	cases := []struct {
+		name   string
+		locker prepalert.MemoLocker
+	}{
+		{"memory", prepalert.NewMemoryMemoLocker()},
+		{"dynamodb", prepalert.NewDynamoDBMemoLocker(&fakeDynamoDBClient{}, "prepalert-lock", time.Minute)},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			client, currentMemo := newSlowMemoClient(t, ctrl, "")
+			svc := prepalert.NewMackerelService(client)
+			body := LoadJSON[prepalert.WebhookBody](t, "example_webhook.json")
+
+			var wg sync.WaitGroup
+			errs := make([]error, 4)
+			for i := range errs {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					u := svc.NewMackerelUpdater(&body, prepalert.NewDiscardBackend())
+					u.SetMemoLocker(c.locker, 10*time.Second)
+					u.AddMemoSectionText(fmt.Sprintf("rule.worker%d", i), fmt.Sprintf("written by worker%d", i), nil)
+					errs[i] = u.Flush(context.Background(), hclutil.NewEvalContext())
+				}(i)
+			}
+			wg.Wait()
+			memo := currentMemo()
+			for i, err := range errs {
+				require.NoError(t, err)
+				require.Contains(t, memo, fmt.Sprintf("### rule.worker%d\n\nwritten by worker%d", i, i))
+			}
+			require.Equal(t, 1, strings.Count(memo, "## Prepalert"))
+		})
+	}
+}
+
+func TestUpdater__KeepExternalMemoEdit(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	client, currentMemo := newSlowMemoClient(t, ctrl, "")
+	svc := prepalert.NewMackerelService(client)
+	body := LoadJSON[prepalert.WebhookBody](t, "example_webhook.json")
+
+	// warm up the alert cache with the empty memo.
+	_, err := svc.GetAlertWithCache(context.Background(), "2bj...")
+	require.NoError(t, err)
+	_, err = client.UpdateAlert("2bj...", mackerel.UpdateAlertParam{Memo: "written by human"})
+	require.NoError(t, err)
+
+	u := svc.NewMackerelUpdater(&body, prepalert.NewDiscardBackend())
+	u.SetMemoLocker(prepalert.NewMemoryMemoLocker(), time.Second)
+	u.AddMemoSectionText("rule.hoge", "hogehoge", nil)
+	require.NoError(t, u.Flush(context.Background(), hclutil.NewEvalContext()))
+	require.Equal(t, "written by human\n\n## Prepalert\n### rule.hoge\n\nhogehoge\n", currentMemo())
+}
+
+func TestMemoLocker__Timeout(t *testing.T) {
+	cases := []struct {
+		name   string
+		locker prepalert.MemoLocker
+	}{
+		{"memory", prepalert.NewMemoryMemoLocker()},
+		{"dynamodb", prepalert.NewDynamoDBMemoLocker(&fakeDynamoDBClient{}, "prepalert-lock", time.Minute)},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx := context.Background()
+			unlock, err := c.locker.Lock(ctx, "2bj...")
+			require.NoError(t, err)
+
+			ctxWithTimeout, cancel := context.WithTimeout(ctx, 300*time.Millisecond)
+			defer cancel()
+			_, err = c.locker.Lock(ctxWithTimeout, "2bj...")
+			require.ErrorIs(t, err, context.DeadlineExceeded)
+
+			unlockOther, err := c.locker.Lock(ctx, "3cd...")
+			require.NoError(t, err, "other alert is not locked")
+			require.NoError(t, unlockOther(ctx))
+
+			require.NoError(t, unlock(ctx))
+			unlock, err = c.locker.Lock(ctx, "2bj...")
+			require.NoError(t, err)
+			require.NoError(t, unlock(ctx))
+		})
+	}
+}
+
+func TestDynamoDBMemoLocker__RenewLease(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	restore := flextime.Fix(now)
+	defer restore()
+	locker := prepalert.NewDynamoDBMemoLocker(&fakeDynamoDBClient{}, "prepalert-lock", 300*time.Millisecond)
+	ctx := context.Background()
+	unlock, err := locker.Lock(ctx, "2bj...")
+	require.NoError(t, err)
+
+	// the lease would have expired an hour ago without the renewal.
+	flextime.Fix(now.Add(time.Hour))
+	time.Sleep(300 * time.Millisecond)
+	ctxWithTimeout, cancel := context.WithTimeout(ctx, 300*time.Millisecond)
+	defer cancel()
+	_, err = locker.Lock(ctxWithTimeout, "2bj...")
+	require.ErrorIs(t, err, context.DeadlineExceeded, "the lease is renewed")
+
+	require.NoError(t, unlock(ctx))
+	unlock, err = locker.Lock(ctx, "2bj...")
+	require.NoError(t, err)
+	require.NoError(t, unlock(ctx))
+}
+
+func TestAppLoadConfig__WithMemoLock(t *testing.T) {
+	dynamoDBClient := &fakeDynamoDBClient{}
+	prepalert.GlobalDynamoDBClient = dynamoDBClient
+	defer func() {
+		prepalert.GlobalDynamoDBClient = nil
+	}()
+	app := LoadApp(t, "testdata/config/with_memo_lock.hcl")
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	client, currentMemo := newSlowMemoClient(t, ctrl, "")
+	app.SetMackerelClient(client)
+
+	h := canyontest.AsWorker(app)
+	r := httptest.NewRequest(http.MethodPost, "/", LoadFileAsReader(t, "example_webhook.json"))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Contains(t, currentMemo(), "How do you respond to alerts?")
+	require.Empty(t, dynamoDBClient.items, "lock is released")
+}
@@ -34,6 +34,36 @@ func (m *MockMackerelClient) EXPECT() *MockMackerelClientMockRecorder {
 	return m.recorder
 }
 
+// CloseAlert mocks base method.
+func (m *MockMackerelClient) CloseAlert(alertID, reason string) (*mackerel.Alert, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CloseAlert", alertID, reason)
+	ret0, _ := ret[0].(*mackerel.Alert)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CloseAlert indicates an expected call of CloseAlert.
+func (mr *MockMackerelClientMockRecorder) CloseAlert(alertID, reason interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CloseAlert", reflect.TypeOf((*MockMackerelClient)(nil).CloseAlert), alertID, reason)
+}
+
+// CreateDowntime mocks base method.
+func (m *MockMackerelClient) CreateDowntime(param *mackerel.Downtime) (*mackerel.Downtime, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateDowntime", param)
+	ret0, _ := ret[0].(*mackerel.Downtime)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CreateDowntime indicates an expected call of CreateDowntime.
+func (mr *MockMackerelClientMockRecorder) CreateDowntime(param interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateDowntime", reflect.TypeOf((*MockMackerelClient)(nil).CreateDowntime), param)
+}
+
 // CreateGraphAnnotation mocks base method.
 func (m *MockMackerelClient) CreateGraphAnnotation(annotation *mackerel.GraphAnnotation) (*mackerel.GraphAnnotation, error) {
 	m.ctrl.T.Helper()
@@ -49,6 +79,81 @@ func (mr *MockMackerelClientMockRecorder) CreateGraphAnnotation(annotation inter
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateGraphAnnotation", reflect.TypeOf((*MockMackerelClient)(nil).CreateGraphAnnotation), annotation)
 }
 
+// FetchHostMetricValues mocks base method.
+func (m *MockMackerelClient) FetchHostMetricValues(hostID, metricName string, from, to int64) ([]mackerel.MetricValue, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FetchHostMetricValues", hostID, metricName, from, to)
+	ret0, _ := ret[0].([]mackerel.MetricValue)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FetchHostMetricValues indicates an expected call of FetchHostMetricValues.
+func (mr *MockMackerelClientMockRecorder) FetchHostMetricValues(hostID, metricName, from, to interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FetchHostMetricValues", reflect.TypeOf((*MockMackerelClient)(nil).FetchHostMetricValues), hostID, metricName, from, to)
+}
+
+// FetchServiceMetricValues mocks base method.
+func (m *MockMackerelClient) FetchServiceMetricValues(serviceName, metricName string, from, to int64) ([]mackerel.MetricValue, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FetchServiceMetricValues", serviceName, metricName, from, to)
+	ret0, _ := ret[0].([]mackerel.MetricValue)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FetchServiceMetricValues indicates an expected call of FetchServiceMetricValues.
+func (mr *MockMackerelClientMockRecorder) FetchServiceMetricValues(serviceName, metricName, from, to interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FetchServiceMetricValues", reflect.TypeOf((*MockMackerelClient)(nil).FetchServiceMetricValues), serviceName, metricName, from, to)
+}
+
+// FindAlerts mocks base method.
+func (m *MockMackerelClient) FindAlerts() (*mackerel.AlertsResp, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FindAlerts")
+	ret0, _ := ret[0].(*mackerel.AlertsResp)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FindAlerts indicates an expected call of FindAlerts.
+func (mr *MockMackerelClientMockRecorder) FindAlerts() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindAlerts", reflect.TypeOf((*MockMackerelClient)(nil).FindAlerts))
+}
+
+// FindAlertsByNextID mocks base method.
+func (m *MockMackerelClient) FindAlertsByNextID(nextID string) (*mackerel.AlertsResp, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FindAlertsByNextID", nextID)
+	ret0, _ := ret[0].(*mackerel.AlertsResp)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FindAlertsByNextID indicates an expected call of FindAlertsByNextID.
+func (mr *MockMackerelClientMockRecorder) FindAlertsByNextID(nextID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindAlertsByNextID", reflect.TypeOf((*MockMackerelClient)(nil).FindAlertsByNextID), nextID)
+}
+
+// FindDowntimes mocks base method.
+func (m *MockMackerelClient) FindDowntimes() ([]*mackerel.Downtime, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FindDowntimes")
+	ret0, _ := ret[0].([]*mackerel.Downtime)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FindDowntimes indicates an expected call of FindDowntimes.
+func (mr *MockMackerelClientMockRecorder) FindDowntimes() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindDowntimes", reflect.TypeOf((*MockMackerelClient)(nil).FindDowntimes))
+}
+
 // FindGraphAnnotations mocks base method.
 func (m *MockMackerelClient) FindGraphAnnotations(service string, from, to int64) ([]*mackerel.GraphAnnotation, error) {
 	m.ctrl.T.Helper()
@@ -79,6 +184,36 @@ func (mr *MockMackerelClientMockRecorder) FindHost(id interface{}) *gomock.Call
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindHost", reflect.TypeOf((*MockMackerelClient)(nil).FindHost), id)
 }
 
+// FindWithClosedAlerts mocks base method.
+func (m *MockMackerelClient) FindWithClosedAlerts() (*mackerel.AlertsResp, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FindWithClosedAlerts")
+	ret0, _ := ret[0].(*mackerel.AlertsResp)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FindWithClosedAlerts indicates an expected call of FindWithClosedAlerts.
+func (mr *MockMackerelClientMockRecorder) FindWithClosedAlerts() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindWithClosedAlerts", reflect.TypeOf((*MockMackerelClient)(nil).FindWithClosedAlerts))
+}
+
+// FindWithClosedAlertsByNextID mocks base method.
+func (m *MockMackerelClient) FindWithClosedAlertsByNextID(nextID string) (*mackerel.AlertsResp, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FindWithClosedAlertsByNextID", nextID)
+	ret0, _ := ret[0].(*mackerel.AlertsResp)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FindWithClosedAlertsByNextID indicates an expected call of FindWithClosedAlertsByNextID.
+func (mr *MockMackerelClientMockRecorder) FindWithClosedAlertsByNextID(nextID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindWithClosedAlertsByNextID", reflect.TypeOf((*MockMackerelClient)(nil).FindWithClosedAlertsByNextID), nextID)
+}
+
 // GetAlert mocks base method.
 func (m *MockMackerelClient) GetAlert(arg0 string) (*mackerel.Alert, error) {
 	m.ctrl.T.Helper()
@@ -94,6 +229,21 @@ func (mr *MockMackerelClientMockRecorder) GetAlert(arg0 interface{}) *gomock.Cal
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAlert", reflect.TypeOf((*MockMackerelClient)(nil).GetAlert), arg0)
 }
 
+// GetAlertGroupSetting mocks base method.
+func (m *MockMackerelClient) GetAlertGroupSetting(id string) (*mackerel.AlertGroupSetting, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAlertGroupSetting", id)
+	ret0, _ := ret[0].(*mackerel.AlertGroupSetting)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAlertGroupSetting indicates an expected call of GetAlertGroupSetting.
+func (mr *MockMackerelClientMockRecorder) GetAlertGroupSetting(id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAlertGroupSetting", reflect.TypeOf((*MockMackerelClient)(nil).GetAlertGroupSetting), id)
+}
+
 // GetMonitor mocks base method.
 func (m *MockMackerelClient) GetMonitor(arg0 string) (mackerel.Monitor, error) {
 	m.ctrl.T.Helper()
@@ -124,6 +274,20 @@ func (mr *MockMackerelClientMockRecorder) GetOrg() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetOrg", reflect.TypeOf((*MockMackerelClient)(nil).GetOrg))
 }
 
+// PostServiceMetricValues mocks base method.
+func (m *MockMackerelClient) PostServiceMetricValues(serviceName string, metricValues []*mackerel.MetricValue) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PostServiceMetricValues", serviceName, metricValues)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// PostServiceMetricValues indicates an expected call of PostServiceMetricValues.
+func (mr *MockMackerelClientMockRecorder) PostServiceMetricValues(serviceName, metricValues interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PostServiceMetricValues", reflect.TypeOf((*MockMackerelClient)(nil).PostServiceMetricValues), serviceName, metricValues)
+}
+
 // UpdateAlert mocks base method.
 func (m *MockMackerelClient) UpdateAlert(alertID string, param mackerel.UpdateAlertParam) (*mackerel.UpdateAlertResponse, error) {
 	m.ctrl.T.Helper()
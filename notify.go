@@ -0,0 +1,246 @@
+package prepalert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/zclconf/go-cty/cty"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+)
+
+const (
+	notifyTypeSlack   = "slack"
+	notifyTypeWebhook = "webhook"
+)
+
+var (
+	// DefaultNotifyTimeout is the default timeout of the notification request.
+	DefaultNotifyTimeout = 10 * time.Second
+
+	defaultNotifier Notifier = NewHTTPNotifier(nil)
+)
+
+// Notification is the message to the chat, posted after the alert memo is updated.
+type Notification struct {
+	RuleName    string          `json:"rule"`
+	Type        string          `json:"type"`
+	WebhookURL  string          `json:"-"`
+	Channel     string          `json:"channel,omitempty"`
+	Text        string          `json:"text"`
+	Blocks      json.RawMessage `json:"blocks,omitempty"`
+	FullTextURL string          `json:"full_text_url,omitempty"`
+}
+
+// Notifier is the destination of the notifications.
+type Notifier interface {
+	PostNotification(ctx context.Context, n *Notification, body *WebhookBody) error
+}
+
+// HTTPNotifier posts the notifications to the webhook URL.
+type HTTPNotifier struct {
+	client *http.Client
+}
+
+func NewHTTPNotifier(client *http.Client) *HTTPNotifier {
+	if client == nil {
+		client = &http.Client{Timeout: DefaultNotifyTimeout}
+	}
+	return &HTTPNotifier{client: client}
+}
+
+// PostNotification posts the Slack incoming webhook payload for slack, or the notification with the webhook body for webhook.
+func (n *HTTPNotifier) PostNotification(ctx context.Context, notification *Notification, body *WebhookBody) error {
+	var payload interface{}
+	switch notification.Type {
+	case notifyTypeSlack:
+		payload = newSlackPayload(notification)
+	default:
+		payload = struct {
+			*Notification
+			Webhook *WebhookBody `json:"webhook"`
+		}{
+			Notification: notification,
+			Webhook:      body,
+		}
+	}
+	bs, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("marshal payload: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, notification.WebhookURL, bytes.NewReader(bs))
+	if err != nil {
+		return fmt.Errorf("new request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("post notification: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("post notification: unexpected status %s: %s", resp.Status, strings.TrimSpace(string(respBody)))
+	}
+	return nil
+}
+
+type slackPayload struct {
+	Channel string            `json:"channel,omitempty"`
+	Text    string            `json:"text"`
+	Blocks  []json.RawMessage `json:"blocks,omitempty"`
+}
+
+// newSlackPayload appends the full text link to the text, and to the blocks as a context block.
+func newSlackPayload(n *Notification) *slackPayload {
+	payload := &slackPayload{
+		Channel: n.Channel,
+		Text:    n.Text,
+	}
+	if len(n.Blocks) > 0 {
+		if err := json.Unmarshal(n.Blocks, &payload.Blocks); err != nil {
+			// validated in Execute, not reached
+			slog.Warn("failed unmarshal slack blocks", "error", err.Error())
+		}
+	}
+	if n.FullTextURL == "" {
+		return payload
+	}
+	link := fmt.Sprintf("<%s|Full Text>", n.FullTextURL)
+	payload.Text += "\n" + link
+	if len(payload.Blocks) > 0 {
+		payload.Blocks = append(payload.Blocks, json.RawMessage(fmt.Sprintf(
+			`{"type":"context","elements":[{"type":"mrkdwn","text":%q}]}`, link,
+		)))
+	}
+	return payload
+}
+
+// NotifyAction posts the rendered text to the chat, such as the incident channel of Slack.
+type NotifyAction struct {
+	app              *App
+	ruleName         string
+	notifyType       string
+	enable           bool
+	webhookURL       string
+	channel          string
+	textExpr         hcl.Expression
+	blocksExpr       hcl.Expression
+	dependsOnQueries map[string]struct{}
+}
+
+func (action *NotifyAction) DecodeBody(body hcl.Body, evalCtx *hcl.EvalContext) hcl.Diagnostics {
+	attrs, diags := body.JustAttributes()
+	if diags.HasErrors() {
+		return diags
+	}
+	for _, attr := range attrs {
+		switch attr.Name {
+		case "webhook_url":
+			diags = diags.Extend(gohcl.DecodeExpression(attr.Expr, evalCtx, &action.webhookURL))
+		case "channel":
+			diags = diags.Extend(gohcl.DecodeExpression(attr.Expr, evalCtx, &action.channel))
+		case "text":
+			action.textExpr = attr.Expr
+			registerQueryFQNs(attr.Expr, action.dependsOnQueries)
+		case "blocks":
+			action.blocksExpr = attr.Expr
+			registerQueryFQNs(attr.Expr, action.dependsOnQueries)
+		default:
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  fmt.Sprintf("unknown attribute %q", attr.Name),
+				Subject:  attr.Range.Ptr(),
+			})
+		}
+	}
+	if diags.HasErrors() {
+		return diags
+	}
+	if action.webhookURL == "" {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  fmt.Sprintf("notify_%s block must have webhook_url attribute", action.notifyType),
+			Subject:  body.MissingItemRange().Ptr(),
+		})
+	}
+	if action.textExpr == nil {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  fmt.Sprintf("notify_%s block must have text attribute", action.notifyType),
+			Subject:  body.MissingItemRange().Ptr(),
+		})
+	}
+	action.enable = !diags.HasErrors()
+	return diags
+}
+
+func (action *NotifyAction) Enable() bool {
+	return action.enable
+}
+
+func (action *NotifyAction) DependsOnQueries() []string {
+	queries := make([]string, 0, len(action.dependsOnQueries))
+	for query := range action.dependsOnQueries {
+		queries = append(queries, query)
+	}
+	return queries
+}
+
+func (action *NotifyAction) Execute(ctx context.Context, evalCtx *hcl.EvalContext, u *MackerelUpdater) error {
+	text, err := ExpressionToString(action.textExpr, evalCtx)
+	if err != nil {
+		return fmt.Errorf("render notify_%s text: %w", action.notifyType, err)
+	}
+	n := &Notification{
+		RuleName:   action.ruleName,
+		Type:       action.notifyType,
+		WebhookURL: action.webhookURL,
+		Channel:    action.channel,
+		Text:       text,
+	}
+	if action.blocksExpr != nil {
+		blocks, err := renderBlocks(action.blocksExpr, evalCtx)
+		if err != nil {
+			return fmt.Errorf("render notify_%s blocks: %w", action.notifyType, err)
+		}
+		n.Blocks = blocks
+	}
+	slog.DebugContext(ctx, "dump notification", "type", n.Type, "text", n.Text)
+	u.AddNotification(n)
+	return nil
+}
+
+// renderBlocks renders blocks as the JSON array, written as the list of objects or the JSON string.
+func renderBlocks(expr hcl.Expression, evalCtx *hcl.EvalContext) (json.RawMessage, error) {
+	value, diags := expr.Value(evalCtx)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	if !value.IsWhollyKnown() || value.IsNull() {
+		return nil, fmt.Errorf("blocks is null or unknown")
+	}
+	var bs []byte
+	if value.Type() == cty.String {
+		bs = []byte(value.AsString())
+	} else {
+		var err error
+		bs, err = ctyjson.SimpleJSONValue{Value: value}.MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+	}
+	var blocks []json.RawMessage
+	if err := json.Unmarshal(bs, &blocks); err != nil {
+		return nil, fmt.Errorf("blocks must be a list of objects: %w", err)
+	}
+	return json.RawMessage(bs), nil
+}
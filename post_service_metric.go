@@ -0,0 +1,138 @@
+package prepalert
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"sort"
+
+	"github.com/Songmu/flextime"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/mackerelio/mackerel-client-go"
+)
+
+var metricNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+
+// PostServiceMetricAction posts the values extracted from the query results as the service metrics,
+// so that the enrichment can be graphed and monitored alongside the alert.
+type PostServiceMetricAction struct {
+	app              *App
+	ruleName         string
+	enable           bool
+	serviceExpr      hcl.Expression
+	metricsExpr      hcl.Expression
+	timeExpr         hcl.Expression
+	dependsOnQueries map[string]struct{}
+}
+
+func (action *PostServiceMetricAction) DecodeBody(body hcl.Body, evalCtx *hcl.EvalContext) hcl.Diagnostics {
+	attrs, diags := body.JustAttributes()
+	if diags.HasErrors() {
+		return diags
+	}
+	for _, attr := range attrs {
+		switch attr.Name {
+		case "service":
+			action.serviceExpr = attr.Expr
+		case "metrics":
+			action.metricsExpr = attr.Expr
+		case "time":
+			action.timeExpr = attr.Expr
+		default:
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  fmt.Sprintf("unknown attribute %q", attr.Name),
+				Subject:  attr.Range.Ptr(),
+			})
+			continue
+		}
+		registerQueryFQNs(attr.Expr, action.dependsOnQueries)
+	}
+	if diags.HasErrors() {
+		return diags
+	}
+	if action.serviceExpr == nil {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "post_service_metric block must have service attribute",
+			Subject:  body.MissingItemRange().Ptr(),
+		})
+	}
+	if action.metricsExpr == nil {
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "post_service_metric block must have metrics attribute",
+			Subject:  body.MissingItemRange().Ptr(),
+		})
+	}
+	action.enable = !diags.HasErrors()
+	return diags
+}
+
+func (action *PostServiceMetricAction) Enable() bool {
+	return action.enable
+}
+
+func (action *PostServiceMetricAction) DependsOnQueries() []string {
+	queries := make([]string, 0, len(action.dependsOnQueries))
+	for query := range action.dependsOnQueries {
+		queries = append(queries, query)
+	}
+	return queries
+}
+
+// Execute renders the metrics, which are posted in Flush together with the metrics of the other rules.
+func (action *PostServiceMetricAction) Execute(ctx context.Context, evalCtx *hcl.EvalContext, u *MackerelUpdater) error {
+	service, err := ExpressionToString(action.serviceExpr, evalCtx)
+	if err != nil {
+		return fmt.Errorf("post_service_metric: render service: %w", err)
+	}
+	var metrics map[string]float64
+	if diags := gohcl.DecodeExpression(action.metricsExpr, evalCtx, &metrics); diags.HasErrors() {
+		return fmt.Errorf("post_service_metric: render metrics: %w", diags)
+	}
+	body, err := WebhookFromEvalContext(evalCtx)
+	if err != nil {
+		return err
+	}
+	t := serviceMetricTime(body)
+	if action.timeExpr != nil {
+		if diags := gohcl.DecodeExpression(action.timeExpr, evalCtx, &t); diags.HasErrors() {
+			return fmt.Errorf("post_service_metric: render time: %w", diags)
+		}
+	}
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		if !metricNameRegexp.MatchString(name) {
+			return fmt.Errorf("post_service_metric: invalid metric name %q", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	values := make([]*mackerel.MetricValue, 0, len(names))
+	for _, name := range names {
+		values = append(values, &mackerel.MetricValue{
+			Name:  name,
+			Time:  t,
+			Value: metrics[name],
+		})
+	}
+	slog.DebugContext(ctx, "dump service metrics", "service", service, "count", len(values))
+	u.AddServiceMetricValues(service, values)
+	return nil
+}
+
+// serviceMetricTime returns the default time of the metrics, the time of the webhook,
+// so that the redelivered webhook posts the metrics to the same point.
+// the webhook without the time, such as the host events, uses the current time.
+func serviceMetricTime(body *WebhookBody) int64 {
+	switch {
+	case body.Alert != nil && body.Alert.OpenedAt > 0:
+		return body.Alert.OpenedAt
+	case body.AlertGroup != nil && body.AlertGroup.CreatedAt > 0:
+		return alertGroupUnixSeconds(body.AlertGroup.CreatedAt)
+	}
+	return flextime.Now().Unix()
+}
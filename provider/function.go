@@ -58,6 +58,10 @@ func newConvertFunctionForQueryResult(
 				return cty.StringVal(str), nil
 			case "failed":
 				return cty.StringVal(fmt.Sprintf("[query %q failed: %s]", query.FQN, query.Error)), nil
+			case "timeout":
+				return cty.StringVal(fmt.Sprintf("[query %q timed out: %s]", query.FQN, query.Error)), nil
+			case "skipped":
+				return cty.StringVal(fmt.Sprintf("[query %q skipped: %s]", query.FQN, query.Error)), nil
 			case "running", "":
 				return cty.StringVal(fmt.Sprintf("[query %q running]", query.FQN)), nil
 			}
@@ -111,9 +115,9 @@ func WithQury(evalCtx *hcl.EvalContext, variables *EvalContextQueryVariables) (*
 		return evalCtx, errors.New("variables.fqn is empty")
 	}
 	switch variables.Status {
-	case "success", "failed", "running", "":
+	case "success", "failed", "timeout", "skipped", "running", "":
 	default:
-		return evalCtx, fmt.Errorf("unknown query status %q allows only success, failed, running", variables.Status)
+		return evalCtx, fmt.Errorf("unknown query status %q allows only success, failed, timeout, skipped, running", variables.Status)
 	}
 	val := map[string]cty.Value{
 		"status": cty.StringVal(variables.Status),
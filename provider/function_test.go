@@ -0,0 +1,67 @@
+package provider_test
+
+import (
+	"testing"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/mashiike/hclutil"
+	"github.com/mashiike/prepalert/provider"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithQury__ConvertFunctions(t *testing.T) {
+	cases := []struct {
+		name     string
+		status   string
+		errStr   string
+		expected string
+	}{
+		{
+			name:     "running",
+			status:   "running",
+			expected: `[query "query.hoge.fuga" running]`,
+		},
+		{
+			name:     "failed",
+			status:   "failed",
+			errStr:   "syntax error",
+			expected: `[query "query.hoge.fuga" failed: syntax error]`,
+		},
+		{
+			name:     "timeout",
+			status:   "timeout",
+			errStr:   "timed out after 30s",
+			expected: `[query "query.hoge.fuga" timed out: timed out after 30s]`,
+		},
+		{
+			name:     "skipped",
+			status:   "skipped",
+			errStr:   "when condition is not satisfied",
+			expected: `[query "query.hoge.fuga" skipped: when condition is not satisfied]`,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			evalCtx := provider.WithFunctions(hclutil.NewEvalContext())
+			evalCtx, err := provider.WithQury(evalCtx, &provider.EvalContextQueryVariables{
+				FQN:    "query.hoge.fuga",
+				Status: c.status,
+				Error:  c.errStr,
+			})
+			require.NoError(t, err)
+			expr, diags := hclsyntax.ParseExpression([]byte(`result_to_table(query.hoge.fuga)`), "test.hcl", hcl.InitialPos)
+			require.False(t, diags.HasErrors(), diags.Error())
+			v, diags := expr.Value(evalCtx)
+			require.False(t, diags.HasErrors(), diags.Error())
+			require.Equal(t, c.expected, v.AsString())
+		})
+	}
+	t.Run("unknown", func(t *testing.T) {
+		_, err := provider.WithQury(hclutil.NewEvalContext(), &provider.EvalContextQueryVariables{
+			FQN:    "query.hoge.fuga",
+			Status: "unknown",
+		})
+		require.Error(t, err)
+	})
+}
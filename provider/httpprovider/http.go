@@ -0,0 +1,246 @@
+package httpprovider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/jmespath/go-jmespath"
+	"github.com/mashiike/prepalert/provider"
+	"github.com/zclconf/go-cty/cty"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+)
+
+func init() {
+	provider.RegisterProvider("http", NewProvider)
+}
+
+type Provider struct {
+	Type   string
+	Name   string
+	Client *http.Client
+	ProviderParameter
+}
+
+// ProviderParameter is parameter of the `http` provider type.
+type ProviderParameter struct {
+	// Headers are added to every request of the provider's queries.
+	Headers map[string]string `json:"headers"`
+}
+
+func NewProvider(pp *provider.ProviderParameter) (*Provider, error) {
+	p := &Provider{
+		Type:   pp.Type,
+		Name:   pp.Name,
+		Client: http.DefaultClient,
+	}
+	if err := json.Unmarshal(pp.Params, &p.ProviderParameter); err != nil {
+		return nil, fmt.Errorf("failed to parse params: %w", err)
+	}
+	return p, nil
+}
+
+type Query struct {
+	Name     string
+	Provider *Provider
+	URL      hcl.Expression
+	Method   hcl.Expression
+	Headers  hcl.Expression
+	Body     hcl.Expression
+	Rows     *jmespath.JMESPath
+	rowsExpr string
+}
+
+func (p *Provider) NewQuery(name string, body hcl.Body, evalCtx *hcl.EvalContext) (provider.Query, error) {
+	schema := &hcl.BodySchema{
+		Attributes: []hcl.AttributeSchema{
+			{Name: "url", Required: true},
+			{Name: "method"},
+			{Name: "headers"},
+			{Name: "body"},
+			{Name: "rows"},
+		},
+	}
+	content, diags := body.Content(schema)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	query := &Query{
+		Name:     name,
+		Provider: p,
+	}
+	for _, attr := range content.Attributes {
+		switch attr.Name {
+		case "url":
+			query.URL = attr.Expr
+		case "method":
+			query.Method = attr.Expr
+		case "headers":
+			query.Headers = attr.Expr
+		case "body":
+			query.Body = attr.Expr
+		case "rows":
+			diags = diags.Extend(gohcl.DecodeExpression(attr.Expr, evalCtx, &query.rowsExpr))
+			if diags.HasErrors() {
+				return nil, diags
+			}
+			var err error
+			query.Rows, err = jmespath.Compile(query.rowsExpr)
+			if err != nil {
+				return nil, fmt.Errorf("failed to compile rows: %w", err)
+			}
+		}
+	}
+	return query, nil
+}
+
+func (q *Query) newRequest(ctx context.Context, evalCtx *hcl.EvalContext) (*http.Request, error) {
+	var url string
+	if diags := gohcl.DecodeExpression(q.URL, evalCtx, &url); diags.HasErrors() {
+		return nil, fmt.Errorf("failed to decode url: %w", diags)
+	}
+	method := http.MethodGet
+	if q.Method != nil {
+		if diags := gohcl.DecodeExpression(q.Method, evalCtx, &method); diags.HasErrors() {
+			return nil, fmt.Errorf("failed to decode method: %w", diags)
+		}
+		method = strings.ToUpper(method)
+	}
+	headers := make(map[string]string, len(q.Provider.Headers))
+	for k, v := range q.Provider.Headers {
+		headers[k] = v
+	}
+	if q.Headers != nil {
+		var queryHeaders map[string]string
+		if diags := gohcl.DecodeExpression(q.Headers, evalCtx, &queryHeaders); diags.HasErrors() {
+			return nil, fmt.Errorf("failed to decode headers: %w", diags)
+		}
+		for k, v := range queryHeaders {
+			headers[k] = v
+		}
+	}
+	var body io.Reader
+	if q.Body != nil {
+		bs, isJSON, err := q.evaluateBody(evalCtx)
+		if err != nil {
+			return nil, err
+		}
+		if isJSON {
+			if _, ok := headers["Content-Type"]; !ok {
+				headers["Content-Type"] = "application/json"
+			}
+		}
+		body = bytes.NewReader(bs)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	return req, nil
+}
+
+// evaluateBody evaluates body attribute, string is sent as is and other values are sent as JSON.
+func (q *Query) evaluateBody(evalCtx *hcl.EvalContext) ([]byte, bool, error) {
+	value, diags := q.Body.Value(evalCtx)
+	if diags.HasErrors() {
+		return nil, false, fmt.Errorf("failed to evaluate body: %w", diags)
+	}
+	if value.IsNull() {
+		return nil, false, nil
+	}
+	if value.Type() == cty.String {
+		return []byte(value.AsString()), false, nil
+	}
+	bs, err := ctyjson.Marshal(value, value.Type())
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to marshal body: %w", err)
+	}
+	return bs, true, nil
+}
+
+func (q *Query) Run(ctx context.Context, evalCtx *hcl.EvalContext) (*provider.QueryResult, error) {
+	req, err := q.newRequest(ctx, evalCtx)
+	if err != nil {
+		return nil, err
+	}
+	queryString := req.Method + " " + req.URL.String()
+	if q.Rows != nil {
+		queryString += "\n" + q.rowsExpr
+	}
+	slog.DebugContext(ctx, "http request", "method", req.Method, "url", req.URL.String())
+	resp, err := q.Provider.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request: %w", err)
+	}
+	defer resp.Body.Close()
+	bs, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, truncate(string(bs), 256))
+	}
+	var data interface{}
+	if err := json.Unmarshal(bs, &data); err != nil {
+		return nil, fmt.Errorf("failed to parse response body as JSON: %w", err)
+	}
+	if q.Rows != nil {
+		data, err = q.Rows.Search(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to search rows: %w", err)
+		}
+	}
+	lines, err := toJSONLines(data)
+	if err != nil {
+		return nil, err
+	}
+	qr := provider.NewQueryResultWithJSONLines(q.Name, queryString, nil, lines...)
+	slog.DebugContext(ctx, "dump QueryResult", "query_result", qr.ToMarkdownTable())
+	return qr, nil
+}
+
+// toJSONLines converts the selected JSON value to lines.
+// an array becomes one line per element, an object becomes one line, and a scalar is put into the `value` column.
+func toJSONLines(data interface{}) ([]map[string]json.RawMessage, error) {
+	if data == nil {
+		return nil, nil
+	}
+	elements, ok := data.([]interface{})
+	if !ok {
+		elements = []interface{}{data}
+	}
+	lines := make([]map[string]json.RawMessage, 0, len(elements))
+	for _, elem := range elements {
+		obj, ok := elem.(map[string]interface{})
+		if !ok {
+			obj = map[string]interface{}{"value": elem}
+		}
+		line := make(map[string]json.RawMessage, len(obj))
+		for k, v := range obj {
+			bs, err := json.Marshal(v)
+			if err != nil {
+				return nil, fmt.Errorf("failed to marshal row value: %w", err)
+			}
+			line[k] = bs
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
@@ -0,0 +1,119 @@
+package httpprovider_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mashiike/prepalert/provider"
+	"github.com/mashiike/prepalert/provider/httpprovider"
+	"github.com/mashiike/prepalert/provider/providertest"
+	"github.com/stretchr/testify/require"
+)
+
+func newProvider(t *testing.T, params string) *httpprovider.Provider {
+	t.Helper()
+	p, err := httpprovider.NewProvider(&provider.ProviderParameter{
+		Type:   "http",
+		Name:   "default",
+		Params: json.RawMessage(params),
+	})
+	require.NoError(t, err)
+	return p
+}
+
+func TestProvider(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodGet, r.Method)
+		require.Equal(t, "/status", r.URL.Path)
+		require.Equal(t, "api", r.URL.Query().Get("service"))
+		require.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		require.Equal(t, "prepalert", r.Header.Get("X-Requested-By"))
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"status":"degraded","components":[{"name":"db","status":"ok","latency":12},{"name":"cache","status":"down","latency":null}]}`)
+	}))
+	defer s.Close()
+	p := newProvider(t, `{"headers":{"Authorization":"Bearer token"}}`)
+	hclBody := []byte(`
+url     = "${var.endpoint}/status?service=api"
+headers = {
+	"X-Requested-By" = "prepalert"
+}
+rows = "components[?status != 'ok']"
+`)
+	q, err := providertest.NewQuery(p, "test-query", hclBody, nil)
+	require.NoError(t, err)
+	result, err := providertest.RunQuery(context.Background(), q, map[string]interface{}{
+		"var": map[string]interface{}{
+			"endpoint": s.URL,
+		},
+	})
+	require.NoError(t, err)
+	require.EqualValues(t, &provider.QueryResult{
+		Name:    "test-query",
+		Query:   "GET " + s.URL + "/status?service=api\ncomponents[?status != 'ok']",
+		Columns: []string{"status", "name", "latency"},
+		Rows: [][]json.RawMessage{
+			{json.RawMessage(`"down"`), json.RawMessage(`"cache"`), json.RawMessage(`null`)},
+		},
+	}, result)
+}
+
+func TestProvider__PostJSONBody(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		bs, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		require.JSONEq(t, `{"alert_id":"2bj...","limit":2}`, string(bs))
+		io.WriteString(w, `[1, 2]`)
+	}))
+	defer s.Close()
+	p := newProvider(t, `{}`)
+	hclBody := []byte(`
+url    = var.endpoint
+method = "post"
+body   = {
+	alert_id = "2bj..."
+	limit    = 2
+}
+`)
+	q, err := providertest.NewQuery(p, "test-query", hclBody, nil)
+	require.NoError(t, err)
+	result, err := providertest.RunQuery(context.Background(), q, map[string]interface{}{
+		"var": map[string]interface{}{
+			"endpoint": s.URL,
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"value"}, result.Columns)
+	require.EqualValues(t, [][]json.RawMessage{
+		{json.RawMessage(`1`)},
+		{json.RawMessage(`2`)},
+	}, result.Rows)
+}
+
+func TestProvider__ErrorStatus(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, `maintenance`)
+	}))
+	defer s.Close()
+	p := newProvider(t, `{}`)
+	q, err := providertest.NewQuery(p, "test-query", []byte(`url = "`+s.URL+`"`), nil)
+	require.NoError(t, err)
+	_, err = providertest.RunQuery(context.Background(), q, nil)
+	require.EqualError(t, err, "unexpected status code 503: maintenance")
+}
+
+func TestProvider__InvalidRows(t *testing.T) {
+	p := newProvider(t, `{}`)
+	_, err := providertest.NewQuery(p, "test-query", []byte(`
+url  = "http://localhost"
+rows = "components[?"
+`), nil)
+	require.Error(t, err)
+}
@@ -0,0 +1,388 @@
+package prometheus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/mashiike/prepalert/provider"
+)
+
+var (
+	defaultStartTimeExpr hcl.Expression
+	defaultEndTimeExpr   hcl.Expression
+)
+
+func init() {
+	provider.RegisterProvider("prometheus", NewProvider)
+	var diags hcl.Diagnostics
+	defaultStartTimeExpr, diags = hclsyntax.ParseExpression([]byte(`webhook.alert.opened_at - duration("15m")`), "start.hcl", hcl.Pos{Line: 1, Column: 1})
+	if diags.HasErrors() {
+		panic(diags)
+	}
+	defaultEndTimeExpr, diags = hclsyntax.ParseExpression([]byte(`coalesce(webhook.alert.closed_at,now())`), "end.hcl", hcl.Pos{Line: 1, Column: 1})
+	if diags.HasErrors() {
+		panic(diags)
+	}
+}
+
+const (
+	// defaultRangePoints is the number of points per series used to calculate the default step of query_range.
+	defaultRangePoints = 60
+)
+
+type Provider struct {
+	Type     string
+	Name     string
+	Endpoint *url.URL
+	Client   *http.Client
+	ProviderParameter
+}
+
+type ProviderParameter struct {
+	Endpoint    string     `json:"endpoint"`
+	BasicAuth   *BasicAuth `json:"basic_auth,omitempty"`
+	BearerToken string     `json:"bearer_token,omitempty"`
+}
+
+type BasicAuth struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func NewProvider(pp *provider.ProviderParameter) (*Provider, error) {
+	p := &Provider{
+		Type:   pp.Type,
+		Name:   pp.Name,
+		Client: http.DefaultClient,
+	}
+	if err := json.Unmarshal(pp.Params, &p.ProviderParameter); err != nil {
+		return nil, fmt.Errorf("failed to parse params: %w", err)
+	}
+	if p.ProviderParameter.Endpoint == "" {
+		return nil, errors.New("endpoint is required")
+	}
+	if p.BasicAuth != nil && p.BearerToken != "" {
+		return nil, errors.New("basic_auth and bearer_token are exclusive")
+	}
+	u, err := url.Parse(p.ProviderParameter.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse endpoint: %w", err)
+	}
+	p.Endpoint = u
+	return p, nil
+}
+
+type QueryParameter struct {
+	Query      hcl.Expression
+	QueryRange hcl.Expression
+	Time       hcl.Expression
+	Start      hcl.Expression
+	End        hcl.Expression
+	Step       hcl.Expression
+}
+
+type Query struct {
+	Name      string
+	Provider  *Provider
+	IsRange   bool
+	Parameter QueryParameter
+}
+
+func (p *Provider) NewQuery(name string, body hcl.Body, evalCtx *hcl.EvalContext) (provider.Query, error) {
+	schema := &hcl.BodySchema{
+		Attributes: []hcl.AttributeSchema{
+			{Name: "query"},
+			{Name: "query_range"},
+			{Name: "time"},
+			{Name: "start"},
+			{Name: "end"},
+			{Name: "step"},
+		},
+	}
+	content, diags := body.Content(schema)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	var params QueryParameter
+	for _, attr := range content.Attributes {
+		switch attr.Name {
+		case "query":
+			params.Query = attr.Expr
+		case "query_range":
+			params.QueryRange = attr.Expr
+		case "time":
+			params.Time = attr.Expr
+		case "start":
+			params.Start = attr.Expr
+		case "end":
+			params.End = attr.Expr
+		case "step":
+			params.Step = attr.Expr
+		}
+	}
+	q := &Query{
+		Name:      name,
+		Provider:  p,
+		Parameter: params,
+	}
+	switch {
+	case params.Query != nil && params.QueryRange != nil:
+		return nil, errors.New("query and query_range are exclusive")
+	case params.Query != nil:
+		if params.Start != nil || params.End != nil || params.Step != nil {
+			return nil, errors.New("start, end and step are only available with query_range")
+		}
+	case params.QueryRange != nil:
+		if params.Time != nil {
+			return nil, errors.New("time is only available with query")
+		}
+		q.IsRange = true
+	default:
+		return nil, errors.New("either query or query_range is required")
+	}
+	if q.Parameter.Start == nil {
+		q.Parameter.Start = defaultStartTimeExpr
+	}
+	if q.Parameter.End == nil {
+		q.Parameter.End = defaultEndTimeExpr
+	}
+	if q.Parameter.Time == nil {
+		q.Parameter.Time = defaultEndTimeExpr
+	}
+	return q, nil
+}
+
+func decodeUnixTime(expr hcl.Expression, evalCtx *hcl.EvalContext) (time.Time, error) {
+	var sec float64
+	if diags := gohcl.DecodeExpression(expr, evalCtx, &sec); diags.HasErrors() {
+		return time.Time{}, diags
+	}
+	whole, frac := math.Modf(sec)
+	return time.Unix(int64(whole), int64(frac*float64(time.Second))).UTC(), nil
+}
+
+func formatUnixTime(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixNano())/float64(time.Second), 'f', -1, 64)
+}
+
+func (q *Query) Run(ctx context.Context, evalCtx *hcl.EvalContext) (*provider.QueryResult, error) {
+	var promQL string
+	values := make(url.Values)
+	var params []interface{}
+	var apiPath string
+	if q.IsRange {
+		apiPath = "api/v1/query_range"
+		if diags := gohcl.DecodeExpression(q.Parameter.QueryRange, evalCtx, &promQL); diags.HasErrors() {
+			return nil, fmt.Errorf("failed to decode query_range: %w", diags)
+		}
+		start, err := decodeUnixTime(q.Parameter.Start, evalCtx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode start: %w", err)
+		}
+		end, err := decodeUnixTime(q.Parameter.End, evalCtx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode end: %w", err)
+		}
+		if !end.After(start) {
+			return nil, fmt.Errorf("end must be after start: start=%s end=%s", start.Format(time.RFC3339), end.Format(time.RFC3339))
+		}
+		step := end.Sub(start) / defaultRangePoints
+		if q.Parameter.Step != nil {
+			var sec float64
+			if diags := gohcl.DecodeExpression(q.Parameter.Step, evalCtx, &sec); diags.HasErrors() {
+				return nil, fmt.Errorf("failed to decode step: %w", diags)
+			}
+			step = time.Duration(sec * float64(time.Second))
+		}
+		if step < time.Second {
+			step = time.Second
+		}
+		step = step.Truncate(time.Second)
+		values.Set("start", formatUnixTime(start))
+		values.Set("end", formatUnixTime(end))
+		values.Set("step", strconv.FormatFloat(step.Seconds(), 'f', -1, 64))
+		params = append(params, start.Format(time.RFC3339), end.Format(time.RFC3339), step.String())
+	} else {
+		apiPath = "api/v1/query"
+		if diags := gohcl.DecodeExpression(q.Parameter.Query, evalCtx, &promQL); diags.HasErrors() {
+			return nil, fmt.Errorf("failed to decode query: %w", diags)
+		}
+		t, err := decodeUnixTime(q.Parameter.Time, evalCtx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode time: %w", err)
+		}
+		values.Set("time", formatUnixTime(t))
+		params = append(params, t.Format(time.RFC3339))
+	}
+	values.Set("query", promQL)
+	data, err := q.Provider.request(ctx, apiPath, values)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := data.rows()
+	if err != nil {
+		return nil, err
+	}
+	qr := &provider.QueryResult{
+		Name:    q.Name,
+		Query:   promQL,
+		Params:  params,
+		Columns: []string{"timestamp", "labels", "value"},
+		Rows:    rows,
+	}
+	slog.DebugContext(ctx, "dump QueryResult", "query_result", qr.ToMarkdownTable())
+	return qr, nil
+}
+
+type apiResponse struct {
+	Status    string   `json:"status"`
+	Data      *apiData `json:"data,omitempty"`
+	ErrorType string   `json:"errorType,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+type apiData struct {
+	ResultType string          `json:"resultType"`
+	Result     json.RawMessage `json:"result"`
+}
+
+type sample struct {
+	Metric map[string]string `json:"metric"`
+	Value  samplePair        `json:"value"`
+	Values []samplePair      `json:"values"`
+}
+
+// samplePair is [<unix_time>, "<sample_value>"]
+type samplePair [2]interface{}
+
+func (p *Provider) request(ctx context.Context, apiPath string, values url.Values) (*apiData, error) {
+	u := p.Endpoint.JoinPath(apiPath)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), strings.NewReader(values.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.BasicAuth != nil {
+		req.SetBasicAuth(p.BasicAuth.Username, p.BasicAuth.Password)
+	}
+	if p.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+p.BearerToken)
+	}
+	slog.DebugContext(ctx, "prometheus request", "url", u.String(), "params", values.Encode())
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request: %w", err)
+	}
+	defer resp.Body.Close()
+	bs, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	var apiResp apiResponse
+	if err := json.Unmarshal(bs, &apiResp); err != nil {
+		return nil, fmt.Errorf("unexpected response (status code %d): %w", resp.StatusCode, err)
+	}
+	if apiResp.Status != "success" {
+		return nil, fmt.Errorf("prometheus api error: %s: %s", apiResp.ErrorType, apiResp.Error)
+	}
+	if apiResp.Data == nil {
+		return nil, errors.New("prometheus api response has no data")
+	}
+	return apiResp.Data, nil
+}
+
+// rows converts vector, matrix, scalar and string results to rows of (timestamp, labels, value).
+func (d *apiData) rows() ([][]json.RawMessage, error) {
+	rows := make([][]json.RawMessage, 0)
+	switch d.ResultType {
+	case "vector", "matrix":
+		var samples []sample
+		if err := json.Unmarshal(d.Result, &samples); err != nil {
+			return nil, fmt.Errorf("failed to parse %s result: %w", d.ResultType, err)
+		}
+		for _, s := range samples {
+			labels, err := json.Marshal(formatLabels(s.Metric))
+			if err != nil {
+				return nil, err
+			}
+			pairs := s.Values
+			if d.ResultType == "vector" {
+				pairs = []samplePair{s.Value}
+			}
+			for _, pair := range pairs {
+				ts, value, err := pair.marshal()
+				if err != nil {
+					return nil, err
+				}
+				rows = append(rows, []json.RawMessage{ts, labels, value})
+			}
+		}
+	case "scalar", "string":
+		var pair samplePair
+		if err := json.Unmarshal(d.Result, &pair); err != nil {
+			return nil, fmt.Errorf("failed to parse %s result: %w", d.ResultType, err)
+		}
+		ts, value, err := pair.marshal()
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, []json.RawMessage{ts, json.RawMessage(`"{}"`), value})
+	default:
+		return nil, fmt.Errorf("unknown result type %q", d.ResultType)
+	}
+	return rows, nil
+}
+
+func (pair samplePair) marshal() (json.RawMessage, json.RawMessage, error) {
+	sec, ok := pair[0].(float64)
+	if !ok {
+		return nil, nil, fmt.Errorf("unexpected sample timestamp %v", pair[0])
+	}
+	whole, frac := math.Modf(sec)
+	ts, err := json.Marshal(time.Unix(int64(whole), int64(frac*float64(time.Second))).UTC().Format(time.RFC3339))
+	if err != nil {
+		return nil, nil, err
+	}
+	str, ok := pair[1].(string)
+	if !ok {
+		return nil, nil, fmt.Errorf("unexpected sample value %v", pair[1])
+	}
+	f, err := strconv.ParseFloat(str, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		// NaN, +Inf and -Inf can not be represented as JSON number
+		value, err := json.Marshal(str)
+		return ts, value, err
+	}
+	return ts, json.RawMessage(strconv.FormatFloat(f, 'f', -1, 64)), nil
+}
+
+// formatLabels formats labels like PromQL selector: {job="api", instance="host:9090"}
+func formatLabels(metric map[string]string) string {
+	if len(metric) == 0 {
+		return "{}"
+	}
+	keys := make([]string, 0, len(metric))
+	for k := range metric {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%q", k, metric[k]))
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
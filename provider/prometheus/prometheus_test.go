@@ -0,0 +1,152 @@
+package prometheus_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mashiike/prepalert/provider"
+	"github.com/mashiike/prepalert/provider/prometheus"
+	"github.com/mashiike/prepalert/provider/providertest"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		require.True(t, ok)
+		require.Equal(t, "prepalert", username)
+		require.Equal(t, "secret", password)
+		require.NoError(t, r.ParseForm())
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/v1/query":
+			require.Equal(t, `up{job="api"}`, r.Form.Get("query"))
+			require.Equal(t, "1700000900", r.Form.Get("time"))
+			io.WriteString(w, `{"status":"success","data":{"resultType":"vector","result":[
+				{"metric":{"__name__":"up","job":"api","instance":"api-1:9090"},"value":[1700000900,"1"]},
+				{"metric":{"__name__":"up","job":"api","instance":"api-2:9090"},"value":[1700000900,"0"]}
+			]}}`)
+		case "/api/v1/query_range":
+			require.Equal(t, `rate(http_requests_total{status="500"}[5m])`, r.Form.Get("query"))
+			require.Equal(t, "1700000000", r.Form.Get("start"))
+			require.Equal(t, "1700000900", r.Form.Get("end"))
+			require.Equal(t, "15", r.Form.Get("step"))
+			io.WriteString(w, `{"status":"success","data":{"resultType":"matrix","result":[
+				{"metric":{"job":"api"},"values":[[1700000000,"0.5"],[1700000015,"NaN"]]}
+			]}}`)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"status":"error","errorType":"bad_data","error":"unknown path"}`)
+		}
+	}))
+}
+
+func newProvider(t *testing.T, endpoint string) *prometheus.Provider {
+	t.Helper()
+	params, err := json.Marshal(map[string]interface{}{
+		"endpoint": endpoint,
+		"basic_auth": map[string]string{
+			"username": "prepalert",
+			"password": "secret",
+		},
+	})
+	require.NoError(t, err)
+	p, err := prometheus.NewProvider(&provider.ProviderParameter{
+		Type:   "prometheus",
+		Name:   "default",
+		Params: params,
+	})
+	require.NoError(t, err)
+	return p
+}
+
+var webhookVariables = map[string]interface{}{
+	"webhook": map[string]interface{}{
+		"alert": map[string]interface{}{
+			"opened_at": 1700000900,
+			"closed_at": 1700000900,
+		},
+	},
+}
+
+func TestProvider__Query(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	p := newProvider(t, s.URL)
+	q, err := providertest.NewQuery(p, "test-query", []byte(`query = "up{job=\"api\"}"`), nil)
+	require.NoError(t, err)
+	result, err := providertest.RunQuery(context.Background(), q, webhookVariables)
+	require.NoError(t, err)
+	require.EqualValues(t, &provider.QueryResult{
+		Name:    "test-query",
+		Query:   `up{job="api"}`,
+		Params:  []interface{}{"2023-11-14T22:28:20Z"},
+		Columns: []string{"timestamp", "labels", "value"},
+		Rows: [][]json.RawMessage{
+			{json.RawMessage(`"2023-11-14T22:28:20Z"`), json.RawMessage(`"{__name__=\"up\", instance=\"api-1:9090\", job=\"api\"}"`), json.RawMessage(`1`)},
+			{json.RawMessage(`"2023-11-14T22:28:20Z"`), json.RawMessage(`"{__name__=\"up\", instance=\"api-2:9090\", job=\"api\"}"`), json.RawMessage(`0`)},
+		},
+	}, result)
+}
+
+func TestProvider__QueryRange(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	p := newProvider(t, s.URL)
+	q, err := providertest.NewQuery(p, "test-query", []byte(`query_range = "rate(http_requests_total{status=\"500\"}[5m])"`), nil)
+	require.NoError(t, err)
+	result, err := providertest.RunQuery(context.Background(), q, webhookVariables)
+	require.NoError(t, err)
+	require.EqualValues(t, &provider.QueryResult{
+		Name:    "test-query",
+		Query:   `rate(http_requests_total{status="500"}[5m])`,
+		Params:  []interface{}{"2023-11-14T22:13:20Z", "2023-11-14T22:28:20Z", "15s"},
+		Columns: []string{"timestamp", "labels", "value"},
+		Rows: [][]json.RawMessage{
+			{json.RawMessage(`"2023-11-14T22:13:20Z"`), json.RawMessage(`"{job=\"api\"}"`), json.RawMessage(`0.5`)},
+			{json.RawMessage(`"2023-11-14T22:13:35Z"`), json.RawMessage(`"{job=\"api\"}"`), json.RawMessage(`"NaN"`)},
+		},
+	}, result)
+}
+
+func TestProvider__InvalidQuery(t *testing.T) {
+	p := newProvider(t, "http://localhost:9090")
+	cases := []struct {
+		name    string
+		hclBody string
+		errStr  string
+	}{
+		{
+			name:    "empty",
+			hclBody: ``,
+			errStr:  "either query or query_range is required",
+		},
+		{
+			name: "exclusive",
+			hclBody: `
+query       = "up"
+query_range = "up"
+`,
+			errStr: "query and query_range are exclusive",
+		},
+		{
+			name: "step with instant query",
+			hclBody: `
+query = "up"
+step  = 60
+`,
+			errStr: "start, end and step are only available with query_range",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := providertest.NewQuery(p, "test-query", []byte(c.hclBody), nil)
+			require.EqualError(t, err, c.errStr)
+		})
+	}
+}
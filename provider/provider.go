@@ -48,13 +48,21 @@ var (
 	providerFactories = map[string]ProviderFactory{}
 )
 
-func RegisterProviderWithError[T Provider](typeName string, factory GenericProviderFactory[T]) error {
+// ValidateTypeName returns an error if typeName can not be used as the provider type.
+func ValidateTypeName(typeName string) error {
 	switch typeName {
 	case "prepalert", "rule", "provider", "query":
 		return fmt.Errorf("provider type %q is reserved", typeName)
 	case "":
 		return fmt.Errorf("provider type name must not be empty")
 	}
+	return nil
+}
+
+func RegisterProviderWithError[T Provider](typeName string, factory GenericProviderFactory[T]) error {
+	if err := ValidateTypeName(typeName); err != nil {
+		return err
+	}
 	providersMu.Lock()
 	defer providersMu.Unlock()
 	if _, dup := providerFactories[typeName]; dup {
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"sort"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/olekukonko/tablewriter"
 )
@@ -20,6 +21,16 @@ type QueryResult struct {
 }
 
 func NewQueryResultWithSQLRows(name string, query string, params []interface{}, rows *sql.Rows) (*QueryResult, error) {
+	return newQueryResultWithSQLRows(name, query, params, rows, false)
+}
+
+// NewQueryResultWithSQLTextRows is NewQueryResultWithSQLRows which converts the valid UTF-8 []byte values into strings,
+// for the drivers which return the text columns as []byte (e.g. mysql).
+func NewQueryResultWithSQLTextRows(name string, query string, params []interface{}, rows *sql.Rows) (*QueryResult, error) {
+	return newQueryResultWithSQLRows(name, query, params, rows, true)
+}
+
+func newQueryResultWithSQLRows(name string, query string, params []interface{}, rows *sql.Rows, bytesAsText bool) (*QueryResult, error) {
 	columns, err := rows.Columns()
 	if err != nil {
 		return nil, fmt.Errorf("NewQueryResultWithSQLRows: Columns: %w", err)
@@ -46,6 +57,9 @@ func NewQueryResultWithSQLRows(name string, query string, params []interface{},
 				row[i] = json.RawMessage("null")
 				continue
 			}
+			if b, ok := val.([]byte); ok && bytesAsText && utf8.Valid(b) {
+				val = string(b)
+			}
 			b, err := json.Marshal(val)
 			if err != nil {
 				return nil, fmt.Errorf("NewQueryResultWithSQLRows: Marshal: %w", err)
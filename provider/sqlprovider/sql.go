@@ -3,14 +3,23 @@ package sqlprovider
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"math/big"
+	"slices"
+	"strings"
 
 	"github.com/hashicorp/hcl/v2"
 	"github.com/mashiike/hclutil"
 	"github.com/mashiike/prepalert/provider"
 )
 
+func init() {
+	provider.RegisterProvider("sql", NewProviderWithParameter)
+}
+
 type Provider struct {
 	DB                      *sql.DB
 	StatementAttributeName  string
@@ -29,6 +38,41 @@ func NewProvider(driverName string, dataSourceName string) (*Provider, error) {
 	}, nil
 }
 
+// ProviderParameter is parameter of the `sql` provider type.
+type ProviderParameter struct {
+	Driver string `json:"driver"`
+	DSN    string `json:"dsn"`
+}
+
+// DriverAliases maps well-known database names to the registered database/sql driver names.
+var DriverAliases = map[string]string{
+	"postgres":   "pgx",
+	"postgresql": "pgx",
+	"sqlite3":    "sqlite",
+}
+
+// NewProviderWithParameter creates the `sql` provider, which works with any registered database/sql driver.
+func NewProviderWithParameter(pp *provider.ProviderParameter) (*Provider, error) {
+	var params ProviderParameter
+	if err := json.Unmarshal(pp.Params, &params); err != nil {
+		return nil, fmt.Errorf("failed to parse params: %w", err)
+	}
+	if params.Driver == "" {
+		return nil, errors.New("driver is required")
+	}
+	if params.DSN == "" {
+		return nil, errors.New("dsn is required")
+	}
+	driverName := params.Driver
+	if alias, ok := DriverAliases[driverName]; ok {
+		driverName = alias
+	}
+	if !slices.Contains(sql.Drivers(), driverName) {
+		return nil, fmt.Errorf("driver %q is not available, available drivers: %s", params.Driver, strings.Join(sql.Drivers(), ", "))
+	}
+	return NewProvider(driverName, params.DSN)
+}
+
 type QueryParam struct {
 	Name  string
 	Index int
@@ -79,6 +123,7 @@ func (ps QueryParams) ToInterfaceSlice(evalCtx *hcl.EvalContext) ([]interface{},
 		if err := hclutil.UnmarshalCTYValue(value, &v); err != nil {
 			return nil, fmt.Errorf("sqlprovider.QueryParams.ToInterfaceSlice UnmarshalCTYValue: %w", err)
 		}
+		v = normalizeNumber(v)
 		if param.Name != "" {
 			params = append(params, sql.Named(param.Name, v))
 			continue
@@ -88,6 +133,26 @@ func (ps QueryParams) ToInterfaceSlice(evalCtx *hcl.EvalContext) ([]interface{},
 	return params, nil
 }
 
+// normalizeNumber converts number value to int64 or float64, because database/sql drivers can not handle big.Float.
+func normalizeNumber(v interface{}) interface{} {
+	var f *big.Float
+	switch n := v.(type) {
+	case *big.Float:
+		f = n
+	case big.Float:
+		f = &n
+	default:
+		return v
+	}
+	if f.IsInt() {
+		if i, accuracy := f.Int64(); accuracy == big.Exact {
+			return i
+		}
+	}
+	f64, _ := f.Float64()
+	return f64
+}
+
 type Query struct {
 	Provider  *Provider
 	Name      string
@@ -154,7 +219,7 @@ func (q *Query) RunWithParamters(ctx context.Context, evalCtx *hcl.EvalContext,
 		return nil, fmt.Errorf("sqlprovider.Query.Run: %w", err)
 	}
 	defer rows.Close()
-	qr, err := provider.NewQueryResultWithSQLRows(q.Name, statement, params, rows)
+	qr, err := provider.NewQueryResultWithSQLTextRows(q.Name, statement, params, rows)
 	if err != nil {
 		return nil, fmt.Errorf("sqlprovider.Query.Run: %w", err)
 	}
@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -16,6 +17,7 @@ import (
 	"github.com/mashiike/prepalert/provider/sqlprovider"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/mock/gomock"
+	_ "modernc.org/sqlite"
 )
 
 //go:generate mockgen -source=$GOFILE -destination=./mock_$GOFILE -package=sqlprovider_test
@@ -83,7 +85,7 @@ func TestProvider(t *testing.T) {
 				dest[0] = int64(3)
 				dest[1] = "2020-01-01"
 				dest[2] = "user3"
-				dest[3] = "/path/to"
+				dest[3] = []byte("/path/to") // text column as []byte, like mysql
 				return nil
 			default:
 				return io.EOF
@@ -118,3 +120,80 @@ params = [strftime("%Y-%m-%d", now())]
 		},
 	}, result)
 }
+
+func TestNewProviderWithParameter(t *testing.T) {
+	// sqlite3 is the alias of the pure Go sqlite driver, which works without cgo
+	for _, driver := range []string{"sqlite", "sqlite3"} {
+		t.Run(driver, func(t *testing.T) {
+			dsn := filepath.Join(t.TempDir(), "test.db")
+			params, err := json.Marshal(map[string]string{
+				"driver": driver,
+				"dsn":    dsn,
+			})
+			require.NoError(t, err)
+			p, err := sqlprovider.NewProviderWithParameter(&provider.ProviderParameter{
+				Type:   "sql",
+				Name:   "default",
+				Params: params,
+			})
+			require.NoError(t, err)
+			defer p.Close()
+			_, err = p.DB.Exec(`CREATE TABLE logs (id INTEGER, path TEXT, status INTEGER)`)
+			require.NoError(t, err)
+			_, err = p.DB.Exec(`INSERT INTO logs VALUES (1, '/path/to', 200), (2, '/path/to', 500), (3, '/other', 500)`)
+			require.NoError(t, err)
+			hclBody := []byte(`
+		sql = "SELECT id, path FROM logs WHERE status = ? ORDER BY id"
+		params = [500]
+		`)
+			q, err := providertest.NewQuery(p, "test-query", hclBody, nil)
+			require.NoError(t, err)
+			result, err := providertest.RunQuery(context.Background(), q, nil)
+			require.NoError(t, err)
+			require.EqualValues(t, &provider.QueryResult{
+				Name:    "test-query",
+				Query:   "SELECT id, path FROM logs WHERE status = ? ORDER BY id",
+				Params:  []interface{}{int64(500)},
+				Columns: []string{"id", "path"},
+				Rows: [][]json.RawMessage{
+					{json.RawMessage(`2`), json.RawMessage(`"/path/to"`)},
+					{json.RawMessage(`3`), json.RawMessage(`"/other"`)},
+				},
+			}, result)
+		})
+	}
+}
+
+func TestNewProviderWithParameter__Invalid(t *testing.T) {
+	cases := []struct {
+		name   string
+		params string
+		errStr string
+	}{
+		{
+			name:   "missing driver",
+			params: `{"dsn":"test.db"}`,
+			errStr: "driver is required",
+		},
+		{
+			name:   "missing dsn",
+			params: `{"driver":"sqlite3"}`,
+			errStr: "dsn is required",
+		},
+		{
+			name:   "unknown driver",
+			params: `{"driver":"oracle","dsn":"test"}`,
+			errStr: `driver "oracle" is not available`,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := sqlprovider.NewProviderWithParameter(&provider.ProviderParameter{
+				Type:   "sql",
+				Name:   "default",
+				Params: json.RawMessage(c.params),
+			})
+			require.ErrorContains(t, err, c.errStr)
+		})
+	}
+}
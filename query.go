@@ -0,0 +1,417 @@
+package prepalert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/mashiike/prepalert/provider"
+	"github.com/mashiike/slogutils"
+)
+
+// QueryDependsOn returns the query FQNs that the given query refers to.
+func (app *App) QueryDependsOn(queryFQN string) []string {
+	return app.queryDependsOn[queryFQN]
+}
+
+type queryOptions struct {
+	timeout     time.Duration
+	maxAttempts int
+	interval    time.Duration
+	when        hcl.Expression
+}
+
+func (opts *queryOptions) decodeRetryAttributes(attrs hcl.Attributes, evalCtx *hcl.EvalContext) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+	for name, attr := range attrs {
+		switch name {
+		case "max_attempts":
+			diags = diags.Extend(gohcl.DecodeExpression(attr.Expr, evalCtx, &opts.maxAttempts))
+			if opts.maxAttempts < 1 {
+				diags = diags.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  `retry attribute validation`,
+					Detail:   "max_attempts must be greater than 0",
+					Subject:  attr.Expr.Range().Ptr(),
+				})
+			}
+		case "interval":
+			interval, intervalDiags := decodeDurationExpression(attr.Expr, evalCtx)
+			diags = diags.Extend(intervalDiags)
+			if interval < 0 {
+				diags = diags.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  `retry attribute validation`,
+					Detail:   "interval must be positive",
+					Subject:  attr.Expr.Range().Ptr(),
+				})
+			}
+			opts.interval = interval
+		default:
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  `retry attribute validation`,
+				Detail:   fmt.Sprintf("attribute %q is not supported", name),
+				Subject:  attr.NameRange.Ptr(),
+			})
+		}
+	}
+	return diags
+}
+
+// decodeQueryDependencies collects `query.*` references in the query attributes.
+// defRanges holds every declared query, attrs only the queries that were created successfully.
+// references to undeclared queries and dependency cycles are reported as diagnostics.
+func (app *App) decodeQueryDependencies(queryAttrs map[string]hcl.Attributes, defRanges map[string]hcl.Range) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+	app.queryDependsOn = make(map[string][]string, len(queryAttrs))
+	fqns := make([]string, 0, len(queryAttrs))
+	for queryFQN := range queryAttrs {
+		fqns = append(fqns, queryFQN)
+	}
+	sort.Strings(fqns)
+	for _, queryFQN := range fqns {
+		attrs := queryAttrs[queryFQN]
+		names := make([]string, 0, len(attrs))
+		for name := range attrs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		dependsOn := make(map[string]struct{})
+		for _, name := range names {
+			attr := attrs[name]
+			refs := make(map[string]struct{})
+			registerQueryFQNs(attr.Expr, refs)
+			for ref := range refs {
+				if _, ok := defRanges[ref]; !ok {
+					diags = diags.Append(&hcl.Diagnostic{
+						Severity: hcl.DiagError,
+						Summary:  `Query dependency validation`,
+						Detail:   fmt.Sprintf("%s refers to unknown query %q", queryFQN, ref),
+						Subject:  attr.Expr.Range().Ptr(),
+					})
+					continue
+				}
+				dependsOn[ref] = struct{}{}
+			}
+		}
+		deps := make([]string, 0, len(dependsOn))
+		for dep := range dependsOn {
+			deps = append(deps, dep)
+		}
+		sort.Strings(deps)
+		app.queryDependsOn[queryFQN] = deps
+	}
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(fqns))
+	var path []string
+	var visit func(queryFQN string)
+	visit = func(queryFQN string) {
+		switch state[queryFQN] {
+		case visited:
+			return
+		case visiting:
+			start := 0
+			for i, p := range path {
+				if p == queryFQN {
+					start = i
+					break
+				}
+			}
+			cycle := append(append([]string{}, path[start:]...), queryFQN)
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  `Query dependency cycle`,
+				Detail:   fmt.Sprintf("queries refer to each other: %s", strings.Join(cycle, " -> ")),
+				Subject:  defRanges[queryFQN].Ptr(),
+			})
+			return
+		}
+		state[queryFQN] = visiting
+		path = append(path, queryFQN)
+		for _, dep := range app.queryDependsOn[queryFQN] {
+			visit(dep)
+		}
+		path = path[:len(path)-1]
+		state[queryFQN] = visited
+	}
+	for _, queryFQN := range fqns {
+		visit(queryFQN)
+	}
+	return diags
+}
+
+// queryWaves resolves the transitive dependencies of the given queries
+// and groups them into waves; every query only depends on queries in earlier waves.
+func (app *App) queryWaves(queryFQNs map[string]struct{}) ([][]string, error) {
+	required := make(map[string]struct{}, len(queryFQNs))
+	stack := make([]string, 0, len(queryFQNs))
+	for queryFQN := range queryFQNs {
+		stack = append(stack, queryFQN)
+	}
+	for len(stack) > 0 {
+		queryFQN := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if _, ok := required[queryFQN]; ok {
+			continue
+		}
+		required[queryFQN] = struct{}{}
+		stack = append(stack, app.queryDependsOn[queryFQN]...)
+	}
+	done := make(map[string]struct{}, len(required))
+	waves := make([][]string, 0)
+	for len(done) < len(required) {
+		wave := make([]string, 0)
+		for queryFQN := range required {
+			if _, ok := done[queryFQN]; ok {
+				continue
+			}
+			ready := true
+			for _, dep := range app.queryDependsOn[queryFQN] {
+				if _, ok := done[dep]; !ok {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				wave = append(wave, queryFQN)
+			}
+		}
+		if len(wave) == 0 {
+			return nil, errors.New("query dependency cycle detected")
+		}
+		sort.Strings(wave)
+		for _, queryFQN := range wave {
+			done[queryFQN] = struct{}{}
+		}
+		waves = append(waves, wave)
+	}
+	return waves, nil
+}
+
+// runQueries runs the given queries and the queries they depend on in topological waves.
+// queries in the same wave run concurrently, and each wave sees the results of the previous waves.
+// the returned eval context holds the status and result of every query, even if some of them failed.
+func (app *App) runQueries(ctx context.Context, evalCtx *hcl.EvalContext, queryFQNs map[string]struct{}) (*hcl.EvalContext, error) {
+	if len(queryFQNs) == 0 {
+		return evalCtx, nil
+	}
+	var errs, queryErrs []error
+	available := make(map[string]struct{}, len(queryFQNs))
+	for queryFQN := range queryFQNs {
+		if _, ok := app.queries[queryFQN]; !ok {
+			errs = append(errs, fmt.Errorf("not found query %q", queryFQN))
+			continue
+		}
+		available[queryFQN] = struct{}{}
+	}
+	waves, err := app.queryWaves(available)
+	if err != nil {
+		return evalCtx, errors.Join(append(errs, err)...)
+	}
+	for _, wave := range waves {
+		for _, queryFQN := range wave {
+			var err error
+			evalCtx, err = provider.WithQury(evalCtx, &provider.EvalContextQueryVariables{
+				FQN:    queryFQN,
+				Status: "running",
+			})
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed set query status %q: %w", queryFQN, err))
+			}
+		}
+	}
+	statuses := make(map[string]string)
+	for i, wave := range waves {
+		slog.DebugContext(ctx, "start query wave", "wave", i, "queries", wave)
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		results := make([]*provider.EvalContextQueryVariables, 0, len(wave))
+		elapsed := make(map[string]time.Duration, len(wave))
+		for _, queryFQN := range wave {
+			if dep, status := app.unsuccessfulDependency(queryFQN, statuses); dep != "" {
+				v := &provider.EvalContextQueryVariables{
+					FQN:    queryFQN,
+					Status: "failed",
+					Error:  fmt.Sprintf("depends on query %q, but it %s", dep, status),
+				}
+				if status == "skipped" {
+					v.Status = "skipped"
+				}
+				results = append(results, v)
+				continue
+			}
+			if skip, err := app.skipQuery(queryFQN, evalCtx); err != nil || skip {
+				v := &provider.EvalContextQueryVariables{
+					FQN:    queryFQN,
+					Status: "skipped",
+					Error:  "when condition is not satisfied",
+				}
+				if err != nil {
+					v.Status = "failed"
+					v.Error = err.Error()
+				}
+				results = append(results, v)
+				continue
+			}
+			wg.Add(1)
+			go func(evalCtx *hcl.EvalContext, queryFQN string, query provider.Query) {
+				defer wg.Done()
+				start := flextime.Now()
+				v := app.runQuery(ctx, evalCtx, queryFQN, query)
+				mu.Lock()
+				defer mu.Unlock()
+				results = append(results, v)
+				elapsed[queryFQN] = flextime.Since(start)
+			}(evalCtx, queryFQN, app.queries[queryFQN])
+		}
+		wg.Wait()
+		sort.Slice(results, func(i, j int) bool {
+			return results[i].FQN < results[j].FQN
+		})
+		for _, v := range results {
+			statuses[v.FQN] = v.Status
+			if rec := dryRunRecorderFromContext(ctx); rec != nil {
+				rec.recordQuery(&DryRunQueryRecord{
+					FQN:     v.FQN,
+					Status:  v.Status,
+					Error:   v.Error,
+					Elapsed: elapsed[v.FQN],
+				})
+			}
+			switch v.Status {
+			case "failed", "timeout":
+				slog.WarnContext(ctx, "query is not succeeded", "query", v.FQN, "status", v.Status, "reason", v.Error)
+				queryErrs = append(queryErrs, fmt.Errorf("query %q: %s", v.FQN, v.Error))
+			case "skipped":
+				slog.InfoContext(ctx, "skip query", "query", v.FQN, "reason", v.Error)
+			}
+			var err error
+			evalCtx, err = provider.WithQury(evalCtx, v)
+			if err != nil {
+				slog.ErrorContext(ctx, "failed marshal query result", "query", v.FQN, "error", err.Error())
+				err = app.UnwrapAndDumpDiagnoctics(err)
+				errs = append(errs, fmt.Errorf("failed set query status %q: %w", v.FQN, err))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return evalCtx, errors.Join(append(errs, queryErrs...)...)
+	}
+	if len(queryErrs) > 0 {
+		return evalCtx, &queryNotSucceededError{errs: queryErrs}
+	}
+	return evalCtx, nil
+}
+
+// queryNotSucceededError is the error of the failed and timed out queries.
+// their statuses can be rendered by the rules, so the rules are executed and flushed before the error is returned.
+type queryNotSucceededError struct {
+	errs []error
+}
+
+func (e *queryNotSucceededError) Error() string {
+	return errors.Join(e.errs...).Error()
+}
+
+func (e *queryNotSucceededError) Unwrap() []error {
+	return e.errs
+}
+
+func (app *App) unsuccessfulDependency(queryFQN string, statuses map[string]string) (string, string) {
+	for _, dep := range app.queryDependsOn[queryFQN] {
+		switch statuses[dep] {
+		case "success":
+		case "skipped":
+			return dep, "skipped"
+		case "timeout":
+			return dep, "timed out"
+		default:
+			return dep, "failed"
+		}
+	}
+	return "", ""
+}
+
+func (app *App) skipQuery(queryFQN string, evalCtx *hcl.EvalContext) (bool, error) {
+	opts, ok := app.queryOptions[queryFQN]
+	if !ok || opts.when == nil {
+		return false, nil
+	}
+	match, err := evaluateWhenExpression(opts.when, evalCtx)
+	if err != nil {
+		return false, err
+	}
+	return !match, nil
+}
+
+func (app *App) runQuery(ctx context.Context, evalCtx *hcl.EvalContext, queryFQN string, query provider.Query) *provider.EvalContextQueryVariables {
+	ctx = slogutils.With(ctx, "query", queryFQN)
+	v := &provider.EvalContextQueryVariables{
+		FQN: queryFQN,
+	}
+	opts, ok := app.queryOptions[queryFQN]
+	if !ok {
+		opts = &queryOptions{maxAttempts: 1}
+	}
+	slog.InfoContext(ctx, "start run query")
+	var result *provider.QueryResult
+	var err error
+	for attempt := 1; ; attempt++ {
+		result, err = runQueryWithTimeout(ctx, evalCtx, query, opts.timeout)
+		if err == nil || attempt >= opts.maxAttempts || ctx.Err() != nil {
+			break
+		}
+		slog.WarnContext(ctx, "failed run query, retry", "attempt", attempt, "reason", err.Error())
+		select {
+		case <-ctx.Done():
+		case <-time.After(opts.interval):
+		}
+	}
+	if err != nil {
+		slog.DebugContext(
+			ctx,
+			"failed run query",
+			"error", err.Error(),
+			"errType", fmt.Sprintf("%T", err),
+		)
+		app.UnwrapAndDumpDiagnoctics(err)
+		slog.WarnContext(ctx, "failed run query", "reason", err.Error())
+		v.Status = "failed"
+		v.Error = err.Error()
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+			v.Status = "timeout"
+			v.Error = fmt.Sprintf("timed out after %s", opts.timeout)
+		}
+		return v
+	}
+	v.Status = "success"
+	v.Result = result
+	slog.InfoContext(ctx, "end run query")
+	return v
+}
+
+func runQueryWithTimeout(ctx context.Context, evalCtx *hcl.EvalContext, query provider.Query, timeout time.Duration) (*provider.QueryResult, error) {
+	if timeout <= 0 {
+		return query.Run(ctx, evalCtx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	result, err := query.Run(ctx, evalCtx)
+	if err != nil && ctx.Err() != nil && !errors.Is(err, context.DeadlineExceeded) {
+		err = fmt.Errorf("%w: %w", ctx.Err(), err)
+	}
+	return result, err
+}
@@ -0,0 +1,473 @@
+package prepalert
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/mashiike/canyon"
+)
+
+const (
+	// DefaultLocalQueueVisibilityTimeout is the default visibility timeout of the local queue.
+	DefaultLocalQueueVisibilityTimeout = 30 * time.Second
+	// DefaultLocalQueueMaxReceiveCount is the default max receive count of the local queue, the message is moved to the dead-letter queue after that.
+	DefaultLocalQueueMaxReceiveCount = 3
+	// DefaultLocalQueueName is the queue name when sqs_queue_name is not set with the local queue.
+	DefaultLocalQueueName = "prepalert"
+
+	localQueueTypeMemory = "memory"
+	localQueueTypeFile   = "file"
+)
+
+// LocalQueue is a queue instead of SQS, for running without AWS.
+type LocalQueue struct {
+	Type              string
+	Path              string
+	VisibilityTimeout time.Duration
+	MaxReceiveCount   int32
+	DLQPath           string
+}
+
+func (app *App) SetupLocalQueue(block *hcl.Block) hcl.Diagnostics {
+	q := &LocalQueue{
+		Type:              block.Labels[0],
+		VisibilityTimeout: DefaultLocalQueueVisibilityTimeout,
+		MaxReceiveCount:   DefaultLocalQueueMaxReceiveCount,
+	}
+	switch q.Type {
+	case localQueueTypeMemory, localQueueTypeFile:
+	default:
+		return hcl.Diagnostics{{
+			Severity: hcl.DiagError,
+			Summary:  `queue block validation`,
+			Detail:   fmt.Sprintf("queue type %q is not supported, allows [memory, file]", q.Type),
+			Subject:  block.LabelRanges[0].Ptr(),
+		}}
+	}
+	schema := &hcl.BodySchema{
+		Attributes: []hcl.AttributeSchema{
+			{
+				Name:     "path",
+				Required: q.Type == localQueueTypeFile,
+			},
+			{
+				Name: "visibility_timeout",
+			},
+			{
+				Name: "max_receive_count",
+			},
+			{
+				Name: "dlq_path",
+			},
+		},
+	}
+	content, diags := block.Body.Content(schema)
+	if diags.HasErrors() {
+		return diags
+	}
+	for name, attr := range content.Attributes {
+		switch name {
+		case "path":
+			if q.Type != localQueueTypeFile {
+				diags = diags.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  `queue block validation`,
+					Detail:   "path is only available with file queue",
+					Subject:  attr.NameRange.Ptr(),
+				})
+				continue
+			}
+			diags = diags.Extend(gohcl.DecodeExpression(attr.Expr, app.evalCtx, &q.Path))
+		case "visibility_timeout":
+			visibilityTimeout, visibilityTimeoutDiags := decodeDurationExpression(attr.Expr, app.evalCtx)
+			diags = diags.Extend(visibilityTimeoutDiags)
+			if visibilityTimeout < time.Second {
+				diags = diags.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  `queue block validation`,
+					Detail:   "visibility_timeout must be at least 1s",
+					Subject:  attr.Expr.Range().Ptr(),
+				})
+				continue
+			}
+			q.VisibilityTimeout = visibilityTimeout
+		case "max_receive_count":
+			diags = diags.Extend(gohcl.DecodeExpression(attr.Expr, app.evalCtx, &q.MaxReceiveCount))
+			if q.MaxReceiveCount < 1 {
+				diags = diags.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  `queue block validation`,
+					Detail:   "max_receive_count must be greater than 0",
+					Subject:  attr.Expr.Range().Ptr(),
+				})
+			}
+		case "dlq_path":
+			diags = diags.Extend(gohcl.DecodeExpression(attr.Expr, app.evalCtx, &q.DLQPath))
+		}
+	}
+	if diags.HasErrors() {
+		return diags
+	}
+	app.localQueue = q
+	return diags
+}
+
+func (q *LocalQueue) String() string {
+	if q.Type == localQueueTypeFile {
+		return fmt.Sprintf("file_queue{path=%s}", q.Path)
+	}
+	return "memory_queue"
+}
+
+// canyonOptions returns the options to run canyon with the local queue, and the cleanup function.
+func (q *LocalQueue) canyonOptions() ([]canyon.Option, func() error, error) {
+	var dlq io.Writer = io.Discard
+	cleanup := func() error { return nil }
+	if q.DLQPath != "" {
+		if err := os.MkdirAll(filepath.Dir(q.DLQPath), 0755); err != nil {
+			return nil, nil, fmt.Errorf("create dlq dir: %w", err)
+		}
+		fp, err := os.OpenFile(q.DLQPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, nil, fmt.Errorf("open dlq file: %w", err)
+		}
+		dlq = fp
+		cleanup = fp.Close
+	}
+	switch q.Type {
+	case localQueueTypeFile:
+		fq, err := NewFileQueue(q.Path, q.VisibilityTimeout, int(q.MaxReceiveCount), dlq)
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		return []canyon.Option{canyon.WithSQSClient(fq)}, cleanup, nil
+	default:
+		return []canyon.Option{canyon.WithInMemoryQueue(q.VisibilityTimeout, q.MaxReceiveCount, dlq)}, cleanup, nil
+	}
+}
+
+// FileQueue is a on-disk queue implements canyon.SQSClient, each message is stored as a JSON file in the directory.
+// messages exceeding the max receive count are written to dlq as JSON lines.
+type FileQueue struct {
+	mu                sync.Mutex
+	dir               string
+	visibilityTimeout time.Duration
+	maxReceiveCount   int
+	dlq               *json.Encoder
+	pollingInterval   time.Duration
+}
+
+type fileQueueMessage struct {
+	MessageID         string                                 `json:"message_id"`
+	Body              string                                 `json:"body"`
+	MD5OfBody         string                                 `json:"md5_of_body"`
+	Attributes        map[string]string                      `json:"attributes"`
+	MessageAttributes map[string]types.MessageAttributeValue `json:"message_attributes,omitempty"`
+	ReceiveCount      int                                    `json:"receive_count"`
+	ReceiptHandle     string                                 `json:"receipt_handle,omitempty"`
+	ReceivableAt      time.Time                              `json:"receivable_at"`
+}
+
+func NewFileQueue(dir string, visibilityTimeout time.Duration, maxReceiveCount int, dlq io.Writer) (*FileQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create queue dir: %w", err)
+	}
+	if dlq == nil {
+		dlq = io.Discard
+	}
+	if visibilityTimeout <= 0 {
+		visibilityTimeout = DefaultLocalQueueVisibilityTimeout
+	}
+	if maxReceiveCount <= 0 {
+		maxReceiveCount = DefaultLocalQueueMaxReceiveCount
+	}
+	return &FileQueue{
+		dir:               dir,
+		visibilityTimeout: visibilityTimeout,
+		maxReceiveCount:   maxReceiveCount,
+		dlq:               json.NewEncoder(dlq),
+		pollingInterval:   100 * time.Millisecond,
+	}, nil
+}
+
+func randomHex(n int) string {
+	bs := make([]byte, n)
+	if _, err := rand.Read(bs); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(bs)
+}
+
+func md5Digest(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func (fq *FileQueue) messagePath(messageID string) string {
+	return filepath.Join(fq.dir, messageID+".json")
+}
+
+func (fq *FileQueue) load(messageID string) (*fileQueueMessage, error) {
+	bs, err := os.ReadFile(fq.messagePath(messageID))
+	if err != nil {
+		return nil, err
+	}
+	var msg fileQueueMessage
+	if err := json.Unmarshal(bs, &msg); err != nil {
+		return nil, fmt.Errorf("parse queue message %s: %w", messageID, err)
+	}
+	return &msg, nil
+}
+
+// save writes the message atomically, by renaming the temporary file.
+func (fq *FileQueue) save(msg *fileQueueMessage) error {
+	bs, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(fq.dir, "."+msg.MessageID+".tmp")
+	if err := os.WriteFile(tmp, bs, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fq.messagePath(msg.MessageID))
+}
+
+func (fq *FileQueue) list() ([]*fileQueueMessage, error) {
+	entries, err := os.ReadDir(fq.dir)
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]*fileQueueMessage, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || filepath.Ext(name) != ".json" {
+			continue
+		}
+		msg, err := fq.load(strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	sort.SliceStable(msgs, func(i, j int) bool {
+		return msgs[i].ReceivableAt.Before(msgs[j].ReceivableAt)
+	})
+	return msgs, nil
+}
+
+// SendMessage implements canyon.SQSClient
+func (fq *FileQueue) SendMessage(ctx context.Context, params *sqs.SendMessageInput, _ ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+	now := flextime.Now()
+	msg := &fileQueueMessage{
+		MessageID:         fmt.Sprintf("%d-%s", now.UnixNano(), randomHex(8)),
+		Body:              aws.ToString(params.MessageBody),
+		MD5OfBody:         md5Digest(aws.ToString(params.MessageBody)),
+		MessageAttributes: params.MessageAttributes,
+		Attributes: map[string]string{
+			"SentTimestamp": fmt.Sprintf("%d", now.UnixMilli()),
+		},
+		ReceivableAt: now.Add(time.Duration(params.DelaySeconds) * time.Second),
+	}
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+	if err := fq.save(msg); err != nil {
+		return nil, fmt.Errorf("save queue message: %w", err)
+	}
+	slog.DebugContext(ctx, "enqueue to file queue", "message_id", msg.MessageID)
+	return &sqs.SendMessageOutput{
+		MessageId: aws.String(msg.MessageID),
+	}, nil
+}
+
+// ReceiveMessage implements canyon.SQSClient
+func (fq *FileQueue) ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, _ ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+	maxNumberOfMessages := int(params.MaxNumberOfMessages)
+	if maxNumberOfMessages <= 0 {
+		maxNumberOfMessages = 1
+	}
+	visibilityTimeout := fq.visibilityTimeout
+	if params.VisibilityTimeout > 0 {
+		visibilityTimeout = time.Duration(params.VisibilityTimeout) * time.Second
+	}
+	deadline := flextime.Now().Add(time.Duration(params.WaitTimeSeconds) * time.Second)
+	for {
+		msgs, err := fq.receive(ctx, maxNumberOfMessages, visibilityTimeout)
+		if err != nil {
+			return nil, err
+		}
+		if len(msgs) > 0 || !flextime.Now().Before(deadline) {
+			return &sqs.ReceiveMessageOutput{Messages: msgs}, nil
+		}
+		select {
+		case <-ctx.Done():
+			return &sqs.ReceiveMessageOutput{}, ctx.Err()
+		case <-time.After(fq.pollingInterval):
+		}
+	}
+}
+
+func (fq *FileQueue) receive(ctx context.Context, maxNumberOfMessages int, visibilityTimeout time.Duration) ([]types.Message, error) {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+	msgs, err := fq.list()
+	if err != nil {
+		return nil, err
+	}
+	now := flextime.Now()
+	received := make([]types.Message, 0, maxNumberOfMessages)
+	for _, msg := range msgs {
+		if len(received) >= maxNumberOfMessages {
+			break
+		}
+		if msg.ReceivableAt.After(now) {
+			continue
+		}
+		if msg.ReceiveCount >= fq.maxReceiveCount {
+			slog.InfoContext(ctx, "move message to dead-letter queue, because receive count reached to max receive count", "message_id", msg.MessageID, "receive_count", msg.ReceiveCount)
+			if err := fq.dlq.Encode(msg.toSQSMessage()); err != nil {
+				return nil, fmt.Errorf("write dead-letter queue: %w", err)
+			}
+			if err := os.Remove(fq.messagePath(msg.MessageID)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		msg.ReceiveCount++
+		msg.ReceiptHandle = msg.MessageID + "/" + randomHex(16)
+		msg.ReceivableAt = now.Add(visibilityTimeout)
+		msg.Attributes["ApproximateReceiveCount"] = fmt.Sprintf("%d", msg.ReceiveCount)
+		if msg.ReceiveCount == 1 {
+			msg.Attributes["ApproximateFirstReceiveTimestamp"] = fmt.Sprintf("%d", now.UnixMilli())
+		}
+		if err := fq.save(msg); err != nil {
+			return nil, err
+		}
+		received = append(received, msg.toSQSMessage())
+	}
+	return received, nil
+}
+
+func (msg *fileQueueMessage) toSQSMessage() types.Message {
+	attributes := make(map[string]string, len(msg.Attributes))
+	for k, v := range msg.Attributes {
+		attributes[k] = v
+	}
+	return types.Message{
+		MessageId:         aws.String(msg.MessageID),
+		ReceiptHandle:     aws.String(msg.ReceiptHandle),
+		Body:              aws.String(msg.Body),
+		MD5OfBody:         aws.String(msg.MD5OfBody),
+		Attributes:        attributes,
+		MessageAttributes: msg.MessageAttributes,
+	}
+}
+
+// loadByReceiptHandle returns the message of the current receipt handle.
+func (fq *FileQueue) loadByReceiptHandle(receiptHandle string) (*fileQueueMessage, error) {
+	messageID, _, ok := strings.Cut(receiptHandle, "/")
+	if !ok {
+		return nil, errors.New("invalid receipt handle")
+	}
+	msg, err := fq.load(messageID)
+	if err != nil {
+		return nil, err
+	}
+	if msg.ReceiptHandle != receiptHandle {
+		return nil, errors.New("receipt handle is expired")
+	}
+	return msg, nil
+}
+
+// DeleteMessage implements canyon.SQSClient
+func (fq *FileQueue) DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, _ ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+	msg, err := fq.loadByReceiptHandle(aws.ToString(params.ReceiptHandle))
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Remove(fq.messagePath(msg.MessageID)); err != nil {
+		return nil, err
+	}
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+// ChangeMessageVisibilityBatch implements canyon.SQSClient, the message is redelivered after the visibility timeout, e.g. Retry-After of the worker response.
+func (fq *FileQueue) ChangeMessageVisibilityBatch(ctx context.Context, params *sqs.ChangeMessageVisibilityBatchInput, _ ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityBatchOutput, error) {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+	output := &sqs.ChangeMessageVisibilityBatchOutput{
+		Failed:     make([]types.BatchResultErrorEntry, 0),
+		Successful: make([]types.ChangeMessageVisibilityBatchResultEntry, 0, len(params.Entries)),
+	}
+	for _, entry := range params.Entries {
+		msg, err := fq.loadByReceiptHandle(aws.ToString(entry.ReceiptHandle))
+		if err == nil {
+			msg.ReceivableAt = flextime.Now().Add(time.Duration(entry.VisibilityTimeout) * time.Second)
+			err = fq.save(msg)
+		}
+		if err != nil {
+			output.Failed = append(output.Failed, types.BatchResultErrorEntry{
+				Id:          entry.Id,
+				Code:        aws.String("ReceiptHandleIsInvalid"),
+				Message:     aws.String(err.Error()),
+				SenderFault: true,
+			})
+			continue
+		}
+		output.Successful = append(output.Successful, types.ChangeMessageVisibilityBatchResultEntry{
+			Id: entry.Id,
+		})
+	}
+	return output, nil
+}
+
+// GetQueueUrl implements canyon.SQSClient, returns a dummy SQS queue url.
+func (fq *FileQueue) GetQueueUrl(ctx context.Context, params *sqs.GetQueueUrlInput, _ ...func(*sqs.Options)) (*sqs.GetQueueUrlOutput, error) {
+	return &sqs.GetQueueUrlOutput{
+		QueueUrl: aws.String(fmt.Sprintf("https://sqs.local.amazonaws.com/000000000000/%s", aws.ToString(params.QueueName))),
+	}, nil
+}
+
+// GetQueueAttributes implements canyon.SQSClient
+func (fq *FileQueue) GetQueueAttributes(ctx context.Context, params *sqs.GetQueueAttributesInput, _ ...func(*sqs.Options)) (*sqs.GetQueueAttributesOutput, error) {
+	return &sqs.GetQueueAttributesOutput{
+		Attributes: map[string]string{
+			"VisibilityTimeout": fmt.Sprintf("%d", int(fq.visibilityTimeout.Seconds())),
+		},
+	}, nil
+}
+
+// MessageCount returns the number of messages in the queue, including in-flight messages.
+func (fq *FileQueue) MessageCount() (int, error) {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+	msgs, err := fq.list()
+	if err != nil {
+		return 0, err
+	}
+	return len(msgs), nil
+}
@@ -0,0 +1,105 @@
+package prepalert_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Songmu/flextime"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/mashiike/prepalert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileQueue(t *testing.T) {
+	now := time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC)
+	restore := flextime.Fix(now)
+	defer restore()
+
+	var dlq bytes.Buffer
+	dir := t.TempDir()
+	fq, err := prepalert.NewFileQueue(dir, 30*time.Second, 2, &dlq)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	urlOutput, err := fq.GetQueueUrl(ctx, &sqs.GetQueueUrlInput{QueueName: aws.String("prepalert")})
+	require.NoError(t, err)
+	require.Equal(t, "https://sqs.local.amazonaws.com/000000000000/prepalert", aws.ToString(urlOutput.QueueUrl))
+
+	sendOutput, err := fq.SendMessage(ctx, &sqs.SendMessageInput{
+		MessageBody: aws.String(`{"hoge":"fuga"}`),
+	})
+	require.NoError(t, err)
+
+	// reopen the queue, messages are persisted in the directory.
+	fq, err = prepalert.NewFileQueue(dir, 30*time.Second, 2, &dlq)
+	require.NoError(t, err)
+
+	receiveOutput, err := fq.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{MaxNumberOfMessages: 10})
+	require.NoError(t, err)
+	require.Len(t, receiveOutput.Messages, 1)
+	msg := receiveOutput.Messages[0]
+	require.Equal(t, aws.ToString(sendOutput.MessageId), aws.ToString(msg.MessageId))
+	require.Equal(t, `{"hoge":"fuga"}`, aws.ToString(msg.Body))
+	require.Equal(t, "1", msg.Attributes["ApproximateReceiveCount"])
+
+	// in visibility timeout
+	receiveOutput, err = fq.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{MaxNumberOfMessages: 10})
+	require.NoError(t, err)
+	require.Len(t, receiveOutput.Messages, 0)
+
+	// redelivery after Retry-After
+	changeOutput, err := fq.ChangeMessageVisibilityBatch(ctx, &sqs.ChangeMessageVisibilityBatchInput{
+		Entries: []types.ChangeMessageVisibilityBatchRequestEntry{
+			{
+				Id:                msg.MessageId,
+				ReceiptHandle:     msg.ReceiptHandle,
+				VisibilityTimeout: 5,
+			},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, changeOutput.Successful, 1)
+	flextime.Fix(now.Add(5 * time.Second))
+	receiveOutput, err = fq.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{MaxNumberOfMessages: 10})
+	require.NoError(t, err)
+	require.Len(t, receiveOutput.Messages, 1)
+	require.Equal(t, "2", receiveOutput.Messages[0].Attributes["ApproximateReceiveCount"])
+
+	// old receipt handle is expired
+	_, err = fq.DeleteMessage(ctx, &sqs.DeleteMessageInput{ReceiptHandle: msg.ReceiptHandle})
+	require.Error(t, err)
+
+	// exceeded max receive count, move to dead-letter queue
+	flextime.Fix(now.Add(time.Minute))
+	receiveOutput, err = fq.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{MaxNumberOfMessages: 10})
+	require.NoError(t, err)
+	require.Len(t, receiveOutput.Messages, 0)
+	count, err := fq.MessageCount()
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+	var dlqMsg types.Message
+	require.NoError(t, json.Unmarshal(dlq.Bytes(), &dlqMsg))
+	require.Equal(t, aws.ToString(sendOutput.MessageId), aws.ToString(dlqMsg.MessageId))
+	require.Equal(t, `{"hoge":"fuga"}`, aws.ToString(dlqMsg.Body))
+}
+
+func TestFileQueue__DeleteMessage(t *testing.T) {
+	fq, err := prepalert.NewFileQueue(t.TempDir(), 30*time.Second, 3, nil)
+	require.NoError(t, err)
+	ctx := context.Background()
+	_, err = fq.SendMessage(ctx, &sqs.SendMessageInput{MessageBody: aws.String("hoge")})
+	require.NoError(t, err)
+	receiveOutput, err := fq.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{MaxNumberOfMessages: 1})
+	require.NoError(t, err)
+	require.Len(t, receiveOutput.Messages, 1)
+	_, err = fq.DeleteMessage(ctx, &sqs.DeleteMessageInput{ReceiptHandle: receiveOutput.Messages[0].ReceiptHandle})
+	require.NoError(t, err)
+	count, err := fq.MessageCount()
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+}
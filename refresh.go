@@ -0,0 +1,263 @@
+package prepalert
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/mashiike/canyon"
+)
+
+const (
+	HeaderRefreshRule  = "Prepalert-Refresh-Rule"
+	HeaderRefreshCount = "Prepalert-Refresh-Count"
+)
+
+var (
+	// DefaultRefreshInterval is the default interval of the refresh of the alert memo.
+	DefaultRefreshInterval = 10 * time.Minute
+	// DefaultRefreshMaxTimes is the default max times of the refresh of the alert memo.
+	DefaultRefreshMaxTimes = 6
+	// MaxRefreshInterval is the max interval of the refresh, limited by the max delay of the SQS message.
+	MaxRefreshInterval = 15 * time.Minute
+)
+
+// RefreshPolicy is the `refresh` block of the rule, the memo of the open alert is refreshed periodically.
+type RefreshPolicy struct {
+	enable   bool
+	interval time.Duration
+	maxTimes int
+}
+
+func (p *RefreshPolicy) DecodeBody(body hcl.Body, evalCtx *hcl.EvalContext) hcl.Diagnostics {
+	attrs, diags := body.JustAttributes()
+	if diags.HasErrors() {
+		return diags
+	}
+	p.enable = true
+	p.interval = DefaultRefreshInterval
+	p.maxTimes = DefaultRefreshMaxTimes
+	for _, attr := range attrs {
+		switch attr.Name {
+		case "interval":
+			interval, intervalDiags := decodeDurationExpression(attr.Expr, evalCtx)
+			diags = diags.Extend(intervalDiags)
+			if intervalDiags.HasErrors() {
+				continue
+			}
+			if interval < time.Second || interval > MaxRefreshInterval {
+				diags = diags.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  fmt.Sprintf("interval must be between 1s and %s", MaxRefreshInterval),
+					Subject:  attr.Expr.Range().Ptr(),
+				})
+				continue
+			}
+			p.interval = interval
+		case "max_times":
+			maxTimesDiags := gohcl.DecodeExpression(attr.Expr, evalCtx, &p.maxTimes)
+			diags = diags.Extend(maxTimesDiags)
+			if maxTimesDiags.HasErrors() {
+				continue
+			}
+			if p.maxTimes <= 0 {
+				diags = diags.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "max_times must be greater than 0",
+					Subject:  attr.Expr.Range().Ptr(),
+				})
+			}
+		default:
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  fmt.Sprintf("unknown attribute %q", attr.Name),
+				Subject:  attr.Range.Ptr(),
+			})
+		}
+	}
+	return diags
+}
+
+func (p *RefreshPolicy) Enable() bool {
+	return p.enable
+}
+
+func (p *RefreshPolicy) Interval() time.Duration {
+	return p.interval
+}
+
+func (p *RefreshPolicy) MaxTimes() int {
+	return p.maxTimes
+}
+
+// refreshRequest is the follow-up request of the rule, scheduled after the previous execution.
+type refreshRequest struct {
+	ruleName string
+	count    int
+}
+
+// parseRefreshRequest returns nil if the request is not the refresh, but the webhook.
+func parseRefreshRequest(header http.Header) (*refreshRequest, error) {
+	ruleName := header.Get(HeaderRefreshRule)
+	if ruleName == "" {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(header.Get(HeaderRefreshCount))
+	if err != nil {
+		return nil, fmt.Errorf("parse %s header: %w", HeaderRefreshCount, err)
+	}
+	return &refreshRequest{
+		ruleName: ruleName,
+		count:    count,
+	}, nil
+}
+
+func (req *refreshRequest) idempotencyKey(key string) string {
+	if req == nil || key == "" {
+		return key
+	}
+	return strings.Join([]string{key, "refresh", req.ruleName, strconv.Itoa(req.count)}, "/")
+}
+
+// SetWorkerSender sets the sender of the follow-up requests to the worker, such as the refresh of the alert memo.
+// if not set, the requests are sent to the worker queue.
+func (app *App) SetWorkerSender(sender canyon.WorkerSender) *App {
+	app.workerSenderMu.Lock()
+	defer app.workerSenderMu.Unlock()
+	app.workerSender = sender
+	return app
+}
+
+func (app *App) getWorkerSender(ctx context.Context) (canyon.WorkerSender, error) {
+	app.workerSenderMu.Lock()
+	defer app.workerSenderMu.Unlock()
+	if app.workerSender != nil {
+		return app.workerSender, nil
+	}
+	if q := app.localQueue; q != nil && q.Type != localQueueTypeFile {
+		app.workerSender = &inProcessWorkerSender{handler: app}
+		return app.workerSender, nil
+	}
+	q, err := app.openWorkerQueue(ctx)
+	if err != nil {
+		return nil, err
+	}
+	app.workerSender = &queueWorkerSender{queue: q}
+	return app.workerSender, nil
+}
+
+// queueWorkerSender sends the request to the worker queue, as canyon does.
+type queueWorkerSender struct {
+	queue *sqsQueue
+}
+
+func (s *queueWorkerSender) SendToWorker(r *http.Request, opts *canyon.SendOptions) (string, error) {
+	ctx := r.Context()
+	input, err := canyon.NewDefaultSerializer().Serialize(ctx, r)
+	if err != nil {
+		return "", fmt.Errorf("serialize request: %w", err)
+	}
+	input.QueueUrl = aws.String(s.queue.queueURL)
+	if opts != nil && opts.DelaySeconds != nil {
+		input.DelaySeconds = *opts.DelaySeconds
+	}
+	output, err := s.queue.client.SendMessage(ctx, input)
+	if err != nil {
+		return "", fmt.Errorf("send message: %w", err)
+	}
+	return aws.ToString(output.MessageId), nil
+}
+
+// inProcessWorkerSender calls the worker in process after the delay, for the memory queue which is not shared with another process.
+type inProcessWorkerSender struct {
+	handler http.Handler
+}
+
+func (s *inProcessWorkerSender) SendToWorker(r *http.Request, opts *canyon.SendOptions) (string, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return "", fmt.Errorf("read request body: %w", err)
+	}
+	var delay time.Duration
+	if opts != nil && opts.DelaySeconds != nil {
+		delay = time.Duration(*opts.DelaySeconds) * time.Second
+	}
+	ctx := canyon.EmbedIsWorkerInContext(context.WithoutCancel(r.Context()), true)
+	req := r.Clone(ctx)
+	time.AfterFunc(delay, func() {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		w := canyon.NewWorkerResponseWriter()
+		s.handler.ServeHTTP(w, req)
+		if resp := w.Response(req); resp.StatusCode != http.StatusOK {
+			slog.WarnContext(ctx, "failed in-process worker request", "status", resp.StatusCode)
+		}
+	})
+	return "in-process", nil
+}
+
+// isAlertClosed returns true if the alert is closed, the alert status is checked through the cache.
+func (app *App) isAlertClosed(ctx context.Context, alertID string) (bool, error) {
+	alert, err := app.mkrSvc.GetAlertWithCache(ctx, alertID)
+	if err != nil {
+		return false, err
+	}
+	return strings.EqualFold(alert.Status, "ok"), nil
+}
+
+// scheduleRefreshes sends the follow-up requests of the executed rules which have the refresh block, with the delay of the interval.
+func (app *App) scheduleRefreshes(ctx context.Context, r *http.Request, payload []byte, body *WebhookBody, rules []*Rule, current *refreshRequest) error {
+	if body.Alert == nil || strings.EqualFold(body.Alert.Status, "ok") {
+		return nil
+	}
+	var errs []error
+	for _, rule := range rules {
+		policy := rule.RefreshPolicy()
+		if !policy.Enable() {
+			continue
+		}
+		next := 1
+		if current != nil {
+			next = current.count + 1
+		}
+		if next > policy.MaxTimes() {
+			slog.InfoContext(ctx, "reached max_times of refresh", "rule_name", rule.Name(), "max_times", policy.MaxTimes())
+			continue
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.URL.String(), bytes.NewReader(payload))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", rule.Name(), err))
+			continue
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(HeaderRequestID, r.Header.Get(HeaderRequestID))
+		req.Header.Set(HeaderRefreshRule, rule.Name())
+		req.Header.Set(HeaderRefreshCount, strconv.Itoa(next))
+		sender, err := app.getWorkerSender(ctx)
+		if err != nil {
+			return fmt.Errorf("get worker sender: %w", err)
+		}
+		delaySeconds := int32(policy.Interval() / time.Second)
+		messageID, err := sender.SendToWorker(req, &canyon.SendOptions{
+			DelaySeconds: &delaySeconds,
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", rule.Name(), err))
+			continue
+		}
+		slog.InfoContext(ctx, "schedule refresh", "rule_name", rule.Name(), "refresh_count", next, "interval", policy.Interval().String(), "sqs_message_id", messageID)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("schedule refresh: %w", errors.Join(errs...))
+	}
+	return nil
+}
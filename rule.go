@@ -5,7 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/hcl/v2"
 	"github.com/hashicorp/hcl/v2/gohcl"
@@ -18,8 +20,19 @@ type Rule struct {
 	priority            int
 	ruleName            string
 	when                hcl.Expression
+	events              []string
+	matchAlertGroup     bool
 	updateAlert         *UpdateAlertAction
 	postGraphAnnotation *PostGraphAnnotationAction
+	correlatedAlerts    *CorrelatedAlertsAction
+	alertGroupReport    *AlertGroupReportAction
+	notifySlack         *NotifyAction
+	notifyWebhook       *NotifyAction
+	httpRequest         *HTTPRequestAction
+	closeAlert          *CloseAlertAction
+	createDowntime      *CreateDowntimeAction
+	postServiceMetric   *PostServiceMetricAction
+	refresh             *RefreshPolicy
 }
 
 type UpdateAlertAction struct {
@@ -60,6 +73,57 @@ func (app *App) NewRule(ruleName string) *Rule {
 			enable:           false,
 			dependsOnQueries: make(map[string]struct{}),
 		},
+		correlatedAlerts: &CorrelatedAlertsAction{
+			app:      app,
+			ruleName: ruleName,
+			enable:   false,
+		},
+		alertGroupReport: &AlertGroupReportAction{
+			app:      app,
+			ruleName: ruleName,
+			enable:   false,
+		},
+		notifySlack: &NotifyAction{
+			app:              app,
+			ruleName:         ruleName,
+			notifyType:       notifyTypeSlack,
+			enable:           false,
+			dependsOnQueries: make(map[string]struct{}),
+		},
+		notifyWebhook: &NotifyAction{
+			app:              app,
+			ruleName:         ruleName,
+			notifyType:       notifyTypeWebhook,
+			enable:           false,
+			dependsOnQueries: make(map[string]struct{}),
+		},
+		httpRequest: &HTTPRequestAction{
+			app:              app,
+			ruleName:         ruleName,
+			enable:           false,
+			dependsOnQueries: make(map[string]struct{}),
+		},
+		closeAlert: &CloseAlertAction{
+			app:              app,
+			ruleName:         ruleName,
+			enable:           false,
+			dependsOnQueries: make(map[string]struct{}),
+		},
+		createDowntime: &CreateDowntimeAction{
+			app:              app,
+			ruleName:         ruleName,
+			enable:           false,
+			dependsOnQueries: make(map[string]struct{}),
+		},
+		postServiceMetric: &PostServiceMetricAction{
+			app:              app,
+			ruleName:         ruleName,
+			enable:           false,
+			dependsOnQueries: make(map[string]struct{}),
+		},
+		refresh: &RefreshPolicy{
+			enable: false,
+		},
 	}
 }
 func (rule *Rule) Priority() int {
@@ -80,6 +144,18 @@ func registerQueryFQNs(expr hcl.Expression, dependsOn map[string]struct{}) {
 	}
 }
 
+// webhookEvents is the events of Mackerel webhooks, which the events attribute of the rule accepts.
+var webhookEvents = []string{
+	WebhookEventAlert,
+	WebhookEventAlertGroup,
+	WebhookEventHostStatus,
+	WebhookEventHostRegister,
+	WebhookEventHostRetire,
+	WebhookEventMonitorCreate,
+	WebhookEventMonitorUpdate,
+	WebhookEventMonitorDelete,
+}
+
 func (rule *Rule) DecodeBody(body hcl.Body, evalCtx *hcl.EvalContext) hcl.Diagnostics {
 	var diags hcl.Diagnostics
 	schema := &hcl.BodySchema{
@@ -91,6 +167,9 @@ func (rule *Rule) DecodeBody(body hcl.Body, evalCtx *hcl.EvalContext) hcl.Diagno
 			{
 				Name: "priority",
 			},
+			{
+				Name: "events",
+			},
 		},
 		Blocks: []hcl.BlockHeaderSchema{
 			{
@@ -99,6 +178,33 @@ func (rule *Rule) DecodeBody(body hcl.Body, evalCtx *hcl.EvalContext) hcl.Diagno
 			{
 				Type: "post_graph_annotation",
 			},
+			{
+				Type: "correlated_alerts",
+			},
+			{
+				Type: "alert_group_report",
+			},
+			{
+				Type: "notify_slack",
+			},
+			{
+				Type: "notify_webhook",
+			},
+			{
+				Type: "http_request",
+			},
+			{
+				Type: "close_alert",
+			},
+			{
+				Type: "create_downtime",
+			},
+			{
+				Type: "post_service_metric",
+			},
+			{
+				Type: "refresh",
+			},
 		},
 	}
 	content, diags := body.Content(schema)
@@ -114,12 +220,53 @@ func (rule *Rule) DecodeBody(body hcl.Body, evalCtx *hcl.EvalContext) hcl.Diagno
 			Type:   "post_graph_annotation",
 			Unique: true,
 		},
+		{
+			Type:   "correlated_alerts",
+			Unique: true,
+		},
+		{
+			Type:   "alert_group_report",
+			Unique: true,
+		},
+		{
+			Type:   "notify_slack",
+			Unique: true,
+		},
+		{
+			Type:   "notify_webhook",
+			Unique: true,
+		},
+		{
+			Type:   "http_request",
+			Unique: true,
+		},
+		{
+			Type:   "close_alert",
+			Unique: true,
+		},
+		{
+			Type:   "create_downtime",
+			Unique: true,
+		},
+		{
+			Type:   "post_service_metric",
+			Unique: true,
+		},
+		{
+			Type:   "refresh",
+			Unique: true,
+		},
 	}...))
 	for _, attr := range content.Attributes {
 		switch attr.Name {
 		case "when":
 			rule.when = attr.Expr
-			v, err := hclutil.MarshalCTYValue(rule.app.MackerelService().NewExampleWebhookBody())
+			rule.matchAlertGroup = refersAlertGroup(attr.Expr)
+			example := rule.app.MackerelService().NewExampleWebhookBody()
+			if rule.matchAlertGroup {
+				example = rule.app.MackerelService().NewExampleAlertGroupWebhookBody()
+			}
+			tempEvalCtx, err := withWebhook(evalCtx, example)
 			if err != nil {
 				diags = diags.Append(&hcl.Diagnostic{
 					Severity: hcl.DiagError,
@@ -129,7 +276,6 @@ func (rule *Rule) DecodeBody(body hcl.Body, evalCtx *hcl.EvalContext) hcl.Diagno
 				})
 				continue
 			}
-			tempEvalCtx := hclutil.WithValue(evalCtx, webhookHCLPrefix, v)
 			if _, err := rule.match(tempEvalCtx); err != nil {
 				diags = diags.Append(&hcl.Diagnostic{
 					Severity: hcl.DiagError,
@@ -143,15 +289,91 @@ func (rule *Rule) DecodeBody(body hcl.Body, evalCtx *hcl.EvalContext) hcl.Diagno
 			diags = diags.Extend(gohcl.DecodeExpression(attr.Expr, evalCtx, &rule.priority))
 		}
 	}
+	// events is decoded after when, to check it with the alert_group reference of when.
+	if attr, ok := content.Attributes["events"]; ok {
+		diags = diags.Extend(rule.decodeEvents(attr, evalCtx))
+	}
+	if rule.events == nil {
+		// the rule handles alert events by default, and the rule referring alert_group handles alert group events.
+		rule.events = []string{WebhookEventAlert}
+		if rule.matchAlertGroup {
+			rule.events = []string{WebhookEventAlertGroup}
+		}
+	}
 	for _, block := range content.Blocks {
 		switch block.Type {
 		case "update_alert":
 			diags = diags.Extend(rule.updateAlert.DecodeBody(block.Body, evalCtx))
 		case "post_graph_annotation":
 			diags = diags.Extend(rule.postGraphAnnotation.DecodeBody(block.Body, evalCtx))
+		case "correlated_alerts":
+			diags = diags.Extend(rule.correlatedAlerts.DecodeBody(block.Body, evalCtx))
+		case "alert_group_report":
+			diags = diags.Extend(rule.alertGroupReport.DecodeBody(block.Body, evalCtx))
+		case "notify_slack":
+			diags = diags.Extend(rule.notifySlack.DecodeBody(block.Body, evalCtx))
+		case "notify_webhook":
+			diags = diags.Extend(rule.notifyWebhook.DecodeBody(block.Body, evalCtx))
+		case "http_request":
+			diags = diags.Extend(rule.httpRequest.DecodeBody(block.Body, evalCtx))
+		case "close_alert":
+			diags = diags.Extend(rule.closeAlert.DecodeBody(block.Body, evalCtx))
+		case "create_downtime":
+			diags = diags.Extend(rule.createDowntime.DecodeBody(block.Body, evalCtx))
+		case "post_service_metric":
+			diags = diags.Extend(rule.postServiceMetric.DecodeBody(block.Body, evalCtx))
+		case "refresh":
+			diags = diags.Extend(rule.refresh.DecodeBody(block.Body, evalCtx))
+			if len(content.Blocks.OfType("update_alert")) == 0 {
+				diags = diags.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "refresh block requires update_alert block",
+					Subject:  block.DefRange.Ptr(),
+				})
+			}
 		}
 	}
-	return nil
+	return diags
+}
+
+func (rule *Rule) decodeEvents(attr *hcl.Attribute, evalCtx *hcl.EvalContext) hcl.Diagnostics {
+	var events []string
+	diags := gohcl.DecodeExpression(attr.Expr, evalCtx, &events)
+	if diags.HasErrors() {
+		return diags
+	}
+	if len(events) == 0 {
+		return diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "invalid events",
+			Detail:   "events must have at least one event",
+			Subject:  attr.Expr.Range().Ptr(),
+		})
+	}
+	for _, event := range events {
+		if !slices.Contains(webhookEvents, event) {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "invalid events",
+				Detail:   fmt.Sprintf("event %q is not supported, allows [%s]", event, strings.Join(webhookEvents, ", ")),
+				Subject:  attr.Expr.Range().Ptr(),
+			})
+			continue
+		}
+		if rule.matchAlertGroup && event != WebhookEventAlertGroup {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "invalid events",
+				Detail:   fmt.Sprintf("the rule referring alert_group handles only alertGroup events, got %q", event),
+				Subject:  attr.Expr.Range().Ptr(),
+			})
+		}
+	}
+	if diags.HasErrors() {
+		return diags
+	}
+	rule.events = events
+	return diags
 }
 
 func (action *UpdateAlertAction) DecodeBody(body hcl.Body, evalCtx *hcl.EvalContext) hcl.Diagnostics {
@@ -234,6 +456,24 @@ func (rule *Rule) DependsOnQueries() []string {
 	for _, q := range rule.PostGraphAnnotationAction().DependsOnQueries() {
 		m[q] = struct{}{}
 	}
+	for _, q := range rule.NotifySlackAction().DependsOnQueries() {
+		m[q] = struct{}{}
+	}
+	for _, q := range rule.NotifyWebhookAction().DependsOnQueries() {
+		m[q] = struct{}{}
+	}
+	for _, q := range rule.HTTPRequestAction().DependsOnQueries() {
+		m[q] = struct{}{}
+	}
+	for _, q := range rule.CloseAlertAction().DependsOnQueries() {
+		m[q] = struct{}{}
+	}
+	for _, q := range rule.CreateDowntimeAction().DependsOnQueries() {
+		m[q] = struct{}{}
+	}
+	for _, q := range rule.PostServiceMetricAction().DependsOnQueries() {
+		m[q] = struct{}{}
+	}
 	queries := make([]string, 0, len(m))
 	for query := range m {
 		queries = append(queries, query)
@@ -265,6 +505,53 @@ func (rule *Rule) PostGraphAnnotationAction() *PostGraphAnnotationAction {
 	return rule.postGraphAnnotation
 }
 
+func (rule *Rule) CorrelatedAlertsAction() *CorrelatedAlertsAction {
+	return rule.correlatedAlerts
+}
+
+func (rule *Rule) AlertGroupReportAction() *AlertGroupReportAction {
+	return rule.alertGroupReport
+}
+
+func (rule *Rule) NotifySlackAction() *NotifyAction {
+	return rule.notifySlack
+}
+
+func (rule *Rule) NotifyWebhookAction() *NotifyAction {
+	return rule.notifyWebhook
+}
+
+func (rule *Rule) HTTPRequestAction() *HTTPRequestAction {
+	return rule.httpRequest
+}
+
+func (rule *Rule) CloseAlertAction() *CloseAlertAction {
+	return rule.closeAlert
+}
+
+func (rule *Rule) CreateDowntimeAction() *CreateDowntimeAction {
+	return rule.createDowntime
+}
+
+func (rule *Rule) PostServiceMetricAction() *PostServiceMetricAction {
+	return rule.postServiceMetric
+}
+
+func (rule *Rule) RefreshPolicy() *RefreshPolicy {
+	return rule.refresh
+}
+
+// Events returns the webhook events which the rule handles, given by the events attribute.
+// the default is alert, or alertGroup for the rule referring alert_group.
+func (rule *Rule) Events() []string {
+	return rule.events
+}
+
+// HandleEvent returns true if the rule is evaluated for the webhook.
+func (rule *Rule) HandleEvent(body *WebhookBody) bool {
+	return slices.Contains(rule.events, body.EventName())
+}
+
 func (rule *Rule) Match(evalCtx *hcl.EvalContext) bool {
 	isMatch, err := rule.match(evalCtx)
 	if err != nil {
@@ -275,7 +562,12 @@ func (rule *Rule) Match(evalCtx *hcl.EvalContext) bool {
 }
 
 func (rule *Rule) match(evalCtx *hcl.EvalContext) (bool, error) {
-	match, err := rule.when.Value(evalCtx)
+	return evaluateWhenExpression(rule.when, evalCtx)
+}
+
+// evaluateWhenExpression evaluates `when` expression, allows bool, list(bool) and tuple(bool).
+func evaluateWhenExpression(when hcl.Expression, evalCtx *hcl.EvalContext) (bool, error) {
+	match, err := when.Value(evalCtx)
 	if err != nil {
 		return false, fmt.Errorf("failed evaluate when expression: %w", err)
 	}
@@ -317,7 +609,7 @@ func (action *PostGraphAnnotationAction) Enable() bool {
 }
 
 func (rule *Rule) Execute(ctx context.Context, evalCtx *hcl.EvalContext, u *MackerelUpdater) error {
-	errs := make([]error, 0, 2)
+	errs := make([]error, 0, 3)
 	if rule.UpdateAlertAction().Enable() {
 		if err := rule.UpdateAlertAction().Execute(ctx, evalCtx, u); err != nil {
 			errs = append(errs, err)
@@ -328,6 +620,77 @@ func (rule *Rule) Execute(ctx context.Context, evalCtx *hcl.EvalContext, u *Mack
 			errs = append(errs, err)
 		}
 	}
+	if rule.CorrelatedAlertsAction().Enable() {
+		if err := rule.CorrelatedAlertsAction().Execute(ctx, evalCtx, u); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if rule.AlertGroupReportAction().Enable() {
+		if err := rule.AlertGroupReportAction().Execute(ctx, evalCtx, u); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if rule.NotifySlackAction().Enable() {
+		if err := rule.NotifySlackAction().Execute(ctx, evalCtx, u); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if rule.NotifyWebhookAction().Enable() {
+		if err := rule.NotifyWebhookAction().Execute(ctx, evalCtx, u); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if rule.HTTPRequestAction().Enable() {
+		if err := rule.HTTPRequestAction().Execute(ctx, evalCtx, u); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if rule.CloseAlertAction().Enable() {
+		if err := rule.CloseAlertAction().Execute(ctx, evalCtx, u); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if rule.CreateDowntimeAction().Enable() {
+		if err := rule.CreateDowntimeAction().Execute(ctx, evalCtx, u); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if rule.PostServiceMetricAction().Enable() {
+		if err := rule.PostServiceMetricAction().Execute(ctx, evalCtx, u); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) != 0 {
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+// Refresh re-renders the memo sections of the rule for the open alert, the graph annotation, the notifications and the http requests are not sent again.
+// close_alert is evaluated again, because the refreshed query results may confirm the alert as noise,
+// and the service metrics are posted again to graph the refreshed values.
+func (rule *Rule) Refresh(ctx context.Context, evalCtx *hcl.EvalContext, u *MackerelUpdater, refreshedAt time.Time) error {
+	errs := make([]error, 0, 4)
+	if rule.UpdateAlertAction().Enable() {
+		if err := rule.UpdateAlertAction().Refresh(ctx, evalCtx, u, refreshedAt); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if rule.CorrelatedAlertsAction().Enable() {
+		if err := rule.CorrelatedAlertsAction().Execute(ctx, evalCtx, u); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if rule.CloseAlertAction().Enable() {
+		if err := rule.CloseAlertAction().Execute(ctx, evalCtx, u); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if rule.PostServiceMetricAction().Enable() {
+		if err := rule.PostServiceMetricAction().Execute(ctx, evalCtx, u); err != nil {
+			errs = append(errs, err)
+		}
+	}
 	if len(errs) != 0 {
 		return errors.Join(errs...)
 	}
@@ -344,6 +707,18 @@ func (action *UpdateAlertAction) Execute(ctx context.Context, evalCtx *hcl.EvalC
 	return nil
 }
 
+// Refresh writes the memo with the last refreshed time at the top, which is kept when the memo is trimmed by max_size.
+func (action *UpdateAlertAction) Refresh(ctx context.Context, evalCtx *hcl.EvalContext, u *MackerelUpdater, refreshedAt time.Time) error {
+	memo, err := ExpressionToString(action.memoExpr, evalCtx)
+	if err != nil {
+		return fmt.Errorf("render memo: %w", err)
+	}
+	slog.DebugContext(ctx, "dump refreshed memo", "memo", memo)
+	memo = fmt.Sprintf("last refreshed: %s\n\n%s", refreshedAt.Format(time.RFC3339), memo)
+	u.AddMemoSectionText("rule."+action.ruleName, memo, action.sizeLimit)
+	return nil
+}
+
 func (action *PostGraphAnnotationAction) Execute(ctx context.Context, evalCtx *hcl.EvalContext, u *MackerelUpdater) error {
 	u.AddService(action.service)
 	if action.additionalDescriptionExpr != nil {
@@ -22,6 +22,15 @@ func (app *App) Run(ctx context.Context, opts *RunOptions) error {
 		canyon.WithServerAddress(opts.Address, opts.Prefix),
 		canyon.WithWorkerBatchSize(opts.BatchSize),
 	}
+	if q := app.LocalQueue(); q != nil {
+		queueOpts, cleanup, err := q.canyonOptions()
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		slog.InfoContext(ctx, "use local queue instead of SQS", "queue", q.String())
+		canyonOpts = append(canyonOpts, queueOpts...)
+	}
 	slog.DebugContext(ctx, "start run", "mode", opts.Mode)
 	switch strings.ToLower(opts.Mode) {
 	case "http", "webhook":
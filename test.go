@@ -0,0 +1,654 @@
+package prepalert
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/mackerelio/mackerel-client-go"
+	"github.com/mashiike/hclutil"
+	"github.com/mashiike/prepalert/provider"
+	"github.com/zclconf/go-cty/cty"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+)
+
+const testFileSuffix = ".test.hcl"
+
+type TestOptions struct {
+	Run    string    `help:"run only tests whose name matches the regular expression"`
+	Update bool      `help:"update golden files of memo_golden"`
+	Writer io.Writer `kong:"-"`
+}
+
+// RuleTest is a test block, which executes the rules with the webhook fixture and mocked query results.
+type RuleTest struct {
+	name        string
+	defRange    hcl.Range
+	webhook     *WebhookBody
+	currentMemo string
+	monitor     mackerel.Monitor
+	mockQueries map[string]*ruleTestMockQuery
+	assert      *ruleTestAssert
+}
+
+type ruleTestMockQuery struct {
+	result *provider.QueryResult
+	err    string
+}
+
+type ruleTestAssert struct {
+	attrs              hcl.Attributes
+	matchedRules       []string
+	memoContains       []string
+	memoEquals         *string
+	memoGolden         *string
+	annotationServices []string
+	alertClosed        *bool
+	errorContains      *string
+}
+
+func (app *App) setTestBlocks(blocks hcl.Blocks) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+	for _, block := range blocks {
+		if !strings.HasSuffix(block.DefRange.Filename, testFileSuffix) {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "test block validation",
+				Detail:   fmt.Sprintf("test block is only allowed in *%s files", testFileSuffix),
+				Subject:  block.DefRange.Ptr(),
+			})
+		}
+	}
+	app.testBlocks = blocks
+	return diags
+}
+
+// Test runs the test blocks in *.test.hcl files of the config dir.
+// queries return the mocked results, Mackerel API and backend are not called.
+func (app *App) Test(ctx context.Context, dir string, opts *TestOptions) error {
+	w := opts.Writer
+	if w == nil {
+		w = os.Stdout
+	}
+	var filter *regexp.Regexp
+	if opts.Run != "" {
+		var err error
+		filter, err = regexp.Compile(opts.Run)
+		if err != nil {
+			return fmt.Errorf("invalid --run: %w", err)
+		}
+	}
+	app.providerFactory = newRuleTestProvider
+	color := false
+	if err := app.LoadConfig(dir, func(lco *LoadConfigOptions) {
+		lco.DiagnosticDestination = w
+		lco.Color = &color
+	}); err != nil {
+		return err
+	}
+	app.backend = NewDiscardBackend()
+	tests := make([]*RuleTest, 0, len(app.testBlocks))
+	var diags hcl.Diagnostics
+	for _, block := range app.testBlocks {
+		if filter != nil && !filter.MatchString(block.Labels[0]) {
+			continue
+		}
+		test, decodeDiags := app.decodeRuleTest(block)
+		diags = diags.Extend(decodeDiags)
+		tests = append(tests, test)
+	}
+	if diags.HasErrors() {
+		return app.diagWriter.WriteDiagnostics(diags)
+	}
+	if len(tests) == 0 {
+		fmt.Fprintln(w, "no test to run")
+		return nil
+	}
+	failed := 0
+	for _, test := range tests {
+		testDiags := app.runRuleTest(ctx, test, opts.Update)
+		if testDiags.HasErrors() {
+			failed++
+			fmt.Fprintf(w, "FAIL: %s\n", test.name)
+			app.diagWriter.WriteDiagnostics(testDiags)
+			continue
+		}
+		fmt.Fprintf(w, "PASS: %s\n", test.name)
+	}
+	if failed > 0 {
+		fmt.Fprintf(w, "FAIL: %d of %d tests failed\n", failed, len(tests))
+		return fmt.Errorf("%d of %d tests failed", failed, len(tests))
+	}
+	fmt.Fprintf(w, "ok: %d tests passed\n", len(tests))
+	return nil
+}
+
+func (app *App) decodeRuleTest(block *hcl.Block) (*RuleTest, hcl.Diagnostics) {
+	test := &RuleTest{
+		name:        block.Labels[0],
+		defRange:    block.DefRange,
+		mockQueries: make(map[string]*ruleTestMockQuery),
+	}
+	schema := &hcl.BodySchema{
+		Attributes: []hcl.AttributeSchema{
+			{
+				Name:     "webhook",
+				Required: true,
+			},
+			{
+				Name: "current_memo",
+			},
+			{
+				Name: "monitor",
+			},
+		},
+		Blocks: []hcl.BlockHeaderSchema{
+			{
+				Type:       "mock_query",
+				LabelNames: []string{"type", "name"},
+			},
+			{
+				Type: "assert",
+			},
+		},
+	}
+	content, diags := block.Body.Content(schema)
+	if diags.HasErrors() {
+		return test, diags
+	}
+	diags = diags.Extend(hclutil.RestrictBlock(content, []hclutil.BlockRestrictionSchema{
+		{
+			Type:         "mock_query",
+			UniqueLabels: true,
+		},
+		{
+			Type:     "assert",
+			Required: true,
+			Unique:   true,
+		},
+	}...))
+	if diags.HasErrors() {
+		return test, diags
+	}
+	for name, attr := range content.Attributes {
+		switch name {
+		case "webhook":
+			body, err := decodeTestWebhook(attr.Expr, app.evalCtx)
+			if err != nil {
+				diags = diags.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "test block validation",
+					Detail:   fmt.Sprintf("failed decode webhook: %s", err),
+					Subject:  attr.Expr.Range().Ptr(),
+				})
+				continue
+			}
+			test.webhook = body
+		case "current_memo":
+			diags = diags.Extend(gohcl.DecodeExpression(attr.Expr, app.evalCtx, &test.currentMemo))
+		case "monitor":
+			monitor, err := decodeTestMonitor(attr.Expr, app.evalCtx)
+			if err != nil {
+				diags = diags.Append(&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "test block validation",
+					Detail:   fmt.Sprintf("failed decode monitor: %s", err),
+					Subject:  attr.Expr.Range().Ptr(),
+				})
+				continue
+			}
+			test.monitor = monitor
+		}
+	}
+	for _, mockBlock := range content.Blocks.OfType("mock_query") {
+		queryFQN := "query." + mockBlock.Labels[0] + "." + mockBlock.Labels[1]
+		if _, ok := app.queries[queryFQN]; !ok {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "mock_query block validation",
+				Detail:   fmt.Sprintf("query %q is not defined", queryFQN),
+				Subject:  mockBlock.DefRange.Ptr(),
+			})
+			continue
+		}
+		mock, mockDiags := decodeRuleTestMockQuery(mockBlock, app.evalCtx)
+		diags = diags.Extend(mockDiags)
+		test.mockQueries[queryFQN] = mock
+	}
+	assert, assertDiags := decodeRuleTestAssert(content.Blocks.OfType("assert")[0], app.evalCtx)
+	diags = diags.Extend(assertDiags)
+	test.assert = assert
+	return test, diags
+}
+
+// decodeTestWebhook decodes webhook from a JSON string, such as file("webhook.json"), or an object.
+func decodeTestWebhook(expr hcl.Expression, evalCtx *hcl.EvalContext) (*WebhookBody, error) {
+	value, diags := expr.Value(evalCtx)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	var bs []byte
+	if value.Type() == cty.String {
+		bs = []byte(value.AsString())
+	} else {
+		var err error
+		bs, err = ctyjson.Marshal(value, value.Type())
+		if err != nil {
+			return nil, err
+		}
+	}
+	var body WebhookBody
+	if err := json.Unmarshal(bs, &body); err != nil {
+		return nil, err
+	}
+	return &body, nil
+}
+
+// decodeTestMonitor decodes the monitor of the alert from a JSON string or an object, as GET /api/v0/monitors/<id> returns.
+func decodeTestMonitor(expr hcl.Expression, evalCtx *hcl.EvalContext) (mackerel.Monitor, error) {
+	value, diags := expr.Value(evalCtx)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	var bs []byte
+	if value.Type() == cty.String {
+		bs = []byte(value.AsString())
+	} else {
+		var err error
+		bs, err = ctyjson.Marshal(value, value.Type())
+		if err != nil {
+			return nil, err
+		}
+	}
+	var typeData struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(bs, &typeData); err != nil {
+		return nil, err
+	}
+	var monitor mackerel.Monitor
+	switch typeData.Type {
+	case "connectivity":
+		monitor = &mackerel.MonitorConnectivity{}
+	case "host":
+		monitor = &mackerel.MonitorHostMetric{}
+	case "service":
+		monitor = &mackerel.MonitorServiceMetric{}
+	case "external":
+		monitor = &mackerel.MonitorExternalHTTP{}
+	case "expression":
+		monitor = &mackerel.MonitorExpression{}
+	case "anomalyDetection":
+		monitor = &mackerel.MonitorAnomalyDetection{}
+	case "query":
+		monitor = &mackerel.MonitorQuery{}
+	default:
+		return nil, fmt.Errorf("unknown monitor type %q", typeData.Type)
+	}
+	if err := json.Unmarshal(bs, monitor); err != nil {
+		return nil, err
+	}
+	if monitor.MonitorID() == "" {
+		return nil, errors.New("monitor must have id")
+	}
+	return monitor, nil
+}
+
+func decodeRuleTestMockQuery(block *hcl.Block, evalCtx *hcl.EvalContext) (*ruleTestMockQuery, hcl.Diagnostics) {
+	mock := &ruleTestMockQuery{}
+	schema := &hcl.BodySchema{
+		Attributes: []hcl.AttributeSchema{
+			{Name: "columns"},
+			{Name: "rows"},
+			{Name: "error"},
+		},
+	}
+	content, diags := block.Body.Content(schema)
+	if diags.HasErrors() {
+		return mock, diags
+	}
+	if attr, ok := content.Attributes["error"]; ok {
+		diags = diags.Extend(gohcl.DecodeExpression(attr.Expr, evalCtx, &mock.err))
+		if len(content.Attributes) > 1 {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "mock_query block validation",
+				Detail:   "error is exclusive with columns and rows",
+				Subject:  attr.Range.Ptr(),
+			})
+		}
+		return mock, diags
+	}
+	mock.result = &provider.QueryResult{
+		Name:    block.Labels[1],
+		Query:   "mock_query",
+		Columns: make([]string, 0),
+		Rows:    make([][]json.RawMessage, 0),
+	}
+	if attr, ok := content.Attributes["columns"]; ok {
+		diags = diags.Extend(gohcl.DecodeExpression(attr.Expr, evalCtx, &mock.result.Columns))
+	}
+	if attr, ok := content.Attributes["rows"]; ok {
+		value, valueDiags := attr.Expr.Value(evalCtx)
+		diags = diags.Extend(valueDiags)
+		if valueDiags.HasErrors() {
+			return mock, diags
+		}
+		rows, err := mockQueryRows(value, len(mock.result.Columns))
+		if err != nil {
+			diags = diags.Append(&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "mock_query block validation",
+				Detail:   err.Error(),
+				Subject:  attr.Expr.Range().Ptr(),
+			})
+			return mock, diags
+		}
+		mock.result.Rows = rows
+	}
+	return mock, diags
+}
+
+func mockQueryRows(value cty.Value, numColumns int) ([][]json.RawMessage, error) {
+	if !value.CanIterateElements() {
+		return nil, errors.New("rows must be a list of lists")
+	}
+	rows := make([][]json.RawMessage, 0, value.LengthInt())
+	for it := value.ElementIterator(); it.Next(); {
+		i, rowValue := it.Element()
+		if !rowValue.CanIterateElements() {
+			return nil, fmt.Errorf("rows[%s] must be a list", i.AsBigFloat().String())
+		}
+		if rowValue.LengthInt() != numColumns {
+			return nil, fmt.Errorf("rows[%s] has %d values, but columns has %d", i.AsBigFloat().String(), rowValue.LengthInt(), numColumns)
+		}
+		row := make([]json.RawMessage, 0, numColumns)
+		for cellIt := rowValue.ElementIterator(); cellIt.Next(); {
+			_, cell := cellIt.Element()
+			bs, err := ctyjson.Marshal(cell, cell.Type())
+			if err != nil {
+				return nil, err
+			}
+			row = append(row, bs)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func decodeRuleTestAssert(block *hcl.Block, evalCtx *hcl.EvalContext) (*ruleTestAssert, hcl.Diagnostics) {
+	assert := &ruleTestAssert{}
+	schema := &hcl.BodySchema{
+		Attributes: []hcl.AttributeSchema{
+			{Name: "matched_rules"},
+			{Name: "memo_contains"},
+			{Name: "memo_equals"},
+			{Name: "memo_golden"},
+			{Name: "annotation_services"},
+			{Name: "alert_closed"},
+			{Name: "error_contains"},
+		},
+	}
+	content, diags := block.Body.Content(schema)
+	if diags.HasErrors() {
+		return assert, diags
+	}
+	assert.attrs = content.Attributes
+	for name, attr := range content.Attributes {
+		switch name {
+		case "matched_rules":
+			diags = diags.Extend(gohcl.DecodeExpression(attr.Expr, evalCtx, &assert.matchedRules))
+		case "memo_contains":
+			diags = diags.Extend(gohcl.DecodeExpression(attr.Expr, evalCtx, &assert.memoContains))
+		case "memo_equals":
+			diags = diags.Extend(gohcl.DecodeExpression(attr.Expr, evalCtx, &assert.memoEquals))
+		case "memo_golden":
+			diags = diags.Extend(gohcl.DecodeExpression(attr.Expr, evalCtx, &assert.memoGolden))
+			if assert.memoGolden != nil && !filepath.IsAbs(*assert.memoGolden) {
+				// golden file path is relative to the test file
+				path := filepath.Join(filepath.Dir(attr.Range.Filename), *assert.memoGolden)
+				assert.memoGolden = &path
+			}
+		case "annotation_services":
+			diags = diags.Extend(gohcl.DecodeExpression(attr.Expr, evalCtx, &assert.annotationServices))
+		case "alert_closed":
+			diags = diags.Extend(gohcl.DecodeExpression(attr.Expr, evalCtx, &assert.alertClosed))
+		case "error_contains":
+			diags = diags.Extend(gohcl.DecodeExpression(attr.Expr, evalCtx, &assert.errorContains))
+		}
+	}
+	return assert, diags
+}
+
+func (app *App) runRuleTest(ctx context.Context, test *RuleTest, update bool) hcl.Diagnostics {
+	app.SetMackerelClient(&ruleTestMackerelClient{
+		currentMemo: test.currentMemo,
+		monitor:     test.monitor,
+	})
+	rec := NewDryRunRecorder()
+	ctx = WithDryRunRecorder(ctx, rec)
+	ctx = context.WithValue(ctx, ruleTestMockQueriesContextKey{}, test.mockQueries)
+	execErr := app.ExecuteRules(ctx, test.webhook)
+	return test.assert.check(test, rec, execErr, update)
+}
+
+func (assert *ruleTestAssert) check(test *RuleTest, rec *DryRunRecorder, execErr error, update bool) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+	fail := func(name string, format string, args ...interface{}) {
+		subject := test.defRange.Ptr()
+		if attr, ok := assert.attrs[name]; ok {
+			subject = attr.Range.Ptr()
+		}
+		diags = diags.Append(&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  fmt.Sprintf("test %q assertion failed", test.name),
+			Detail:   fmt.Sprintf(format, args...),
+			Subject:  subject,
+		})
+	}
+	switch {
+	case assert.errorContains != nil && execErr == nil:
+		fail("error_contains", "expected error containing %q, but rules executed without error", *assert.errorContains)
+	case assert.errorContains != nil && !strings.Contains(execErr.Error(), *assert.errorContains):
+		fail("error_contains", "expected error containing %q, actual error: %s", *assert.errorContains, execErr)
+	case assert.errorContains == nil && execErr != nil:
+		fail("", "failed execute rules: %s", execErr)
+	}
+	if assert.matchedRules != nil {
+		expected := append([]string{}, assert.matchedRules...)
+		actual := append([]string{}, rec.MatchedRules...)
+		sort.Strings(expected)
+		sort.Strings(actual)
+		if strings.Join(expected, "\n") != strings.Join(actual, "\n") {
+			fail("matched_rules", "expected matched rules %q, actual %q", expected, actual)
+		}
+	}
+	var memo string
+	if len(rec.AlertMemos) > 0 {
+		memo = rec.AlertMemos[len(rec.AlertMemos)-1].Memo
+	}
+	for _, s := range assert.memoContains {
+		if !strings.Contains(memo, s) {
+			fail("memo_contains", "expected memo containing %q, actual memo:\n%s", s, memo)
+		}
+	}
+	if assert.memoEquals != nil && strings.TrimSpace(*assert.memoEquals) != strings.TrimSpace(memo) {
+		fail("memo_equals", "expected memo:\n%s\nactual memo:\n%s", *assert.memoEquals, memo)
+	}
+	if assert.memoGolden != nil {
+		if update {
+			if err := os.MkdirAll(filepath.Dir(*assert.memoGolden), 0755); err != nil {
+				fail("memo_golden", "failed update golden file: %s", err)
+			} else if err := os.WriteFile(*assert.memoGolden, []byte(memo), 0644); err != nil {
+				fail("memo_golden", "failed update golden file: %s", err)
+			}
+		}
+		bs, err := os.ReadFile(*assert.memoGolden)
+		switch {
+		case err != nil:
+			fail("memo_golden", "failed read golden file: %s, run with --update to create it", err)
+		case string(bs) != memo:
+			fail("memo_golden", "memo does not match the golden file %s, actual memo:\n%s", *assert.memoGolden, memo)
+		}
+	}
+	if assert.annotationServices != nil {
+		expected := append([]string{}, assert.annotationServices...)
+		actual := make([]string, 0, len(rec.GraphAnnotations))
+		for _, annotation := range rec.GraphAnnotations {
+			actual = append(actual, annotation.Service)
+		}
+		sort.Strings(expected)
+		sort.Strings(actual)
+		if strings.Join(expected, "\n") != strings.Join(actual, "\n") {
+			fail("annotation_services", "expected annotation services %q, actual %q", expected, actual)
+		}
+	}
+	if assert.alertClosed != nil && *assert.alertClosed != (len(rec.ClosedAlerts) > 0) {
+		fail("alert_closed", "expected alert closed %t, actual %t", *assert.alertClosed, len(rec.ClosedAlerts) > 0)
+	}
+	return diags
+}
+
+type ruleTestMockQueriesContextKey struct{}
+
+// ruleTestProvider is a provider in prepalert test, the queries return the mocked results.
+type ruleTestProvider struct {
+	providerType string
+}
+
+func newRuleTestProvider(pp *provider.ProviderParameter) (provider.Provider, error) {
+	return &ruleTestProvider{
+		providerType: pp.Type,
+	}, nil
+}
+
+func (p *ruleTestProvider) NewQuery(name string, _ hcl.Body, _ *hcl.EvalContext) (provider.Query, error) {
+	return &ruleTestQuery{
+		queryFQN: "query." + p.providerType + "." + name,
+	}, nil
+}
+
+type ruleTestQuery struct {
+	queryFQN string
+}
+
+func (q *ruleTestQuery) Run(ctx context.Context, _ *hcl.EvalContext) (*provider.QueryResult, error) {
+	mocks, _ := ctx.Value(ruleTestMockQueriesContextKey{}).(map[string]*ruleTestMockQuery)
+	mock, ok := mocks[q.queryFQN]
+	if !ok {
+		return nil, fmt.Errorf("mock_query %q is not defined in the test", q.queryFQN)
+	}
+	if mock.err != "" {
+		return nil, errors.New(mock.err)
+	}
+	return mock.result, nil
+}
+
+var errRuleTestMackerelAPI = errors.New("Mackerel API is not available in prepalert test")
+
+// ruleTestMackerelClient is a MackerelClient in prepalert test,
+// only GetAlert returns the current memo and GetMonitor returns the monitor of the test block.
+type ruleTestMackerelClient struct {
+	currentMemo string
+	monitor     mackerel.Monitor
+}
+
+func (c *ruleTestMackerelClient) GetAlert(alertID string) (*mackerel.Alert, error) {
+	alert := &mackerel.Alert{
+		ID:   alertID,
+		Memo: c.currentMemo,
+	}
+	if c.monitor != nil {
+		alert.MonitorID = c.monitor.MonitorID()
+	}
+	return alert, nil
+}
+
+func (c *ruleTestMackerelClient) UpdateAlert(string, mackerel.UpdateAlertParam) (*mackerel.UpdateAlertResponse, error) {
+	return nil, errRuleTestMackerelAPI
+}
+
+func (c *ruleTestMackerelClient) FindGraphAnnotations(string, int64, int64) ([]*mackerel.GraphAnnotation, error) {
+	return nil, errRuleTestMackerelAPI
+}
+
+func (c *ruleTestMackerelClient) UpdateGraphAnnotation(string, *mackerel.GraphAnnotation) (*mackerel.GraphAnnotation, error) {
+	return nil, errRuleTestMackerelAPI
+}
+
+func (c *ruleTestMackerelClient) CreateGraphAnnotation(*mackerel.GraphAnnotation) (*mackerel.GraphAnnotation, error) {
+	return nil, errRuleTestMackerelAPI
+}
+
+func (c *ruleTestMackerelClient) GetOrg() (*mackerel.Org, error) {
+	return nil, errRuleTestMackerelAPI
+}
+
+// GetMonitor returns the monitor of the test block, and the not found error without it, so get_monitor returns null.
+func (c *ruleTestMackerelClient) GetMonitor(monitorID string) (mackerel.Monitor, error) {
+	if c.monitor == nil || c.monitor.MonitorID() != monitorID {
+		return nil, &mackerel.APIError{
+			StatusCode: http.StatusNotFound,
+			Message:    "monitor is not given in the test block",
+		}
+	}
+	return c.monitor, nil
+}
+
+func (c *ruleTestMackerelClient) FindHost(string) (*mackerel.Host, error) {
+	return nil, errRuleTestMackerelAPI
+}
+
+func (c *ruleTestMackerelClient) FetchHostMetricValues(string, string, int64, int64) ([]mackerel.MetricValue, error) {
+	return nil, errRuleTestMackerelAPI
+}
+
+func (c *ruleTestMackerelClient) FetchServiceMetricValues(string, string, int64, int64) ([]mackerel.MetricValue, error) {
+	return nil, errRuleTestMackerelAPI
+}
+
+func (c *ruleTestMackerelClient) FindAlerts() (*mackerel.AlertsResp, error) {
+	return nil, errRuleTestMackerelAPI
+}
+
+func (c *ruleTestMackerelClient) FindAlertsByNextID(string) (*mackerel.AlertsResp, error) {
+	return nil, errRuleTestMackerelAPI
+}
+
+func (c *ruleTestMackerelClient) FindWithClosedAlerts() (*mackerel.AlertsResp, error) {
+	return nil, errRuleTestMackerelAPI
+}
+
+func (c *ruleTestMackerelClient) FindWithClosedAlertsByNextID(string) (*mackerel.AlertsResp, error) {
+	return nil, errRuleTestMackerelAPI
+}
+
+func (c *ruleTestMackerelClient) GetAlertGroupSetting(string) (*mackerel.AlertGroupSetting, error) {
+	return nil, errRuleTestMackerelAPI
+}
+
+func (c *ruleTestMackerelClient) CloseAlert(string, string) (*mackerel.Alert, error) {
+	return nil, errRuleTestMackerelAPI
+}
+
+func (c *ruleTestMackerelClient) FindDowntimes() ([]*mackerel.Downtime, error) {
+	return nil, errRuleTestMackerelAPI
+}
+
+func (c *ruleTestMackerelClient) CreateDowntime(*mackerel.Downtime) (*mackerel.Downtime, error) {
+	return nil, errRuleTestMackerelAPI
+}
+
+func (c *ruleTestMackerelClient) PostServiceMetricValues(string, []*mackerel.MetricValue) error {
+	return errRuleTestMackerelAPI
+}
@@ -0,0 +1,68 @@
+package prepalert_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mashiike/prepalert"
+	"github.com/sebdah/goldie/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppTest(t *testing.T) {
+	app := prepalert.New("dummy-api-key")
+	t.Cleanup(func() {
+		app.Close()
+	})
+	var buf bytes.Buffer
+	err := app.Test(context.Background(), "testdata/config/with_test", &prepalert.TestOptions{
+		Writer: &buf,
+	})
+	require.NoError(t, err, buf.String())
+	require.Equal(t, "PASS: alb_target_5xx\nPASS: query_failed\nPASS: service_monitor\nok: 3 tests passed\n", buf.String())
+}
+
+func TestAppTest__Failed(t *testing.T) {
+	dir := t.TempDir()
+	config := LoadFile(t, "testdata/config/with_test/config.hcl")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "config.hcl"), config, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "failed.test.hcl"), []byte(`
+test "failed" {
+  webhook = jsonencode({
+    orgName = "Macker..."
+    event   = "alert"
+    alert = {
+      id          = "2bj..."
+      monitorName = "Monitor"
+      status      = "critical"
+    }
+  })
+
+  mock_query "redshift_data" "access_logs" {
+    columns = ["path", "cnt"]
+    rows    = [["/api/users", 10]]
+  }
+
+  assert {
+    matched_rules       = ["ignored"]
+    memo_contains       = ["/api/items"]
+    annotation_services = ["prod"]
+  }
+}
+`), 0644))
+	app := prepalert.New("dummy-api-key")
+	t.Cleanup(func() {
+		app.Close()
+	})
+	var buf bytes.Buffer
+	err := app.Test(context.Background(), dir, &prepalert.TestOptions{
+		Writer: &buf,
+	})
+	require.EqualError(t, err, "1 of 1 tests failed")
+	actual := bytes.ReplaceAll(buf.Bytes(), []byte(dir), []byte("<dir>"))
+	g := goldie.New(t, goldie.WithFixtureDir("testdata/fixture/"), goldie.WithNameSuffix(".golden"))
+	g.Assert(t, "rule_test__failed", actual)
+}
@@ -0,0 +1,26 @@
+prepalert {
+  required_version = ">=v0.12.0"
+  sqs_queue_name   = "prepalert"
+}
+
+rule "unknown_event" {
+  events = ["hostRetired"]
+  when   = true
+  update_alert {
+    memo = "memo"
+  }
+}
+
+rule "empty_events" {
+  events = []
+  when   = true
+  update_alert {
+    memo = "memo"
+  }
+}
+
+rule "alert_group_with_alert" {
+  events = ["alert"]
+  when   = alert_group.status == "critical"
+  alert_group_report {}
+}
@@ -0,0 +1,12 @@
+prepalert {
+  required_version = ">=v0.12.0"
+  sqs_queue_name   = "prepalert"
+}
+
+rule "typo_method" {
+  when = true
+  http_request {
+    url    = "https://example.com/incidents"
+    method = "POTS"
+  }
+}
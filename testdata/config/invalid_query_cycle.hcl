@@ -0,0 +1,21 @@
+prepalert {
+  required_version = ">=v0.12.0"
+  sqs_queue_name   = "prepalert"
+}
+
+provider "mock" {}
+
+query "mock" "first" {
+  sql    = "SELECT * FROM first WHERE id = ?"
+  params = [query.mock.second.result.rows[0][0]]
+}
+
+query "mock" "second" {
+  sql    = "SELECT * FROM second WHERE id = ?"
+  params = [query.mock.first.result.rows[0][0]]
+}
+
+query "mock" "third" {
+  sql    = "SELECT * FROM third WHERE id = ?"
+  params = [query.mock.unknown.result.rows[0][0]]
+}
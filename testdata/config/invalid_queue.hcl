@@ -0,0 +1,7 @@
+prepalert {
+  required_version = ">=v0.12.0"
+
+  queue "file" {
+    visibility_timeout = 0
+  }
+}
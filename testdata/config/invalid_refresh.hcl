@@ -0,0 +1,34 @@
+prepalert {
+  required_version = ">=v0.12.0"
+  sqs_queue_name   = "prepalert"
+}
+
+rule "without_update_alert" {
+  when = true
+  post_graph_annotation {
+    service = "prod"
+  }
+  refresh {
+    interval = "10m"
+  }
+}
+
+rule "too_long_interval" {
+  when = true
+  update_alert {
+    memo = "memo"
+  }
+  refresh {
+    interval = "1h"
+  }
+}
+
+rule "invalid_max_times" {
+  when = true
+  update_alert {
+    memo = "memo"
+  }
+  refresh {
+    max_times = 0
+  }
+}
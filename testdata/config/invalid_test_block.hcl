@@ -0,0 +1,18 @@
+prepalert {
+  required_version = ">=v0.12.0"
+  sqs_queue_name   = "prepalert"
+}
+
+rule "simple" {
+  when = true
+  update_alert {
+    memo = "hello"
+  }
+}
+
+test "simple" {
+  webhook = "{}"
+  assert {
+    matched_rules = ["simple"]
+  }
+}
@@ -0,0 +1,22 @@
+prepalert {
+  required_version = ">=v0.12.0"
+  sqs_queue_name   = "prepalert"
+}
+
+rule "simple" {
+  when = (webhook.org_name == "Macker...")
+  update_alert {
+    memo = "How do you respond to alerts?"
+  }
+}
+
+rule "outage" {
+  when = [
+    alert_group.status == "critical",
+    contains(alert_group.service_scopes, "Service"),
+  ]
+  alert_group_report {
+    window   = duration("10m")
+    max_size = 2000
+  }
+}
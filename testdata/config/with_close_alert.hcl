@@ -0,0 +1,22 @@
+prepalert {
+  required_version = ">=v0.12.0"
+  sqs_queue_name   = "prepalert"
+}
+
+provider "mock" {}
+
+query "mock" "user_agents" {
+  query = "stats count(*) as cnt by user_agent"
+}
+
+rule "bot_noise" {
+  when = (webhook.org_name == "Macker...")
+  update_alert {
+    memo = "checked user agents of the 5xx burst"
+  }
+  close_alert {
+    when     = !can(query.mock.user_agents.result.rows[1])
+    reason   = "5xx burst came from a single user agent: ${query.mock.user_agents.result.rows[0][0]}"
+    evidence = result_to_markdown(query.mock.user_agents)
+  }
+}
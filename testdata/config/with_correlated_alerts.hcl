@@ -0,0 +1,15 @@
+prepalert {
+  required_version = ">=v0.12.0"
+  sqs_queue_name   = "prepalert"
+}
+
+rule "correlated" {
+  when = true
+  update_alert {
+    memo = "this alert is ${webhook.alert.status}"
+  }
+  correlated_alerts {
+    window   = "10m"
+    group_by = "role"
+  }
+}
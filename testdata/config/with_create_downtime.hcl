@@ -0,0 +1,20 @@
+prepalert {
+  required_version = ">=v0.12.0"
+  sqs_queue_name   = "prepalert"
+}
+
+provider "mock" {}
+
+query "mock" "running_migrations" {
+  query = "select name from migrations where status = 'running'"
+}
+
+rule "maintenance" {
+  when = (webhook.org_name == "Macker...")
+  create_downtime {
+    when     = can(query.mock.running_migrations.result.rows[0])
+    name     = "prepalert: migration ${query.mock.running_migrations.result.rows[0][0]}"
+    memo     = "muted during the migration"
+    duration = "30m"
+  }
+}
@@ -0,0 +1,14 @@
+prepalert {
+  required_version           = ">=v0.12.0"
+  sqs_queue_name             = "prepalert"
+  sqs_dead_letter_queue_name = "prepalert-dlq"
+}
+
+rule "host_retired" {
+  events = ["hostRetire"]
+  when   = webhook.org_name == "Macker..."
+  post_graph_annotation {
+    service                = "prod"
+    additional_description = "${webhook.host.name} is retired"
+  }
+}
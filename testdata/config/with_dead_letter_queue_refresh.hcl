@@ -0,0 +1,23 @@
+prepalert {
+  required_version           = ">=v0.12.0"
+  sqs_queue_name             = "prepalert"
+  sqs_dead_letter_queue_name = "prepalert-dlq"
+}
+
+rule "refresh" {
+  when = (webhook.org_name == "Macker...")
+  update_alert {
+    memo = "alert ${webhook.alert.id} is still open"
+  }
+  refresh {
+    interval  = "10m"
+    max_times = 2
+  }
+}
+
+rule "once" {
+  when = (webhook.org_name == "Macker...")
+  update_alert {
+    memo = "written only once"
+  }
+}
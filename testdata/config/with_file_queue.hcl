@@ -0,0 +1,17 @@
+prepalert {
+  required_version = ">=v0.12.0"
+
+  queue "file" {
+    path               = env("PREPALERT_QUEUE_DIR", ".prepalert/queue")
+    visibility_timeout = "1m"
+    max_receive_count  = 5
+    dlq_path           = env("PREPALERT_DLQ_PATH", ".prepalert/dlq.jsonl")
+  }
+}
+
+rule "simple" {
+  when = true
+  update_alert {
+    memo = "hello"
+  }
+}
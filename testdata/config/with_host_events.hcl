@@ -0,0 +1,23 @@
+prepalert {
+  required_version = ">=v0.12.0"
+  sqs_queue_name   = "prepalert"
+}
+
+rule "simple" {
+  when = (webhook.org_name == "Macker...")
+  update_alert {
+    memo = "How do you respond to alerts?"
+  }
+}
+
+rule "host_retired" {
+  events = ["hostRetire"]
+  when   = webhook.org_name == "Macker..."
+  update_alert {
+    memo = "skipped, hostRetire has no alert"
+  }
+  post_graph_annotation {
+    service                = "prod"
+    additional_description = "${webhook.host.name} is retired by ${webhook.user.screen_name}"
+  }
+}
@@ -0,0 +1,29 @@
+prepalert {
+  required_version = ">=v0.12.0"
+  sqs_queue_name   = "prepalert"
+}
+
+rule "tracker" {
+  when = (webhook.org_name == "Macker...")
+  update_alert {
+    memo = "reported to the incident tracker"
+  }
+  http_request {
+    url    = "${must_env("TRACKER_URL")}/incidents/${webhook.alert.id}"
+    method = "put"
+    headers = {
+      Authorization = "Bearer ${must_env("TRACKER_TOKEN")}"
+    }
+    body = {
+      title  = webhook.alert.monitor_name
+      status = webhook.alert.status
+    }
+    retry {
+      max_attempts = 3
+      interval     = "10ms"
+    }
+    hmac {
+      secret = must_env("TRACKER_SECRET")
+    }
+  }
+}
@@ -0,0 +1,15 @@
+prepalert {
+  required_version = ">=v0.12.0"
+  sqs_queue_name   = "prepalert"
+
+  idempotency "memory" {
+    ttl = "1h"
+  }
+}
+
+rule "simple" {
+  when = (webhook.org_name == "Macker...")
+  update_alert {
+    memo = "How do you respond to alerts?"
+  }
+}
@@ -0,0 +1,28 @@
+prepalert {
+  required_version = ">=v0.12.0"
+  sqs_queue_name   = "prepalert"
+}
+
+provider "mackerel_alerts" {
+  offset = duration("24h")
+}
+
+query "mackerel_alerts" "history" {
+  limit = 3
+}
+
+query "mackerel_alerts" "same_host" {
+  monitor_id  = null
+  host_id     = webhook.host.id
+  with_closed = false
+}
+
+rule "with_alert_history" {
+  when = true
+  update_alert {
+    memo = <<EOF
+${result_to_markdown(query.mackerel_alerts.history)}
+${result_to_markdown(query.mackerel_alerts.same_host)}
+EOF
+  }
+}
@@ -0,0 +1,28 @@
+prepalert {
+  required_version = ">=v0.12.0"
+  sqs_queue_name   = "prepalert"
+}
+
+provider "mackerel_metrics" {
+  offset = "10m"
+}
+
+query "mackerel_metrics" "loadavg" {
+  metric_name = "loadavg5"
+}
+
+query "mackerel_metrics" "response_time" {
+  service_name = "prod"
+  metric_name  = "response_time"
+  from         = webhook.alert.opened_at - duration("5m")
+}
+
+rule "with_metrics" {
+  when = true
+  update_alert {
+    memo = <<EOF
+${result_to_markdown(query.mackerel_metrics.loadavg)}
+${result_to_markdown(query.mackerel_metrics.response_time)}
+EOF
+  }
+}
@@ -0,0 +1,17 @@
+prepalert {
+  required_version = ">=v0.12.0"
+  sqs_queue_name   = "prepalert"
+
+  memo_lock "dynamodb" {
+    table_name = "prepalert-lock"
+    wait       = "10s"
+    lease      = "30s"
+  }
+}
+
+rule "simple" {
+  when = (webhook.org_name == "Macker...")
+  update_alert {
+    memo = "How do you respond to alerts?"
+  }
+}
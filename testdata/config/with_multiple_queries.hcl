@@ -0,0 +1,31 @@
+prepalert {
+  required_version = ">=v0.12.0"
+  sqs_queue_name   = "prepalert"
+}
+
+provider "mock" {}
+
+query "mock" "access_logs" {}
+
+query "mock" "error_logs" {}
+
+query "mock" "slow_logs" {}
+
+rule "multiple_queries" {
+  when = true
+  update_alert {
+    memo = <<EOF
+access_logs:
+${result_to_jsonlines(query.mock.access_logs)}
+error_logs:
+${result_to_jsonlines(query.mock.error_logs)}
+EOF
+  }
+  post_graph_annotation {
+    service                = "prod"
+    additional_description = <<EOF
+slow_logs:
+${result_to_jsonlines(query.mock.slow_logs)}
+EOF
+  }
+}
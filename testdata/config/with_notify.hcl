@@ -0,0 +1,42 @@
+prepalert {
+  required_version = ">=v0.12.0"
+  sqs_queue_name   = "prepalert"
+
+  backend "s3" {
+    bucket_name         = "prepalert-information"
+    object_key_prefix   = "alerts/"
+    object_key_template = "${webhook.org_name}/${webhook.alert.id}/"
+    viewer_base_url     = "http://localhost:8080"
+  }
+}
+
+provider "mock" {}
+
+query "mock" "error_count" {
+  query = "stats count(*) as cnt"
+}
+
+rule "incident" {
+  when = (webhook.org_name == "Macker...")
+  update_alert {
+    memo = result_to_jsonlines(query.mock.error_count)
+  }
+  notify_slack {
+    webhook_url = must_env("SLACK_WEBHOOK_URL")
+    channel     = "#incident"
+    text        = "${webhook.alert.monitor_name} is ${webhook.alert.status}"
+    blocks = [
+      {
+        type = "section"
+        text = {
+          type = "mrkdwn"
+          text = "errors: ${query.mock.error_count.result.rows[0][0]}"
+        }
+      },
+    ]
+  }
+  notify_webhook {
+    webhook_url = must_env("NOTIFY_WEBHOOK_URL")
+    text        = "errors: ${query.mock.error_count.result.rows[0][0]}"
+  }
+}
@@ -0,0 +1,21 @@
+prepalert {
+  required_version = ">=v0.12.0"
+  sqs_queue_name   = "prepalert"
+
+  idempotency "memory" {
+    ttl = "1h"
+  }
+}
+
+rule "incident" {
+  when = (webhook.org_name == "Macker...")
+  notify_slack {
+    webhook_url = must_env("SLACK_WEBHOOK_URL")
+    channel     = "#incident"
+    text        = "${webhook.alert.monitor_name} is ${webhook.alert.status}"
+  }
+  notify_webhook {
+    webhook_url = must_env("NOTIFY_WEBHOOK_URL")
+    text        = "${webhook.alert.monitor_name} is ${webhook.alert.status}"
+  }
+}
@@ -0,0 +1,31 @@
+prepalert {
+  required_version = ">=v0.12.0"
+  sqs_queue_name   = "prepalert"
+}
+
+provider "mock" {}
+
+query "mock" "alb_5xx" {
+  query = "stats count(*) as cnt by path"
+}
+
+rule "alb_5xx_count" {
+  when = (webhook.org_name == "Macker...")
+  post_service_metric {
+    service = "prod"
+    metrics = {
+      "prepalert.alb.5xx_count" = query.mock.alb_5xx.result.rows[0][1]
+    }
+  }
+}
+
+rule "alb_5xx_paths" {
+  when = (webhook.org_name == "Macker...")
+  post_service_metric {
+    service = "prod"
+    metrics = {
+      "prepalert.alb.5xx_paths" = query.mock.alb_5xx.result.rows[1][1]
+    }
+    time = 1700000000
+  }
+}
@@ -0,0 +1,24 @@
+prepalert {
+  required_version = ">=v0.12.0"
+  sqs_queue_name   = "prepalert"
+}
+
+provider "mock" {}
+
+query "mock" "top_error_path" {
+  query = "fields path | stats count(*) as cnt by path | sort cnt desc | limit 1"
+}
+
+query "mock" "access_logs" {
+  sql    = "SELECT * FROM access_logs WHERE path = :path"
+  params = {
+    path = query.mock.top_error_path.result.rows[0][0]
+  }
+}
+
+rule "query_dependencies" {
+  when = true
+  update_alert {
+    memo = result_to_jsonlines(query.mock.access_logs)
+  }
+}
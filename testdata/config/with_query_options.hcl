@@ -0,0 +1,32 @@
+prepalert {
+  required_version = ">=v0.12.0"
+  sqs_queue_name   = "prepalert"
+}
+
+provider "mock" {}
+
+query "mock" "slow" {
+  timeout = "50ms"
+}
+
+query "mock" "flaky" {
+  retry {
+    max_attempts = 3
+    interval     = duration("10ms")
+  }
+}
+
+query "mock" "only_warning" {
+  when = webhook.alert.status == "warning"
+}
+
+rule "query_options" {
+  when = true
+  update_alert {
+    memo = <<EOF
+${result_to_jsonlines(query.mock.slow)}
+${result_to_jsonlines(query.mock.flaky)}
+${result_to_jsonlines(query.mock.only_warning)}
+EOF
+  }
+}
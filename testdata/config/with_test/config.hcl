@@ -0,0 +1,48 @@
+prepalert {
+  required_version = ">=v0.12.0"
+  sqs_queue_name   = "prepalert"
+
+  backend "s3" {
+    bucket_name         = "prepalert-information"
+    object_key_prefix   = "alerts/"
+    object_key_template = "${webhook.org_name}/${webhook.alert.id}/"
+    viewer_base_url     = "http://localhost:8080"
+  }
+}
+
+provider "redshift_data" {
+  cluster_identifier = "warehouse"
+  database           = "dev"
+  db_user            = "admin"
+}
+
+query "redshift_data" "access_logs" {
+  sql = "SELECT path, count(*) AS cnt FROM access_logs GROUP BY 1"
+}
+
+rule "alb_target_5xx" {
+  when = has_prefix(webhook.alert.monitor_name, "Monitor")
+  update_alert {
+    memo = <<EOF
+this is access_logs:
+${result_to_table(query.redshift_data.access_logs)}
+EOF
+  }
+  post_graph_annotation {
+    service = "prod"
+  }
+}
+
+rule "ignored" {
+  when = webhook.alert.status == "ok"
+  update_alert {
+    memo = "alert closed"
+  }
+}
+
+rule "service_monitor" {
+  when = get_monitor(webhook.alert).type == "service"
+  update_alert {
+    memo = "monitor: ${get_monitor(webhook.alert).name}"
+  }
+}
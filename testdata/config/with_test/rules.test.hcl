@@ -0,0 +1,55 @@
+test "alb_target_5xx" {
+  webhook      = file("fixtures/webhook.json")
+  current_memo = "this is a pen"
+
+  mock_query "redshift_data" "access_logs" {
+    columns = ["path", "cnt"]
+    rows = [
+      ["/api/users", 10],
+      ["/api/items", 3],
+    ]
+  }
+
+  assert {
+    matched_rules       = ["alb_target_5xx"]
+    memo_contains       = ["this is a pen", "/api/users"]
+    memo_golden         = "fixtures/alb_target_5xx.golden.md"
+    annotation_services = ["prod"]
+    alert_closed        = false
+  }
+}
+
+test "query_failed" {
+  webhook = file("fixtures/webhook.json")
+
+  mock_query "redshift_data" "access_logs" {
+    error = "connection refused"
+  }
+
+  assert {
+    matched_rules  = ["alb_target_5xx"]
+    error_contains = "connection refused"
+    memo_contains  = ["[query \"query.redshift_data.access_logs\" failed: connection refused]"]
+  }
+}
+
+test "service_monitor" {
+  webhook = file("fixtures/webhook.json")
+  monitor = {
+    id      = "4gx..."
+    name    = "api latency"
+    type    = "service"
+    service = "prod"
+    metric  = "custom.api.latency"
+  }
+
+  mock_query "redshift_data" "access_logs" {
+    columns = ["path", "cnt"]
+    rows    = []
+  }
+
+  assert {
+    matched_rules = ["alb_target_5xx", "service_monitor"]
+    memo_contains = ["monitor: api latency"]
+  }
+}
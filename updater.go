@@ -2,19 +2,40 @@ package prepalert
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/Songmu/flextime"
 	"github.com/hashicorp/hcl/v2"
 	"github.com/mackerelio/mackerel-client-go"
+	"github.com/mashiike/hclutil"
 )
 
+// MackerelSink is the destination of MackerelUpdater.Flush.
+// MackerelService is the default sink, which writes to Mackerel.
+type MackerelSink interface {
+	UpdateAlertMemo(ctx context.Context, alertID string, memo string) error
+	PostGraphAnnotation(ctx context.Context, params *mackerel.GraphAnnotation) error
+	CloseAlert(ctx context.Context, alertID string, reason string) error
+	CreateDowntime(ctx context.Context, downtime *mackerel.Downtime) error
+	PostServiceMetricValues(ctx context.Context, serviceName string, values []*mackerel.MetricValue) error
+}
+
 type MackerelUpdater struct {
 	svc                    *MackerelService
+	sink                   MackerelSink
+	notifier               Notifier
+	httpRequestSender      HTTPRequestSender
+	locker                 MemoLocker
+	lockWait               time.Duration
+	sentStore              IdempotencyStore
+	sentKey                string
+	sentTTL                time.Duration
 	mu                     sync.Mutex
 	backend                Backend
 	body                   *WebhookBody
@@ -23,11 +44,22 @@ type MackerelUpdater struct {
 	memoSectionSizeLimit   map[string]*int
 	additionalDescriptions map[string][]string
 	postServices           map[string]struct{}
+	notifications          []*Notification
+	httpRequests           []*HTTPRequest
+	alertClosings          []*alertClosing
+	downtimeCreations      []*downtimeCreation
+	metricServices         []string
+	serviceMetricValues    map[string][]*mackerel.MetricValue
+	alertUpdaterIDs        []string
+	alertUpdaters          map[string]*MackerelUpdater
 }
 
 func (svc *MackerelService) NewMackerelUpdater(body *WebhookBody, backend Backend) *MackerelUpdater {
 	return &MackerelUpdater{
 		svc:                    svc,
+		sink:                   svc,
+		notifier:               defaultNotifier,
+		httpRequestSender:      defaultHTTPRequestSender,
 		body:                   body,
 		backend:                backend,
 		memoSectionNames:       make([]string, 0),
@@ -35,9 +67,70 @@ func (svc *MackerelService) NewMackerelUpdater(body *WebhookBody, backend Backen
 		memoSectionSizeLimit:   make(map[string]*int),
 		additionalDescriptions: make(map[string][]string),
 		postServices:           make(map[string]struct{}),
+		serviceMetricValues:    make(map[string][]*mackerel.MetricValue),
+		alertUpdaters:          make(map[string]*MackerelUpdater),
 	}
 }
 
+// SetSink replaces the destination of Flush.
+func (u *MackerelUpdater) SetSink(sink MackerelSink) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.sink = sink
+}
+
+// SetNotifier replaces the destination of the notifications.
+func (u *MackerelUpdater) SetNotifier(notifier Notifier) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.notifier = notifier
+}
+
+// SetHTTPRequestSender replaces the destination of the requests of the http_request action.
+func (u *MackerelUpdater) SetHTTPRequestSender(sender HTTPRequestSender) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.httpRequestSender = sender
+}
+
+// SetMemoLocker sets the lock of the alert memo, Flush holds the lock while reading and writing the memo.
+func (u *MackerelUpdater) SetMemoLocker(locker MemoLocker, wait time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.locker = locker
+	u.lockWait = wait
+}
+
+// SetSentRecorder records the notifications and the http requests sent in Flush under the idempotency key of the webhook,
+// so that the redelivered webhook does not send them again when a later step of Flush failed.
+// store can be nil, then nothing is recorded and only the Idempotency-Key header of the http requests is set.
+func (u *MackerelUpdater) SetSentRecorder(store IdempotencyStore, key string, ttl time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.sentStore = store
+	u.sentKey = key
+	u.sentTTL = ttl
+}
+
+// AlertUpdater returns the updater of another alert, such as a member alert of the alert group.
+// it shares the sink, the memo lock and the backend with u, and is flushed with u.
+func (u *MackerelUpdater) AlertUpdater(body *WebhookBody) *MackerelUpdater {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if child, ok := u.alertUpdaters[body.Alert.ID]; ok {
+		return child
+	}
+	child := u.svc.NewMackerelUpdater(body, u.backend)
+	child.sink = u.sink
+	child.notifier = u.notifier
+	child.httpRequestSender = u.httpRequestSender
+	child.locker = u.locker
+	child.lockWait = u.lockWait
+	u.alertUpdaterIDs = append(u.alertUpdaterIDs, body.Alert.ID)
+	u.alertUpdaters[body.Alert.ID] = child
+	return child
+}
+
 func (u *MackerelUpdater) AddMemoSectionText(sectionName string, text string, sizeLimit *int) {
 	u.mu.Lock()
 	defer u.mu.Unlock()
@@ -46,6 +139,50 @@ func (u *MackerelUpdater) AddMemoSectionText(sectionName string, text string, si
 	u.memoSectionSizeLimit[sectionName] = sizeLimit
 }
 
+// AddNotification adds the notification, which is posted in Flush with the full text URL of the memo.
+func (u *MackerelUpdater) AddNotification(n *Notification) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.notifications = append(u.notifications, n)
+}
+
+// AddHTTPRequest adds the request of the http_request action, which is sent in Flush.
+func (u *MackerelUpdater) AddHTTPRequest(req *HTTPRequest) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.httpRequests = append(u.httpRequests, req)
+}
+
+// AddAlertClosing adds the close of the alert by the close_alert action, which is done in Flush after the memo is updated.
+func (u *MackerelUpdater) AddAlertClosing(ruleName string, reason string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.alertClosings = append(u.alertClosings, &alertClosing{
+		ruleName: ruleName,
+		reason:   reason,
+	})
+}
+
+// AddDowntimeCreation adds the downtime of the create_downtime action, which is created in Flush.
+func (u *MackerelUpdater) AddDowntimeCreation(ruleName string, downtime *mackerel.Downtime) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.downtimeCreations = append(u.downtimeCreations, &downtimeCreation{
+		ruleName: ruleName,
+		downtime: downtime,
+	})
+}
+
+// AddServiceMetricValues adds the values of the post_service_metric action, the values of the rules are posted in Flush at once per service.
+func (u *MackerelUpdater) AddServiceMetricValues(service string, values []*mackerel.MetricValue) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if _, ok := u.serviceMetricValues[service]; !ok {
+		u.metricServices = append(u.metricServices, service)
+	}
+	u.serviceMetricValues[service] = append(u.serviceMetricValues[service], values...)
+}
+
 func (u *MackerelUpdater) AddService(service string) {
 	u.mu.Lock()
 	defer u.mu.Unlock()
@@ -77,86 +214,42 @@ func (u *MackerelUpdater) Flush(ctx context.Context, evalCtx *hcl.EvalContext) e
 	u.mu.Lock()
 	defer u.mu.Unlock()
 	body := u.body
+	var fullTextURL string
 	if len(u.memoSectionText) > 0 {
-		alert, err := u.svc.GetAlertWithCache(ctx, body.Alert.ID)
-		if err != nil {
-			return fmt.Errorf("get alert: %w", err)
-		}
-		currentMemo := alert.Memo
-		currentPrepalertSection := extructSection(currentMemo, prepalertSectionHeader)
-		fullText := strings.Trim(prepalertHeaderRegexp.ReplaceAllString(currentPrepalertSection, ""), "\n")
-		memo := fullText
-		for _, sectionName := range u.memoSectionNames {
-			extracted := extructSection(fullText, "### "+sectionName)
-			sectionText := u.memoSectionText[sectionName]
-			trimedSectionText := sectionText
-			if u.memoSectionSizeLimit[sectionName] != nil {
-				trimedSectionText = triming(sectionText, *u.memoSectionSizeLimit[sectionName], "\n...")
-			}
-			if extracted != "" {
-				fullText = strings.ReplaceAll(fullText, extracted, "### "+sectionName+"\n\n"+sectionText)
-				memo = strings.ReplaceAll(memo, extracted, "### "+sectionName+"\n\n"+trimedSectionText)
-
-			} else {
-				fullText += "\n\n### " + sectionName + "\n\n" + u.memoSectionText[sectionName]
-				memo += "\n\n### " + sectionName + "\n\n" + trimedSectionText
-			}
-		}
-		fullText = strings.TrimPrefix(fullText, "\n\n")
-		memo = strings.TrimPrefix(memo, "\n\n")
-		uploadBody := strings.NewReader(fmt.Sprintf("related alert: %s\n\n%s", body.Alert.URL, fullText))
-		fullTextURL, uploaded, err := u.backend.Upload(ctx, evalCtx, body.Alert.ID, uploadBody)
-		if err != nil {
-			return fmt.Errorf("upload to backend:%w", err)
-		}
-		if uploaded {
-			slog.DebugContext(ctx, "uploaded to backend", "full_text_url", fullTextURL)
-			memo = fmt.Sprintf("Full Text URL: %s\n\n%s", fullTextURL, memo)
+		if body.Alert == nil {
+			slog.WarnContext(ctx, "skip update alert memo, the webhook has no alert", "event", body.Event)
 		} else {
-			memo = fullText
+			var err error
+			fullTextURL, err = u.updateMemo(ctx, evalCtx)
+			if err != nil {
+				return err
+			}
 		}
-		memo = prepalertSectionHeader + "\n" + memo
-		if currentPrepalertSection != "" {
-			memo = strings.ReplaceAll(currentMemo, currentPrepalertSection, memo)
-		} else {
-			memo = alert.Memo + "\n\n" + memo
-		}
-		if len(memo) > AlertMemoMaxSize {
-			slog.WarnContext(
-				ctx,
-				"alert memo is too long",
-				"length", len(memo),
-				"full_text_url", fullTextURL,
-			)
-			slog.DebugContext(
-				ctx,
-				"alert memo is too long",
-				"memo", memo,
-			)
-			memo = triming(memo, AlertMemoMaxSize, "\n...")
-		}
-		memo = strings.Trim(memo, "\n") + "\n"
-		err = u.svc.UpdateAlertMemo(ctx, body.Alert.ID, memo)
-		if err != nil {
-			return fmt.Errorf("update alert memo: %w", err)
+	}
+	if len(u.alertClosings) > 0 && body.Alert != nil {
+		// the reason and the evidence are already written to the memo.
+		// the alert is closed once with the reason of the first rule, even if several rules request the close.
+		c := u.alertClosings[0]
+		if err := u.sink.CloseAlert(ctx, body.Alert.ID, c.reason); err != nil {
+			return fmt.Errorf("rule %s: close alert: %w", c.ruleName, err)
 		}
 	}
 	errs := make([]error, 0, 2)
 	if len(u.postServices) > 0 {
-		to := flextime.Now().Unix()
-		if body.Alert.ClosedAt != nil {
-			to = *body.Alert.ClosedAt
-		}
+		title, related, from, to := u.graphAnnotationTarget()
 		for service := range u.postServices {
-			description := fmt.Sprintf("related alert: %s\n", body.Alert.URL)
+			var description string
+			if related != "" {
+				description = related + "\n"
+			}
 			for _, text := range u.additionalDescriptions[service] {
 				description += text + "\n"
 			}
 			slog.DebugContext(ctx, "dump description", "description", description)
-			err := u.svc.PostGraphAnnotation(ctx, &mackerel.GraphAnnotation{
-				Title:       fmt.Sprintf("prepalert alert_id=%s", body.Alert.ID),
+			err := u.sink.PostGraphAnnotation(ctx, &mackerel.GraphAnnotation{
+				Title:       title,
 				Description: description,
-				From:        body.Alert.OpenedAt,
+				From:        from,
 				To:          to,
 				Service:     service,
 			})
@@ -168,5 +261,203 @@ func (u *MackerelUpdater) Flush(ctx context.Context, evalCtx *hcl.EvalContext) e
 	if len(errs) > 0 {
 		return fmt.Errorf("post graph annotation failed: %v", errs)
 	}
+	for _, c := range u.downtimeCreations {
+		if err := u.sink.CreateDowntime(ctx, c.downtime); err != nil {
+			errs = append(errs, fmt.Errorf("rule %s: create downtime %q: %w", c.ruleName, c.downtime.Name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("create downtime failed: %w", errors.Join(errs...))
+	}
+	for _, service := range u.metricServices {
+		if err := u.sink.PostServiceMetricValues(ctx, service, u.serviceMetricValues[service]); err != nil {
+			errs = append(errs, fmt.Errorf("service %s: %w", service, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("post service metrics failed: %w", errors.Join(errs...))
+	}
+	for _, n := range u.notifications {
+		n.FullTextURL = fullTextURL
+		key := u.sentRecordKey(n.RuleName, "notify_"+n.Type)
+		if u.alreadySent(ctx, key) {
+			slog.InfoContext(ctx, "skip notification, already sent", "rule_name", n.RuleName, "type", n.Type)
+			continue
+		}
+		if err := u.notifier.PostNotification(ctx, n, body); err != nil {
+			errs = append(errs, fmt.Errorf("rule %s: notify_%s: %w", n.RuleName, n.Type, err))
+			continue
+		}
+		u.recordSent(ctx, key)
+	}
+	for _, req := range u.httpRequests {
+		key := u.sentRecordKey(req.RuleName, "http_request")
+		if u.alreadySent(ctx, key) {
+			slog.InfoContext(ctx, "skip http_request, already sent", "rule_name", req.RuleName)
+			continue
+		}
+		req.idempotencyKey = key
+		if err := u.httpRequestSender.SendHTTPRequest(ctx, req); err != nil {
+			errs = append(errs, fmt.Errorf("rule %s: http_request %s %s: %w", req.RuleName, req.Method, req.URL, err))
+			continue
+		}
+		u.recordSent(ctx, key)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("send outbound requests failed: %w", errors.Join(errs...))
+	}
+	for _, alertID := range u.alertUpdaterIDs {
+		child := u.alertUpdaters[alertID]
+		webhook, err := hclutil.MarshalCTYValue(child.body)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("alert %s: marshal webhook body: %w", alertID, err))
+			continue
+		}
+		// the backend object key is rendered with the webhook of the alert.
+		if err := child.Flush(ctx, hclutil.WithValue(evalCtx, webhookHCLPrefix, webhook)); err != nil {
+			errs = append(errs, fmt.Errorf("alert %s: %w", alertID, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("flush alert updaters failed: %w", errors.Join(errs...))
+	}
 	return nil
 }
+
+func (u *MackerelUpdater) sentRecordKey(ruleName string, action string) string {
+	if u.sentKey == "" {
+		return ""
+	}
+	return strings.Join([]string{u.sentKey, "sent", ruleName, action}, "/")
+}
+
+func (u *MackerelUpdater) alreadySent(ctx context.Context, key string) bool {
+	if u.sentStore == nil || key == "" {
+		return false
+	}
+	exists, err := u.sentStore.Exists(ctx, key)
+	if err != nil {
+		slog.WarnContext(ctx, "failed to check the sent record, send again", "error", err.Error())
+		return false
+	}
+	return exists
+}
+
+func (u *MackerelUpdater) recordSent(ctx context.Context, key string) {
+	if u.sentStore == nil || key == "" {
+		return
+	}
+	if err := u.sentStore.Put(ctx, key, flextime.Now().Add(u.sentTTL)); err != nil {
+		slog.WarnContext(ctx, "failed to record the sent request, it may be sent again on redelivery", "error", err.Error())
+	}
+}
+
+// graphAnnotationTarget returns the title, the related link and the period of the graph annotation.
+// the annotation of the alert covers the alert period, the other events are annotated at the time of the event.
+func (u *MackerelUpdater) graphAnnotationTarget() (title string, related string, from int64, to int64) {
+	body := u.body
+	now := flextime.Now().Unix()
+	switch {
+	case body.Alert != nil:
+		to = now
+		if body.Alert.ClosedAt != nil {
+			to = *body.Alert.ClosedAt
+		}
+		return fmt.Sprintf("prepalert alert_id=%s", body.Alert.ID), "related alert: " + body.Alert.URL, body.Alert.OpenedAt, to
+	case body.AlertGroup != nil:
+		return fmt.Sprintf("prepalert alert_group_id=%s", body.AlertGroup.ID), "related alert group: " + body.AlertGroup.URL, now, now
+	case body.Host != nil:
+		return fmt.Sprintf("prepalert event=%s host_id=%s", body.Event, body.Host.ID), "related host: " + body.Host.URL, now, now
+	case body.Monitor != nil:
+		return fmt.Sprintf("prepalert event=%s monitor_id=%s", body.Event, body.Monitor.ID),
+			fmt.Sprintf("related monitor: https://mackerel.io/orgs/%s/monitors/%s", body.OrgName, body.Monitor.ID), now, now
+	}
+	return fmt.Sprintf("prepalert event=%s", body.Event), "", now, now
+}
+
+// updateMemo rewrites the Prepalert section of the latest memo, other sections written by another worker or a person are kept.
+// it returns the full text URL if the full text is uploaded to the backend.
+func (u *MackerelUpdater) updateMemo(ctx context.Context, evalCtx *hcl.EvalContext) (string, error) {
+	body := u.body
+	if u.locker != nil {
+		lockCtx := ctx
+		if u.lockWait > 0 {
+			var cancel context.CancelFunc
+			lockCtx, cancel = context.WithTimeout(ctx, u.lockWait)
+			defer cancel()
+		}
+		unlock, err := u.locker.Lock(lockCtx, body.Alert.ID)
+		if err != nil {
+			return "", fmt.Errorf("lock alert memo: %w", err)
+		}
+		defer func() {
+			if err := unlock(context.WithoutCancel(ctx)); err != nil {
+				slog.WarnContext(ctx, "failed to unlock alert memo", "error", err.Error())
+			}
+		}()
+	}
+	alert, err := u.svc.GetAlert(ctx, body.Alert.ID)
+	if err != nil {
+		return "", fmt.Errorf("get alert: %w", err)
+	}
+	currentMemo := alert.Memo
+	currentPrepalertSection := extructSection(currentMemo, prepalertSectionHeader)
+	fullText := strings.Trim(prepalertHeaderRegexp.ReplaceAllString(currentPrepalertSection, ""), "\n")
+	memo := fullText
+	for _, sectionName := range u.memoSectionNames {
+		extracted := extructSection(fullText, "### "+sectionName)
+		sectionText := u.memoSectionText[sectionName]
+		trimedSectionText := sectionText
+		if u.memoSectionSizeLimit[sectionName] != nil {
+			trimedSectionText = triming(sectionText, *u.memoSectionSizeLimit[sectionName], "\n...")
+		}
+		if extracted != "" {
+			fullText = strings.ReplaceAll(fullText, extracted, "### "+sectionName+"\n\n"+sectionText)
+			memo = strings.ReplaceAll(memo, extracted, "### "+sectionName+"\n\n"+trimedSectionText)
+
+		} else {
+			fullText += "\n\n### " + sectionName + "\n\n" + u.memoSectionText[sectionName]
+			memo += "\n\n### " + sectionName + "\n\n" + trimedSectionText
+		}
+	}
+	fullText = strings.TrimPrefix(fullText, "\n\n")
+	memo = strings.TrimPrefix(memo, "\n\n")
+	uploadBody := strings.NewReader(fmt.Sprintf("related alert: %s\n\n%s", body.Alert.URL, fullText))
+	fullTextURL, uploaded, err := u.backend.Upload(ctx, evalCtx, body.Alert.ID, uploadBody)
+	if err != nil {
+		return "", fmt.Errorf("upload to backend:%w", err)
+	}
+	if uploaded {
+		slog.DebugContext(ctx, "uploaded to backend", "full_text_url", fullTextURL)
+		memo = fmt.Sprintf("Full Text URL: %s\n\n%s", fullTextURL, memo)
+	} else {
+		fullTextURL = ""
+		memo = fullText
+	}
+	memo = prepalertSectionHeader + "\n" + memo
+	if currentPrepalertSection != "" {
+		memo = strings.ReplaceAll(currentMemo, currentPrepalertSection, memo)
+	} else {
+		memo = alert.Memo + "\n\n" + memo
+	}
+	if len(memo) > AlertMemoMaxSize {
+		slog.WarnContext(
+			ctx,
+			"alert memo is too long",
+			"length", len(memo),
+			"full_text_url", fullTextURL,
+		)
+		slog.DebugContext(
+			ctx,
+			"alert memo is too long",
+			"memo", memo,
+		)
+		memo = triming(memo, AlertMemoMaxSize, "\n...")
+	}
+	memo = strings.Trim(memo, "\n") + "\n"
+	err = u.sink.UpdateAlertMemo(ctx, body.Alert.ID, memo)
+	if err != nil {
+		return "", fmt.Errorf("update alert memo: %w", err)
+	}
+	return fullTextURL, nil
+}